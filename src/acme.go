@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	letsEncryptDirectory = acme.LetsEncryptURL
+
+	// acmeRenewBefore is how long before expiry a certificate is renewed;
+	// Let's Encrypt's are valid for 90 days.
+	acmeRenewBefore   = 30 * 24 * time.Hour
+	acmeCheckInterval = 12 * time.Hour
+	acmeMinRetry      = time.Minute
+	acmeMaxRetry      = time.Hour
+)
+
+// acmeConfig configures automatic certificates for ?acme listeners.
+type acmeConfig struct {
+	domains   []string
+	email     string
+	directory string
+	cacheDir  string
+	// httpListen, when set, serves HTTP-01 challenges there (usually :80)
+	// and redirects everything else to https. Without it challenges are
+	// answered with TLS-ALPN-01 on the ?acme listeners themselves.
+	httpListen string
+}
+
+// acmeManager obtains and renews a certificate for each of the -acme
+// domains from an ACME CA such as Let's Encrypt through autocert, keeping
+// them and the account key in cacheDir so restarts reuse them.
+type acmeManager struct {
+	cfg     acmeConfig
+	manager *autocert.Manager
+	metrics *metricsRegistry
+}
+
+func newACMEManager(cfg acmeConfig, metrics *metricsRegistry) (*acmeManager, error) {
+	if len(cfg.domains) == 0 {
+		return nil, errors.New("-acme-domains is required for ?acme listeners")
+	}
+	if cfg.directory == "" {
+		cfg.directory = letsEncryptDirectory
+	}
+	// The cache holds private keys; autocert writes them 0600.
+	if err := os.MkdirAll(cfg.cacheDir, 0o700); err != nil {
+		return nil, err
+	}
+	m := &acmeManager{
+		cfg: cfg,
+		manager: &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       autocert.DirCache(cfg.cacheDir),
+			HostPolicy:  autocert.HostWhitelist(cfg.domains...),
+			RenewBefore: acmeRenewBefore,
+			Client:      &acme.Client{DirectoryURL: cfg.directory},
+			Email:       cfg.email,
+		},
+		metrics: metrics,
+	}
+	metrics.register("browserd_acme_certificate_expiry_timestamp_seconds", metricGauge, "When the ACME certificate for each domain expires, as a Unix time.")
+	metrics.register("browserd_acme_renewals_total", metricCounter, "ACME certificates issued or failed to be, by result.")
+	return m, nil
+}
+
+// tlsConfig is the configuration of every ?acme listener.
+func (m *acmeManager) tlsConfig() *tls.Config {
+	// WebSocket upgrades need HTTP/1.1.
+	return &tls.Config{NextProtos: []string{"http/1.1", acme.ALPNProto}, GetCertificate: m.manager.GetCertificate}
+}
+
+// run gets each domain's certificate ahead of the first handshake, and
+// checks on it every acmeCheckInterval to keep the expiry metric current,
+// until ctx ends. autocert renews certificates on its own.
+func (m *acmeManager) run(ctx context.Context) {
+	expiries := make(map[string]time.Time)
+	retry := acmeMinRetry
+	for {
+		wait := acmeCheckInterval
+		for _, domain := range m.cfg.domains {
+			// A client hello offering ECDSA gets the certificate autocert
+			// serves modern clients.
+			cert, err := m.manager.GetCertificate(&tls.ClientHelloInfo{
+				ServerName:   domain,
+				CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			})
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				m.metrics.add("browserd_acme_renewals_total", map[string]string{"result": "failed"}, 1)
+				slog.Error("failed to obtain ACME certificate", "event", "acme_error", "domain", domain, "error", err, "retry_in", retry.String())
+				wait = retry
+				continue
+			}
+			if cert.Leaf == nil {
+				continue
+			}
+			if last, ok := expiries[domain]; ok && !cert.Leaf.NotAfter.After(last) {
+				continue
+			}
+			if _, ok := expiries[domain]; ok {
+				m.metrics.add("browserd_acme_renewals_total", map[string]string{"result": "issued"}, 1)
+			}
+			expiries[domain] = cert.Leaf.NotAfter
+			m.metrics.set("browserd_acme_certificate_expiry_timestamp_seconds", map[string]string{"domain": domain}, float64(cert.Leaf.NotAfter.Unix()))
+		}
+		if wait < acmeCheckInterval {
+			retry = min(retry*2, acmeMaxRetry)
+		} else {
+			retry = acmeMinRetry
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// serveHTTP answers HTTP-01 challenges on -acme-http-listen and sends
+// every other request to https.
+func (m *acmeManager) serveHTTP(ctx context.Context, ln net.Listener) {
+	server := &http.Server{Handler: m.manager.HTTPHandler(nil)}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	slog.Info("ACME HTTP-01 responder listening", "event", "listening", "addr", ln.Addr().String())
+	if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("ACME HTTP-01 responder failed", "error", err)
+	}
+}
+
+// stateDir is where browserd keeps what should outlive a restart when no
+// flag says otherwise: systemd's StateDirectory=, $XDG_STATE_HOME, or the
+// user's equivalent.
+func stateDir() string {
+	if dir, _, _ := strings.Cut(os.Getenv("STATE_DIRECTORY"), ":"); dir != "" {
+		return dir
+	}
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "browserd")
+	}
+	if runtime.GOOS != "windows" {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, ".local", "state", "browserd")
+		}
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, "browserd")
+	}
+	return "browserd"
+}
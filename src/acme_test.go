@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestACMECacheIsPrivate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no Unix permissions")
+	}
+	dir := filepath.Join(t.TempDir(), "state", "acme")
+	m, err := newACMEManager(acmeConfig{domains: []string{"browser.example.com"}, cacheDir: dir}, newMetricsRegistry(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.manager.Cache.Put(context.Background(), "acme_account+key", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]os.FileMode{
+		filepath.Dir(dir):                      0o700,
+		dir:                                    0o700,
+		filepath.Join(dir, "acme_account+key"): 0o600,
+	} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != want {
+			t.Errorf("%s: mode %o, want %o", path, got, want)
+		}
+	}
+}
+
+func TestStateDir(t *testing.T) {
+	t.Setenv("STATE_DIRECTORY", "/var/lib/browserd:/var/lib/other")
+	if got := stateDir(); got != "/var/lib/browserd" {
+		t.Errorf("with STATE_DIRECTORY: %s", got)
+	}
+	t.Setenv("STATE_DIRECTORY", "")
+	t.Setenv("XDG_STATE_HOME", "/home/ops/.state")
+	if got := stateDir(); got != filepath.Join("/home/ops/.state", "browserd") {
+		t.Errorf("with XDG_STATE_HOME: %s", got)
+	}
+}
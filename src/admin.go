@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type sessionView struct {
+	ID         string    `json:"id"`
+	RemoteAddr string    `json:"remoteAddr"`
+	StartedAt  time.Time `json:"startedAt"`
+	// LastActivity is when the client last sent a CDP command.
+	LastActivity time.Time         `json:"lastActivity"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	APIKey       string            `json:"apiKey,omitempty"`
+	Pool         string            `json:"pool,omitempty"`
+	Proxy        string            `json:"proxy,omitempty"`
+	Device       string            `json:"device,omitempty"`
+	Emulation    *sessionEmulation `json:"emulation,omitempty"`
+	Network      string            `json:"network,omitempty"`
+	Screencast   *screencastCap    `json:"screencast,omitempty"`
+	Permissions  *permissionPolicy `json:"permissions,omitempty"`
+	Stealth      bool              `json:"stealth,omitempty"`
+	Exclusive    bool              `json:"exclusive,omitempty"`
+	Profile      string            `json:"profile,omitempty"`
+	Flags        string            `json:"flags,omitempty"`
+	LaunchEnv    []string          `json:"launchEnv,omitempty"`
+	LaunchArgs   []string          `json:"launchArgs,omitempty"`
+	Build        string            `json:"build,omitempty"`
+	Fallback     bool              `json:"fallback,omitempty"`
+	// Migrated is the backend POST /admin/migrate moved the session to.
+	Migrated string   `json:"migrated,omitempty"`
+	Targets  []string `json:"targets,omitempty"`
+	// Stats is the traffic relayed so far, in each direction.
+	Stats *sessionTally `json:"stats"`
+	// Relay is the most the session's relay has had to buffer.
+	Relay relayHighWater `json:"relay"`
+	// Annotations are the notes added to the session so far.
+	Annotations []sessionAnnotation `json:"annotations,omitempty"`
+}
+
+func (p *proxyServer) handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	sessions := p.allSessions()
+	views := make([]sessionView, 0, len(sessions))
+	for _, s := range sessions {
+		views = append(views, s.view())
+	}
+
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (s *session) view() sessionView {
+	view := sessionView{
+		ID:           s.id,
+		RemoteAddr:   s.remoteAddr,
+		StartedAt:    s.startedAt,
+		LastActivity: s.lastActive(),
+		Labels:       s.labels,
+		APIKey:       s.apiKey,
+		Pool:         s.pool,
+		Device:       s.device,
+		Emulation:    s.emulation,
+		Network:      s.network,
+		Permissions:  s.permissions,
+		Stealth:      s.stealth,
+		Exclusive:    s.browser != nil,
+		Fallback:     s.onFallback,
+		Targets:      s.pageTargets(),
+		Stats:        s.tally(),
+		Relay:        s.stats.highWater(),
+		Annotations:  s.annotationList(),
+	}
+	if s.proxy != nil {
+		view.Proxy = s.proxy.Redacted()
+	}
+	if s.screencast.enabled() {
+		screencast := s.screencast
+		view.Screencast = &screencast
+	}
+	if to := s.migrated.Load(); to != nil {
+		view.Migrated = to.endpoint.Redacted()
+	}
+	if s.browser != nil {
+		view.Profile = s.browser.profile
+		view.Flags = s.browser.flags
+		if o := s.browser.overrides; o != nil {
+			view.LaunchEnv, view.LaunchArgs = o.envNames(), o.args
+		}
+		view.Build = s.browser.build
+	}
+	return view
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("failed to encode response", "error", err)
+	}
+}
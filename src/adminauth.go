@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// adminAuth holds the credentials for /admin/*, /metrics, the gRPC admin
+// service and, with healthz, /healthz. They are separate from the client
+// token so clients can't read or end each other's sessions. oidc, when set,
+// also lets people in who signed in with single sign-on.
+type adminAuth struct {
+	token    string
+	user     string
+	password string
+	healthz  bool
+	oidc     *oidcAuth
+}
+
+func (a adminAuth) enabled() bool {
+	return a.token != "" || a.user != "" || a.oidc != nil
+}
+
+// authorizeAdmin checks the admin credentials: a bearer token, basic auth,
+// or an SSO login cookie. An API key allowed admin-read may also make GET
+// requests. Until admin credentials are configured, the client's -token or
+// -auth credentials stand in for them, so the control plane is only open
+// when the client endpoints are.
+func (p *proxyServer) authorizeAdmin(r *http.Request) bool {
+	a := p.adminAuth
+	if a.oidc != nil && a.oidc.authorized(r) {
+		return true
+	}
+	if p.apiKeys != nil && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		if key := p.apiKeys.matchRequest(r); key != nil && key.allows(capabilityAdminRead) {
+			return true
+		}
+	}
+	if !a.enabled() {
+		// Other API keys are for clients only.
+		key, ok := p.authenticate(r)
+		return ok && key == nil
+	}
+	auth := r.Header.Get("Authorization")
+	if a.token != "" && strings.HasPrefix(auth, "Bearer ") {
+		return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(a.token)) == 1
+	}
+	if a.user != "" {
+		user, password, ok := r.BasicAuth()
+		// Both comparisons always run so timing doesn't tell which failed.
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(a.user)) == 1
+		passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(a.password)) == 1
+		return ok && userOK && passwordOK
+	}
+	return false
+}
+
+// adminOnly wraps an operational endpoint in authorizeAdmin.
+func (p *proxyServer) adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !p.authorizeAdmin(r) {
+			// People in a browser are sent to sign in; scripts get a 401.
+			if p.adminAuth.oidc != nil && r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, "/admin/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+			if p.adminAuth.user != "" {
+				w.Header().Set("WWW-Authenticate", p.headers.adminRealm())
+			}
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAdminFallsBackToClientToken(t *testing.T) {
+	h := newHarness(t, proxyConfig{token: "client-secret"})
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{"no credentials", http.MethodGet, "/admin/sessions", "", http.StatusUnauthorized},
+		{"wrong token", http.MethodGet, "/admin/sessions", "nope", http.StatusUnauthorized},
+		{"drain without credentials", http.MethodPost, "/admin/drain", "", http.StatusUnauthorized},
+		{"client token", http.MethodGet, "/admin/sessions", "client-secret", http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tc.method, h.url(tc.path), nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			resp, err := h.client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.want {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tc.want)
+			}
+		})
+	}
+}
+
+func TestAdminTokenReplacesClientToken(t *testing.T) {
+	h := newHarness(t, proxyConfig{token: "client-secret", adminAuth: adminAuth{token: "admin-secret"}})
+	for token, want := range map[string]int{"client-secret": http.StatusUnauthorized, "admin-secret": http.StatusOK} {
+		req, _ := http.NewRequest(http.MethodGet, h.url("/admin/sessions"), nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := h.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("%s: status %d, want %d", token, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestAdminCredentials(t *testing.T) {
+	h := newHarness(t, proxyConfig{
+		adminAuth:   adminAuth{token: "admin-secret", user: "ops", password: "hunter2"},
+		apiKeysFile: writeAPIKeys(t, `{"dash": {"key": "k-dash", "allow": ["admin-read"]}, "client": {"key": "k-client"}}`),
+	})
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		auth   func(*http.Request)
+		want   int
+	}{
+		{"admin token", http.MethodGet, "/admin/sessions", bearer("admin-secret"), http.StatusOK},
+		{"basic auth", http.MethodGet, "/admin/sessions", basic("ops", "hunter2"), http.StatusOK},
+		{"wrong password", http.MethodGet, "/admin/sessions", basic("ops", "hunter3"), http.StatusUnauthorized},
+		{"wrong user", http.MethodGet, "/admin/sessions", basic("root", "hunter2"), http.StatusUnauthorized},
+		{"admin-read key", http.MethodGet, "/admin/sessions", bearer("k-dash"), http.StatusOK},
+		{"admin-read key drains", http.MethodPost, "/admin/drain", bearer("k-dash"), http.StatusUnauthorized},
+		{"client key", http.MethodGet, "/admin/sessions", bearer("k-client"), http.StatusUnauthorized},
+		{"metrics", http.MethodGet, "/metrics", bearer("admin-secret"), http.StatusOK},
+		{"metrics without credentials", http.MethodGet, "/metrics", nil, http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tc.method, h.url(tc.path), nil)
+			if tc.auth != nil {
+				tc.auth(req)
+			}
+			resp, err := h.client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.want {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tc.want)
+			}
+		})
+	}
+}
+
+func bearer(token string) func(*http.Request) {
+	return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+}
+
+func basic(user, password string) func(*http.Request) {
+	return func(r *http.Request) { r.SetBasicAuth(user, password) }
+}
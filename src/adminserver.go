@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// handleAdmin registers the operational endpoints on mux: on the client
+// listener by default, on their own with -admin-listen.
+func (p *proxyServer) handleAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("/metrics", p.adminOnly(p.handleMetrics))
+	mux.HandleFunc("/admin/sessions", p.adminOnly(p.handleAdminSessions))
+	mux.HandleFunc("/admin/chromium/logs", p.adminOnly(p.handleChromiumLogs))
+	mux.HandleFunc("/admin/events", p.adminOnly(p.handleEvents))
+	mux.HandleFunc("/scale", p.adminOnly(p.handleScale))
+	mux.HandleFunc("POST /admin/drain", p.adminOnly(p.handleDrain(true)))
+	mux.HandleFunc("POST /admin/undrain", p.adminOnly(p.handleDrain(false)))
+	mux.HandleFunc("POST /admin/migrate", p.adminOnly(p.handleMigrate))
+	if o := p.adminAuth.oidc; o != nil {
+		mux.HandleFunc("GET /admin/login", o.handleLogin)
+		mux.HandleFunc("GET /admin/oidc/callback", o.handleCallback)
+		mux.HandleFunc("POST /admin/logout", o.handleLogout)
+	}
+	mux.HandleFunc("GET /admin/sessions/{id}/tap", p.adminOnly(p.handleTap))
+	mux.HandleFunc("GET /admin/sessions/{id}/bundle", p.adminOnly(p.handleBundle))
+	mux.HandleFunc("GET /admin/sessions/{id}/annotations", p.adminOnly(p.handleAnnotations(true)))
+	mux.HandleFunc("POST /admin/sessions/{id}/annotations", p.adminOnly(p.handleAnnotations(true)))
+	mux.HandleFunc("GET /admin/recordings", p.adminOnly(p.handleRecordings))
+	mux.HandleFunc("GET /admin/recordings/{id}", p.adminOnly(p.handleRecording))
+	mux.HandleFunc("GET /admin/recordings/{id}/script", p.adminOnly(p.handleRecordingScript))
+	if p.artifacts != nil {
+		mux.HandleFunc("GET /admin/artifacts", p.adminOnly(p.handleArtifacts))
+		mux.HandleFunc("GET /admin/artifacts/{key...}", p.adminOnly(p.handleArtifact))
+	}
+	if p.apiKeys != nil {
+		mux.HandleFunc("/admin/api-keys", p.adminOnly(p.handleAPIKeys))
+	}
+	if p.cluster != nil {
+		mux.HandleFunc("/admin/cluster/replicas", p.adminOnly(p.handleClusterReplicas))
+	}
+}
+
+// serveAdmin serves the operational endpoints, /healthz and pprof on the
+// -admin-listen listener.
+func (p *proxyServer) serveAdmin(ctx context.Context, ln net.Listener) {
+	mux := http.NewServeMux()
+	p.handleAdmin(mux)
+	mux.HandleFunc("/healthz", p.handleHealthz())
+	mux.HandleFunc("/readyz", p.handleReadyz)
+	// pprof is only ever served here, never to clients.
+	mux.HandleFunc("/debug/pprof/", p.adminOnly(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", p.adminOnly(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", p.adminOnly(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", p.adminOnly(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", p.adminOnly(pprof.Trace))
+	server := &http.Server{Handler: p.headers.secure(mux)}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("admin server shutdown error", "error", err)
+		}
+	}()
+
+	slog.Info("admin endpoints listening", "event", "listening", "addr", ln.Addr().String())
+	if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("admin server failed", "error", err)
+	}
+}
+
+// handleDrain serves POST /admin/drain, which stops this replica taking
+// new sessions until POST /admin/undrain while its sessions carry on.
+func (p *proxyServer) handleDrain(drain bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p.setDrained(drain)
+		active := len(p.allSessions())
+		slog.Info("drain set via admin api", "event", "drain", "draining", drain, "active_sessions", active, "operator_ip", clientIP(r.RemoteAddr))
+		writeJSON(w, http.StatusOK, map[string]any{"draining": p.draining.Load(), "activeSessions": active})
+	}
+}
+
+// handleReadyz tells a load balancer or Kubernetes readiness probe whether
+// to send this replica new sessions: not while it is draining or the
+// health prober has found Chromium down. Unlike /healthz it doesn't call
+// Chromium itself.
+func (p *proxyServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case p.draining.Load():
+		writeErrorCode(w, http.StatusServiceUnavailable, errorCodeDraining, "draining", nil)
+	case !p.health.healthy():
+		writeErrorCode(w, http.StatusServiceUnavailable, errorCodeUpstreamUnhealthy, "upstream unhealthy", nil)
+	default:
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+	}
+}
+
+// handleHealthz is /healthz, behind the admin credentials with
+// -admin-auth-healthz.
+func (p *proxyServer) handleHealthz() http.HandlerFunc {
+	if p.adminAuth.healthz {
+		return p.adminOnly(p.handleHealth)
+	}
+	return p.handleHealth
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Priority classes of the admission queue, lowest first.
+const (
+	priorityLow = iota
+	priorityNormal
+	priorityHigh
+)
+
+var priorityNames = []string{"low", "normal", "high"}
+
+// parsePriority reads a priority class name; the empty name is normal.
+func parsePriority(name string) (int, error) {
+	if name == "" {
+		return priorityNormal, nil
+	}
+	for class, known := range priorityNames {
+		if name == known {
+			return class, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown priority %q (known: low, normal, high)", name)
+}
+
+// admissionQueue holds connections over -max-sessions for up to wait,
+// admitting them as slots free up: the highest priority class first, and
+// within a class the one waiting longest. A waiter moves up a class for
+// every aging it has waited, so a steady stream of high-priority clients
+// can't starve the others.
+type admissionQueue struct {
+	wait  time.Duration
+	aging time.Duration
+
+	mu      sync.Mutex
+	waiters []*admissionWaiter
+}
+
+type admissionWaiter struct {
+	priority int
+	since    time.Time
+	// ready is closed once admitted is set, under the queue's lock.
+	ready    chan struct{}
+	admitted bool
+}
+
+// effectivePriority is the waiter's class after aging.
+func (q *admissionQueue) effectivePriority(w *admissionWaiter, now time.Time) int {
+	priority := w.priority
+	if q.aging > 0 {
+		priority += int(now.Sub(w.since) / q.aging)
+	}
+	return min(priority, priorityHigh)
+}
+
+// nextLocked removes and returns the waiter to admit next, or nil.
+func (q *admissionQueue) nextLocked() *admissionWaiter {
+	if len(q.waiters) == 0 {
+		return nil
+	}
+	now := time.Now()
+	best := 0
+	for i, w := range q.waiters[1:] {
+		// Waiters are in arrival order, so a tie keeps the earlier one.
+		if q.effectivePriority(w, now) > q.effectivePriority(q.waiters[best], now) {
+			best = i + 1
+		}
+	}
+	w := q.waiters[best]
+	q.waiters = append(q.waiters[:best], q.waiters[best+1:]...)
+	return w
+}
+
+func (q *admissionQueue) removeLocked(w *admissionWaiter) {
+	for i, other := range q.waiters {
+		if other == w {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// waiting returns how many connections are queued.
+func (q *admissionQueue) waiting() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiters)
+}
+
+// acquireSession reserves a session slot under -max-sessions. With
+// -admission-wait, a connection finding none waits in the admission queue
+// at priority until one is handed to it, ctx ends or the wait runs out.
+func (p *proxyServer) acquireSession(ctx context.Context, priority int) bool {
+	if p.maxSessions <= 0 {
+		return true
+	}
+	q := p.admission
+	q.mu.Lock()
+	// Slots only go to new connections when nobody is queued ahead.
+	if len(q.waiters) == 0 && p.sessionSlots.Load() < int64(p.maxSessions) {
+		p.sessionSlots.Add(1)
+		q.mu.Unlock()
+		return true
+	}
+	if q.wait <= 0 {
+		q.mu.Unlock()
+		return false
+	}
+	w := &admissionWaiter{priority: priority, since: time.Now(), ready: make(chan struct{})}
+	q.waiters = append(q.waiters, w)
+	q.mu.Unlock()
+
+	labels := map[string]string{"priority": priorityNames[priority]}
+	p.metrics.add("browserd_admission_queue", labels, 1)
+	defer p.metrics.add("browserd_admission_queue", labels, -1)
+
+	timer := time.NewTimer(q.wait)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !w.admitted {
+		q.removeLocked(w)
+		return false
+	}
+	slog.Info("session admitted from queue", "event", "session_admitted", "priority", priorityNames[priority], "waited", time.Since(w.since).Round(time.Millisecond).String())
+	return true
+}
+
+// releaseSession frees a session slot, handing it straight to the next
+// queued connection if there is one.
+func (p *proxyServer) releaseSession() {
+	if p.maxSessions <= 0 {
+		return
+	}
+	q := p.admission
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if w := q.nextLocked(); w != nil {
+		w.admitted = true
+		close(w.ready)
+		return
+	}
+	p.sessionSlots.Add(-1)
+}
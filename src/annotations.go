@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Bounds on a session's annotations.
+const (
+	maxSessionAnnotations = 100
+	maxAnnotationText     = 1024
+)
+
+// annotationsFile is the JSON Lines file of a session's annotations, in
+// its temp directory.
+const annotationsFile = "annotations.jsonl"
+
+// sessionAnnotation is a note marking a moment of a session, such as
+// "captcha encountered here" or "deploy happened now".
+type sessionAnnotation struct {
+	Time time.Time `json:"time"`
+	// OffsetMs is how far into the session it was added, to find the
+	// moment in its recording.
+	OffsetMs int64  `json:"offsetMs"`
+	Text     string `json:"text"`
+	// Author is "client" for the session's API, or "operator" for the
+	// admin one.
+	Author string `json:"author"`
+}
+
+// annotate adds a note to the session. Its errors are the client's to
+// fix.
+func (s *session) annotate(text, author string) (sessionAnnotation, error) {
+	text = strings.TrimSpace(text)
+	switch {
+	case text == "":
+		return sessionAnnotation{}, errors.New("text is required")
+	case len(text) > maxAnnotationText:
+		return sessionAnnotation{}, fmt.Errorf("text is longer than %d bytes", maxAnnotationText)
+	case strings.ContainsFunc(text, func(r rune) bool { return unicode.IsControl(r) && r != '\n' && r != '\t' }):
+		return sessionAnnotation{}, errors.New("text contains control characters")
+	}
+	now := time.Now()
+	note := sessionAnnotation{Time: now.UTC(), OffsetMs: now.Sub(s.startedAt).Milliseconds(), Text: text, Author: author}
+
+	s.annotationsMu.Lock()
+	defer s.annotationsMu.Unlock()
+	if len(s.annotations) >= maxSessionAnnotations {
+		return sessionAnnotation{}, fmt.Errorf("session has %d annotations already", maxSessionAnnotations)
+	}
+	s.annotations = append(s.annotations, note)
+	if s.temp != nil {
+		// Kept on disk too, so the bundle and -artifact-store have them
+		// after the session ends.
+		if dir, err := s.temp.sessionDir(s.id); err == nil {
+			if line, err := json.Marshal(note); err == nil {
+				if f, err := os.OpenFile(filepath.Join(dir, annotationsFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644); err == nil {
+					_, _ = f.Write(append(line, '\n'))
+					_ = f.Close()
+				}
+			}
+		}
+	}
+	return note, nil
+}
+
+// annotationList returns a copy of the session's annotations.
+func (s *session) annotationList() []sessionAnnotation {
+	s.annotationsMu.Lock()
+	defer s.annotationsMu.Unlock()
+	return append([]sessionAnnotation(nil), s.annotations...)
+}
+
+// handleAnnotations serves /api/sessions/{id}/annotations, and with
+// operator set /admin/sessions/{id}/annotations: GET lists a live
+// session's annotations, and POST {"text": "..."} adds one, logging it and
+// telling webhooks with a session.annotated event.
+func (p *proxyServer) handleAnnotations(operator bool) http.HandlerFunc {
+	author := "client"
+	if operator {
+		author = "operator"
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !operator && !p.authorize(r) {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		var sess *session
+		if operator {
+			if sess = p.findSession(r.PathValue("id")); sess == nil {
+				writeError(w, http.StatusNotFound, "session not found")
+				return
+			}
+		} else if sess = p.clientSession(w, r); sess == nil {
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			writeJSON(w, http.StatusOK, sess.annotationList())
+			return
+		}
+		var body struct {
+			Text string `json:"text"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4*maxAnnotationText)).Decode(&body); err != nil {
+			p.writeBodyError(w, err)
+			return
+		}
+		note, err := sess.annotate(body.Text, author)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		owner := p.sessionOwner(sess)
+		owner.metrics.add("browserd_session_annotations_total", map[string]string{"author": author}, 1)
+		sess.log.Info("session annotated", "event", "session_annotated", "author", author, "text", note.Text)
+		sess.logf("annotation by %s: %s", author, note.Text)
+		event := owner.sessionEvent(eventSessionAnnotated, sess, nil)
+		event.Reason = note.Text
+		owner.notify(event)
+		writeJSON(w, http.StatusCreated, note)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+// Actions an anomaly rule can take.
+const (
+	anomalyAlert     = "alert"
+	anomalyTerminate = "terminate"
+)
+
+// errAnomalyTerminated ends a session an anomaly rule with the terminate
+// action fired for. The client has already been closed with 1008.
+var errAnomalyTerminated = errors.New("session terminated for anomalous CDP usage")
+
+// anomalyRule is one entry of the -anomaly-rules file. It fires once a
+// session sends Count matching commands within Window.
+type anomalyRule struct {
+	Name string `json:"name"`
+	// Methods are the CDP methods the rule counts, wildcards allowed;
+	// empty counts every command whose params.url matches URL.
+	Methods []string `json:"methods,omitempty"`
+	// URL, when set, is a wildcard the command's params.url must match.
+	URL string `json:"url,omitempty"`
+	// Distinct counts the browser contexts, or flattened sessions, the
+	// commands ran in rather than the commands themselves.
+	Distinct bool   `json:"distinct,omitempty"`
+	Count    int    `json:"count,omitempty"`
+	Window   string `json:"window,omitempty"`
+	Action   string `json:"action,omitempty"`
+
+	window time.Duration
+}
+
+func loadAnomalyRules(path string) ([]anomalyRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []anomalyRule
+	if err := unmarshalConfig(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Name == "" {
+			return nil, fmt.Errorf("parse %s: rule %d has no name", path, i)
+		}
+		if len(rule.Methods) == 0 && rule.URL == "" {
+			return nil, fmt.Errorf("parse %s: rule %q needs methods or url", path, rule.Name)
+		}
+		if rule.Count == 0 {
+			rule.Count = 1
+		}
+		if rule.Count < 0 {
+			return nil, fmt.Errorf("parse %s: rule %q has a negative count", path, rule.Name)
+		}
+		if rule.Window != "" {
+			if rule.window, err = time.ParseDuration(rule.Window); err != nil || rule.window < 0 {
+				return nil, fmt.Errorf("parse %s: rule %q has an invalid window %q", path, rule.Name, rule.Window)
+			}
+		}
+		switch rule.Action {
+		case "":
+			rule.Action = anomalyAlert
+		case anomalyAlert, anomalyTerminate:
+		default:
+			return nil, fmt.Errorf("parse %s: rule %q has unknown action %q", path, rule.Name, rule.Action)
+		}
+	}
+	return rules, nil
+}
+
+func (rule *anomalyRule) matches(method, url string) bool {
+	if rule.URL != "" && (url == "" || !wildcardMatch(rule.URL, url)) {
+		return false
+	}
+	if len(rule.Methods) == 0 {
+		return true
+	}
+	for _, pattern := range rule.Methods {
+		if wildcardMatch(pattern, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// anomalyWatch applies the anomaly rules to one session's client commands.
+// Only pumpClient uses it, so it needs no locking.
+type anomalyWatch struct {
+	rules []anomalyRule
+	// hits are the matching commands each rule has seen within its window,
+	// keyed by context for a Distinct rule.
+	hits [][]anomalyHit
+	// onAnomaly is told of each rule that fires, with what it counted.
+	onAnomaly func(rule *anomalyRule, method string, seen int)
+}
+
+type anomalyHit struct {
+	at  time.Time
+	key string
+}
+
+func newAnomalyWatch(rules []anomalyRule, onAnomaly func(rule *anomalyRule, method string, seen int)) *anomalyWatch {
+	return &anomalyWatch{rules: rules, hits: make([][]anomalyHit, len(rules)), onAnomaly: onAnomaly}
+}
+
+// observe counts a client frame against every rule, returning the rule
+// that fired if it terminates the session. A rule that fires starts
+// counting afresh.
+func (w *anomalyWatch) observe(data []byte) *anomalyRule {
+	var msg struct {
+		ID        *int64 `json:"id"`
+		Method    string `json:"method"`
+		SessionID string `json:"sessionId"`
+		Params    struct {
+			URL              string `json:"url"`
+			BrowserContextID string `json:"browserContextId"`
+		} `json:"params"`
+	}
+	if json.Unmarshal(data, &msg) != nil || msg.ID == nil || msg.Method == "" {
+		return nil
+	}
+
+	now := time.Now()
+	for i := range w.rules {
+		rule := &w.rules[i]
+		if !rule.matches(msg.Method, msg.Params.URL) {
+			continue
+		}
+		hits := w.hits[i]
+		if rule.window > 0 {
+			kept := hits[:0]
+			for _, hit := range hits {
+				if now.Sub(hit.at) < rule.window {
+					kept = append(kept, hit)
+				}
+			}
+			hits = kept
+		}
+		hit := anomalyHit{at: now}
+		if rule.Distinct {
+			hit.key = firstNonEmpty(msg.Params.BrowserContextID, msg.SessionID)
+			hits = slices.DeleteFunc(hits, func(h anomalyHit) bool { return h.key == hit.key })
+		}
+		hits = append(hits, hit)
+		if len(hits) < rule.Count {
+			w.hits[i] = hits
+			continue
+		}
+
+		w.hits[i] = hits[:0]
+		w.onAnomaly(rule, msg.Method, len(hits))
+		if rule.Action == anomalyTerminate {
+			return rule
+		}
+	}
+	return nil
+}
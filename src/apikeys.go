@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Rejection reasons for API key quotas, alongside those in overload.go.
+const (
+	reasonKeyMaxSessions     = "key_max_sessions"
+	reasonKeyMonthlySessions = "key_monthly_sessions"
+)
+
+// API key capabilities, granted by a key's allow list: raw CDP sessions
+// and the endpoints that act on them, the stateless rendering APIs, and
+// reading the admin endpoints.
+const (
+	capabilityCDP       = "cdp"
+	capabilityRender    = "render"
+	capabilityAdminRead = "admin-read"
+)
+
+// defaultCapabilities are those of a key without an allow list.
+var defaultCapabilities = []string{capabilityCDP, capabilityRender}
+
+// apiKey is one entry of the -api-keys file. Zero limits are unlimited.
+type apiKey struct {
+	name string
+	Key  string `json:"key,omitempty"`
+	// Certificates are wildcards matched against the common name and SANs
+	// of a verified client certificate, which then counts as presenting
+	// the key; a key may have only these.
+	Certificates       []string `json:"certificates,omitempty"`
+	MaxSessions        int      `json:"maxSessions,omitempty"`
+	MaxSessionDuration string   `json:"maxSessionDuration,omitempty"`
+	MonthlySessions    int      `json:"monthlySessions,omitempty"`
+	Priority           string   `json:"priority,omitempty"`
+	Allow              []string `json:"allow,omitempty"`
+	// Labels are set on every session of the key, over any the client
+	// gives.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	maxDuration time.Duration
+	priority    int
+	allowed     map[string]bool
+}
+
+// allows reports whether the key was granted capability.
+func (k *apiKey) allows(capability string) bool {
+	return k.allowed[capability]
+}
+
+// apiKeyUsage is what a key has used: sessions in Month (UTC, as
+// 2006-01), sessions ever, and sessions open now.
+type apiKeyUsage struct {
+	Month         string `json:"month"`
+	MonthSessions int    `json:"monthSessions"`
+	TotalSessions int64  `json:"totalSessions"`
+	active        int
+}
+
+// apiKeyStore holds the -api-keys and their usage, which is saved to
+// statePath, when set, so monthly counts survive restarts.
+type apiKeyStore struct {
+	keys      []*apiKey
+	statePath string
+	metrics   *metricsRegistry
+
+	mu    sync.Mutex
+	usage map[string]*apiKeyUsage
+}
+
+// loadAPIKeys reads a JSON object of key names to keys, e.g.
+// {"payments": {"key": "…", "maxSessions": 5, "maxSessionDuration": "30m",
+// "monthlySessions": 10000, "priority": "high", "allow": ["render"]},
+// "billing": {"certificates": ["billing.svc.internal"], "labels":
+// {"team": "billing"}}}.
+func loadAPIKeys(path, statePath string, metrics *metricsRegistry) (*apiKeyStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries map[string]*apiKey
+	if err := unmarshalConfig(data, &entries); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	s := &apiKeyStore{statePath: statePath, metrics: metrics, usage: make(map[string]*apiKeyUsage)}
+	seen := make(map[string]string)
+	for name, key := range entries {
+		if !profileNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("parse %s: invalid key name %q", path, name)
+		}
+		if key == nil || (key.Key == "" && len(key.Certificates) == 0) {
+			return nil, fmt.Errorf("parse %s: key %q has no key or certificates", path, name)
+		}
+		if key.Key != "" {
+			if other, ok := seen[key.Key]; ok {
+				return nil, fmt.Errorf("parse %s: keys %q and %q are the same", path, other, name)
+			}
+			seen[key.Key] = name
+		}
+		if len(key.Labels) > maxSessionLabels {
+			return nil, fmt.Errorf("parse %s: key %q has too many labels", path, name)
+		}
+		for label, value := range key.Labels {
+			if !labelKeyPattern.MatchString(label) || reservedQueryParams[label] || len(value) > maxSessionLabelValue {
+				return nil, fmt.Errorf("parse %s: key %q: invalid label %q", path, name, label)
+			}
+		}
+		if key.MaxSessionDuration != "" {
+			if key.maxDuration, err = time.ParseDuration(key.MaxSessionDuration); err != nil || key.maxDuration <= 0 {
+				return nil, fmt.Errorf("parse %s: key %q: invalid maxSessionDuration %q", path, name, key.MaxSessionDuration)
+			}
+		}
+		if key.priority, err = parsePriority(key.Priority); err != nil {
+			return nil, fmt.Errorf("parse %s: key %q: %w", path, name, err)
+		}
+		if key.Allow == nil {
+			key.Allow = defaultCapabilities
+		}
+		key.allowed = make(map[string]bool)
+		for _, capability := range key.Allow {
+			switch capability {
+			case capabilityCDP, capabilityRender, capabilityAdminRead:
+				key.allowed[capability] = true
+			default:
+				return nil, fmt.Errorf("parse %s: key %q: unknown capability %q (want cdp, render or admin-read)", path, name, capability)
+			}
+		}
+		key.name = name
+		s.keys = append(s.keys, key)
+		s.usage[name] = &apiKeyUsage{}
+	}
+	sort.Slice(s.keys, func(i, j int) bool { return s.keys[i].name < s.keys[j].name })
+
+	if statePath != "" {
+		if data, err := os.ReadFile(statePath); err == nil {
+			var saved map[string]*apiKeyUsage
+			if err := json.Unmarshal(data, &saved); err != nil {
+				return nil, fmt.Errorf("parse %s: %w", statePath, err)
+			}
+			for name, usage := range saved {
+				if s.usage[name] != nil && usage != nil {
+					s.usage[name] = usage
+				}
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	metrics.register("browserd_api_key_sessions_total", metricCounter, "Sessions accepted per API key.")
+	metrics.register("browserd_api_key_active_sessions", metricGauge, "Sessions open per API key.")
+	metrics.register("browserd_api_key_denied_total", metricCounter, "Requests refused because their API key lacks the capability, per key and capability.")
+	return s, nil
+}
+
+// match finds the key a client presented. Every key is compared so the
+// time taken doesn't tell which one was close.
+func (s *apiKeyStore) match(provided string) *apiKey {
+	var found *apiKey
+	for _, key := range s.keys {
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(key.Key)) == 1 && key.Key != "" {
+			found = key
+		}
+	}
+	return found
+}
+
+// matchRequest finds the key r presents: its token, or else its verified
+// client certificate, which belongs to the first key, by name, whose
+// certificates match it.
+func (s *apiKeyStore) matchRequest(r *http.Request) *apiKey {
+	if key := s.match(providedToken(r)); key != nil {
+		return key
+	}
+	cert := verifiedCertificate(r)
+	if cert == nil {
+		return nil
+	}
+	for _, key := range s.keys {
+		if len(key.Certificates) > 0 && certificateMatches(cert, key.Certificates) {
+			return key
+		}
+	}
+	return nil
+}
+
+// certificateBound reports whether any key is bound to certificates.
+func (s *apiKeyStore) certificateBound() bool {
+	for _, key := range s.keys {
+		if len(key.Certificates) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// requireCapability refuses requests to handler with 403 when they present
+// an API key that wasn't granted capability. Other requests, including
+// unauthenticated ones, are left to handler.
+func (p *proxyServer) requireCapability(capability string, handler http.HandlerFunc) http.HandlerFunc {
+	if p.apiKeys == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if key, _ := p.authenticate(r); key != nil && !key.allows(capability) {
+			p.metrics.add("browserd_api_key_denied_total", map[string]string{"key": key.name, "capability": capability}, 1)
+			message := fmt.Sprintf("API key %q is not allowed %s", key.name, capability)
+			if websocket.IsWebSocketUpgrade(r) {
+				_ = p.closeUpgrade(w, r, nil, closeForbidden, message)
+				return
+			}
+			writeError(w, http.StatusForbidden, message)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// callerKey returns the name of the -api-keys key r presents, or "".
+func (p *proxyServer) callerKey(r *http.Request) string {
+	if key, _ := p.authenticate(r); key != nil {
+		return key.name
+	}
+	return ""
+}
+
+// clientSession returns the live session /api/sessions/{id} names, or
+// answers r and returns nil. A session started with an API key is only
+// found for that key, or for the admin credentials, so a key's clients
+// can't record, trace or take the cookies of another's sessions.
+func (p *proxyServer) clientSession(w http.ResponseWriter, r *http.Request) *session {
+	id := r.PathValue("id")
+	sess := p.sessions.get(id)
+	if sess == nil {
+		if !p.redirectToOwner(w, r, id) {
+			writeError(w, http.StatusNotFound, "session not found")
+		}
+		return nil
+	}
+	if sess.apiKey != p.callerKey(r) && !(p.adminAuth.enabled() && p.authorizeAdmin(r)) {
+		writeError(w, http.StatusNotFound, "session not found")
+		return nil
+	}
+	return sess
+}
+
+// acquire admits a session for key, returning the rejection reason when a
+// quota is used up. release must be called when the session ends.
+func (s *apiKeyStore) acquire(key *apiKey) (release func(), reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := s.usage[key.name]
+	if month := time.Now().UTC().Format("2006-01"); usage.Month != month {
+		usage.Month, usage.MonthSessions = month, 0
+	}
+	if key.MaxSessions > 0 && usage.active >= key.MaxSessions {
+		return nil, reasonKeyMaxSessions
+	}
+	if key.MonthlySessions > 0 && usage.MonthSessions >= key.MonthlySessions {
+		return nil, reasonKeyMonthlySessions
+	}
+	usage.active++
+	usage.MonthSessions++
+	usage.TotalSessions++
+	s.saveLocked()
+
+	labels := map[string]string{"key": key.name}
+	s.metrics.add("browserd_api_key_sessions_total", labels, 1)
+	s.metrics.add("browserd_api_key_active_sessions", labels, 1)
+	return func() {
+		s.mu.Lock()
+		usage.active--
+		s.mu.Unlock()
+		s.metrics.add("browserd_api_key_active_sessions", labels, -1)
+	}, ""
+}
+
+// saveLocked writes the usage to statePath, through a temporary file so a
+// crash can't leave it half written.
+func (s *apiKeyStore) saveLocked() {
+	if s.statePath == "" {
+		return
+	}
+	data, _ := json.Marshal(s.usage)
+	tmp, err := os.CreateTemp(filepath.Dir(s.statePath), ".api-key-state-*")
+	if err == nil {
+		_, err = tmp.Write(data)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), s.statePath)
+		}
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		slog.Warn("failed to save API key usage", "event", "api_key_state_error", "path", s.statePath, "error", err)
+	}
+}
+
+// apiKeyView is one key and its usage, for /admin/api-keys. The key
+// itself is never shown.
+type apiKeyView struct {
+	Name               string            `json:"name"`
+	MaxSessions        int               `json:"maxSessions,omitempty"`
+	MaxSessionDuration string            `json:"maxSessionDuration,omitempty"`
+	MonthlySessions    int               `json:"monthlySessions,omitempty"`
+	Priority           string            `json:"priority"`
+	Allow              []string          `json:"allow"`
+	Certificates       []string          `json:"certificates,omitempty"`
+	Labels             map[string]string `json:"labels,omitempty"`
+	ActiveSessions     int               `json:"activeSessions"`
+	apiKeyUsage
+}
+
+func (p *proxyServer) handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	s := p.apiKeys
+	month := time.Now().UTC().Format("2006-01")
+	s.mu.Lock()
+	views := make([]apiKeyView, 0, len(s.keys))
+	for _, key := range s.keys {
+		usage := *s.usage[key.name]
+		if usage.Month != month {
+			usage.Month, usage.MonthSessions = month, 0
+		}
+		views = append(views, apiKeyView{
+			Name:               key.name,
+			MaxSessions:        key.MaxSessions,
+			MaxSessionDuration: key.MaxSessionDuration,
+			MonthlySessions:    key.MonthlySessions,
+			Priority:           priorityNames[key.priority],
+			Allow:              key.Allow,
+			Certificates:       key.Certificates,
+			Labels:             key.Labels,
+			ActiveSessions:     usage.active,
+			apiKeyUsage:        usage,
+		})
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, views)
+}
+
+// providedToken is the credential a client sent, as ?token= or an
+// Authorization bearer header.
+func providedToken(r *http.Request) string {
+	if provided := r.URL.Query().Get("token"); provided != "" {
+		return provided
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
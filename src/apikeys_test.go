@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// writeAPIKeys writes an -api-keys file of keys to a temporary directory.
+func writeAPIKeys(t *testing.T, keys string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "api-keys.json")
+	if err := os.WriteFile(path, []byte(keys), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAPIKeyMaxSessionDuration(t *testing.T) {
+	h := newHarness(t, proxyConfig{apiKeysFile: writeAPIKeys(t, `{"short": {"key": "k-short", "maxSessionDuration": "300ms"}}`)})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, _, err := h.connect(ctx, "/?token=k-short")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	start := time.Now()
+	for {
+		if _, _, err = client.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if !websocket.IsCloseError(err, closeSessionLimit) {
+		t.Fatalf("read: %v, want close %d", err, closeSessionLimit)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("closed after %s", elapsed)
+	}
+}
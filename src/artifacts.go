@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Artifact types, each kept under its own prefix of -artifact-store.
+const (
+	artifactRecording  = "recording"
+	artifactHAR        = "har"
+	artifactDownload   = "download"
+	artifactBundle     = "bundle"
+	artifactScreenshot = "screenshot"
+	artifactAnnotation = "annotations"
+)
+
+var artifactPrefixes = map[string]string{
+	artifactRecording:  "recordings/",
+	artifactHAR:        "hars/",
+	artifactDownload:   "downloads/",
+	artifactBundle:     "bundles/",
+	artifactScreenshot: "screenshots/",
+	artifactAnnotation: "annotations/",
+}
+
+const (
+	// artifactUploadTimeout bounds the upload of one artifact.
+	artifactUploadTimeout = 10 * time.Minute
+	// artifactExpireInterval is how often expired artifacts are deleted.
+	artifactExpireInterval = time.Hour
+	// artifactDrainTimeout is how long shutdown waits for uploads still
+	// in progress.
+	artifactDrainTimeout = 30 * time.Second
+)
+
+// artifactStore is where artifacts outlive the temp directory: a local
+// directory, or an S3-compatible bucket. get reports a missing artifact
+// as os.ErrNotExist.
+type artifactStore interface {
+	put(ctx context.Context, key string, body io.ReadSeeker, contentType string) error
+	get(ctx context.Context, key string) (io.ReadCloser, error)
+	remove(ctx context.Context, key string) error
+	list(ctx context.Context, prefix string) ([]artifactObject, error)
+	String() string
+}
+
+// artifactObject is a stored artifact, as GET /admin/artifacts lists it.
+type artifactObject struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// newArtifactStore opens -artifact-store: a directory path or file://
+// URL, s3://bucket/prefix or gs://bucket/prefix.
+func newArtifactStore(raw string) (artifactStore, error) {
+	if !strings.Contains(raw, "://") {
+		return newDiskStore(raw)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		return newDiskStore(u.Path)
+	case "s3", "gs":
+		return newS3Store(u)
+	}
+	return nil, fmt.Errorf("%q: must be a directory, file://, s3:// or gs://", raw)
+}
+
+// parseArtifactRetention parses -artifact-retention, type=duration
+// entries naming the artifact types to store; 0 keeps them for good.
+func parseArtifactRetention(entries []string) (map[string]time.Duration, error) {
+	retention := make(map[string]time.Duration, len(entries))
+	for _, entry := range entries {
+		name, value, ok := strings.Cut(entry, "=")
+		if _, known := artifactPrefixes[name]; !ok || !known {
+			return nil, fmt.Errorf("%q: entries must be recording, har, download, bundle, screenshot or annotations=<duration>", entry)
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("%q: invalid duration", entry)
+		}
+		retention[name] = d
+	}
+	return retention, nil
+}
+
+// artifactArchive copies the artifacts of every session that ends to the
+// store, so they survive the replica, and deletes each type once its
+// retention has passed.
+type artifactArchive struct {
+	store     artifactStore
+	retention map[string]time.Duration
+	metrics   *metricsRegistry
+	pending   sync.WaitGroup
+}
+
+func newArtifactArchive(store artifactStore, retention map[string]time.Duration, metrics *metricsRegistry) *artifactArchive {
+	metrics.register("browserd_artifact_uploads_total", metricCounter, "Session artifacts copied to -artifact-store, by type and result (ok or error).")
+	metrics.register("browserd_artifacts_expired_total", metricCounter, "Stored artifacts deleted after their -artifact-retention, by type.")
+	return &artifactArchive{store: store, retention: retention, metrics: metrics}
+}
+
+// stores reports whether artifacts of kind are kept.
+func (a *artifactArchive) stores(kind string) bool {
+	_, ok := a.retention[kind]
+	return ok
+}
+
+// archiveSession uploads what an ended session left in its temp
+// directory, in the background. Sessions that never reached Chromium
+// have nothing to keep.
+func (p *proxyServer) archiveSession(sess *session) {
+	select {
+	case <-sess.ended:
+	default:
+		return
+	}
+	a := p.artifacts
+	a.pending.Add(1)
+	go func() {
+		defer a.pending.Done()
+		p.uploadArtifacts(sess)
+	}()
+}
+
+func (p *proxyServer) uploadArtifacts(sess *session) {
+	a := p.artifacts
+	upload := func(kind, key string, body io.ReadSeeker) {
+		ctx, cancel := context.WithTimeout(context.Background(), artifactUploadTimeout)
+		defer cancel()
+		key = artifactPrefixes[kind] + key
+		err := a.store.put(ctx, key, body, mime.TypeByExtension(path.Ext(key)))
+		result := "ok"
+		if err != nil {
+			result = "error"
+			sess.log.Warn("failed to store session artifact", "event", "artifact_upload_failed", "key", key, "error", err)
+		}
+		a.metrics.add("browserd_artifact_uploads_total", map[string]string{"type": kind, "result": result}, 1)
+	}
+
+	if path, err := p.recordingPath(sess.id); err == nil && fileExists(path) {
+		if a.stores(artifactRecording) {
+			if f, err := os.Open(path); err == nil {
+				upload(artifactRecording, sess.id+".jsonl", f)
+				_ = f.Close()
+			}
+		}
+		if a.stores(artifactHAR) {
+			frames, _ := p.readRecording(sess.id)
+			if har, err := json.MarshalIndent(harFromFrames(frames), "", "  "); err == nil {
+				upload(artifactHAR, sess.id+".har", bytes.NewReader(har))
+			}
+		}
+	}
+	if a.stores(artifactDownload) && p.temp != nil {
+		dir := filepath.Join(p.temp.root, tempSessionsDir, sess.id, tempDownloads)
+		_ = filepath.WalkDir(dir, func(file string, entry fs.DirEntry, err error) error {
+			// Chromium's partial .crdownload files never finished.
+			if err != nil || entry.IsDir() || strings.HasSuffix(file, ".crdownload") {
+				return nil
+			}
+			rel, _ := filepath.Rel(dir, file)
+			if f, err := os.Open(file); err == nil {
+				upload(artifactDownload, sess.id+"/"+filepath.ToSlash(rel), f)
+				_ = f.Close()
+			}
+			return nil
+		})
+	}
+	if a.stores(artifactScreenshot) && p.temp != nil {
+		dir := filepath.Join(p.temp.root, tempSessionsDir, sess.id, tempScreenshots)
+		for _, name := range p.temp.errorScreenshots(sess.id) {
+			if f, err := os.Open(filepath.Join(dir, name)); err == nil {
+				upload(artifactScreenshot, sess.id+"/"+name, f)
+				_ = f.Close()
+			}
+		}
+	}
+	if a.stores(artifactAnnotation) && p.temp != nil {
+		if f, err := os.Open(filepath.Join(p.temp.root, tempSessionsDir, sess.id, annotationsFile)); err == nil {
+			upload(artifactAnnotation, sess.id+".jsonl", f)
+			_ = f.Close()
+		}
+	}
+	if a.stores(artifactBundle) {
+		files, problems := p.bundleRecords(sess.id, sess)
+		if len(problems) > 0 {
+			files = append(files, bundleFile{name: "errors.txt", data: []byte(strings.Join(problems, "\n") + "\n")})
+		}
+		var buf bytes.Buffer
+		if err := writeBundle(&buf, files); err == nil {
+			upload(artifactBundle, sess.id+".zip", bytes.NewReader(buf.Bytes()))
+		}
+	}
+}
+
+// wait lets uploads in progress finish, for up to artifactDrainTimeout.
+func (a *artifactArchive) wait() {
+	if a == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		a.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(artifactDrainTimeout):
+		slog.Warn("gave up waiting for artifact uploads", "event", "artifact_upload_abandoned")
+	}
+}
+
+// runExpiry deletes expired artifacts until ctx ends.
+func (a *artifactArchive) runExpiry(ctx context.Context) {
+	ticker := time.NewTicker(artifactExpireInterval)
+	defer ticker.Stop()
+	for {
+		a.expire(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *artifactArchive) expire(ctx context.Context) {
+	for kind, retention := range a.retention {
+		if retention <= 0 {
+			continue
+		}
+		objects, err := a.store.list(ctx, artifactPrefixes[kind])
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Warn("failed to list stored artifacts", "event", "artifact_expiry_failed", "store", a.store.String(), "type", kind, "error", err)
+			}
+			continue
+		}
+		for _, object := range objects {
+			if time.Since(object.Modified) < retention {
+				continue
+			}
+			if err := a.store.remove(ctx, object.Key); err != nil {
+				slog.Warn("failed to delete expired artifact", "event", "artifact_expiry_failed", "key", object.Key, "error", err)
+				continue
+			}
+			a.metrics.add("browserd_artifacts_expired_total", map[string]string{"type": kind}, 1)
+		}
+	}
+}
+
+// artifactKey checks a key taken from a request names an artifact.
+func artifactKey(key string) bool {
+	if key == "" || path.Clean(key) != key || strings.HasPrefix(key, "/") || strings.Contains(key, "..") {
+		return false
+	}
+	for _, prefix := range artifactPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleArtifacts serves GET /admin/artifacts: the stored artifacts of
+// ?session=, or of every session.
+func (p *proxyServer) handleArtifacts(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("session")
+	if id != "" && (id != filepath.Base(id) || id == "." || id == "..") {
+		writeError(w, http.StatusBadRequest, "invalid session")
+		return
+	}
+	objects := []artifactObject{}
+	for kind, prefix := range artifactPrefixes {
+		if !p.artifacts.stores(kind) {
+			continue
+		}
+		found, err := p.artifacts.store.list(r.Context(), prefix+id)
+		if err != nil {
+			slog.Warn("failed to list stored artifacts", "store", p.artifacts.store.String(), "error", err)
+			writeError(w, http.StatusBadGateway, "failed to list artifacts")
+			return
+		}
+		for _, object := range found {
+			// ?session=ab must not match session abc.
+			rest := strings.TrimPrefix(object.Key, prefix+id)
+			if id == "" || strings.HasPrefix(rest, ".") || strings.HasPrefix(rest, "/") {
+				objects = append(objects, object)
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, objects)
+}
+
+// handleArtifact serves GET /admin/artifacts/{key...}, one stored
+// artifact.
+func (p *proxyServer) handleArtifact(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !artifactKey(key) {
+		writeError(w, http.StatusNotFound, "artifact not found")
+		return
+	}
+	p.serveArtifact(w, r, key, "artifact not found")
+}
+
+// serveArtifact streams a stored artifact, answering 404 with notFound
+// when there is none.
+func (p *proxyServer) serveArtifact(w http.ResponseWriter, r *http.Request, key, notFound string) {
+	body, err := p.artifacts.store.get(r.Context(), key)
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, http.StatusNotFound, notFound)
+		return
+	}
+	if err != nil {
+		slog.Warn("failed to read stored artifact", "key", key, "error", err)
+		writeError(w, http.StatusBadGateway, "failed to read artifact")
+		return
+	}
+	defer body.Close()
+	if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(key)))
+	_, _ = io.Copy(w, body)
+}
+
+// diskStore keeps artifacts under a local directory, such as a mounted
+// persistent volume.
+type diskStore struct {
+	root string
+}
+
+func newDiskStore(root string) (*diskStore, error) {
+	if root == "" {
+		return nil, errors.New("missing directory")
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &diskStore{root: root}, nil
+}
+
+func (d *diskStore) String() string {
+	return d.root
+}
+
+// put writes through a temporary file, so a half-written artifact is
+// never listed.
+func (d *diskStore) put(_ context.Context, key string, body io.ReadSeeker, _ string) error {
+	file := filepath.Join(d.root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".upload-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (d *diskStore) get(_ context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(d.root, filepath.FromSlash(key)))
+}
+
+func (d *diskStore) remove(_ context.Context, key string) error {
+	err := os.Remove(filepath.Join(d.root, filepath.FromSlash(key)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// list walks the directory holding prefix, matching keys by prefix as a
+// bucket would.
+func (d *diskStore) list(_ context.Context, prefix string) ([]artifactObject, error) {
+	dir := path.Dir(prefix)
+	if strings.HasSuffix(prefix, "/") {
+		dir = strings.TrimSuffix(prefix, "/")
+	}
+	var objects []artifactObject
+	err := filepath.WalkDir(filepath.Join(d.root, filepath.FromSlash(dir)), func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".upload-") {
+			return nil
+		}
+		rel, _ := filepath.Rel(d.root, file)
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		objects = append(objects, artifactObject{Key: key, Size: info.Size(), Modified: info.ModTime()})
+		return nil
+	})
+	return objects, err
+}
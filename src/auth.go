@@ -0,0 +1,333 @@
+package main
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Client authentication methods -auth selects.
+const (
+	authToken     = "token"
+	authMTLS      = "mtls"
+	authSignedURL = "signed-url"
+	authCallout   = "callout"
+)
+
+// authenticator checks the credential a client request carries, other than
+// an -api-keys key. A request any configured authenticator accepts is let
+// in; an error means the credential couldn't be checked, and counts as a
+// refusal.
+type authenticator interface {
+	authenticate(r *http.Request) (bool, error)
+	String() string
+}
+
+// authConfig selects and configures the client authenticators.
+type authConfig struct {
+	// methods are the -auth methods, tried in order.
+	methods []string
+	// clientCA is a PEM file of the CAs client certificates must chain
+	// to, and clientSubjects wildcards one of a certificate's common name
+	// or SANs must match; empty accepts any verified certificate.
+	clientCA       string
+	clientSubjects []string
+	// requireCert makes TLS listeners refuse handshakes without a
+	// certificate from clientCA.
+	requireCert bool
+	// signingKey verifies signed URLs.
+	signingKey string
+	// callout is the URL asked about each request.
+	callout string
+}
+
+// parseAuthMethods checks a comma-separated -auth list against the settings
+// each method needs.
+func parseAuthMethods(raw string, cfg proxyConfig) ([]string, error) {
+	methods := splitList(raw)
+	for _, method := range methods {
+		var missing string
+		switch method {
+		case authToken:
+			if cfg.token == "" {
+				missing = "-token"
+			}
+		case authMTLS:
+			if cfg.auth.clientCA == "" {
+				missing = "-client-ca"
+			}
+		case authSignedURL:
+			if cfg.auth.signingKey == "" {
+				missing = "-url-signing-key"
+			}
+		case authCallout:
+			if cfg.auth.callout == "" {
+				missing = "-auth-callout"
+			}
+		default:
+			return nil, fmt.Errorf("unknown method %q: must be token, mtls, signed-url or callout", method)
+		}
+		if missing != "" {
+			return nil, fmt.Errorf("%s requires %s", method, missing)
+		}
+	}
+	return methods, nil
+}
+
+// newAuthenticators builds the authenticators -auth lists, and the pool of
+// -client-ca certificates TLS listeners verify clients against. Without
+// -auth a -token still protects clients, as it always has.
+func newAuthenticators(token string, cfg authConfig) ([]authenticator, *x509.CertPool, error) {
+	methods := cfg.methods
+	if len(methods) == 0 && token != "" {
+		methods = []string{authToken}
+	}
+	var (
+		auths []authenticator
+		pool  *x509.CertPool
+	)
+	// API keys may be bound to certificates without -auth mtls.
+	if cfg.clientCA != "" {
+		pem, err := os.ReadFile(cfg.clientCA)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("%s: no PEM certificates", cfg.clientCA)
+		}
+	}
+	for _, method := range methods {
+		switch method {
+		case authToken:
+			auths = append(auths, tokenAuth(token))
+		case authMTLS:
+			auths = append(auths, certAuth{subjects: cfg.clientSubjects})
+		case authSignedURL:
+			auths = append(auths, signedURLAuth{key: []byte(cfg.signingKey)})
+		case authCallout:
+			u, err := url.Parse(cfg.callout)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, nil, fmt.Errorf("invalid callout URL %q", cfg.callout)
+			}
+			auths = append(auths, newCalloutAuth(u))
+		}
+	}
+	return auths, pool, nil
+}
+
+// tokenAuth accepts the shared -token as ?token= or a bearer header.
+type tokenAuth string
+
+func (t tokenAuth) authenticate(r *http.Request) (bool, error) {
+	return subtle.ConstantTimeCompare([]byte(providedToken(r)), []byte(t)) == 1, nil
+}
+
+func (tokenAuth) String() string { return authToken }
+
+// certAuth accepts a client certificate the TLS listener verified against
+// -client-ca. Listeners without TLS never carry one.
+type certAuth struct {
+	subjects []string
+}
+
+func (a certAuth) authenticate(r *http.Request) (bool, error) {
+	leaf := verifiedCertificate(r)
+	if leaf == nil {
+		return false, nil
+	}
+	return len(a.subjects) == 0 || certificateMatches(leaf, a.subjects), nil
+}
+
+func (certAuth) String() string { return authMTLS }
+
+// verifiedCertificate is the client certificate the TLS listener verified
+// for r, or nil.
+func verifiedCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// certificateMatches reports whether the common name or one of the SANs of
+// cert matches one of the wildcards.
+func certificateMatches(cert *x509.Certificate, patterns []string) bool {
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	for _, pattern := range patterns {
+		for _, name := range names {
+			if name != "" && wildcardMatch(pattern, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// signedURLAuth accepts a URL carrying ?expires=, a Unix time still to
+// come, and ?signature=, the hex HMAC-SHA256 under -url-signing-key of the
+// path, a newline and the rest of the query, sorted by name. A backend
+// hands such URLs out so a client can connect for a while without holding
+// a long-lived credential, and can't change what it connects with.
+type signedURLAuth struct {
+	key []byte
+}
+
+func (a signedURLAuth) authenticate(r *http.Request) (bool, error) {
+	query := r.URL.Query()
+	expires, signature := query.Get("expires"), query.Get("signature")
+	if expires == "" || signature == "" {
+		return false, nil
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return false, nil
+	}
+	provided, err := hex.DecodeString(signature)
+	if err != nil {
+		return false, nil
+	}
+	return hmac.Equal(provided, signURL(a.key, r.URL.Path, query)), nil
+}
+
+func (signedURLAuth) String() string { return authSignedURL }
+
+// signURL signs path and query, less any signature. Encode sorts the
+// query by name, keeping the order of repeated values.
+func signURL(key []byte, path string, query url.Values) []byte {
+	signed := make(url.Values, len(query))
+	for name, values := range query {
+		if name != "signature" {
+			signed[name] = values
+		}
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(path + "\n" + signed.Encode()))
+	return mac.Sum(nil)
+}
+
+// calloutCacheTTL is how long a callout's answer is reused for requests
+// with the same path and credentials, since one client request is often
+// authenticated more than once. At most calloutCacheSize answers are kept.
+const (
+	calloutCacheTTL  = 5 * time.Second
+	calloutCacheSize = 4096
+)
+
+// calloutAuth asks an external HTTP service about each request, as a
+// reverse proxy's forward auth does: a GET carrying the client's
+// Authorization and Cookie headers, with the original method, URI, host
+// and client address in X-Forwarded-* headers. A 2xx answer lets the
+// client in and 401 or 403 keeps it out; anything else is an error.
+type calloutAuth struct {
+	url    *url.URL
+	client *http.Client
+
+	// cached holds the answers, the most recently used first in lru,
+	// which drops the least recently used past calloutCacheSize.
+	mu     sync.Mutex
+	cached map[string]*list.Element
+	lru    *list.List
+}
+
+type calloutAnswer struct {
+	key     string
+	ok      bool
+	expires time.Time
+}
+
+func newCalloutAuth(u *url.URL) *calloutAuth {
+	return &calloutAuth{url: u, client: &http.Client{Timeout: requestTimeout}, cached: make(map[string]*list.Element), lru: list.New()}
+}
+
+func (a *calloutAuth) authenticate(r *http.Request) (bool, error) {
+	key := r.Method + "\n" + r.URL.RequestURI() + "\n" + r.Header.Get("Authorization") + "\n" + r.Header.Get("Cookie")
+	if ok, cached := a.lookup(key); cached {
+		return ok, nil
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, a.url.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range []string{"Authorization", "Cookie"} {
+		if value := r.Header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-For", clientIP(r.RemoteAddr))
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	var ok bool
+	switch {
+	case resp.StatusCode/100 == 2:
+		ok = true
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		ok = false
+	default:
+		return false, errors.New("callout answered " + resp.Status)
+	}
+
+	a.remember(key, ok)
+	return ok, nil
+}
+
+// lookup returns the cached answer for key, if one is still fresh.
+func (a *calloutAuth) lookup(key string) (ok, cached bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	el, found := a.cached[key]
+	if !found {
+		return false, false
+	}
+	answer := el.Value.(*calloutAnswer)
+	if time.Now().After(answer.expires) {
+		a.lru.Remove(el)
+		delete(a.cached, key)
+		return false, false
+	}
+	a.lru.MoveToFront(el)
+	return answer.ok, true
+}
+
+// remember caches the answer for key.
+func (a *calloutAuth) remember(key string, ok bool) {
+	expires := time.Now().Add(calloutCacheTTL)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if el, found := a.cached[key]; found {
+		answer := el.Value.(*calloutAnswer)
+		answer.ok, answer.expires = ok, expires
+		a.lru.MoveToFront(el)
+		return
+	}
+	a.cached[key] = a.lru.PushFront(&calloutAnswer{key: key, ok: ok, expires: expires})
+	if a.lru.Len() > calloutCacheSize {
+		oldest := a.lru.Back()
+		a.lru.Remove(oldest)
+		delete(a.cached, oldest.Value.(*calloutAnswer).key)
+	}
+}
+
+func (a *calloutAuth) String() string { return authCallout }
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTokenAuth(t *testing.T) {
+	h := newHarness(t, proxyConfig{token: "client-secret"})
+	for _, tc := range []struct {
+		name   string
+		path   string
+		bearer string
+		want   int
+	}{
+		{"query", "/json/list?token=client-secret", "", http.StatusOK},
+		{"bearer", "/json/list", "client-secret", http.StatusOK},
+		{"missing", "/json/list", "", http.StatusUnauthorized},
+		{"wrong query", "/json/list?token=client", "", http.StatusUnauthorized},
+		{"wrong bearer", "/json/list", "client-secret-2", http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, h.url(tc.path), nil)
+			if tc.bearer != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.bearer)
+			}
+			resp, err := h.client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.want {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tc.want)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, _, err := h.connect(ctx, "/?token=wrong")
+	if err == nil {
+		_, _, err = client.ReadMessage()
+		client.Close()
+	}
+	if !websocket.IsCloseError(err, closeAuthFailed) {
+		t.Fatalf("session with a wrong token: %v, want close %d", err, closeAuthFailed)
+	}
+	client, _, err = h.connect(ctx, "/?token=client-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+}
+
+// testCA issues certificates for TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "browserd test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate for name, usable by a server or a client.
+func (ca *testCA) issue(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeKeyPair writes cert as PEM files in dir, returning their paths.
+func writeKeyPair(t *testing.T, dir string, cert tls.Certificate) (certFile, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestMTLSAuth(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, ca.pem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := writeKeyPair(t, dir, ca.issue(t, "browserd"))
+	h := newHarness(t, proxyConfig{
+		listen: []listenSpec{{certFile: certFile, keyFile: keyFile}},
+		auth:   authConfig{methods: []string{authMTLS}, clientCA: caFile, clientSubjects: []string{"*.ci.example.com"}},
+	})
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	for _, tc := range []struct {
+		name string
+		cert []tls.Certificate
+		want int
+	}{
+		{"matching subject", []tls.Certificate{ca.issue(t, "runner.ci.example.com")}, http.StatusOK},
+		{"other subject", []tls.Certificate{ca.issue(t, "laptop.example.com")}, http.StatusUnauthorized},
+		{"no certificate", nil, http.StatusUnauthorized},
+		{"other CA", []tls.Certificate{newTestCA(t).issue(t, "runner.ci.example.com")}, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{
+				DialContext:     h.dial,
+				TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "browserd", Certificates: tc.cert},
+			}}
+			resp, err := client.Get("https://browserd/json/list")
+			if tc.want == 0 {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("status %d, want the handshake refused", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.want {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tc.want)
+			}
+		})
+	}
+}
+
+func signedQuery(key, path string, query url.Values) url.Values {
+	query.Set("signature", hex.EncodeToString(signURL([]byte(key), path, query)))
+	return query
+}
+
+func TestSignedURLs(t *testing.T) {
+	const key = "signing-key"
+	h := newHarness(t, proxyConfig{auth: authConfig{methods: []string{authSignedURL}, signingKey: key}})
+	expires := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)
+	valid := signedQuery(key, "/json/list", url.Values{"expires": {expires}, "flags": {"low-memory"}})
+
+	tampered := func(change func(url.Values)) string {
+		query := url.Values{}
+		for name, values := range valid {
+			query[name] = append([]string(nil), values...)
+		}
+		change(query)
+		return "/json/list?" + query.Encode()
+	}
+	for _, tc := range []struct {
+		name string
+		path string
+		want int
+	}{
+		{"valid", "/json/list?" + valid.Encode(), http.StatusOK},
+		{"reordered", "/json/list?signature=" + valid.Get("signature") + "&flags=low-memory&expires=" + expires, http.StatusOK},
+		{"added parameter", tampered(func(q url.Values) { q.Set("proxy", "http://attacker.example") }), http.StatusUnauthorized},
+		{"changed parameter", tampered(func(q url.Values) { q.Set("flags", "default") }), http.StatusUnauthorized},
+		{"repeated parameter", tampered(func(q url.Values) { q.Add("flags", "default") }), http.StatusUnauthorized},
+		{"removed parameter", tampered(func(q url.Values) { q.Del("flags") }), http.StatusUnauthorized},
+		{"changed expiry", tampered(func(q url.Values) { q.Set("expires", expires+"0") }), http.StatusUnauthorized},
+		{"other path", "/json?" + valid.Encode(), http.StatusUnauthorized},
+		{"expired", "/json/list?" + signedQuery(key, "/json/list", url.Values{"expires": {"1"}}).Encode(), http.StatusUnauthorized},
+		{"wrong key", "/json/list?" + signedQuery("other", "/json/list", url.Values{"expires": {expires}}).Encode(), http.StatusUnauthorized},
+		{"unsigned", "/json/list?expires=" + expires, http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := h.client.Get(h.url(tc.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.want {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tc.want)
+			}
+		})
+	}
+}
+
+func TestCalloutCacheIsBounded(t *testing.T) {
+	a := newCalloutAuth(&url.URL{Scheme: "http", Host: "auth.example"})
+	for i := range calloutCacheSize + 10 {
+		a.remember(strconv.Itoa(i), true)
+	}
+	if len(a.cached) != calloutCacheSize || a.lru.Len() != calloutCacheSize {
+		t.Fatalf("cache holds %d answers, want %d", len(a.cached), calloutCacheSize)
+	}
+	if _, cached := a.lookup("0"); cached {
+		t.Fatal("oldest answer was kept")
+	}
+	if ok, cached := a.lookup(strconv.Itoa(calloutCacheSize + 9)); !ok || !cached {
+		t.Fatal("newest answer was dropped")
+	}
+}
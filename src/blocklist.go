@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// blockList is a compiled subset of EasyList-style network filters:
+// "||domain^" anchors, "|" start/end anchors, '*' wildcards, '^'
+// separators and "@@" exceptions. Cosmetic ("##") rules are ignored.
+// Rules with $options are skipped: none are implemented, and applied
+// without them, "$third-party" or "$domain=" rules would block far more
+// than they mean to.
+type blockList struct {
+	blockDomains map[string]bool
+	allowDomains map[string]bool
+	block        []string
+	allow        []string
+	// skipped counts the rules left out for their $options.
+	skipped int
+}
+
+func newBlockList() *blockList {
+	return &blockList{
+		blockDomains: make(map[string]bool),
+		allowDomains: make(map[string]bool),
+	}
+}
+
+// loadBlockLists reads and compiles filter lists from files or http(s) URLs.
+func loadBlockLists(ctx context.Context, client *http.Client, sources []string) (*blockList, error) {
+	list := newBlockList()
+	for _, source := range sources {
+		if err := list.load(ctx, client, source); err != nil {
+			return nil, fmt.Errorf("load %s: %w", source, err)
+		}
+	}
+	return list, nil
+}
+
+func (b *blockList) load(ctx context.Context, client *http.Client, source string) error {
+	var body io.ReadCloser
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return errors.New(resp.Status)
+		}
+		body = resp.Body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return err
+		}
+		body = f
+	}
+	defer body.Close()
+
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		b.addRule(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+func (b *blockList) addRule(line string) {
+	rule := strings.TrimSpace(line)
+	if rule == "" || strings.HasPrefix(rule, "!") || strings.HasPrefix(rule, "[") || strings.Contains(rule, "#") {
+		return
+	}
+
+	domains, patterns := b.blockDomains, &b.block
+	if exception, ok := strings.CutPrefix(rule, "@@"); ok {
+		rule = exception
+		domains, patterns = b.allowDomains, &b.allow
+	}
+	if strings.IndexByte(rule, '$') >= 0 {
+		b.skipped++
+		return
+	}
+	if rule == "" {
+		return
+	}
+
+	// "||example.com^" is the overwhelmingly common form; keep it in a set.
+	if host, ok := strings.CutPrefix(rule, "||"); ok {
+		host = strings.TrimSuffix(host, "^")
+		if host != "" && !strings.ContainsAny(host, "/*^|") {
+			domains[strings.ToLower(host)] = true
+			return
+		}
+	}
+	*patterns = append(*patterns, rule)
+}
+
+func (b *blockList) size() int {
+	return len(b.blockDomains) + len(b.block)
+}
+
+// blocks reports whether rawURL matches a block rule and no exception.
+func (b *blockList) blocks(rawURL string) bool {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return false
+	}
+	host := strings.ToLower(parsed.Hostname())
+
+	if matchesDomain(b.allowDomains, host) || matchesAny(b.allow, rawURL, host) {
+		return false
+	}
+	return matchesDomain(b.blockDomains, host) || matchesAny(b.block, rawURL, host)
+}
+
+// policy adapts the list to the relay's request policy chain.
+func (b *blockList) policy() requestPolicy {
+	return func(req *pausedRequest) *fetchDecision {
+		if b.blocks(req.Request.URL) {
+			return failRequest("BlockedByClient")
+		}
+		return nil
+	}
+}
+
+// matchesDomain checks host and each of its parent domains.
+func matchesDomain(domains map[string]bool, host string) bool {
+	for host != "" {
+		if domains[host] {
+			return true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return false
+		}
+		host = host[i+1:]
+	}
+	return false
+}
+
+func matchesAny(rules []string, rawURL, host string) bool {
+	for _, rule := range rules {
+		if matchFilter(rule, rawURL, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchFilter(rule, rawURL, host string) bool {
+	if rest, ok := strings.CutPrefix(rule, "||"); ok {
+		// Domain anchor with a path: the rule must match starting at the
+		// host or at any of its parent domains.
+		hostStart := strings.Index(rawURL, "://")
+		if hostStart < 0 {
+			return false
+		}
+		hostStart += 3
+		for offset := 0; offset < len(host); offset++ {
+			if (offset == 0 || host[offset-1] == '.') && matchFrom(rest, rawURL[hostStart+offset:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if rest, ok := strings.CutPrefix(rule, "|"); ok {
+		return matchFrom(rest, rawURL)
+	}
+
+	// Only try positions where the rule's leading literal occurs.
+	literal := rule
+	if i := strings.IndexAny(rule, "*^|"); i >= 0 {
+		literal = rule[:i]
+	}
+	if literal == "" {
+		for i := 0; i <= len(rawURL); i++ {
+			if matchFrom(rule, rawURL[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	for offset := 0; ; {
+		i := strings.Index(rawURL[offset:], literal)
+		if i < 0 {
+			return false
+		}
+		if matchFrom(rule, rawURL[offset+i:]) {
+			return true
+		}
+		offset += i + 1
+	}
+}
+
+// matchFrom matches rule against the start of s, with '*' wildcards, '^'
+// separators and a trailing '|' end anchor.
+func matchFrom(rule, s string) bool {
+	if rule == "" {
+		return true
+	}
+	switch c := rule[0]; c {
+	case '*':
+		for i := 0; i <= len(s); i++ {
+			if matchFrom(rule[1:], s[i:]) {
+				return true
+			}
+		}
+		return false
+	case '^':
+		if s == "" {
+			return matchFrom(rule[1:], s)
+		}
+		if isFilterSeparator(s[0]) {
+			return matchFrom(rule[1:], s[1:])
+		}
+		return false
+	case '|':
+		if len(rule) == 1 {
+			return s == ""
+		}
+	}
+	if s == "" || s[0] != rule[0] {
+		return false
+	}
+	return matchFrom(rule[1:], s[1:])
+}
+
+func isFilterSeparator(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return false
+	case c == '_' || c == '-' || c == '.' || c == '%':
+		return false
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// needsContext reports whether the session gets a browser context of its
+// own. A permission policy needs one so it doesn't apply to other sessions.
+func (r *relay) needsContext() bool {
+	return r.isolation != nil || r.proxy != nil || r.permissions != nil
+}
+
+// createSessionContext gives the session its own disposable browser
+// context, routed through the session's egress proxy if it has one, before
+// any client frame is forwarded.
+func (r *relay) createSessionContext() error {
+	id, err := r.openSessionContext()
+	if err != nil {
+		return err
+	}
+
+	r.contextID = id
+	if r.isolation != nil {
+		r.isolation.mu.Lock()
+		r.isolation.contexts[r.contextID] = true
+		r.isolation.mu.Unlock()
+	}
+	r.sess.logf("using browser context %s", r.contextID)
+	return nil
+}
+
+// openSessionContext creates a browser context with the session's settings
+// and returns its ID.
+func (r *relay) openSessionContext() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	params := map[string]any{"disposeOnDetach": true}
+	if r.proxy != nil {
+		params["proxyServer"] = proxyServerArg(r.proxy)
+	}
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := r.call(ctx, "", "Target.createBrowserContext", raw)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Error) > 0 {
+		return "", errors.New(string(resp.Error))
+	}
+	id := createdContext(resp.Result)
+	if id == "" {
+		return "", errors.New("createBrowserContext returned no browserContextId")
+	}
+	return id, nil
+}
+
+// createdContext is the browserContextId of a Target.createBrowserContext
+// result, or "".
+func createdContext(result json.RawMessage) string {
+	var created struct {
+		BrowserContextID string `json:"browserContextId"`
+	}
+	_ = json.Unmarshal(result, &created)
+	return created.BrowserContextID
+}
+
+// defaultTargetContext opens new targets in the session's context when the
+// client doesn't name one. Strict isolation does this in checkClient.
+func (r *relay) defaultTargetContext(msg *cdpMessage) bool {
+	if msg.Method != "Target.createTarget" || msg.SessionID != "" {
+		return false
+	}
+	var params map[string]any
+	if err := json.Unmarshal(msg.Params, &params); err != nil || params == nil {
+		return false
+	}
+	if id, _ := params["browserContextId"].(string); id != "" {
+		return false
+	}
+	params["browserContextId"] = r.contextID
+	msg.Params, _ = json.Marshal(params)
+	return true
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+)
+
+// launchOptions mirrors the subset of browserless.io's ?launch= payload
+// browserd can honor: stealth, and args, which are checked against
+// -session-args-allow like ?arg= values. Other options, such as headless or
+// defaultViewport, are listed in ignored and otherwise left alone, since
+// Chromium's remaining settings belong to whoever started it.
+type launchOptions struct {
+	Args    []string `json:"args,omitempty"`
+	Stealth bool     `json:"stealth,omitempty"`
+
+	ignored []string
+}
+
+// authorize checks the client token when one is configured. Browserless
+// clients pass it as ?token=, other clients may prefer an Authorization
+// bearer header.
+func (p *proxyServer) authorize(r *http.Request) bool {
+	_, ok := p.authenticate(r)
+	return ok
+}
+
+// authenticate checks the client's credential against the -api-keys and
+// the -auth methods, returning the API key it matched, if any.
+func (p *proxyServer) authenticate(r *http.Request) (*apiKey, bool) {
+	if len(p.auths) == 0 && p.apiKeys == nil {
+		return nil, true
+	}
+
+	if p.apiKeys != nil {
+		if key := p.apiKeys.matchRequest(r); key != nil {
+			return key, true
+		}
+	}
+	for _, auth := range p.auths {
+		ok, err := auth.authenticate(r)
+		if err != nil {
+			slog.Warn("client authentication failed", "event", "auth_error", "method", auth.String(), "client_ip", clientIP(r.RemoteAddr), "error", err)
+			continue
+		}
+		if ok {
+			return nil, true
+		}
+	}
+	return nil, false
+}
+
+// parseLaunchOptions decodes the browserless ?launch= JSON payload, if any.
+func parseLaunchOptions(r *http.Request) (*launchOptions, error) {
+	raw := r.URL.Query().Get("launch")
+	if raw == "" {
+		return nil, nil
+	}
+
+	var (
+		opts launchOptions
+		all  map[string]json.RawMessage
+	)
+	if err := json.Unmarshal([]byte(raw), &all); err != nil {
+		return nil, errors.New("invalid launch parameter: " + err.Error())
+	}
+	if err := json.Unmarshal([]byte(raw), &opts); err != nil {
+		return nil, errors.New("invalid launch parameter: " + err.Error())
+	}
+	for name := range all {
+		if name != "args" && name != "stealth" {
+			opts.ignored = append(opts.ignored, name)
+		}
+	}
+	slices.Sort(opts.ignored)
+	return &opts, nil
+}
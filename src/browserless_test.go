@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestParseLaunchOptionsIgnoresUnsupported(t *testing.T) {
+	launch := `{"headless":true,"defaultViewport":{"width":1280,"height":720},"args":["--lang=de"],"stealth":true}`
+	r := httptest.NewRequest("GET", "/?launch="+url.QueryEscape(launch), nil)
+	opts, err := parseLaunchOptions(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.Stealth || !slices.Equal(opts.Args, []string{"--lang=de"}) {
+		t.Fatalf("options = %+v", opts)
+	}
+	if !slices.Equal(opts.ignored, []string{"defaultViewport", "headless"}) {
+		t.Fatalf("ignored = %v", opts.ignored)
+	}
+
+	for _, bad := range []string{`{"args":"--lang=de"}`, `[true]`, `{`} {
+		r := httptest.NewRequest("GET", "/?launch="+url.QueryEscape(bad), nil)
+		if _, err := parseLaunchOptions(r); err == nil {
+			t.Errorf("%s: no error", bad)
+		}
+	}
+}
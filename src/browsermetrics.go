@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// browserSample is what one browser reported in a metrics sweep. rss is
+// -1 when browserd doesn't run the browser and can't read /proc for it.
+type browserSample struct {
+	cpuSeconds float64
+	rss        int64
+	targets    int
+	heapUsed   float64
+	heapTotal  float64
+}
+
+// collectBrowserMetrics samples every browser each interval until ctx
+// ends, exporting the results as per-browser gauges.
+func (p *proxyServer) collectBrowserMetrics(ctx context.Context) {
+	ticker := time.NewTicker(p.browserMetricsInterval)
+	defer ticker.Stop()
+
+	exported := make(map[string]bool)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		seen := make(map[string]bool)
+		sample := func(name string, endpoint func(context.Context) (*cdpClient, error), pid int) {
+			sampleCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+			defer cancel()
+			s, err := p.sampleBrowser(sampleCtx, endpoint, pid)
+			if err != nil {
+				slog.Debug("failed to sample browser metrics", "event", "browser_metrics_error", "browser", name, "error", err)
+				return
+			}
+			seen[name] = true
+			p.exportBrowserSample(name, s)
+		}
+
+		pid := 0
+		if p.supervisor != nil {
+			pid, _, _ = p.supervisor.usage()
+		}
+		sample("main", func(ctx context.Context) (*cdpClient, error) { return p.dialCDP(ctx, nil) }, pid)
+		if p.pool != nil {
+			for _, b := range p.pool.browsers() {
+				sample("pool-"+strconv.Itoa(b.port), func(ctx context.Context) (*cdpClient, error) {
+					conn, _, err := p.dial(ctx, b.debuggerURL, nil)
+					if err != nil {
+						return nil, err
+					}
+					return newCDPClient(conn), nil
+				}, b.cmd.Process.Pid)
+			}
+		}
+
+		// Browsers that went away, or stopped answering, drop out rather
+		// than leave their last values exported.
+		for name := range exported {
+			if !seen[name] {
+				p.removeBrowserSample(name)
+			}
+		}
+		exported = seen
+	}
+}
+
+// sampleBrowser reads CPU time from SystemInfo.getProcessInfo, the open
+// targets, and the JS heap of every page, attaching to each in turn. The
+// RSS comes from /proc when pid is known.
+func (p *proxyServer) sampleBrowser(ctx context.Context, dial func(context.Context) (*cdpClient, error), pid int) (browserSample, error) {
+	s := browserSample{rss: -1}
+	client, err := dial(ctx)
+	if err != nil {
+		return s, err
+	}
+	defer client.close()
+
+	result, err := client.call(ctx, "", "SystemInfo.getProcessInfo", nil)
+	if err != nil {
+		return s, err
+	}
+	var info struct {
+		ProcessInfo []struct {
+			CPUTime float64 `json:"cpuTime"`
+		} `json:"processInfo"`
+	}
+	_ = json.Unmarshal(result, &info)
+	for _, process := range info.ProcessInfo {
+		s.cpuSeconds += process.CPUTime
+	}
+
+	result, err = client.call(ctx, "", "Target.getTargets", nil)
+	if err != nil {
+		return s, err
+	}
+	var targets struct {
+		TargetInfos []struct {
+			TargetID string `json:"targetId"`
+			Type     string `json:"type"`
+		} `json:"targetInfos"`
+	}
+	_ = json.Unmarshal(result, &targets)
+	s.targets = len(targets.TargetInfos)
+	for _, target := range targets.TargetInfos {
+		if target.Type != "page" {
+			continue
+		}
+		sessionID, err := client.attach(ctx, target.TargetID)
+		if err != nil {
+			continue
+		}
+		if result, err := client.call(ctx, sessionID, "Runtime.getHeapUsage", nil); err == nil {
+			var heap struct {
+				UsedSize  float64 `json:"usedSize"`
+				TotalSize float64 `json:"totalSize"`
+			}
+			_ = json.Unmarshal(result, &heap)
+			s.heapUsed += heap.UsedSize
+			s.heapTotal += heap.TotalSize
+		}
+		_, _ = client.call(ctx, "", "Target.detachFromTarget", map[string]any{"sessionId": sessionID})
+	}
+
+	if pid != 0 {
+		if rss, err := processTreeRSS(pid); err == nil {
+			s.rss = rss
+		}
+	}
+	return s, nil
+}
+
+func (p *proxyServer) exportBrowserSample(name string, s browserSample) {
+	labels := map[string]string{"browser": name}
+	p.metrics.set("browserd_browser_cpu_seconds_total", labels, s.cpuSeconds)
+	p.metrics.set("browserd_browser_targets", labels, float64(s.targets))
+	p.metrics.set("browserd_browser_js_heap_used_bytes", labels, s.heapUsed)
+	p.metrics.set("browserd_browser_js_heap_total_bytes", labels, s.heapTotal)
+	if s.rss >= 0 {
+		p.metrics.set("browserd_browser_rss_bytes", labels, float64(s.rss))
+	}
+}
+
+func (p *proxyServer) removeBrowserSample(name string) {
+	labels := map[string]string{"browser": name}
+	for _, metric := range []string{
+		"browserd_browser_cpu_seconds_total",
+		"browserd_browser_targets",
+		"browserd_browser_js_heap_used_bytes",
+		"browserd_browser_js_heap_total_bytes",
+		"browserd_browser_rss_bytes",
+	} {
+		p.metrics.remove(metric, labels)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// browserResetTimeout bounds resetting a warm pool browser for its next
+// session; one that takes longer is stopped instead.
+const browserResetTimeout = 15 * time.Second
+
+// releaseExclusive hands back the warm pool browser of an ?exclusive
+// session. With -warm-pool-reuse it is reset and made ready for the next
+// session; without it, or if the reset fails, it is stopped.
+func (p *proxyServer) releaseExclusive(b *pooledBrowser) {
+	if !p.pool.reuse {
+		p.pool.release(b)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), browserResetTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := p.resetBrowser(ctx, b); err != nil {
+		slog.Warn("failed to reset warm pool browser", "event", "pool_browser_reset_failed", "port", b.port, "error", err)
+		p.metrics.add("browserd_warm_pool_reset_failures_total", nil, 1)
+		p.pool.release(b)
+		return
+	}
+	slog.Info("warm pool browser reset", "event", "pool_browser_reset", "port", b.port, "duration", time.Since(start).String())
+	p.metrics.add("browserd_warm_pool_resets_total", nil, 1)
+	p.pool.giveBack(b)
+}
+
+// resetBrowser leaves b as a fresh launch would: a single about:blank
+// page, with no cookies, cache, site storage or permission overrides.
+// Pages are replaced rather than navigated so that open dialogs and
+// beforeunload handlers can't hold the reset up; closing a page
+// dismisses its dialogs with it.
+func (p *proxyServer) resetBrowser(ctx context.Context, b *pooledBrowser) error {
+	conn, _, err := p.dial(ctx, b.debuggerURL, nil)
+	if err != nil {
+		return err
+	}
+	client := newCDPClient(conn)
+	defer client.close()
+
+	result, err := client.call(ctx, "", "Target.getTargets", nil)
+	if err != nil {
+		return err
+	}
+	var targets struct {
+		TargetInfos []struct {
+			TargetID string `json:"targetId"`
+			Type     string `json:"type"`
+		} `json:"targetInfos"`
+	}
+	_ = json.Unmarshal(result, &targets)
+
+	// Collect the origins the pages went to, whose storage is cleared
+	// once they are gone.
+	origins := make(map[string]bool)
+	for _, target := range targets.TargetInfos {
+		if target.Type != "page" {
+			continue
+		}
+		sessionID, err := client.attach(ctx, target.TargetID)
+		if err != nil {
+			continue
+		}
+		if result, err := client.call(ctx, sessionID, "Page.getNavigationHistory", nil); err == nil {
+			var history struct {
+				Entries []struct {
+					URL string `json:"url"`
+				} `json:"entries"`
+			}
+			_ = json.Unmarshal(result, &history)
+			for _, entry := range history.Entries {
+				if origin := webOrigin(entry.URL); origin != "" {
+					origins[origin] = true
+				}
+			}
+		}
+		_, _ = client.call(ctx, "", "Target.detachFromTarget", map[string]any{"sessionId": sessionID})
+	}
+
+	result, err = client.call(ctx, "", "Target.createTarget", map[string]any{"url": "about:blank"})
+	if err != nil {
+		return err
+	}
+	var blank struct {
+		TargetID string `json:"targetId"`
+	}
+	_ = json.Unmarshal(result, &blank)
+	for _, target := range targets.TargetInfos {
+		if target.Type != "page" || target.TargetID == blank.TargetID {
+			continue
+		}
+		if _, err := client.call(ctx, "", "Target.closeTarget", map[string]any{"targetId": target.TargetID}); err != nil {
+			return fmt.Errorf("close target %s: %w", target.TargetID, err)
+		}
+	}
+
+	// Contexts the session created go with everything in them.
+	result, err = client.call(ctx, "", "Target.getBrowserContexts", nil)
+	if err != nil {
+		return err
+	}
+	var contexts struct {
+		BrowserContextIDs []string `json:"browserContextIds"`
+	}
+	_ = json.Unmarshal(result, &contexts)
+	for _, id := range contexts.BrowserContextIDs {
+		if _, err := client.call(ctx, "", "Target.disposeBrowserContext", map[string]any{"browserContextId": id}); err != nil {
+			return fmt.Errorf("dispose browser context %s: %w", id, err)
+		}
+	}
+
+	if _, err := client.call(ctx, "", "Storage.clearCookies", nil); err != nil {
+		return err
+	}
+	for origin := range origins {
+		if _, err := client.call(ctx, "", "Storage.clearDataForOrigin", map[string]any{"origin": origin, "storageTypes": "all"}); err != nil {
+			return fmt.Errorf("clear storage of %s: %w", origin, err)
+		}
+	}
+	if _, err := client.call(ctx, "", "Browser.resetPermissions", nil); err != nil {
+		return err
+	}
+	sessionID, err := client.attach(ctx, blank.TargetID)
+	if err != nil {
+		return err
+	}
+	if _, err := client.call(ctx, sessionID, "Network.clearBrowserCache", nil); err != nil {
+		return err
+	}
+	_, _ = client.call(ctx, "", "Target.detachFromTarget", map[string]any{"sessionId": sessionID})
+	return nil
+}
+
+// webOrigin returns the scheme://host[:port] of an http(s) URL, or "" for
+// other URLs, which have no storage to clear.
+func webOrigin(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	host := u.Host
+	if port := u.Port(); (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		host = strings.TrimSuffix(host, ":"+port)
+	}
+	return u.Scheme + "://" + host
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+)
+
+// defaultBuild names -chromium-bin among the -warm-pool-builds.
+const defaultBuild = "default"
+
+// chromiumBuild is a Chromium binary the warm pool launches browsers from,
+// picked for each launch in proportion to its weight, so a canary build
+// can take a small share of new sessions.
+type chromiumBuild struct {
+	name   string
+	bin    string
+	weight int
+}
+
+// parseBuilds reads -warm-pool-builds, name=path entries added to the
+// default build, and -warm-pool-weights, name=weight entries; builds
+// without a weight get 1. It returns nil when neither is set.
+func parseBuilds(defaultBin string, builds, weights []string) ([]*chromiumBuild, error) {
+	if len(builds) == 0 && len(weights) == 0 {
+		return nil, nil
+	}
+	out := []*chromiumBuild{{name: defaultBuild, bin: defaultBin, weight: 1}}
+	find := func(name string) *chromiumBuild {
+		for _, b := range out {
+			if b.name == name {
+				return b
+			}
+		}
+		return nil
+	}
+	for _, entry := range builds {
+		name, bin, ok := strings.Cut(entry, "=")
+		if !ok || bin == "" {
+			return nil, fmt.Errorf("%q is not name=path", entry)
+		}
+		if !profileNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid build name %q", name)
+		}
+		if find(name) != nil {
+			return nil, fmt.Errorf("build %q is listed twice", name)
+		}
+		out = append(out, &chromiumBuild{name: name, bin: bin, weight: 1})
+	}
+	for _, entry := range weights {
+		name, value, ok := strings.Cut(entry, "=")
+		weight, err := strconv.Atoi(value)
+		if !ok || err != nil || weight < 0 {
+			return nil, fmt.Errorf("%q is not name=weight", entry)
+		}
+		b := find(name)
+		if b == nil {
+			return nil, fmt.Errorf("weight for unknown build %q", name)
+		}
+		b.weight = weight
+	}
+	total := 0
+	for _, b := range out {
+		total += b.weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("every build has weight 0")
+	}
+	return out, nil
+}
+
+// pickBuild chooses the build of the next browser launched. Without
+// -warm-pool-builds it is an unnamed one of -chromium-bin.
+func (w *warmPool) pickBuild() *chromiumBuild {
+	if len(w.builds) == 0 {
+		return &chromiumBuild{bin: w.cfg.chromiumBin, weight: 1}
+	}
+	total := 0
+	for _, b := range w.builds {
+		total += b.weight
+	}
+	n := rand.IntN(total)
+	for _, b := range w.builds {
+		if n < b.weight {
+			return b
+		}
+		n -= b.weight
+	}
+	return w.builds[0]
+}
+
+// countBuildError counts a session that ended with an error against the
+// build of its browser, if it ran in one of the builds.
+func (p *proxyServer) countBuildError(sess *session) {
+	if sess.browser != nil && sess.browser.build != "" {
+		p.metrics.add("browserd_build_session_errors_total", sess.browser.buildLabels(), 1)
+	}
+}
+
+// buildLabels split the build metrics by build and by the Browser string
+// the browser reported, so builds can be compared.
+func (b *pooledBrowser) buildLabels() map[string]string {
+	return map[string]string{"build": b.build, "version": b.version}
+}
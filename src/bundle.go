@@ -0,0 +1,176 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// handleBundle serves GET /admin/sessions/{id}/bundle: a zip of what there
+// is to know about a session, to attach to a bug report. A live session
+// contributes its details, screenshots of its pages and its browser's
+// output; a session that has ended, only what it left on disk within
+// -temp-retention, or else the bundle -artifact-store kept. Parts that can't be collected are listed in errors.txt
+// rather than failing the bundle.
+func (p *proxyServer) handleBundle(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	sess := p.findSession(id)
+
+	files, problems := p.bundleRecords(id, sess)
+	add := func(name string, data []byte) {
+		files = append(files, bundleFile{name: name, data: data})
+	}
+	fail := func(part string, err error) {
+		problems = append(problems, part+": "+err.Error())
+	}
+
+	if sess == nil && len(files) == 0 {
+		// Past -temp-retention or another replica's, it may be stored.
+		if p.artifacts != nil && p.artifacts.stores(artifactBundle) && id == filepath.Base(id) {
+			p.serveArtifact(w, r, artifactPrefixes[artifactBundle]+id+".zip", "session not found")
+			return
+		}
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+
+	if sess != nil {
+		owner := p.sessionOwner(sess)
+		ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+		for _, targetID := range sess.pageTargets() {
+			data, err := owner.screenshot(ctx, sess, targetID)
+			if err != nil {
+				fail("screenshot of "+targetID, err)
+				continue
+			}
+			add("screenshots/"+targetID+".png", data)
+		}
+		cancel()
+		if logs := owner.chromiumLogs; logs != nil {
+			add("chromium.log", chromiumLogText(logs.tail(sess.browserName(), 0), sess.startedAt))
+		}
+	}
+	if len(problems) > 0 {
+		add("errors.txt", []byte(strings.Join(problems, "\n")+"\n"))
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="browserd-`+id+`.zip"`)
+	if err := writeBundle(w, files); err != nil {
+		slog.Warn("failed to write session bundle", "session_id", id, "error", err)
+	}
+}
+
+// bundleRecords collects the parts of a session's bundle that outlive it:
+// its details when sess is known, its log and its recording, as is and as
+// a HAR. Parts that failed are returned as problems.
+func (p *proxyServer) bundleRecords(id string, sess *session) (files []bundleFile, problems []string) {
+	add := func(name string, data []byte) {
+		files = append(files, bundleFile{name: name, data: data})
+	}
+	fail := func(part string, err error) {
+		problems = append(problems, part+": "+err.Error())
+	}
+
+	if sess != nil {
+		if data, err := json.MarshalIndent(sess.view(), "", "  "); err == nil {
+			add("session.json", data)
+		}
+	}
+	if p.sessionLogDir != "" && id == filepath.Base(id) {
+		if data, err := os.ReadFile(filepath.Join(p.sessionLogDir, id+".log")); err == nil {
+			add("session.log", data)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			fail("session.log", err)
+		}
+	}
+	if path, err := p.recordingPath(id); err == nil {
+		if data, err := os.ReadFile(path); err == nil {
+			add(recordingFile, data)
+			frames, _ := p.readRecording(id)
+			if har, err := json.MarshalIndent(harFromFrames(frames), "", "  "); err == nil {
+				add("session.har", har)
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			fail(recordingFile, err)
+		}
+	}
+	if p.temp != nil && id == filepath.Base(id) {
+		if data, err := os.ReadFile(filepath.Join(p.temp.root, tempSessionsDir, id, annotationsFile)); err == nil {
+			add(annotationsFile, data)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			fail(annotationsFile, err)
+		}
+		dir := filepath.Join(p.temp.root, tempSessionsDir, id, tempScreenshots)
+		for _, name := range p.temp.errorScreenshots(id) {
+			if data, err := os.ReadFile(filepath.Join(dir, name)); err == nil {
+				add("error-screenshots/"+name, data)
+			} else {
+				fail("error-screenshots/"+name, err)
+			}
+		}
+	}
+	return files, problems
+}
+
+type bundleFile struct {
+	name string
+	data []byte
+}
+
+func writeBundle(w io.Writer, files []bundleFile) error {
+	zw := zip.NewWriter(w)
+	now := time.Now()
+	for _, file := range files {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(file.data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// screenshot captures a page of a live session as PNG.
+func (p *proxyServer) screenshot(ctx context.Context, sess *session, targetID string) ([]byte, error) {
+	page, err := p.attachPage(ctx, sess, targetID)
+	if err != nil {
+		return nil, err
+	}
+	defer page.close()
+	return page.screenshot(ctx, false)
+}
+
+// browserName is the name the session's browser goes by in
+// /admin/chromium/logs.
+func (s *session) browserName() string {
+	if s.browser != nil {
+		return "pool-" + strconv.Itoa(s.browser.port)
+	}
+	return "main"
+}
+
+// chromiumLogText renders the output a browser produced since a session
+// started, one line per line of output.
+func chromiumLogText(lines []chromiumLogLine, since time.Time) []byte {
+	var b strings.Builder
+	for _, line := range lines {
+		if line.Time.Before(since) {
+			continue
+		}
+		fmt.Fprintf(&b, "%s %s %s\n", line.Time.Format(time.RFC3339Nano), line.Stream, line.Line)
+	}
+	return []byte(b.String())
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// cdpClient is browserd's own CDP connection to Chromium, used by the
+// HTTP APIs that drive the browser without a client library.
+type cdpClient struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+	nextID  atomic.Int64
+
+	mu      sync.Mutex
+	pending map[int64]chan cdpMessage
+	// events are queued without bound so a reply is never stuck behind
+	// events nobody has read yet; notify signals new ones.
+	events []cdpMessage
+	notify chan struct{}
+	// intercept, when set, sees each event first and takes those it
+	// handles out of the queue. It runs on the read loop, so it must not
+	// call back into the client synchronously.
+	intercept func(msg cdpMessage) bool
+
+	done chan struct{}
+	err  error
+}
+
+// cdpError is an error response to a CDP command.
+type cdpError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *cdpError) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+// dialCDP opens a new connection to the browser sess runs in, or to the
+// shared Chromium when sess is nil.
+func (p *proxyServer) dialCDP(ctx context.Context, sess *session) (*cdpClient, error) {
+	conn, _, err := p.dialWithRetry(ctx, sess, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newCDPClient(conn), nil
+}
+
+// newCDPClient starts reading from an established connection.
+func newCDPClient(conn *websocket.Conn) *cdpClient {
+	c := &cdpClient{
+		conn:    conn,
+		pending: make(map[int64]chan cdpMessage),
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *cdpClient) readLoop() {
+	defer close(c.done)
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.err = err
+			return
+		}
+		var msg cdpMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		if msg.ID != nil {
+			c.mu.Lock()
+			ch, ok := c.pending[*msg.ID]
+			delete(c.pending, *msg.ID)
+			c.mu.Unlock()
+			if ok {
+				ch <- msg
+			}
+			continue
+		}
+		c.mu.Lock()
+		intercept := c.intercept
+		c.mu.Unlock()
+		if intercept != nil && intercept(msg) {
+			continue
+		}
+		c.mu.Lock()
+		c.events = append(c.events, msg)
+		c.mu.Unlock()
+		select {
+		case c.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// next returns the oldest unread event.
+func (c *cdpClient) next(ctx context.Context) (cdpMessage, error) {
+	for {
+		c.mu.Lock()
+		if len(c.events) > 0 {
+			msg := c.events[0]
+			c.events = c.events[1:]
+			c.mu.Unlock()
+			return msg, nil
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-c.notify:
+		case <-c.done:
+			return cdpMessage{}, fmt.Errorf("connection closed: %v", c.err)
+		case <-ctx.Done():
+			return cdpMessage{}, ctx.Err()
+		}
+	}
+}
+
+// setIntercept installs fn to handle events before they are queued.
+func (c *cdpClient) setIntercept(fn func(msg cdpMessage) bool) {
+	c.mu.Lock()
+	c.intercept = fn
+	c.mu.Unlock()
+}
+
+// waitEvent skips events until one of methods arrives on sessionID.
+func (c *cdpClient) waitEvent(ctx context.Context, sessionID string, methods ...string) (cdpMessage, error) {
+	for {
+		msg, err := c.next(ctx)
+		if err != nil {
+			return cdpMessage{}, err
+		}
+		if msg.SessionID == sessionID && slices.Contains(methods, msg.Method) {
+			return msg, nil
+		}
+	}
+}
+
+// call sends a command and waits for its result.
+func (c *cdpClient) call(ctx context.Context, sessionID, method string, params any) (json.RawMessage, error) {
+	var raw json.RawMessage
+	if params != nil {
+		var err error
+		if raw, err = json.Marshal(params); err != nil {
+			return nil, err
+		}
+	}
+
+	id := c.nextID.Add(1)
+	ch := make(chan cdpMessage, 1)
+	c.mu.Lock()
+	c.pending[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	data, err := json.Marshal(cdpMessage{ID: &id, Method: method, SessionID: sessionID, Params: raw})
+	if err != nil {
+		return nil, err
+	}
+	c.writeMu.Lock()
+	err = c.conn.WriteMessage(websocket.TextMessage, data)
+	c.writeMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		if len(resp.Error) > 0 {
+			var cerr cdpError
+			if json.Unmarshal(resp.Error, &cerr) != nil {
+				return nil, errors.New(string(resp.Error))
+			}
+			return nil, fmt.Errorf("%s: %w", method, &cerr)
+		}
+		return resp.Result, nil
+	case <-c.done:
+		return nil, fmt.Errorf("%s: connection closed: %v", method, c.err)
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%s: %w", method, ctx.Err())
+	}
+}
+
+// attach opens a flattened CDP session on a target and returns its ID.
+func (c *cdpClient) attach(ctx context.Context, targetID string) (string, error) {
+	result, err := c.call(ctx, "", "Target.attachToTarget", map[string]any{"targetId": targetID, "flatten": true})
+	if err != nil {
+		return "", err
+	}
+	var attached struct {
+		SessionID string `json:"sessionId"`
+	}
+	if err := json.Unmarshal(result, &attached); err != nil || attached.SessionID == "" {
+		return "", errors.New("Target.attachToTarget returned no sessionId")
+	}
+	return attached.SessionID, nil
+}
+
+func (c *cdpClient) close() {
+	_ = c.conn.Close()
+	<-c.done
+}
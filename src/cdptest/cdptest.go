@@ -0,0 +1,472 @@
+// Package cdptest is a fake Chromium remote debugging endpoint, for
+// exercising browserd and other CDP clients without a browser binary.
+//
+// A Server answers /json/version, /json/list, /json/new, /json/close and
+// /json/protocol like Chromium's DevTools HTTP handler does, and accepts
+// WebSocket connections on /devtools/browser/<id> and /devtools/page/<id>.
+// Commands received there are answered by handlers registered with Handle;
+// the Target domain is handled by default, and any other command gets an
+// empty result. Events are sent with Conn.Send or Server.Emit.
+package cdptest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultBrowser is the Browser string a Server reports unless told
+// otherwise.
+const DefaultBrowser = "HeadlessChrome/120.0.0.0"
+
+// Message is a CDP frame, in either direction.
+type Message struct {
+	ID        *int64          `json:"id,omitempty"`
+	Method    string          `json:"method,omitempty"`
+	Params    json.RawMessage `json:"params,omitempty"`
+	SessionID string          `json:"sessionId,omitempty"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     *Error          `json:"error,omitempty"`
+}
+
+// Error is a CDP error response. A Handler returning one answers with it;
+// any other error is answered with code -32000 and its message.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+// Handler answers a command received on c. The result is marshaled into
+// the response; a nil result is sent as an empty object.
+type Handler func(c *Conn, msg Message) (result any, err error)
+
+// Target is a debugging target listed by /json/list and Target.getTargets.
+type Target struct {
+	ID               string
+	Type             string
+	Title            string
+	URL              string
+	BrowserContextID string
+}
+
+// Server is a fake Chromium debugging endpoint. Its methods are safe for
+// concurrent use.
+type Server struct {
+	srv       *httptest.Server
+	browserID string
+	ids       atomic.Int64
+
+	mu       sync.Mutex
+	browser  string
+	handlers map[string]Handler
+	targets  []Target
+	conns    []*Conn
+	received []Message
+	// changed is closed and replaced whenever a command is received.
+	changed chan struct{}
+}
+
+// NewServer starts a Server on a loopback port with one blank page
+// target. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		browser:  DefaultBrowser,
+		handlers: make(map[string]Handler),
+		changed:  make(chan struct{}),
+	}
+	s.browserID = s.newID("browser")
+	s.targets = []Target{{ID: s.newID("page"), Type: "page", URL: "about:blank"}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/json/version", s.handleVersion)
+	mux.HandleFunc("/json/list", s.handleList)
+	mux.HandleFunc("/json", s.handleList)
+	mux.HandleFunc("/json/new", s.handleNew)
+	mux.HandleFunc("/json/close/{id}", s.handleClose)
+	mux.HandleFunc("/json/protocol", s.handleProtocol)
+	mux.HandleFunc("/devtools/browser/{id}", s.handleWebSocket)
+	mux.HandleFunc("/devtools/page/{id}", s.handleWebSocket)
+	s.srv = httptest.NewServer(mux)
+	return s
+}
+
+// URL is the server's http:// base URL, to pass as browserd's -chromium.
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// BrowserURL is the browser-level WebSocket debugger URL.
+func (s *Server) BrowserURL() string {
+	return "ws" + strings.TrimPrefix(s.srv.URL, "http") + "/devtools/browser/" + s.browserID
+}
+
+// Close closes every connection and stops the server.
+func (s *Server) Close() {
+	s.mu.Lock()
+	conns := s.conns
+	s.conns = nil
+	s.mu.Unlock()
+	for _, c := range conns {
+		_ = c.ws.Close()
+	}
+	s.srv.Close()
+}
+
+// SetBrowser sets the Browser string of /json/version and
+// Browser.getVersion.
+func (s *Server) SetBrowser(browser string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.browser = browser
+}
+
+// Handle answers method with h from now on, replacing the default.
+func (s *Server) Handle(method string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[method] = h
+}
+
+// Targets returns the current targets.
+func (s *Server) Targets() []Target {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Target(nil), s.targets...)
+}
+
+// AddTarget adds a page target showing url and returns it.
+func (s *Server) AddTarget(url string) Target {
+	return s.addTarget(Target{ID: s.newID("page"), Type: "page", URL: url})
+}
+
+func (s *Server) addTarget(t Target) Target {
+	s.mu.Lock()
+	s.targets = append(s.targets, t)
+	s.mu.Unlock()
+	return t
+}
+
+// Conns returns the open WebSocket connections, oldest first.
+func (s *Server) Conns() []*Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Conn(nil), s.conns...)
+}
+
+// Received returns every command received so far, in order.
+func (s *Server) Received() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.received...)
+}
+
+// WaitFor returns the first command received for method, waiting for one
+// until ctx ends.
+func (s *Server) WaitFor(ctx context.Context, method string) (Message, error) {
+	for {
+		s.mu.Lock()
+		for _, msg := range s.received {
+			if msg.Method == method {
+				s.mu.Unlock()
+				return msg, nil
+			}
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return Message{}, fmt.Errorf("waiting for %s: %w", method, ctx.Err())
+		}
+	}
+}
+
+// Emit sends an event to every open connection.
+func (s *Server) Emit(method string, params any) error {
+	for _, c := range s.Conns() {
+		if err := c.Send(method, params, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) newID(kind string) string {
+	return fmt.Sprintf("%s-%04d", strings.ToUpper(kind), s.ids.Add(1))
+}
+
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	browser := s.browser
+	s.mu.Unlock()
+	writeJSON(w, map[string]string{
+		"Browser":              browser,
+		"Protocol-Version":     "1.3",
+		"User-Agent":           "Mozilla/5.0 " + browser,
+		"webSocketDebuggerUrl": "ws://" + r.Host + "/devtools/browser/" + s.browserID,
+	})
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	list := []map[string]string{}
+	for _, t := range s.Targets() {
+		list = append(list, s.listEntry(r.Host, t))
+	}
+	writeJSON(w, list)
+}
+
+func (s *Server) listEntry(host string, t Target) map[string]string {
+	return map[string]string{
+		"id":                   t.ID,
+		"type":                 t.Type,
+		"title":                t.Title,
+		"url":                  t.URL,
+		"devtoolsFrontendUrl":  "/devtools/inspector.html?ws=" + host + "/devtools/page/" + t.ID,
+		"webSocketDebuggerUrl": "ws://" + host + "/devtools/page/" + t.ID,
+	}
+}
+
+func (s *Server) handleNew(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Using unsafe HTTP verb "+r.Method+" to invoke /json/new. This action supports only PUT verb.", http.StatusMethodNotAllowed)
+		return
+	}
+	url := r.URL.RawQuery
+	if url == "" {
+		url = "about:blank"
+	}
+	writeJSON(w, s.listEntry(r.Host, s.AddTarget(url)))
+}
+
+func (s *Server) handleClose(w http.ResponseWriter, r *http.Request) {
+	if !s.closeTarget(r.PathValue("id")) {
+		http.Error(w, "No such target id: "+r.PathValue("id"), http.StatusNotFound)
+		return
+	}
+	_, _ = w.Write([]byte("Target is closing"))
+}
+
+func (s *Server) handleProtocol(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]any{
+		"version": map[string]string{"major": "1", "minor": "3"},
+		"domains": []any{},
+	})
+}
+
+func (s *Server) closeTarget(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, t := range s.targets {
+		if t.ID == id {
+			s.targets = append(s.targets[:i], s.targets[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+var upgrader = websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/devtools/browser/") && r.PathValue("id") != s.browserID {
+		http.Error(w, "No such target id: "+r.PathValue("id"), http.StatusNotFound)
+		return
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &Conn{Path: r.URL.Path, server: s, ws: ws}
+	s.mu.Lock()
+	s.conns = append(s.conns, c)
+	s.mu.Unlock()
+	defer s.removeConn(c)
+
+	for {
+		var msg Message
+		if err := ws.ReadJSON(&msg); err != nil {
+			return
+		}
+		if msg.ID == nil {
+			continue
+		}
+		s.mu.Lock()
+		s.received = append(s.received, msg)
+		close(s.changed)
+		s.changed = make(chan struct{})
+		h := s.handlers[msg.Method]
+		s.mu.Unlock()
+		if h == nil {
+			h = s.defaultHandler(msg.Method)
+		}
+		result, err := h(c, msg)
+		if err := c.reply(msg, result, err); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) removeConn(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, other := range s.conns {
+		if other == c {
+			s.conns = append(s.conns[:i], s.conns[i+1:]...)
+			break
+		}
+	}
+	_ = c.ws.Close()
+}
+
+// defaultHandler answers the Target domain and Browser.getVersion well
+// enough for clients to start up; everything else succeeds with an empty
+// result.
+func (s *Server) defaultHandler(method string) Handler {
+	switch method {
+	case "Browser.getVersion":
+		return func(*Conn, Message) (any, error) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return map[string]string{"protocolVersion": "1.3", "product": s.browser}, nil
+		}
+	case "Target.getTargets":
+		return func(*Conn, Message) (any, error) {
+			infos := []map[string]any{}
+			for _, t := range s.Targets() {
+				infos = append(infos, targetInfo(t))
+			}
+			return map[string]any{"targetInfos": infos}, nil
+		}
+	case "Target.getTargetInfo":
+		return func(_ *Conn, msg Message) (any, error) {
+			var params struct {
+				TargetID string `json:"targetId"`
+			}
+			_ = json.Unmarshal(msg.Params, &params)
+			for _, t := range s.Targets() {
+				if t.ID == params.TargetID {
+					return map[string]any{"targetInfo": targetInfo(t)}, nil
+				}
+			}
+			return nil, &Error{Code: -32602, Message: "No target with given id found"}
+		}
+	case "Target.createTarget":
+		return func(c *Conn, msg Message) (any, error) {
+			var params struct {
+				URL              string `json:"url"`
+				BrowserContextID string `json:"browserContextId"`
+			}
+			_ = json.Unmarshal(msg.Params, &params)
+			t := s.addTarget(Target{ID: s.newID("page"), Type: "page", URL: params.URL, BrowserContextID: params.BrowserContextID})
+			_ = c.Send("Target.targetCreated", map[string]any{"targetInfo": targetInfo(t)}, "")
+			return map[string]string{"targetId": t.ID}, nil
+		}
+	case "Target.closeTarget":
+		return func(c *Conn, msg Message) (any, error) {
+			var params struct {
+				TargetID string `json:"targetId"`
+			}
+			_ = json.Unmarshal(msg.Params, &params)
+			if !s.closeTarget(params.TargetID) {
+				return nil, &Error{Code: -32602, Message: "No target with given id found"}
+			}
+			_ = c.Send("Target.targetDestroyed", map[string]string{"targetId": params.TargetID}, "")
+			return map[string]bool{"success": true}, nil
+		}
+	case "Target.attachToTarget":
+		return func(*Conn, Message) (any, error) {
+			return map[string]string{"sessionId": s.newID("session")}, nil
+		}
+	case "Target.createBrowserContext":
+		return func(*Conn, Message) (any, error) {
+			return map[string]string{"browserContextId": s.newID("context")}, nil
+		}
+	}
+	return func(*Conn, Message) (any, error) { return nil, nil }
+}
+
+func targetInfo(t Target) map[string]any {
+	info := map[string]any{
+		"targetId": t.ID,
+		"type":     t.Type,
+		"title":    t.Title,
+		"url":      t.URL,
+		"attached": false,
+	}
+	if t.BrowserContextID != "" {
+		info["browserContextId"] = t.BrowserContextID
+	}
+	return info
+}
+
+// Conn is a client's WebSocket connection to the Server.
+type Conn struct {
+	// Path is the connection's URL path, such as /devtools/page/<id>.
+	Path string
+
+	server  *Server
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+}
+
+// Send sends an event on the connection, for the flattened session
+// sessionID if it is set.
+func (c *Conn) Send(method string, params any, sessionID string) error {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return c.write(Message{Method: method, Params: raw, SessionID: sessionID})
+}
+
+// Close sends a close frame with code and reason and closes the
+// connection, as Chromium does when a target goes away.
+func (c *Conn) Close(code int, reason string) error {
+	c.writeMu.Lock()
+	_ = c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+	c.writeMu.Unlock()
+	return c.ws.Close()
+}
+
+func (c *Conn) reply(msg Message, result any, err error) error {
+	resp := Message{ID: msg.ID, SessionID: msg.SessionID}
+	if err != nil {
+		cdpErr, ok := err.(*Error)
+		if !ok {
+			cdpErr = &Error{Code: -32000, Message: err.Error()}
+		}
+		resp.Error = cdpErr
+		return c.write(resp)
+	}
+	if result == nil {
+		result = struct{}{}
+	}
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	resp.Result = raw
+	return c.write(resp)
+}
+
+func (c *Conn) write(msg Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.ws.WriteJSON(msg)
+}
@@ -0,0 +1,162 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	cgroupRoot      = "/sys/fs/cgroup"
+	cpuPeriodMicros = 100000
+)
+
+// chromiumCgroup is a cgroup v2 child group that holds the supervised
+// Chromium process tree.
+type chromiumCgroup struct {
+	path string
+	fd   int
+}
+
+type cgroupEvents struct {
+	oomKills     int64
+	memoryMax    int64
+	cpuThrottled int64
+}
+
+// setupChromiumCgroup creates a "chromium" cgroup next to browserd's own
+// group and applies the limits. cgroup v2 forbids processes in inner nodes,
+// so browserd first moves itself into a sibling "browserd" leaf.
+func setupChromiumCgroup(limits resourceLimits) (*chromiumCgroup, error) {
+	self, err := ownCgroup()
+	if err != nil {
+		return nil, err
+	}
+	base := filepath.Join(cgroupRoot, self)
+
+	leaf := filepath.Join(base, "browserd")
+	if err := os.MkdirAll(leaf, 0o755); err != nil {
+		return nil, err
+	}
+	if err := writeCgroupFile(leaf, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+		return nil, err
+	}
+
+	var controllers []string
+	if limits.memoryBytes > 0 {
+		controllers = append(controllers, "+memory")
+	}
+	if limits.cpuCores > 0 {
+		controllers = append(controllers, "+cpu")
+	}
+	if err := writeCgroupFile(base, "cgroup.subtree_control", strings.Join(controllers, " ")); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(base, "chromium")
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return nil, err
+	}
+	if limits.memoryBytes > 0 {
+		if err := writeCgroupFile(path, "memory.max", strconv.FormatInt(limits.memoryBytes, 10)); err != nil {
+			return nil, err
+		}
+	}
+	if limits.cpuCores > 0 {
+		quota := int64(limits.cpuCores * cpuPeriodMicros)
+		if err := writeCgroupFile(path, "cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriodMicros)); err != nil {
+			return nil, err
+		}
+	}
+
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &chromiumCgroup{path: path, fd: fd}, nil
+}
+
+// apply makes the child process start directly inside the cgroup, so no
+// renderer forked during startup escapes the limits.
+func (c *chromiumCgroup) apply(attr *syscall.SysProcAttr) {
+	attr.UseCgroupFD = true
+	attr.CgroupFD = c.fd
+}
+
+// add moves an already running process into the cgroup.
+func (c *chromiumCgroup) add(pid int) error {
+	return writeCgroupFile(c.path, "cgroup.procs", strconv.Itoa(pid))
+}
+
+func (c *chromiumCgroup) close() {
+	_ = syscall.Close(c.fd)
+}
+
+func (c *chromiumCgroup) events() (cgroupEvents, error) {
+	var ev cgroupEvents
+
+	memory, err := readCgroupKeyed(filepath.Join(c.path, "memory.events"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return ev, err
+	}
+	ev.oomKills = memory["oom_kill"]
+	ev.memoryMax = memory["max"]
+
+	cpu, err := readCgroupKeyed(filepath.Join(c.path, "cpu.stat"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return ev, err
+	}
+	ev.cpuThrottled = cpu["nr_throttled"]
+	return ev, nil
+}
+
+func ownCgroup() (string, error) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if rel, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			return rel, nil
+		}
+	}
+	return "", errors.New("cgroup v2 hierarchy not found")
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	if value == "" {
+		return nil
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0o644); err != nil {
+		return fmt.Errorf("write %s: %w", name, err)
+	}
+	return nil
+}
+
+func readCgroupKeyed(path string) (map[string]int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]int64)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if n, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			out[fields[0]] = n
+		}
+	}
+	return out, nil
+}
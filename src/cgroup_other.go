@@ -0,0 +1,32 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+type chromiumCgroup struct {
+	path string
+}
+
+type cgroupEvents struct {
+	oomKills     int64
+	memoryMax    int64
+	cpuThrottled int64
+}
+
+func setupChromiumCgroup(resourceLimits) (*chromiumCgroup, error) {
+	return nil, errors.New("cgroup resource limits are only supported on Linux")
+}
+
+func (c *chromiumCgroup) apply(*syscall.SysProcAttr) {}
+
+func (c *chromiumCgroup) add(int) error { return nil }
+
+func (c *chromiumCgroup) close() {}
+
+func (c *chromiumCgroup) events() (cgroupEvents, error) {
+	return cgroupEvents{}, nil
+}
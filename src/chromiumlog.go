@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxChromiumLogLine bounds a line buffered while waiting for its newline.
+const maxChromiumLogLine = 64 << 10
+
+type chromiumLogLine struct {
+	Time    time.Time `json:"time"`
+	Browser string    `json:"browser"`
+	PID     int       `json:"pid,omitempty"`
+	Stream  string    `json:"stream"`
+	Line    string    `json:"line"`
+}
+
+// chromiumLogs captures the output of supervised browsers: each line is
+// logged through slog, tagged with the browser it came from, and the last
+// size lines are kept for /admin/chromium/logs, including those of
+// browsers that have since crashed.
+type chromiumLogs struct {
+	size int
+
+	mu    sync.Mutex
+	lines []chromiumLogLine
+	next  int
+}
+
+func newChromiumLogs(size int) *chromiumLogs {
+	return &chromiumLogs{size: size, lines: make([]chromiumLogLine, 0, size)}
+}
+
+// attach points cmd's stdout and stderr at the capture for browser, an
+// instance name such as "main" or "pool-9400". The returned function is
+// called with the pid once the process has started. With capture off the
+// output goes to browserd's own, as it is.
+func (c *chromiumLogs) attach(cmd *exec.Cmd, browser string) func(pid int) {
+	if c == nil {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return func(int) {}
+	}
+	stdout := &chromiumOutput{logs: c, browser: browser, stream: "stdout"}
+	stderr := &chromiumOutput{logs: c, browser: browser, stream: "stderr"}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	return func(pid int) {
+		stdout.pid.Store(int64(pid))
+		stderr.pid.Store(int64(pid))
+	}
+}
+
+func (c *chromiumLogs) add(line chromiumLogLine) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.lines) < c.size {
+		c.lines = append(c.lines, line)
+		return
+	}
+	c.lines[c.next] = line
+	c.next = (c.next + 1) % c.size
+}
+
+// tail returns up to n of the most recent lines, oldest first, of browser
+// or of every browser when it is empty. n <= 0 means all that are kept.
+func (c *chromiumLogs) tail(browser string, n int) []chromiumLogLine {
+	c.mu.Lock()
+	ordered := append(append([]chromiumLogLine(nil), c.lines[c.next:]...), c.lines[:c.next]...)
+	c.mu.Unlock()
+
+	out := ordered[:0]
+	for _, line := range ordered {
+		if browser == "" || line.Browser == browser {
+			out = append(out, line)
+		}
+	}
+	if n > 0 && len(out) > n {
+		out = out[len(out)-n:]
+	}
+	return out
+}
+
+// chromiumOutput splits one stream of a browser into lines.
+type chromiumOutput struct {
+	logs    *chromiumLogs
+	browser string
+	stream  string
+	pid     atomic.Int64
+
+	mu      sync.Mutex
+	partial []byte
+}
+
+func (o *chromiumOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.partial = append(o.partial, p...)
+	for {
+		i := bytes.IndexByte(o.partial, '\n')
+		if i < 0 {
+			break
+		}
+		o.record(string(o.partial[:i]))
+		o.partial = o.partial[i+1:]
+	}
+	if len(o.partial) > maxChromiumLogLine {
+		o.record(string(o.partial))
+		o.partial = nil
+	}
+	return len(p), nil
+}
+
+func (o *chromiumOutput) record(line string) {
+	line = strings.TrimRight(line, "\r")
+	if line == "" {
+		return
+	}
+	pid := int(o.pid.Load())
+	slog.Log(context.Background(), chromiumLogLevel(line), "chromium output", "event", "chromium_log", "browser", o.browser, "pid", pid, "stream", o.stream, "line", line)
+	o.logs.add(chromiumLogLine{Time: time.Now(), Browser: o.browser, PID: pid, Stream: o.stream, Line: line})
+}
+
+// chromiumLogLevel maps Chromium's "[pid:tid:MMDD/HHMMSS.micros:ERROR:file(line)]"
+// severities onto slog levels.
+func chromiumLogLevel(line string) slog.Level {
+	switch {
+	case strings.Contains(line, ":FATAL:"):
+		return slog.LevelError
+	case strings.Contains(line, ":ERROR:"), strings.Contains(line, ":WARNING:"):
+		return slog.LevelWarn
+	}
+	return slog.LevelInfo
+}
+
+func (p *proxyServer) handleChromiumLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if p.chromiumLogs == nil {
+		writeError(w, http.StatusNotFound, "chromium output capture requires supervised mode and -chromium-log-lines")
+		return
+	}
+
+	n := 0
+	if raw := r.URL.Query().Get("lines"); raw != "" {
+		var err error
+		if n, err = strconv.Atoi(raw); err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "lines must be a non-negative integer")
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, p.chromiumLogs.tail(r.URL.Query().Get("browser"), n))
+}
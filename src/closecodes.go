@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket close codes browserd ends client connections with, so client
+// libraries can branch on why a session ended rather than parse the
+// reason. A standard code is used where one fits; the others are in the
+// 4000-4999 range reserved for applications, as 4000 plus the closest
+// HTTP status.
+const (
+	// closeTerminated ends a session an operator killed, or a tap whose
+	// session ended.
+	closeTerminated = websocket.CloseNormalClosure
+	// closePolicyViolation ends a session that broke a rule, such as an
+	// anomaly rule with the terminate action.
+	closePolicyViolation = websocket.ClosePolicyViolation
+	// closeMessageTooBig ends a session that sent, or whose upstream sent,
+	// a frame over -max-message-size.
+	closeMessageTooBig = websocket.CloseMessageTooBig
+	// closeProtocolError refuses a client whose WebSocket subprotocol the
+	// upstream didn't accept.
+	closeProtocolError = websocket.CloseProtocolError
+	// closeUpstreamLost ends a session whose upstream connection was lost
+	// without a close frame, or whose page target crashed.
+	closeUpstreamLost = websocket.CloseInternalServerErr
+	// closeUpstreamUnavailable refuses a session, or ends one, because
+	// the browser can't be reached for now; trying again later may work.
+	closeUpstreamUnavailable = websocket.CloseTryAgainLater
+	// closeAuthFailed refuses a client whose credentials were missing or
+	// wrong, mirroring HTTP 401.
+	closeAuthFailed = 4401
+	// closeForbidden refuses a client whose API key wasn't allowed what
+	// it asked for, mirroring HTTP 403.
+	closeForbidden = 4403
+	// closeIdle ends sessions closed by -idle-timeout, mirroring HTTP 408.
+	closeIdle = 4408
+	// closeSessionLimit ends sessions that ran past their API key's
+	// maxSessionDuration, mirroring HTTP 408 like closeIdle.
+	closeSessionLimit = 4408
+	// closeTargetTakenOver ends a client whose page target was taken over
+	// by another debugger, such as Chrome's own DevTools, mirroring HTTP
+	// 409.
+	closeTargetTakenOver = 4409
+	// closeOverloaded refuses a client because a limit or quota is
+	// reached, mirroring HTTP 429.
+	closeOverloaded = 4429
+	// closeDraining refuses new sessions while the replica drains,
+	// mirroring HTTP 503.
+	closeDraining = 4503
+)
+
+// closeUpgrade completes the client's upgrade only to close it with code
+// and reason, which CDP clients surface better than an HTTP error. The
+// first subprotocol the client asked for is accepted, since some clients
+// fail a handshake that picks none.
+func (p *proxyServer) closeUpgrade(w http.ResponseWriter, r *http.Request, header http.Header, code int, reason string) error {
+	upgrader := p.upgrader
+	if requested := websocket.Subprotocols(r); len(requested) > 0 {
+		upgrader.Subprotocols = requested[:1]
+	}
+	conn, err := upgrader.Upgrade(w, r, header)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+}
+
+// refuseUnauthorized answers a request whose credentials were refused:
+// with closeAuthFailed for WebSocket upgrades and 401 otherwise.
+func (p *proxyServer) refuseUnauthorized(w http.ResponseWriter, r *http.Request) {
+	if websocket.IsWebSocketUpgrade(r) {
+		_ = p.closeUpgrade(w, r, nil, closeAuthFailed, "unauthorized")
+		return
+	}
+	writeError(w, http.StatusUnauthorized, "unauthorized")
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clusterQueueSize bounds pending session registrations; when it
+// overflows, the next heartbeat catches up.
+const clusterQueueSize = 1024
+
+// clusterReplica is what a replica publishes about itself.
+type clusterReplica struct {
+	ID       string `json:"id"`
+	URL      string `json:"url,omitempty"`
+	Sessions int    `json:"sessions"`
+	// MaxSessions is the replica's -max-sessions, 0 meaning unlimited.
+	MaxSessions int       `json:"maxSessions"`
+	Draining    bool      `json:"draining,omitempty"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// clusterSession is where a session lives, for /cluster/sessions/{id}.
+type clusterSession struct {
+	Session string `json:"session"`
+	Replica string `json:"replica"`
+	URL     string `json:"url,omitempty"`
+}
+
+type clusterOp struct {
+	sessionID string
+	add       bool
+}
+
+// clusterRegistry shares sessions and capacity between replicas through
+// Redis, under keys starting with prefix:
+//
+//	<prefix>replica:<id>    the replica's clusterReplica as JSON
+//	<prefix>replicas        sorted set of replica IDs by expiry
+//	<prefix>session:<id>    the ID of the replica holding the session
+//
+// Every key expires after ttl unless the replica keeps refreshing it, so a
+// replica that dies drops out of the cluster on its own.
+type clusterRegistry struct {
+	redis     *redisClient
+	prefix    string
+	replicaID string
+	url       string
+	ttl       time.Duration
+	metrics   *metricsRegistry
+
+	ops chan clusterOp
+}
+
+func newClusterRegistry(redisURL, prefix, replicaID, advertise string, ttl time.Duration, metrics *metricsRegistry) (*clusterRegistry, error) {
+	client, err := newRedisClient(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	if replicaID == "" {
+		replicaID, _ = os.Hostname()
+	}
+	metrics.register("browserd_cluster_replicas", metricGauge, "Live replicas in the cluster.")
+	metrics.register("browserd_cluster_sessions", metricGauge, "Active sessions across the cluster.")
+	metrics.register("browserd_cluster_capacity", metricGauge, "Sum of -max-sessions across replicas that set it.")
+	metrics.register("browserd_cluster_errors_total", metricCounter, "Failed cluster registry updates.")
+	return &clusterRegistry{
+		redis:     client,
+		prefix:    prefix,
+		replicaID: replicaID,
+		url:       strings.TrimSuffix(advertise, "/"),
+		ttl:       ttl,
+		metrics:   metrics,
+		ops:       make(chan clusterOp, clusterQueueSize),
+	}, nil
+}
+
+func (c *clusterRegistry) ttlSeconds() string {
+	return strconv.Itoa(max(int(c.ttl/time.Second), 1))
+}
+
+// sessionStarted and sessionEnded queue registry updates in order, so a
+// short session's removal can't overtake its registration.
+func (c *clusterRegistry) sessionStarted(id string) {
+	select {
+	case c.ops <- clusterOp{sessionID: id, add: true}:
+	default:
+	}
+}
+
+func (c *clusterRegistry) sessionEnded(id string) {
+	select {
+	case c.ops <- clusterOp{sessionID: id}:
+	default:
+	}
+}
+
+// runCluster applies queued updates and heartbeats every third of the TTL
+// until ctx ends, then withdraws the replica.
+func (p *proxyServer) runCluster(ctx context.Context) {
+	c := p.cluster
+	ticker := time.NewTicker(c.ttl / 3)
+	defer ticker.Stop()
+	p.clusterHeartbeat()
+	for {
+		select {
+		case <-ctx.Done():
+			c.withdraw(p.sessions.list())
+			return
+		case op := <-c.ops:
+			cmd := []string{"DEL", c.prefix + "session:" + op.sessionID}
+			if op.add {
+				cmd = []string{"SET", c.prefix + "session:" + op.sessionID, c.replicaID, "EX", c.ttlSeconds()}
+			}
+			if _, err := c.redis.do(cmd...); err != nil {
+				c.failed(err)
+			}
+		case <-ticker.C:
+			p.clusterHeartbeat()
+		}
+	}
+}
+
+// clusterHeartbeat refreshes the replica and its sessions, and updates the
+// cluster-wide gauges.
+func (p *proxyServer) clusterHeartbeat() {
+	c := p.cluster
+	sessions := p.sessions.list()
+	self := clusterReplica{
+		ID:          c.replicaID,
+		URL:         c.url,
+		Sessions:    len(sessions),
+		MaxSessions: p.maxSessions,
+		Draining:    p.draining.Load(),
+		UpdatedAt:   time.Now().UTC(),
+	}
+	data, _ := json.Marshal(self)
+	now := time.Now()
+	expiry := strconv.FormatInt(now.Add(c.ttl).Unix(), 10)
+
+	commands := [][]string{
+		{"SET", c.prefix + "replica:" + c.replicaID, string(data), "EX", c.ttlSeconds()},
+		{"ZADD", c.prefix + "replicas", expiry, c.replicaID},
+		{"ZREMRANGEBYSCORE", c.prefix + "replicas", "-inf", strconv.FormatInt(now.Unix(), 10)},
+	}
+	for _, sess := range sessions {
+		commands = append(commands, []string{"SET", c.prefix + "session:" + sess.id, c.replicaID, "EX", c.ttlSeconds()})
+	}
+	replies, err := c.redis.pipeline(commands)
+	if err == nil {
+		for _, reply := range replies {
+			if e, ok := reply.(redisError); ok {
+				err = e
+				break
+			}
+		}
+	}
+	if err != nil {
+		c.failed(err)
+		return
+	}
+
+	replicas, err := c.replicas()
+	if err != nil {
+		c.failed(err)
+		return
+	}
+	total, capacity := 0, 0
+	for _, replica := range replicas {
+		total += replica.Sessions
+		capacity += replica.MaxSessions
+	}
+	c.metrics.set("browserd_cluster_replicas", nil, float64(len(replicas)))
+	c.metrics.set("browserd_cluster_sessions", nil, float64(total))
+	c.metrics.set("browserd_cluster_capacity", nil, float64(capacity))
+}
+
+func (c *clusterRegistry) failed(err error) {
+	c.metrics.add("browserd_cluster_errors_total", nil, 1)
+	slog.Warn("cluster registry update failed", "event", "cluster_error", "error", err)
+}
+
+// replicas lists the live replicas, ordered by ID.
+func (c *clusterRegistry) replicas() ([]clusterReplica, error) {
+	reply, err := c.redis.do("ZRANGEBYSCORE", c.prefix+"replicas", strconv.FormatInt(time.Now().Unix(), 10), "+inf")
+	if err != nil {
+		return nil, err
+	}
+	ids, _ := reply.([]any)
+	replicas := make([]clusterReplica, 0, len(ids))
+	if len(ids) == 0 {
+		return replicas, nil
+	}
+	keys := []string{"MGET"}
+	for _, id := range ids {
+		name, _ := id.(string)
+		keys = append(keys, c.prefix+"replica:"+name)
+	}
+	if reply, err = c.redis.do(keys...); err != nil {
+		return nil, err
+	}
+	values, _ := reply.([]any)
+	for _, value := range values {
+		raw, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var replica clusterReplica
+		if json.Unmarshal([]byte(raw), &replica) == nil {
+			replicas = append(replicas, replica)
+		}
+	}
+	sort.Slice(replicas, func(i, j int) bool { return replicas[i].ID < replicas[j].ID })
+	return replicas, nil
+}
+
+// lookup returns where a session lives, or nil when no replica holds it.
+func (c *clusterRegistry) lookup(id string) (*clusterSession, error) {
+	reply, err := c.redis.do("GET", c.prefix+"session:"+id)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	replicaID, _ := reply.(string)
+	found := &clusterSession{Session: id, Replica: replicaID}
+	if replicaID == c.replicaID {
+		found.URL = c.url
+		return found, nil
+	}
+	if reply, err = c.redis.do("GET", c.prefix+"replica:"+replicaID); err == nil {
+		if raw, ok := reply.(string); ok {
+			var replica clusterReplica
+			if json.Unmarshal([]byte(raw), &replica) == nil {
+				found.URL = replica.URL
+			}
+		}
+	}
+	return found, nil
+}
+
+// withdraw removes the replica, and its sessions, on shutdown.
+func (c *clusterRegistry) withdraw(sessions []*session) {
+	commands := [][]string{
+		{"DEL", c.prefix + "replica:" + c.replicaID},
+		{"ZREM", c.prefix + "replicas", c.replicaID},
+	}
+	for _, sess := range sessions {
+		commands = append(commands, []string{"DEL", c.prefix + "session:" + sess.id})
+	}
+	_, _ = c.redis.pipeline(commands)
+}
+
+func (p *proxyServer) handleClusterReplicas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	replicas, err := p.cluster.replicas()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "cluster registry unavailable")
+		return
+	}
+	writeJSON(w, http.StatusOK, replicas)
+}
+
+// handleClusterSession tells a load balancer which replica holds a session.
+func (p *proxyServer) handleClusterSession(w http.ResponseWriter, r *http.Request) {
+	if !p.authorize(r) {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	found, err := p.cluster.lookup(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "cluster registry unavailable")
+		return
+	}
+	if found == nil {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, found)
+}
+
+// redirectToOwner sends a request for a session held by another replica
+// there, reporting whether it did.
+func (p *proxyServer) redirectToOwner(w http.ResponseWriter, r *http.Request, id string) bool {
+	if p.cluster == nil {
+		return false
+	}
+	found, err := p.cluster.lookup(id)
+	if err != nil || found == nil || found.Replica == p.cluster.replicaID || found.URL == "" {
+		return false
+	}
+	http.Redirect(w, r, found.URL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	return true
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// commandKey identifies a client command by the CDP session it was sent
+// on and its ID, which clients only keep unique per session.
+type commandKey struct {
+	sessionID string
+	id        int64
+}
+
+type outstandingCommand struct {
+	method string
+	timer  *time.Timer
+}
+
+// trackCommand starts the -command-timeout deadline of a client command
+// about to be sent upstream.
+func (r *relay) trackCommand(msg *cdpMessage) {
+	if r.commandTimeout <= 0 || msg.ID == nil || msg.Method == "" {
+		return
+	}
+	key := commandKey{sessionID: msg.SessionID, id: *msg.ID}
+	cmd := &outstandingCommand{method: msg.Method}
+
+	r.commandsMu.Lock()
+	defer r.commandsMu.Unlock()
+	if previous, ok := r.outstanding[key]; ok {
+		// A client reusing an ID it is still waiting on gets the deadline
+		// of the newer command.
+		previous.timer.Stop()
+	}
+	cmd.timer = time.AfterFunc(r.commandTimeout, func() { r.commandTimedOut(key, cmd) })
+	r.outstanding[key] = cmd
+}
+
+// answerCommand settles a client command with the upstream's response. It
+// reports whether the response should be forwarded, which is not the case
+// once the client has been told the command timed out.
+func (r *relay) answerCommand(msg *cdpMessage) bool {
+	if r.commandTimeout <= 0 || msg.ID == nil || msg.Method != "" {
+		return true
+	}
+	key := commandKey{sessionID: msg.SessionID, id: *msg.ID}
+
+	r.commandsMu.Lock()
+	defer r.commandsMu.Unlock()
+	if cmd, ok := r.outstanding[key]; ok {
+		cmd.timer.Stop()
+		delete(r.outstanding, key)
+		return true
+	}
+	if r.timedOut[key] {
+		delete(r.timedOut, key)
+		return false
+	}
+	return true
+}
+
+func (r *relay) commandTimedOut(key commandKey, cmd *outstandingCommand) {
+	r.commandsMu.Lock()
+	if r.outstanding[key] != cmd {
+		r.commandsMu.Unlock()
+		return
+	}
+	delete(r.outstanding, key)
+	r.timedOut[key] = true
+	r.commandsMu.Unlock()
+	r.endTurnFor(key)
+
+	id := key.id
+	reason := fmt.Sprintf("%s timed out after %s", cmd.method, r.commandTimeout)
+	_ = r.replyError(&cdpMessage{ID: &id, SessionID: key.sessionID}, reason)
+
+	targetID := ""
+	if r.killHung {
+		targetID = r.hungTarget(key.sessionID)
+		if targetID != "" {
+			go r.send("", "Target.closeTarget", map[string]any{"targetId": targetID})
+		}
+	}
+	if r.onCommandTimeout != nil {
+		r.onCommandTimeout(cmd.method, targetID)
+	}
+}
+
+// hungTarget is the page target a command on sessionID ran in: the
+// attached target for a flattened session, or the page the client
+// connected to directly.
+func (r *relay) hungTarget(sessionID string) string {
+	if sessionID != "" {
+		return r.sess.targetFor(sessionID)
+	}
+	if strings.HasPrefix(r.sess.upstreamPath, "/devtools/page/") {
+		return path.Base(r.sess.upstreamPath)
+	}
+	return ""
+}
+
+// stopCommandTimers drops the deadlines of commands still outstanding when
+// the relay ends.
+func (r *relay) stopCommandTimers() {
+	r.commandsMu.Lock()
+	defer r.commandsMu.Unlock()
+	for key, cmd := range r.outstanding {
+		cmd.timer.Stop()
+		delete(r.outstanding, key)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// protocolShim translates between the CDP a current client speaks and
+// that of browsers older than milestone before, which still use older
+// names for a command, its parameters or its result.
+type protocolShim struct {
+	name   string
+	before int
+	// methods maps the client's command names to the browser's, and
+	// params, by the client's name, the parameters renamed with them.
+	methods map[string]string
+	params  map[string]map[string]string
+	// events maps the browser's event names to the client's.
+	events map[string]string
+	// results, by the client's command name, copies result fields the
+	// browser returns under an older name to the one the client expects.
+	results map[string]map[string]string
+}
+
+// protocolShims are the shims -protocol-shims can name.
+var protocolShims = []*protocolShim{
+	{
+		// Page.addScriptToEvaluateOnNewDocument replaced the OnLoad
+		// variant in M61, with source instead of scriptSource.
+		name:   "script-on-load",
+		before: 61,
+		methods: map[string]string{
+			"Page.addScriptToEvaluateOnNewDocument":    "Page.addScriptToEvaluateOnLoad",
+			"Page.removeScriptToEvaluateOnNewDocument": "Page.removeScriptToEvaluateOnLoad",
+		},
+		params: map[string]map[string]string{
+			"Page.addScriptToEvaluateOnNewDocument": {"source": "scriptSource"},
+		},
+	},
+	{
+		// Browser.setDownloadBehavior arrived in M76; older browsers only
+		// have the page-level command.
+		name:   "download-behavior",
+		before: 76,
+		methods: map[string]string{
+			"Browser.setDownloadBehavior": "Page.setDownloadBehavior",
+		},
+	},
+	{
+		// M92 added the CSS pixel metrics clients now read and turned the
+		// old fields into device pixels; before it, the old fields were
+		// already in CSS pixels.
+		name:   "layout-metrics",
+		before: 92,
+		results: map[string]map[string]string{
+			"Page.getLayoutMetrics": {
+				"layoutViewport": "cssLayoutViewport",
+				"visualViewport": "cssVisualViewport",
+				"contentSize":    "cssContentSize",
+			},
+		},
+	},
+	{
+		// Page.frameRequestedNavigation replaced
+		// Page.frameScheduledNavigation in M80.
+		name:   "frame-navigation",
+		before: 80,
+		events: map[string]string{
+			"Page.frameScheduledNavigation": "Page.frameRequestedNavigation",
+		},
+	},
+}
+
+// protocolCompat is the -protocol-shims selection: the shims forced on
+// every session, or with auto those each session's browser is too old for.
+type protocolCompat struct {
+	auto   bool
+	forced []*protocolShim
+}
+
+func parseProtocolShims(names []string) (*protocolCompat, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	compat := &protocolCompat{}
+	for _, name := range names {
+		if name == "auto" {
+			compat.auto = true
+			continue
+		}
+		shim := lookupShim(name)
+		if shim == nil {
+			known := make([]string, 0, len(protocolShims))
+			for _, s := range protocolShims {
+				known = append(known, s.name)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("unknown protocol shim %q (known: auto, %s)", name, strings.Join(known, ", "))
+		}
+		compat.forced = append(compat.forced, shim)
+	}
+	return compat, nil
+}
+
+func lookupShim(name string) *protocolShim {
+	for _, shim := range protocolShims {
+		if shim.name == name {
+			return shim
+		}
+	}
+	return nil
+}
+
+// browserMilestonePattern finds the major version in a /json/version
+// Browser string such as "HeadlessChrome/120.0.6099.109" or
+// "Edg/118.0.2088.46".
+var browserMilestonePattern = regexp.MustCompile(`(?:Chrome|Chromium|Edg|Edge)/(\d+)`)
+
+// browserMilestone returns the major version of browser, or 0 when it
+// can't be told.
+func browserMilestone(browser string) int {
+	match := browserMilestonePattern.FindStringSubmatch(browser)
+	if match == nil {
+		return 0
+	}
+	milestone, _ := strconv.Atoi(match[1])
+	return milestone
+}
+
+// forSession picks the shims for a session on browser, or nil when none
+// apply. auto leaves a browser whose version is unknown alone.
+func (c *protocolCompat) forSession(browser string) *sessionCompat {
+	shims := append([]*protocolShim(nil), c.forced...)
+	if milestone := browserMilestone(browser); c.auto && milestone > 0 {
+		for _, shim := range protocolShims {
+			if milestone < shim.before && !slices.Contains(shims, shim) {
+				shims = append(shims, shim)
+			}
+		}
+	}
+	if len(shims) == 0 {
+		return nil
+	}
+	return &sessionCompat{shims: shims, pending: make(map[string]string)}
+}
+
+// sessionCompat is a session's shims and the commands whose results they
+// still have to translate, by CDP session and command ID.
+type sessionCompat struct {
+	shims []*protocolShim
+
+	mu      sync.Mutex
+	pending map[string]string
+}
+
+func (c *sessionCompat) names() []string {
+	names := make([]string, len(c.shims))
+	for i, shim := range c.shims {
+		names[i] = shim.name
+	}
+	return names
+}
+
+// compatMiddleware applies a session's protocol shims, if it has any.
+type compatMiddleware struct{}
+
+func (compatMiddleware) handleFrame(f *relayFrame) bool {
+	c := f.sess.compat
+	if c == nil || f.msgType != websocket.TextMessage {
+		return true
+	}
+	var msg cdpMessage
+	if err := json.Unmarshal(f.data, &msg); err != nil {
+		return true
+	}
+	var changed bool
+	if f.dir == toUpstream {
+		changed = c.translateCommand(&msg)
+	} else {
+		changed = c.translateUpstream(&msg)
+	}
+	if changed {
+		if data, err := json.Marshal(msg); err == nil {
+			f.data = data
+		}
+	}
+	return true
+}
+
+func (c *sessionCompat) translateCommand(msg *cdpMessage) bool {
+	if msg.ID == nil || msg.Method == "" {
+		return false
+	}
+	method, changed := msg.Method, false
+	for _, shim := range c.shims {
+		if _, ok := shim.results[method]; ok {
+			c.mu.Lock()
+			c.pending[msg.SessionID+":"+strconv.FormatInt(*msg.ID, 10)] = method
+			c.mu.Unlock()
+		}
+		if renames := shim.params[method]; len(renames) > 0 && len(msg.Params) > 0 {
+			changed = renameFields(&msg.Params, renames, true) || changed
+		}
+		if name, ok := shim.methods[method]; ok {
+			msg.Method, changed = name, true
+		}
+	}
+	return changed
+}
+
+func (c *sessionCompat) translateUpstream(msg *cdpMessage) bool {
+	if msg.ID == nil {
+		for _, shim := range c.shims {
+			if name, ok := shim.events[msg.Method]; ok {
+				msg.Method = name
+				return true
+			}
+		}
+		return false
+	}
+	key := msg.SessionID + ":" + strconv.FormatInt(*msg.ID, 10)
+	c.mu.Lock()
+	method, ok := c.pending[key]
+	delete(c.pending, key)
+	c.mu.Unlock()
+	if !ok || len(msg.Result) == 0 {
+		return false
+	}
+	changed := false
+	for _, shim := range c.shims {
+		if copies := shim.results[method]; len(copies) > 0 {
+			changed = renameFields(&msg.Result, copies, false) || changed
+		}
+	}
+	return changed
+}
+
+// renameFields renames the fields of the JSON object in raw named in
+// renames, or with move false copies them, leaving a field already
+// present under its new name as it is.
+func renameFields(raw *json.RawMessage, renames map[string]string, move bool) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(*raw, &fields); err != nil {
+		return false
+	}
+	changed := false
+	for from, to := range renames {
+		value, ok := fields[from]
+		if _, exists := fields[to]; !ok || exists {
+			continue
+		}
+		fields[to] = value
+		if move {
+			delete(fields, from)
+		}
+		changed = true
+	}
+	if !changed {
+		return false
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return false
+	}
+	*raw = data
+	return true
+}
+
+// sessionBrowserVersion is the Browser string of the browser sess is
+// connected to, or "" when it isn't known, as for a ws:// endpoint.
+func (p *proxyServer) sessionBrowserVersion(sess *session) string {
+	switch {
+	case sess.browser != nil:
+		return sess.browser.version
+	case sess.onFallback:
+		p.fallback.mu.Lock()
+		defer p.fallback.mu.Unlock()
+		return p.fallback.version
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.browserVersion
+}
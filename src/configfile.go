@@ -0,0 +1,25 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// unmarshalConfig decodes one of the operator's JSON configuration files,
+// such as -api-keys or -pools. Unlike json.Unmarshal it refuses keys
+// nothing reads: a misspelt setting would otherwise be left at its default
+// without a word.
+func unmarshalConfig(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return fmt.Errorf("unexpected data after offset %d", dec.InputOffset())
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"chromiumproxy/cdptest"
+)
+
+func TestConfigFilesRefuseUnknownFields(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+		load func(path string) error
+	}{
+		{"anomaly rules", `[{"name": "burst", "method": "Runtime.evaluate", "count": 10, "windw": "1s"}]`, func(path string) error {
+			_, err := loadAnomalyRules(path)
+			return err
+		}},
+		{"intercept rules", `[{"match": {"url": "*://ads.example/*"}, "acton": "block"}]`, func(path string) error {
+			_, err := loadInterceptRules(path)
+			return err
+		}},
+		{"site credentials", `[{"match": "*.example.com", "usrname": "ops"}]`, func(path string) error {
+			_, err := loadSiteCredentials(path)
+			return err
+		}},
+		{"init commands", `[{"method": "Page.enable", "parms": {}}]`, func(path string) error {
+			_, err := loadCDPCommands(path)
+			return err
+		}},
+		{"pools", `{"stealth": {"chromium": "http://chromium-stealth:9222", "stelth": true}}`, func(path string) error {
+			_, err := loadPools(path)
+			return err
+		}},
+		{"flag profiles", `{"low-memory": {"arg": ["--renderer-process-limit=1"]}}`, func(path string) error {
+			_, err := loadFlagProfiles(path)
+			return err
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(tc.data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if err := tc.load(path); err == nil || !strings.Contains(err.Error(), "unknown field") {
+				t.Fatalf("load: %v, want an unknown field error", err)
+			}
+		})
+	}
+}
+
+func TestConfigFilesRefuseTrailingData(t *testing.T) {
+	var v []cdpCommand
+	if err := unmarshalConfig([]byte(`[{"method": "Page.enable"}] [{"method": "Network.enable"}]`), &v); err == nil {
+		t.Fatal("trailing data accepted")
+	}
+	if err := unmarshalConfig([]byte(`[{"method": "Page.enable"}]`+"\n"), &v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHarnessRefusesUnknownAPIKeyFields(t *testing.T) {
+	chromium := cdptest.NewServer()
+	defer chromium.Close()
+	cfg := proxyConfig{apiKeysFile: writeAPIKeys(t, `{"alpha": {"key": "k-alpha", "maxSesions": 5}}`)}
+	h, err := startHarness(cfg, chromium, t.TempDir())
+	if err == nil {
+		_ = h.close()
+		t.Fatal("proxy started with a misspelled API key field")
+	}
+	if !strings.Contains(err.Error(), `unknown field "maxSesions"`) {
+		t.Fatalf("error %v, want it to name the field", err)
+	}
+}
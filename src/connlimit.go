@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// limitListener caps the connections open at once on one client listener.
+// One accepted beyond the cap is closed straight away rather than left
+// queued, so a flood of idle connections can't starve the accept loop
+// and well-behaved clients see a prompt failure they can retry.
+type limitListener struct {
+	net.Listener
+	name  string
+	limit int64
+	open  atomic.Int64
+	// onChange is told of every connection opened (1), closed (-1) or
+	// refused (0).
+	onChange func(delta int)
+	// lastWarned, in Unix nanoseconds, rate-limits the warning logged
+	// while connections are refused.
+	lastWarned atomic.Int64
+}
+
+// connLimitWarnInterval is how often refused connections are logged.
+const connLimitWarnInterval = time.Minute
+
+func newLimitListener(ln net.Listener, name string, limit int, onChange func(delta int)) *limitListener {
+	return &limitListener{Listener: ln, name: name, limit: int64(limit), onChange: onChange}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.open.Add(1) <= l.limit {
+			l.onChange(1)
+			return &limitConn{Conn: conn, release: l.release}, nil
+		}
+		l.open.Add(-1)
+		_ = conn.Close()
+		l.onChange(0)
+		now := time.Now().UnixNano()
+		if last := l.lastWarned.Load(); now-last >= int64(connLimitWarnInterval) && l.lastWarned.CompareAndSwap(last, now) {
+			slog.Warn("connection limit reached, refusing connections", "event", "connections_refused", "listener", l.name, "limit", l.limit)
+		}
+	}
+}
+
+func (l *limitListener) release() {
+	l.open.Add(-1)
+	l.onChange(-1)
+}
+
+// limitConn gives its slot back once, however often it is closed: by the
+// HTTP server, or by a relay that hijacked it for a WebSocket.
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
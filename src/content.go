@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// contentRequest is the body of POST /api/content.
+type contentRequest struct {
+	URL             string `json:"url"`
+	WaitUntil       string `json:"waitUntil"`
+	WaitForSelector string `json:"waitForSelector"`
+	Timeout         int    `json:"timeout"`
+	Device          string `json:"device"`
+	Viewport        *struct {
+		Width             int     `json:"width"`
+		Height            int     `json:"height"`
+		DeviceScaleFactor float64 `json:"deviceScaleFactor"`
+		Mobile            bool    `json:"mobile"`
+	} `json:"viewport"`
+}
+
+// Serializes the document, doctype included.
+const contentExpression = `(document.doctype ? new XMLSerializer().serializeToString(document.doctype) + "\n" : "") + document.documentElement.outerHTML`
+
+// handleContent loads a page in a fresh browser context and returns its
+// rendered HTML, from the render cache when it has it.
+func (p *proxyServer) handleContent(w http.ResponseWriter, r *http.Request) {
+	if !p.authorize(r) {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if p.draining.Load() {
+		writeErrorCode(w, http.StatusServiceUnavailable, errorCodeDraining, "draining", nil)
+		return
+	}
+
+	var req contentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		p.writeBodyError(w, err)
+		return
+	}
+	emulation, err := req.emulation()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if reason := p.refuseNavigation(r, req.URL); reason != "" {
+		writeErrorCode(w, http.StatusForbidden, errorCodeNavigationBlocked, reason, nil)
+		return
+	}
+
+	var cacheKey string
+	if p.renderCache != nil {
+		keyed := req
+		keyed.Timeout = 0
+		cacheKey = renderCacheKey("content", keyed)
+		if contentType, body, ok := p.renderCache.lookup(r, "content", cacheKey); ok {
+			p.metrics.add("browserd_api_requests_total", map[string]string{"endpoint": "content", "status": "ok"}, 1)
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("X-Cache", "HIT")
+			_, _ = w.Write(body)
+			return
+		}
+		w.Header().Set("X-Cache", "MISS")
+	}
+
+	if !p.acquireAPI() {
+		p.rejectOverloaded(w, r, reasonMaxAPIRequests)
+		return
+	}
+	defer p.releaseAPI()
+
+	ctx, cancel := context.WithTimeout(r.Context(), apiTimeout(req.Timeout))
+	defer cancel()
+
+	page, err := p.loadPage(ctx, req, emulation)
+	if err != nil {
+		p.apiError(w, "content", err)
+		return
+	}
+	defer page.close()
+
+	html, err := page.content(ctx)
+	if err != nil {
+		p.apiError(w, "content", err)
+		return
+	}
+
+	const contentType = "text/html; charset=utf-8"
+	if p.renderCache != nil {
+		p.renderCache.store(cacheKey, contentType, []byte(html))
+	}
+	p.metrics.add("browserd_api_requests_total", map[string]string{"endpoint": "content", "status": "ok"}, 1)
+	w.Header().Set("Content-Type", contentType)
+	_, _ = w.Write([]byte(html))
+}
+
+// emulation validates the request, defaulting WaitUntil, and returns the
+// commands that set up its device and viewport.
+func (req *contentRequest) emulation() ([]cdpCommand, error) {
+	if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.New("url must be an http(s) URL")
+	}
+	if req.WaitUntil == "" {
+		req.WaitUntil = waitLoad
+	}
+	if !validWaitUntil(req.WaitUntil) {
+		return nil, errors.New("waitUntil must be load, domcontentloaded or networkidle")
+	}
+
+	var emulation []cdpCommand
+	if req.Device != "" {
+		name, err := lookupDevice(req.Device)
+		if err != nil {
+			return nil, err
+		}
+		emulation = devicePresets[name].commands()
+	}
+	if vp := req.Viewport; vp != nil {
+		if vp.Width <= 0 || vp.Height <= 0 {
+			return nil, errors.New("viewport width and height must be positive")
+		}
+		scale := vp.DeviceScaleFactor
+		if scale <= 0 {
+			scale = 1
+		}
+		viewport := devicePreset{Width: vp.Width, Height: vp.Height, ScaleFactor: scale, Mobile: vp.Mobile}
+		emulation = append(emulation, viewport.metricsCommand())
+	}
+	return emulation, nil
+}
+
+// loadPage opens a page in a fresh browser context, emulates on it and
+// loads req's URL, waiting as req asks. The caller closes the page.
+func (p *proxyServer) loadPage(ctx context.Context, req contentRequest, emulation []cdpCommand) (*apiPage, error) {
+	page, err := p.openPage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = page.run(ctx, emulation)
+	if err == nil {
+		err = page.navigate(ctx, req.URL, req.WaitUntil)
+	}
+	if err == nil && req.WaitForSelector != "" {
+		err = page.waitForSelector(ctx, req.WaitForSelector)
+	}
+	if err != nil {
+		page.close()
+		return nil, err
+	}
+	return page, nil
+}
+
+// content returns the page's rendered HTML.
+func (pg *apiPage) content(ctx context.Context) (string, error) {
+	result, err := pg.evaluate(ctx, contentExpression, false)
+	if err != nil {
+		return "", err
+	}
+	var html string
+	if err := json.Unmarshal(result.Value, &html); err != nil {
+		return "", err
+	}
+	return html, nil
+}
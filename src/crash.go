@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	crashPollInterval = 10 * time.Second
+	// crashLogLines is how much recent browser output goes into an
+	// incident.
+	crashLogLines = 200
+)
+
+// Why an incident was collected.
+const (
+	crashBrowserExited = "browser_exited"
+	crashMinidump      = "minidump"
+)
+
+// crashIncident is the incident.json written next to the collected files.
+type crashIncident struct {
+	Time    time.Time `json:"time"`
+	Reason  string    `json:"reason"`
+	Browser string    `json:"browser,omitempty"`
+	PID     int       `json:"pid,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Dumps   []string  `json:"dumps,omitempty"`
+}
+
+// crashCollector gathers what is needed to diagnose a Chromium crash into
+// a directory per incident under -crash-dir: the crashpad minidumps the
+// browsers wrote to <crash-dir>/crashpad, their recent output, and
+// incident.json. Renderer crashes leave a minidump without stopping the
+// browser, so the crashpad directory is also polled.
+type crashCollector struct {
+	dir          string
+	maxIncidents int
+	logs         *chromiumLogs
+	metrics      *metricsRegistry
+	// notify publishes crash events to webhooks and /admin/events.
+	notify func(webhookEvent)
+
+	mu sync.Mutex
+}
+
+func newCrashCollector(dir string, maxIncidents int, logs *chromiumLogs, metrics *metricsRegistry, notify func(webhookEvent)) (*crashCollector, error) {
+	if err := os.MkdirAll(crashpadDir(dir), 0o755); err != nil {
+		return nil, err
+	}
+	metrics.register("browserd_chromium_crashes_total", metricCounter, "Chromium crash incidents collected under -crash-dir, by reason.")
+	return &crashCollector{dir: dir, maxIncidents: maxIncidents, logs: logs, metrics: metrics, notify: notify}, nil
+}
+
+// crashpadDir is where supervised browsers are told to write minidumps.
+func crashpadDir(crashDir string) string {
+	return filepath.Join(crashDir, "crashpad")
+}
+
+func (c *crashCollector) run(ctx context.Context) {
+	ticker := time.NewTicker(crashPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.collect(crashMinidump, "", nil)
+		}
+	}
+}
+
+// collect files an incident for browser, or for whichever browser wrote
+// the pending minidumps when it is empty. A poll that finds no minidumps
+// files nothing.
+func (c *crashCollector) collect(reason, browser string, exitErr error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dumps := c.pendingDumps()
+	if reason == crashMinidump && len(dumps) == 0 {
+		return
+	}
+
+	now := time.Now().UTC()
+	dir := filepath.Join(c.dir, now.Format(logFileTimeFormat)+"-"+reason)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		slog.Error("failed to create crash incident directory", "dir", dir, "error", err)
+		return
+	}
+
+	incident := crashIncident{Time: now, Reason: reason, Browser: browser}
+	if exitErr != nil {
+		incident.Error = exitErr.Error()
+	}
+	for _, dump := range dumps {
+		name := filepath.Base(dump)
+		if err := os.Rename(dump, filepath.Join(dir, name)); err != nil {
+			slog.Warn("failed to move minidump", "file", dump, "error", err)
+			continue
+		}
+		incident.Dumps = append(incident.Dumps, name)
+		// Crashpad keeps its annotations next to the dump.
+		meta := strings.TrimSuffix(dump, ".dmp") + ".meta"
+		_ = os.Rename(meta, filepath.Join(dir, filepath.Base(meta)))
+	}
+	incident.PID = c.writeLog(dir, browser)
+
+	if data, err := json.MarshalIndent(incident, "", "  "); err == nil {
+		if err := os.WriteFile(filepath.Join(dir, "incident.json"), append(data, '\n'), 0o644); err != nil {
+			slog.Warn("failed to write crash incident", "dir", dir, "error", err)
+		}
+	}
+	c.prune()
+
+	slog.Warn("chromium crash collected", "event", "crash_collected", "reason", reason, "browser", browser, "dir", dir, "dumps", len(incident.Dumps))
+	c.metrics.add("browserd_chromium_crashes_total", map[string]string{"reason": reason}, 1)
+	c.notify(webhookEvent{Event: eventBrowserCrashed, Reason: reason, Error: incident.Error, Incident: dir})
+}
+
+// pendingDumps lists the minidumps crashpad has finished writing; those
+// still under new/ are left for the next poll.
+func (c *crashCollector) pendingDumps() []string {
+	var dumps []string
+	root := crashpadDir(c.dir)
+	_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() && d.Name() == "new" && filepath.Dir(path) == root {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && strings.HasSuffix(d.Name(), ".dmp") {
+			dumps = append(dumps, path)
+		}
+		return nil
+	})
+	return dumps
+}
+
+// writeLog saves the recent output of browser, limited to its last
+// process, as chromium.log in dir, and returns that process's pid.
+func (c *crashCollector) writeLog(dir, browser string) int {
+	if c.logs == nil {
+		return 0
+	}
+	lines := c.logs.tail(browser, 0)
+	pid := 0
+	if browser != "" && len(lines) > 0 {
+		pid = lines[len(lines)-1].PID
+		kept := lines[:0]
+		for _, line := range lines {
+			if line.PID == pid {
+				kept = append(kept, line)
+			}
+		}
+		lines = kept
+	}
+	if len(lines) > crashLogLines {
+		lines = lines[len(lines)-crashLogLines:]
+	}
+
+	var sb strings.Builder
+	for _, line := range lines {
+		fmt.Fprintf(&sb, "%s %s[%d] %s: %s\n", line.Time.UTC().Format(time.RFC3339Nano), line.Browser, line.PID, line.Stream, line.Line)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "chromium.log"), []byte(sb.String()), 0o644); err != nil {
+		slog.Warn("failed to write crash log", "dir", dir, "error", err)
+	}
+	return pid
+}
+
+// prune removes the oldest incidents beyond maxIncidents.
+func (c *crashCollector) prune() {
+	if c.maxIncidents <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	var incidents []string
+	for _, e := range entries {
+		if e.IsDir() && e.Name() != filepath.Base(crashpadDir(c.dir)) {
+			incidents = append(incidents, e.Name())
+		}
+	}
+	if len(incidents) <= c.maxIncidents {
+		return
+	}
+	// The timestamp prefix sorts chronologically.
+	sort.Strings(incidents)
+	for _, name := range incidents[:len(incidents)-c.maxIncidents] {
+		if err := os.RemoveAll(filepath.Join(c.dir, name)); err != nil {
+			slog.Warn("failed to remove old crash incident", "dir", name, "error", err)
+		}
+	}
+}
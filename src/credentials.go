@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// siteCredential is one entry of the -site-credentials file: the URLs it
+// applies to, as a Fetch urlPattern wildcard, and either a username and
+// password answered to their HTTP auth challenges or a token sent with
+// every request as a bearer Authorization header.
+type siteCredential struct {
+	Match    string `json:"match"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+// siteCredentials are tried in file order; the first match applies.
+type siteCredentials []siteCredential
+
+func loadSiteCredentials(path string) (siteCredentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var creds siteCredentials
+	if err := unmarshalConfig(data, &creds); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i, cred := range creds {
+		if cred.Match == "" {
+			return nil, fmt.Errorf("parse %s: entry %d has no match", path, i)
+		}
+		if (cred.Token == "") == (cred.Username == "") {
+			return nil, fmt.Errorf("parse %s: entry %d needs either username or token", path, i)
+		}
+	}
+	return creds, nil
+}
+
+// lookup returns the first credential matching rawURL, or nil.
+func (c siteCredentials) lookup(rawURL string) *siteCredential {
+	for i := range c {
+		if wildcardMatch(c[i].Match, rawURL) {
+			return &c[i]
+		}
+	}
+	return nil
+}
+
+// hasBasic reports whether any entry answers auth challenges.
+func (c siteCredentials) hasBasic() bool {
+	for _, cred := range c {
+		if cred.Username != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// bearerPolicy adds the bearer token of the matching entry to requests
+// that don't carry an Authorization header of their own.
+func (c siteCredentials) bearerPolicy(onInject func(req *pausedRequest)) requestPolicy {
+	return func(req *pausedRequest) *fetchDecision {
+		cred := c.lookup(req.Request.URL)
+		if cred == nil || cred.Token == "" {
+			return nil
+		}
+		entries := make([]headerEntry, 0, len(req.Request.Headers)+1)
+		for name, value := range req.Request.Headers {
+			if strings.EqualFold(name, "Authorization") {
+				return nil
+			}
+			entries = append(entries, headerEntry{Name: name, Value: value})
+		}
+		entries = append(entries, headerEntry{Name: "Authorization", Value: "Bearer " + cred.Token})
+		onInject(req)
+		return &fetchDecision{method: "Fetch.continueRequest", params: map[string]any{"headers": entries}}
+	}
+}
+
+// siteAuthResponse answers a site's auth challenge with the matching
+// credentials, once per request: a second challenge means they were
+// rejected. It returns nil when no entry applies.
+func (r *relay) siteAuthResponse(params authRequiredParams) map[string]any {
+	if params.AuthChallenge.Source == "Proxy" {
+		return nil
+	}
+	requestID, url := params.RequestID, params.Request.URL
+	cred := r.siteCredentials.lookup(url)
+	if cred == nil || cred.Username == "" {
+		return nil
+	}
+	r.fetchMu.Lock()
+	retry := r.siteChallenged[requestID]
+	if retry {
+		delete(r.siteChallenged, requestID)
+	} else {
+		r.siteChallenged[requestID] = true
+	}
+	r.fetchMu.Unlock()
+
+	if retry {
+		r.sess.logf("site rejected credentials for %s", url)
+		return map[string]any{"response": "CancelAuth"}
+	}
+	r.sess.logf("answered auth challenge for %s", url)
+	return map[string]any{
+		"response": "ProvideCredentials",
+		"username": cred.Username,
+		"password": cred.Password,
+	}
+}
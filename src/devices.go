@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// devicePreset is a named viewport and user agent applied to every page
+// target of a session through the Emulation domain.
+type devicePreset struct {
+	Width       int
+	Height      int
+	ScaleFactor float64
+	Mobile      bool
+	// UserAgent and Platform are left unchanged when empty.
+	UserAgent string
+	Platform  string
+}
+
+var devicePresets = map[string]devicePreset{
+	"iphone-14": {
+		Width: 390, Height: 844, ScaleFactor: 3, Mobile: true,
+		UserAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 16_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.0 Mobile/15E148 Safari/604.1",
+		Platform:  "iPhone",
+	},
+	"pixel-7": {
+		Width: 412, Height: 915, ScaleFactor: 2.625, Mobile: true,
+		UserAgent: "Mozilla/5.0 (Linux; Android 13; Pixel 7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/116.0.0.0 Mobile Safari/537.36",
+		Platform:  "Linux armv8l",
+	},
+	"desktop-1080p": {
+		Width: 1920, Height: 1080, ScaleFactor: 1,
+	},
+}
+
+// metricsCommand sets the device's viewport only.
+func (d devicePreset) metricsCommand() cdpCommand {
+	metrics, _ := json.Marshal(map[string]any{
+		"width":             d.Width,
+		"height":            d.Height,
+		"deviceScaleFactor": d.ScaleFactor,
+		"mobile":            d.Mobile,
+	})
+	return cdpCommand{Method: "Emulation.setDeviceMetricsOverride", Params: metrics}
+}
+
+// commands returns the init commands that emulate the device.
+func (d devicePreset) commands() []cdpCommand {
+	touch, _ := json.Marshal(map[string]any{"enabled": d.Mobile, "maxTouchPoints": 5})
+	commands := []cdpCommand{
+		d.metricsCommand(),
+		{Method: "Emulation.setTouchEmulationEnabled", Params: touch},
+	}
+	if d.UserAgent != "" {
+		ua, _ := json.Marshal(map[string]any{"userAgent": d.UserAgent, "platform": d.Platform})
+		commands = append(commands, cdpCommand{Method: "Emulation.setUserAgentOverride", Params: ua})
+	}
+	return commands
+}
+
+// lookupDevice validates a preset name; the empty name means no emulation.
+func lookupDevice(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return "", nil
+	}
+	if _, ok := devicePresets[name]; !ok {
+		names := make([]string, 0, len(devicePresets))
+		for known := range devicePresets {
+			names = append(names, known)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("unknown device %q (known: %s)", name, strings.Join(names, ", "))
+	}
+	return name, nil
+}
+
+// parseDevice reads the ?device= parameter, falling back to the configured
+// default preset.
+func parseDevice(query url.Values, fallback string) (string, error) {
+	if raw, ok := query["device"]; ok && len(raw) > 0 {
+		return lookupDevice(raw[0])
+	}
+	return fallback, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// newDevtoolsFrontend serves the DevTools UI under /devtools/ from source:
+// a directory holding a devtools-frontend build, or the http(s) base URL
+// of a hosted one, such as
+// https://chrome-devtools-frontend.appspot.com/serve_rev/@<revision>.
+// A hosted frontend's server headers are dropped under headers.hideServer.
+func newDevtoolsFrontend(source string, headers headerPolicy) (http.Handler, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		base, err := url.Parse(source)
+		if err != nil || base.Host == "" {
+			return nil, fmt.Errorf("invalid frontend URL %q", source)
+		}
+		return &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.Out.URL.Scheme = base.Scheme
+				r.Out.URL.Host = base.Host
+				r.Out.URL.Path = path.Join(base.Path, strings.TrimPrefix(r.In.URL.Path, "/devtools"))
+				r.Out.URL.RawPath = ""
+				r.Out.Host = base.Host
+				// The token, if any, belongs to browserd.
+				r.Out.URL.RawQuery = ""
+				r.Out.Header.Del("Authorization")
+			},
+			ModifyResponse: func(resp *http.Response) error {
+				headers.stripIdentity(resp.Header)
+				return nil
+			},
+		}, nil
+	}
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", source)
+	}
+	return http.StripPrefix("/devtools", http.FileServer(http.Dir(source))), nil
+}
+
+// rewriteFrontendURL points a /json/list entry's devtoolsFrontendUrl at
+// browserd's own frontend, connected back through browserd to the target.
+// The client's ?token=, if it used one, is passed along so the frontend's
+// WebSocket is authorized too.
+func rewriteFrontendURL(target map[string]any, r *http.Request) {
+	wsURL, _ := target["webSocketDebuggerUrl"].(string)
+	parsed, err := url.Parse(wsURL)
+	if err != nil || !strings.HasPrefix(parsed.Path, "/devtools/") {
+		return
+	}
+
+	endpoint := r.Host + parsed.Path
+	if token := r.URL.Query().Get("token"); token != "" {
+		endpoint += "?" + url.Values{"token": {token}}.Encode()
+	}
+	scheme := "ws"
+	if r.TLS != nil {
+		scheme = "wss"
+	}
+	target["devtoolsFrontendUrl"] = "/devtools/inspector.html?" + url.Values{scheme: {endpoint}}.Encode()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	dialRetryMinBackoff = 100 * time.Millisecond
+	dialRetryMaxBackoff = 2 * time.Second
+)
+
+// dialWithRetry is dialSession retried with capped exponential backoff and
+// jitter until ctx expires, so a client connecting while Chromium restarts
+// waits for it instead of failing. A -preconnect connection is used
+// instead when there is one. Only transport errors are retried: a
+// handshake Chromium answered, e.g. with 404 for an unknown target, fails
+// straight away.
+func (p *proxyServer) dialWithRetry(ctx context.Context, sess *session, subprotocols []string) (*websocket.Conn, *http.Response, error) {
+	if conn := p.takePreconnected(sess, subprotocols); conn != nil {
+		return conn, nil, nil
+	}
+	backoff := dialRetryMinBackoff
+	for {
+		conn, resp, err := p.dialSession(ctx, sess, subprotocols)
+		if err == nil || resp != nil || p.dialWindow <= 0 {
+			return conn, resp, err
+		}
+
+		// A restarted Chromium has a new browser id, so the cached
+		// debugger URL is refreshed before the next attempt.
+		if !p.staticDebugger && (sess == nil || sess.browser == nil && !sess.onFallback) {
+			_ = p.refreshDebuggerURL(ctx)
+		}
+
+		// Equal jitter keeps clients that failed together from retrying
+		// in lockstep.
+		wait := backoff/2 + rand.N(backoff/2)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return nil, nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, err
+		case <-time.After(wait):
+		}
+		if sess != nil {
+			sess.log.Debug("retrying upstream dial", "event", "upstream_dial_retry", "error", err, "backoff", wait.String())
+		}
+		p.metrics.add("browserd_upstream_dial_retries_total", nil, 1)
+		backoff = min(backoff*2, dialRetryMaxBackoff)
+	}
+}
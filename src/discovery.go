@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// refreshDebuggerURL asks Chromium for its debugger URL and caches it.
+func (p *proxyServer) refreshDebuggerURL(ctx context.Context) error {
+	info, err := p.fetchVersionInfo(ctx)
+	if err != nil {
+		return err
+	}
+	p.setDebuggerURL(info.WebSocketDebuggerURL)
+	p.mu.Lock()
+	p.browserVersion = info.Browser
+	p.mu.Unlock()
+	return nil
+}
+
+// setDebuggerURL caches debuggerURL. A URL other than the last one seen,
+// such as that of a restarted browser, starts a new upstream generation.
+func (p *proxyServer) setDebuggerURL(debuggerURL string) {
+	p.mu.Lock()
+	previous := p.lastDebuggerURL
+	p.debuggerURL = debuggerURL
+	changed := debuggerURL != previous
+	if changed {
+		p.lastDebuggerURL = debuggerURL
+		p.generation++
+	}
+	generation := p.generation
+	p.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	p.metrics.set("browserd_upstream_generation", nil, float64(generation))
+	if previous == "" {
+		slog.Info("chromium debugger endpoint set", "backend", debuggerURL, "generation", generation)
+		return
+	}
+	slog.Info("chromium debugger endpoint changed", "event", "upstream_changed", "backend", debuggerURL, "previous", previous, "generation", generation)
+	p.metrics.add("browserd_upstream_changes_total", nil, 1)
+	p.preconnect.refresh()
+}
+
+// requestRefresh has refreshDebuggerURLs refresh now rather than at its
+// next tick.
+func (p *proxyServer) requestRefresh() {
+	select {
+	case p.refreshNow <- struct{}{}:
+	default:
+	}
+}
+
+// refreshDebuggerURLs keeps the cached debugger URL fresh, polling
+// /json/version every -debugger-refresh until ctx ends, so dials don't find
+// out about a new browser by failing.
+func (p *proxyServer) refreshDebuggerURLs(ctx context.Context) {
+	ticker := time.NewTicker(p.debuggerRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.refreshNow:
+		}
+		refreshCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+		if err := p.refreshDebuggerURL(refreshCtx); err != nil {
+			slog.Debug("debugger url refresh failed", "event", "upstream_refresh_failed", "backend", p.versionEndpoint(), "error", err)
+		}
+		cancel()
+	}
+}
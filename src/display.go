@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const xvfbStartTimeout = 5 * time.Second
+
+// displaySize is the geometry of a managed virtual display.
+type displaySize struct {
+	width, height, depth int
+}
+
+// parseDisplaySize accepts WIDTHxHEIGHT or WIDTHxHEIGHTxDEPTH.
+func parseDisplaySize(raw string) (displaySize, error) {
+	parts := strings.Split(strings.ToLower(raw), "x")
+	if len(parts) != 2 && len(parts) != 3 {
+		return displaySize{}, fmt.Errorf("invalid display size %q, expected WIDTHxHEIGHT[xDEPTH]", raw)
+	}
+	size := displaySize{depth: 24}
+	fields := []*int{&size.width, &size.height, &size.depth}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n <= 0 {
+			return displaySize{}, fmt.Errorf("invalid display size %q", raw)
+		}
+		*fields[i] = n
+	}
+	return size, nil
+}
+
+func (s displaySize) String() string {
+	return fmt.Sprintf("%dx%dx%d", s.width, s.height, s.depth)
+}
+
+// virtualDisplay runs an Xvfb server for headful Chromium and restarts it
+// on demand when it has gone away.
+type virtualDisplay struct {
+	bin    string
+	number int
+	size   displaySize
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	exited chan struct{}
+}
+
+func newVirtualDisplay(bin string, number int, size displaySize) *virtualDisplay {
+	return &virtualDisplay{bin: bin, number: number, size: size}
+}
+
+// name is the DISPLAY value clients of the server use.
+func (d *virtualDisplay) name() string {
+	return ":" + strconv.Itoa(d.number)
+}
+
+func (d *virtualDisplay) socketPath() string {
+	return fmt.Sprintf("/tmp/.X11-unix/X%d", d.number)
+}
+
+// ensure starts the display server unless it is already running, and waits
+// until it accepts connections.
+func (d *virtualDisplay) ensure() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cmd != nil {
+		return nil
+	}
+
+	cmd := exec.Command(d.bin, d.name(), "-screen", "0", d.size.String(), "-nolisten", "tcp", "-ac")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan struct{})
+	go func() {
+		err := cmd.Wait()
+		slog.Warn("xvfb exited", "event", "xvfb_exited", "display", d.name(), "error", err)
+		d.mu.Lock()
+		if d.cmd == cmd {
+			d.cmd = nil
+		}
+		d.mu.Unlock()
+		close(exited)
+	}()
+
+	deadline := time.After(xvfbStartTimeout)
+	for {
+		if _, err := os.Stat(d.socketPath()); err == nil {
+			break
+		}
+		select {
+		case <-exited:
+			return errors.New("Xvfb exited during startup")
+		case <-deadline:
+			_ = cmd.Process.Kill()
+			return fmt.Errorf("Xvfb did not create %s within %s", d.socketPath(), xvfbStartTimeout)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	d.cmd, d.exited = cmd, exited
+	slog.Info("started xvfb", "event", "xvfb_started", "display", d.name(), "size", d.size.String(), "pid", cmd.Process.Pid)
+	return nil
+}
+
+// stop terminates the display server and waits for it to exit.
+func (d *virtualDisplay) stop() {
+	d.mu.Lock()
+	cmd, exited := d.cmd, d.exited
+	d.cmd = nil
+	d.mu.Unlock()
+	if cmd == nil {
+		return
+	}
+
+	terminate(cmd.Process)
+	select {
+	case <-exited:
+	case <-time.After(supervisorStopTimeout):
+		_ = cmd.Process.Kill()
+		<-exited
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// dnsConfig pins how the browsers browserd launches resolve host names:
+// through a DNS-over-HTTPS resolver with no fallback to the system's, and
+// with --host-resolver-rules mappings checked before any lookup.
+type dnsConfig struct {
+	// resolver is a DNS-over-HTTPS URL template.
+	resolver string
+	// hostRules are Chromium host resolver rules, e.g.
+	// "MAP *.internal 10.0.0.5" or "EXCLUDE localhost", first match wins.
+	hostRules []string
+}
+
+// parseDNSResolver checks a DNS-over-HTTPS URL template such as
+// https://dns.internal/dns-query or https://dns.internal/{?dns}.
+func parseDNSResolver(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%q is not an https:// DNS-over-HTTPS URL", raw)
+	}
+	return nil
+}
+
+// parseHostRules splits comma-separated host resolver rules, checking
+// each is a MAP or EXCLUDE rule.
+func parseHostRules(raw string) ([]string, error) {
+	var rules []string
+	for _, rule := range strings.Split(raw, ",") {
+		fields := strings.Fields(rule)
+		if len(fields) == 0 {
+			continue
+		}
+		rule = strings.Join(fields, " ")
+		switch {
+		case strings.EqualFold(fields[0], "MAP") && len(fields) == 3:
+		case strings.EqualFold(fields[0], "EXCLUDE") && len(fields) == 2:
+		default:
+			return nil, fmt.Errorf("%q is not a MAP <host> <replacement> or EXCLUDE <host> rule", rule)
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) == 0 {
+		return nil, errors.New("no rules")
+	}
+	return rules, nil
+}
+
+// args are the Chromium flags that apply c.
+func (c dnsConfig) args() []string {
+	var args []string
+	if c.resolver != "" {
+		args = append(args, dohFeature(c.resolver))
+	}
+	if len(c.hostRules) > 0 {
+		args = append(args, "--host-resolver-rules="+strings.Join(c.hostRules, ", "))
+	}
+	return args
+}
+
+// dohFeature turns on Chromium's DNS-over-HTTPS in secure mode, without
+// falling back to the system resolver, through the DnsOverHttps feature's
+// parameters, whose values are URL-escaped.
+func dohFeature(template string) string {
+	return "--enable-features=DnsOverHttps:Fallback/false/Templates/" + url.QueryEscape(template)
+}
+
+// mergeFeatureFlags folds every --enable-features flag in args into the
+// first, since Chromium only heeds the last one given. A feature named
+// twice keeps its later setting.
+func mergeFeatureFlags(args []string) []string {
+	const prefix = "--enable-features="
+	var features []string
+	first := -1
+	out := make([]string, 0, len(args))
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, prefix) {
+			out = append(out, arg)
+			continue
+		}
+		if first < 0 {
+			first = len(out)
+			out = append(out, "")
+		}
+		for _, feature := range strings.Split(strings.TrimPrefix(arg, prefix), ",") {
+			if feature == "" {
+				continue
+			}
+			name := featureName(feature)
+			features = slices.DeleteFunc(features, func(f string) bool { return featureName(f) == name })
+			features = append(features, feature)
+		}
+	}
+	if first < 0 {
+		return args
+	}
+	out[first] = prefix + strings.Join(features, ",")
+	return out
+}
+
+// featureName is a --enable-features entry without its field trial or
+// parameters.
+func featureName(feature string) string {
+	if i := strings.IndexAny(feature, ":<"); i >= 0 {
+		feature = feature[:i]
+	}
+	return strings.TrimPrefix(feature, "*")
+}
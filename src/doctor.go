@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Levels of browserd doctor findings.
+const (
+	doctorOK   = "ok"
+	doctorWarn = "warn"
+	doctorFail = "fail"
+)
+
+const (
+	// doctorTimeout bounds each check that reaches the upstream or runs
+	// Chromium.
+	doctorTimeout = 10 * time.Second
+	// doctorCertWarning is how close to expiry a listener's certificate
+	// is reported.
+	doctorCertWarning = 14 * 24 * time.Hour
+)
+
+// chromiumVersionPattern finds the major version in chromium --version
+// output such as "Chromium 120.0.6099.109".
+var chromiumVersionPattern = regexp.MustCompile(`\b(\d+)\.\d+\.\d+\.\d+\b`)
+
+// doctorFinding is one line of browserd doctor's report, with what to do
+// about it unless it is ok.
+type doctorFinding struct {
+	level  string
+	check  string
+	detail string
+	fix    string
+}
+
+type doctorReport struct {
+	findings []doctorFinding
+}
+
+func (r *doctorReport) add(level, check, fix, format string, args ...any) {
+	r.findings = append(r.findings, doctorFinding{level: level, check: check, detail: fmt.Sprintf(format, args...), fix: fix})
+}
+
+// runDoctor checks what cfg, which main has already validated, would
+// start: that the server can be built, that each upstream answers and
+// speaks a protocol current clients work with, that TLS listeners have
+// usable certificates, and that the directories browserd writes to are
+// writable. It prints its findings to out and returns the exit status,
+// 1 when any check failed.
+func runDoctor(cfg proxyConfig, out io.Writer) int {
+	r := &doctorReport{}
+	p, err := newProxyServer(cfg)
+	if err != nil {
+		r.add(doctorFail, "config", "Fix the setting the error names.", "server can't be built: %v", err)
+	} else {
+		r.add(doctorOK, "config", "", "flags, environment and configuration files are valid")
+		r.checkUpstream("upstream", p, cfg.chromiumBin)
+		names := make([]string, 0, len(p.namedPools))
+		for name := range p.namedPools {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			r.checkUpstream("pool "+name, p.namedPools[name], "")
+		}
+	}
+	r.checkTLS(cfg)
+	r.checkDirs(cfg)
+	return r.print(out)
+}
+
+// checkUpstream runs the supervised binary's --version, or fetches an
+// external Chromium's /json/version and dials the debugger URL it gives.
+func (r *doctorReport) checkUpstream(check string, p *proxyServer, chromiumBin string) {
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	if chromiumBin != "" {
+		out, err := exec.CommandContext(ctx, chromiumBin, "--version").Output()
+		if err != nil {
+			r.add(doctorFail, check, "Point -chromium-bin at an installed Chromium or Chrome binary.", "%s --version failed: %v", chromiumBin, err)
+			return
+		}
+		version := strings.TrimSpace(string(out))
+		r.add(doctorOK, check, "", "supervised %s", version)
+		r.checkVersion(check, p, version)
+		return
+	}
+	if err := p.refreshDebuggerURL(ctx); err != nil {
+		r.add(doctorFail, check, "Check -chromium, and that Chromium runs with --remote-debugging-port and, on another host, --remote-debugging-address=0.0.0.0.", "%s: %v", p.versionEndpoint(), err)
+		return
+	}
+	client, err := p.dialCDP(ctx, nil)
+	if err != nil {
+		r.add(doctorFail, check, "Start Chromium with --remote-allow-origins=*, and check -debugger-host and -debugger-port if its address needs rewriting.", "%s answered, but its debugger %s can't be dialed: %v", p.versionEndpoint(), p.getDebuggerURL(), err)
+		return
+	}
+	client.close()
+	p.mu.RLock()
+	browser := p.browserVersion
+	p.mu.RUnlock()
+	r.add(doctorOK, check, "", "%s answered and its debugger took a connection", p.versionEndpoint())
+	r.checkVersion(check, p, browser)
+}
+
+// checkVersion reports a browser too old for current clients without the
+// -protocol-shims that cover it.
+func (r *doctorReport) checkVersion(check string, p *proxyServer, browser string) {
+	milestone := browserMilestone(browser)
+	if match := chromiumVersionPattern.FindStringSubmatch(browser); milestone == 0 && match != nil {
+		milestone, _ = strconv.Atoi(match[1])
+	}
+	if milestone == 0 {
+		r.add(doctorWarn, check, "Name the -protocol-shims old clients need, since auto leaves such browsers alone.", "can't tell the browser's version from %q", browser)
+		return
+	}
+	var older []string
+	for _, shim := range protocolShims {
+		if milestone < shim.before {
+			older = append(older, shim.name)
+		}
+	}
+	if len(older) > 0 && p.compat == nil {
+		r.add(doctorWarn, check, "Add -protocol-shims auto so current clients work with it.", "M%d predates CDP changes current clients rely on: %s", milestone, strings.Join(older, ", "))
+		return
+	}
+	r.add(doctorOK, check, "", "M%d is compatible", milestone)
+}
+
+// checkTLS loads the certificate and key of each TLS listener.
+func (r *doctorReport) checkTLS(cfg proxyConfig) {
+	for _, spec := range cfg.listen {
+		if spec.certFile == "" {
+			continue
+		}
+		check := "tls " + spec.addr
+		pair, err := tls.LoadX509KeyPair(spec.certFile, spec.keyFile)
+		if err != nil {
+			r.add(doctorFail, check, "Check the listener's ?cert= and ?key=: both PEM files, the key matching the certificate.", "%v", err)
+			continue
+		}
+		leaf, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			r.add(doctorFail, check, "Replace "+spec.certFile+" with a valid certificate.", "%v", err)
+			continue
+		}
+		names := strings.Join(append([]string{leaf.Subject.CommonName}, leaf.DNSNames...), ", ")
+		switch left := time.Until(leaf.NotAfter); {
+		case left <= 0:
+			r.add(doctorFail, check, "Renew "+spec.certFile+", or use ?acme.", "certificate for %s expired on %s", names, leaf.NotAfter.Format(time.DateOnly))
+		case left < doctorCertWarning:
+			r.add(doctorWarn, check, "Renew "+spec.certFile+" soon, or use ?acme.", "certificate for %s expires on %s", names, leaf.NotAfter.Format(time.DateOnly))
+		default:
+			r.add(doctorOK, check, "", "certificate for %s valid until %s", names, leaf.NotAfter.Format(time.DateOnly))
+		}
+	}
+}
+
+// checkDirs writes a file to each directory browserd keeps files in,
+// creating it as browserd would.
+func (r *doctorReport) checkDirs(cfg proxyConfig) {
+	dirs := []struct{ flag, dir string }{
+		{"-temp-dir", cfg.tempDir},
+		{"-session-log-dir", cfg.sessionLogDir},
+		{"-dump-dir", cfg.dumpDir},
+		{"-crash-dir", cfg.crashDir},
+		{"-profiles-dir", cfg.profilesDir},
+		{"-render-cache-dir", cfg.renderCacheDir},
+	}
+	if !strings.Contains(cfg.artifactStore, "://") {
+		dirs = append(dirs, struct{ flag, dir string }{"-artifact-store", cfg.artifactStore})
+	} else if u, err := url.Parse(cfg.artifactStore); err == nil && u.Scheme == "file" {
+		dirs = append(dirs, struct{ flag, dir string }{"-artifact-store", u.Path})
+	}
+	if cfg.apiKeyState != "" {
+		dirs = append(dirs, struct{ flag, dir string }{"-api-key-state", filepath.Dir(cfg.apiKeyState)})
+	}
+	for _, spec := range cfg.listen {
+		if spec.acme {
+			dirs = append(dirs, struct{ flag, dir string }{"-acme-cache", cfg.acme.cacheDir})
+			break
+		}
+	}
+	for _, d := range dirs {
+		if d.dir == "" {
+			continue
+		}
+		err := os.MkdirAll(d.dir, 0o755)
+		if err == nil {
+			var f *os.File
+			if f, err = os.CreateTemp(d.dir, ".browserd-doctor-*"); err == nil {
+				_ = f.Close()
+				_ = os.Remove(f.Name())
+			}
+		}
+		if err != nil {
+			r.add(doctorFail, d.flag, "Let the user browserd runs as write to it, or pick another directory with "+d.flag+".", "%s isn't writable: %v", d.dir, err)
+			continue
+		}
+		r.add(doctorOK, d.flag, "", "%s is writable", d.dir)
+	}
+}
+
+// print writes one line per finding, with its fix indented below, and a
+// summary, returning the exit status.
+func (r *doctorReport) print(out io.Writer) int {
+	failed, warned := 0, 0
+	for _, f := range r.findings {
+		fmt.Fprintf(out, "%-4s  %-18s %s\n", f.level, f.check, f.detail)
+		if f.fix != "" {
+			fmt.Fprintf(out, "      %-18s fix: %s\n", "", f.fix)
+		}
+		switch f.level {
+		case doctorFail:
+			failed++
+		case doctorWarn:
+			warned++
+		}
+	}
+	fmt.Fprintf(out, "%d failed, %d warnings\n", failed, warned)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// diagnosticDump is the snapshot written on SIGUSR1.
+type diagnosticDump struct {
+	Time       time.Time     `json:"time"`
+	Goroutines int           `json:"goroutines"`
+	Draining   bool          `json:"draining"`
+	Backend    backendDump   `json:"backend"`
+	Pool       *poolDump     `json:"warmPool,omitempty"`
+	Queues     queueDump     `json:"queues"`
+	Sessions   []sessionView `json:"sessions"`
+}
+
+type backendDump struct {
+	DebuggerURL string `json:"debuggerUrl"`
+	Healthy     bool   `json:"healthy"`
+	Supervised  bool   `json:"supervised"`
+	// The fields below are only set in supervised mode.
+	PID            int       `json:"pid,omitempty"`
+	StartedAt      time.Time `json:"startedAt,omitzero"`
+	SessionsServed int       `json:"sessionsServed,omitempty"`
+}
+
+type poolDump struct {
+	Ready    int `json:"ready"`
+	Starting int `json:"starting"`
+	Assigned int `json:"assigned"`
+}
+
+type queueDump struct {
+	Webhooks    int `json:"webhooks"`
+	APIRequests int `json:"apiRequests"`
+	Sessions    int `json:"sessionSlots"`
+	Admission   int `json:"admission"`
+}
+
+func (p *proxyServer) snapshot() diagnosticDump {
+	dump := diagnosticDump{
+		Time:       time.Now().UTC(),
+		Goroutines: runtime.NumGoroutine(),
+		Draining:   p.draining.Load(),
+		Backend: backendDump{
+			DebuggerURL: p.getDebuggerURL(),
+			Healthy:     p.health.healthy(),
+		},
+		Queues: queueDump{
+			APIRequests: len(p.apiSlots),
+			Sessions:    int(p.sessionSlots.Load()),
+			Admission:   p.admission.waiting(),
+		},
+		Sessions: []sessionView{},
+	}
+	if p.supervisor != nil {
+		dump.Backend.Supervised = true
+		dump.Backend.PID, dump.Backend.StartedAt, dump.Backend.SessionsServed = p.supervisor.usage()
+	}
+	if p.pool != nil {
+		pool := &poolDump{}
+		pool.Ready, pool.Starting, pool.Assigned = p.pool.counts()
+		dump.Pool = pool
+	}
+	if p.webhooks != nil {
+		dump.Queues.Webhooks = len(p.webhooks.queue)
+	}
+	for _, s := range p.allSessions() {
+		dump.Sessions = append(dump.Sessions, s.view())
+	}
+	return dump
+}
+
+// watchDumpSignal writes a diagnostic dump each time SIGUSR1 arrives,
+// until ctx is cancelled.
+func (p *proxyServer) watchDumpSignal(ctx context.Context) {
+	if len(dumpSignals) == 0 {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, dumpSignals...)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			if err := p.writeDump(); err != nil {
+				slog.Error("diagnostic dump failed", "error", err)
+			}
+		}
+	}
+}
+
+// writeDump logs the snapshot as one JSON line, or writes it under
+// -dump-dir and logs the file name.
+func (p *proxyServer) writeDump() error {
+	dump := p.snapshot()
+	if p.dumpDir == "" {
+		data, err := json.Marshal(dump)
+		if err != nil {
+			return err
+		}
+		slog.Info("diagnostic dump", "event", "diagnostic_dump", "dump", json.RawMessage(data))
+		return nil
+	}
+
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Join(p.dumpDir, fmt.Sprintf("browserd-dump-%s.json", dump.Time.Format("20060102T150405.000Z")))
+	if err := os.WriteFile(name, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	slog.Info("diagnostic dump written", "event", "diagnostic_dump", "file", name)
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// dumpSignals is empty where SIGUSR1 doesn't exist.
+var dumpSignals []os.Signal
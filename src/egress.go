@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+)
+
+// parseEgressProxy reads the ?proxy= parameter naming the HTTP or SOCKS
+// proxy a session's browsing traffic is sent through.
+func parseEgressProxy(query url.Values) (*url.URL, error) {
+	raw := query.Get("proxy")
+	if raw == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, errors.New("invalid proxy parameter: " + err.Error())
+	}
+	switch u.Scheme {
+	case "http", "https", "socks4", "socks5":
+	default:
+		return nil, errors.New("invalid proxy parameter: scheme must be http, https, socks4 or socks5")
+	}
+	if u.Hostname() == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return nil, errors.New("invalid proxy parameter: expected scheme://[user:pass@]host[:port]")
+	}
+	if u.User != nil && (u.Scheme == "socks4" || u.Scheme == "socks5") {
+		return nil, errors.New("invalid proxy parameter: Chromium does not support SOCKS proxy credentials")
+	}
+	return u, nil
+}
+
+// proxyServerArg formats a proxy URL for Chromium, which takes credentials
+// through auth challenges rather than in the URL.
+func proxyServerArg(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+type authRequiredParams struct {
+	RequestID string `json:"requestId"`
+	Request   struct {
+		URL string `json:"url"`
+	} `json:"request"`
+	AuthChallenge struct {
+		Source string `json:"source"`
+	} `json:"authChallenge"`
+}
+
+// onAuthRequired answers proxy challenges with the session proxy's
+// credentials and site challenges with the matching -site-credentials.
+// Other challenges go to the client if it asked for them and get the
+// default behaviour otherwise. It reports whether the event should be
+// forwarded.
+func (r *relay) onAuthRequired(msg cdpMessage) bool {
+	var params authRequiredParams
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		return true
+	}
+
+	response := map[string]any{"response": "Default"}
+	if params.AuthChallenge.Source == "Proxy" && r.proxyAuth() {
+		r.fetchMu.Lock()
+		retry := r.proxyChallenged[params.RequestID]
+		if retry {
+			delete(r.proxyChallenged, params.RequestID)
+		} else {
+			r.proxyChallenged[params.RequestID] = true
+		}
+		r.fetchMu.Unlock()
+
+		if retry {
+			// The proxy rejected the credentials once already.
+			r.sess.logf("proxy rejected credentials for %s", proxyServerArg(r.proxy))
+			response = map[string]any{"response": "CancelAuth"}
+		} else {
+			password, _ := r.proxy.User.Password()
+			response = map[string]any{
+				"response": "ProvideCredentials",
+				"username": r.proxy.User.Username(),
+				"password": password,
+			}
+		}
+	} else if site := r.siteAuthResponse(params); site != nil {
+		response = site
+	} else {
+		r.fetchMu.Lock()
+		clientAuth := r.clientAuth[msg.SessionID]
+		r.fetchMu.Unlock()
+		if clientAuth {
+			return true
+		}
+	}
+
+	go r.send(msg.SessionID, "Fetch.continueWithAuth", map[string]any{
+		"requestId":             params.RequestID,
+		"authChallengeResponse": response,
+	})
+	return false
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	// Embedded so ?tz= can be checked on hosts without a zoneinfo database.
+	_ "time/tzdata"
+)
+
+// localePattern accepts BCP 47 tags such as "de", "de-DE" or "zh-Hant-TW".
+var localePattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// sessionEmulation is the timezone, locale and geolocation a client asked
+// for with ?tz=, ?locale= and ?geo=, applied to every page target of the
+// session. Empty fields are left as the browser has them.
+type sessionEmulation struct {
+	Timezone string `json:"timezone,omitempty"`
+	Locale   string `json:"locale,omitempty"`
+	// Geo is "latitude,longitude" with an optional ",accuracy" in meters.
+	Geo string `json:"geo,omitempty"`
+
+	latitude, longitude, accuracy float64
+}
+
+// parseEmulation reads ?tz=, ?locale= and ?geo=, returning nil when none
+// is set.
+func parseEmulation(query url.Values) (*sessionEmulation, error) {
+	e := &sessionEmulation{
+		Timezone: query.Get("tz"),
+		Locale:   query.Get("locale"),
+		Geo:      query.Get("geo"),
+	}
+	if e.Timezone == "" && e.Locale == "" && e.Geo == "" {
+		return nil, nil
+	}
+	if e.Timezone != "" {
+		if _, err := time.LoadLocation(e.Timezone); err != nil || e.Timezone == "Local" {
+			return nil, fmt.Errorf("unknown timezone %q", e.Timezone)
+		}
+	}
+	if e.Locale != "" && !localePattern.MatchString(e.Locale) {
+		return nil, fmt.Errorf("invalid locale %q", e.Locale)
+	}
+	if e.Geo != "" {
+		if err := e.parseGeo(); err != nil {
+			return nil, fmt.Errorf("invalid geo %q: %w", e.Geo, err)
+		}
+	}
+	return e, nil
+}
+
+func (e *sessionEmulation) parseGeo() error {
+	parts := strings.Split(e.Geo, ",")
+	if len(parts) < 2 || len(parts) > 3 {
+		return errors.New("want latitude,longitude[,accuracy]")
+	}
+	values := make([]float64, len(parts))
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return err
+		}
+		values[i] = value
+	}
+	e.latitude, e.longitude, e.accuracy = values[0], values[1], 1
+	if len(values) == 3 {
+		e.accuracy = values[2]
+	}
+	switch {
+	case e.latitude < -90 || e.latitude > 90:
+		return errors.New("latitude out of range")
+	case e.longitude < -180 || e.longitude > 180:
+		return errors.New("longitude out of range")
+	case e.accuracy < 0:
+		return errors.New("negative accuracy")
+	}
+	return nil
+}
+
+// commands returns the init commands that apply the emulation.
+func (e *sessionEmulation) commands() []cdpCommand {
+	var commands []cdpCommand
+	if e.Timezone != "" {
+		params, _ := json.Marshal(map[string]string{"timezoneId": e.Timezone})
+		commands = append(commands, cdpCommand{Method: "Emulation.setTimezoneOverride", Params: params})
+	}
+	if e.Locale != "" {
+		params, _ := json.Marshal(map[string]string{"locale": e.Locale})
+		commands = append(commands, cdpCommand{Method: "Emulation.setLocaleOverride", Params: params})
+	}
+	if e.Geo != "" {
+		params, _ := json.Marshal(map[string]float64{"latitude": e.latitude, "longitude": e.longitude, "accuracy": e.accuracy})
+		commands = append(commands, cdpCommand{Method: "Emulation.setGeolocationOverride", Params: params})
+	}
+	return commands
+}
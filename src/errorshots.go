@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// maxErrorScreenshots bounds the pages captured for one session.
+	maxErrorScreenshots = 10
+	// errorScreenshotTimeout bounds the capture, which holds up the end of
+	// the session.
+	errorScreenshotTimeout = 10 * time.Second
+)
+
+// captureErrorScreenshots saves a screenshot of each of the session's
+// pages to its temp directory, as screenshots/<target id>.png, when the
+// session is ending with an error: a lost upstream, a policy kill or a
+// timeout. It runs once per session, before the session's connections are
+// closed, so pages in a browser context that goes with them can still be
+// captured. A page that can't be, such as a crashed one, is logged and
+// skipped.
+func (p *proxyServer) captureErrorScreenshots(sess *session, cause string) {
+	sess.screenshotOnce.Do(func() {
+		targets := sess.pageTargets()
+		if len(targets) == 0 {
+			return
+		}
+		if len(targets) > maxErrorScreenshots {
+			// The most recent pages are the likeliest to show what failed.
+			targets = targets[len(targets)-maxErrorScreenshots:]
+		}
+		dir, err := p.temp.sessionDir(sess.id)
+		if err == nil {
+			dir = filepath.Join(dir, tempScreenshots)
+			err = os.MkdirAll(dir, 0o755)
+		}
+		if err != nil {
+			sess.log.Warn("failed to create screenshot directory", "error", err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), errorScreenshotTimeout)
+		defer cancel()
+		var names []string
+		for _, targetID := range targets {
+			data, err := p.screenshot(ctx, sess, targetID)
+			if err == nil {
+				err = os.WriteFile(filepath.Join(dir, targetID+".png"), data, 0o644)
+			}
+			if err != nil {
+				p.metrics.add("browserd_error_screenshots_total", map[string]string{"result": "error"}, 1)
+				sess.log.Warn("failed to capture screenshot of failed session", "event", "error_screenshot_failed", "target_id", targetID, "error", err)
+				continue
+			}
+			p.metrics.add("browserd_error_screenshots_total", map[string]string{"result": "ok"}, 1)
+			names = append(names, targetID+".png")
+		}
+		if len(names) > 0 {
+			sess.log.Info("captured screenshots of failed session", "event", "error_screenshots", "cause", cause, "count", len(names))
+			sess.logf("captured %d screenshots after %s", len(names), cause)
+		}
+		sess.screenshots = names
+	})
+}
+
+// errorScreenshots lists the screenshots captureErrorScreenshots left in
+// a session's temp directory, by file name.
+func (t *tempStore) errorScreenshots(id string) []string {
+	entries, _ := os.ReadDir(filepath.Join(t.root, tempSessionsDir, id, tempScreenshots))
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && filepath.Ext(entry.Name()) == ".png" {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+)
+
+// evaluateRequest is the body of POST /api/evaluate. Either URL names a
+// page to load in a fresh context, or Session (and optionally Target)
+// names a live session's page to run the expression in.
+type evaluateRequest struct {
+	URL          string `json:"url"`
+	Session      string `json:"session"`
+	Target       string `json:"target"`
+	Expression   string `json:"expression"`
+	AwaitPromise bool   `json:"awaitPromise"`
+	Timeout      int    `json:"timeout"`
+}
+
+func (p *proxyServer) handleEvaluate(w http.ResponseWriter, r *http.Request) {
+	if !p.authorize(r) {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if p.draining.Load() {
+		writeErrorCode(w, http.StatusServiceUnavailable, errorCodeDraining, "draining", nil)
+		return
+	}
+	if !p.acquireAPI() {
+		p.rejectOverloaded(w, r, reasonMaxAPIRequests)
+		return
+	}
+	defer p.releaseAPI()
+
+	var req evaluateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		p.writeBodyError(w, err)
+		return
+	}
+	if req.Expression == "" {
+		writeError(w, http.StatusBadRequest, "expression is required")
+		return
+	}
+	if (req.URL == "") == (req.Session == "") {
+		writeError(w, http.StatusBadRequest, "exactly one of url and session is required")
+		return
+	}
+	if req.URL != "" {
+		if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			writeError(w, http.StatusBadRequest, "url must be an http(s) URL")
+			return
+		}
+		if reason := p.refuseNavigation(r, req.URL); reason != "" {
+			writeErrorCode(w, http.StatusForbidden, errorCodeNavigationBlocked, reason, nil)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), apiTimeout(req.Timeout))
+	defer cancel()
+
+	var page *apiPage
+	var err error
+	if req.URL != "" {
+		page, err = p.openPage(ctx)
+	} else {
+		sess := p.sessions.get(req.Session)
+		if sess == nil {
+			writeError(w, http.StatusNotFound, "session not found")
+			return
+		}
+		targetID, terr := sess.resolveTarget(req.Target)
+		if terr != nil {
+			writeError(w, targetErrorStatus(terr), terr.Error())
+			return
+		}
+		page, err = p.attachPage(ctx, sess, targetID)
+	}
+	if err != nil {
+		p.apiError(w, "evaluate", err)
+		return
+	}
+	defer page.close()
+
+	if req.URL != "" {
+		if err := page.navigate(ctx, req.URL, waitLoad); err != nil {
+			p.apiError(w, "evaluate", err)
+			return
+		}
+	}
+
+	result, err := page.evaluate(ctx, req.Expression, req.AwaitPromise)
+	if err != nil {
+		p.apiError(w, "evaluate", err)
+		return
+	}
+	p.metrics.add("browserd_api_requests_total", map[string]string{"endpoint": "evaluate", "status": "ok"}, 1)
+	writeJSON(w, http.StatusOK, result)
+}
+
+// apiError maps a failed API request to a status code and counts it.
+func (p *proxyServer) apiError(w http.ResponseWriter, endpoint string, err error) {
+	status, code := http.StatusBadGateway, ""
+	var scriptErr *scriptError
+	switch {
+	case errors.As(err, &scriptErr):
+		status, code = http.StatusUnprocessableEntity, errorCodeScriptError
+	case errors.Is(err, context.DeadlineExceeded):
+		status = http.StatusGatewayTimeout
+	case errors.Is(err, errPageDebugger):
+		status = http.StatusNotImplemented
+	}
+	if status == http.StatusBadGateway {
+		slog.Warn("api request failed", "endpoint", endpoint, "error", err)
+	}
+	p.metrics.add("browserd_api_requests_total", map[string]string{"endpoint": endpoint, "status": "error"}, 1)
+	writeErrorCode(w, status, code, err.Error(), nil)
+}
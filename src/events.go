@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// eventStreamBuffer bounds the events queued for one /admin/events
+	// subscriber; a subscriber that falls further behind misses events
+	// rather than slowing down sessions.
+	eventStreamBuffer    = 64
+	eventStreamKeepalive = 15 * time.Second
+)
+
+// eventBroker fans the events sent to webhooks out to /admin/events
+// subscribers as well.
+type eventBroker struct {
+	metrics *metricsRegistry
+
+	mu          sync.Mutex
+	nextID      int64
+	subscribers map[chan eventRecord]struct{}
+}
+
+// eventRecord is an event with its position in the stream.
+type eventRecord struct {
+	id    int64
+	event webhookEvent
+}
+
+func newEventBroker(metrics *metricsRegistry) *eventBroker {
+	metrics.register("browserd_event_subscribers", metricGauge, "Clients connected to /admin/events.")
+	metrics.register("browserd_event_stream_dropped_total", metricCounter, "Events an /admin/events subscriber missed by falling behind.")
+	return &eventBroker{metrics: metrics, subscribers: make(map[chan eventRecord]struct{})}
+}
+
+// active reports whether anyone is subscribed.
+func (b *eventBroker) active() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers) > 0
+}
+
+func (b *eventBroker) publish(event webhookEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	record := eventRecord{id: b.nextID, event: event}
+	for ch := range b.subscribers {
+		select {
+		case ch <- record:
+		default:
+			b.metrics.add("browserd_event_stream_dropped_total", nil, 1)
+		}
+	}
+}
+
+func (b *eventBroker) subscribe() chan eventRecord {
+	ch := make(chan eventRecord, eventStreamBuffer)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.metrics.set("browserd_event_subscribers", nil, float64(len(b.subscribers)))
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan eventRecord) {
+	b.mu.Lock()
+	delete(b.subscribers, ch)
+	b.metrics.set("browserd_event_subscribers", nil, float64(len(b.subscribers)))
+	b.mu.Unlock()
+}
+
+// notify stamps an event and hands it to the webhooks and the
+// /admin/events subscribers.
+func (p *proxyServer) notify(event webhookEvent) {
+	event.Time = time.Now().UTC()
+	p.webhooks.notify(event)
+	p.events.publish(event)
+}
+
+// handleEvents streams events as server-sent events until the client goes
+// away. ?event= narrows the stream to a comma-separated list of event
+// types, where "session.*" stands for every session event.
+func (p *proxyServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	filter := splitList(r.URL.Query().Get("event"))
+
+	ch := p.events.subscribe()
+	defer p.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep reverse proxies such as nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventStreamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case record := <-ch:
+			if !eventMatches(filter, record.event.Event) {
+				continue
+			}
+			data, err := json.Marshal(record.event)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", record.id, record.event.Event, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func eventMatches(filter []string, event string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, pattern := range filter {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(event, prefix) || pattern == event {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// primaryRecheckInterval is how long new sessions go straight to the
+// fallback after the primary failed, before the primary is tried again.
+const primaryRecheckInterval = 10 * time.Second
+
+// fallbackBackend is the secondary Chromium of -chromium-fallback. While the
+// primary can't be dialed, new sessions are sent here; the primary is
+// tried again every primaryRecheckInterval and takes new sessions once it
+// answers. Sessions stay on the backend they started on.
+type fallbackBackend struct {
+	endpoint *url.URL
+	static   bool
+
+	mu          sync.Mutex
+	debuggerURL string
+	// version is the Browser string of its /json/version, if it has one.
+	version string
+	// primaryDownAt is when dialing the primary last failed; zero while
+	// it is up.
+	primaryDownAt time.Time
+}
+
+func newFallbackBackend(raw string) (*fallbackBackend, error) {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	f := &fallbackBackend{endpoint: parsed}
+	switch parsed.Scheme {
+	case "http", "https":
+	case "ws", "wss":
+		f.static = true
+		f.debuggerURL = parsed.String()
+	default:
+		return nil, errors.New("fallback URL scheme must be http, https, ws or wss")
+	}
+	return f, nil
+}
+
+// primaryDue reports whether the primary should be tried: it is up, or it
+// has been down long enough to check again.
+func (f *fallbackBackend) primaryDue() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.primaryDownAt.IsZero() || time.Since(f.primaryDownAt) >= primaryRecheckInterval
+}
+
+// markPrimary records the outcome of dialing the primary and reports
+// whether that changed its state.
+func (f *fallbackBackend) markPrimary(err error) (changed bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	wasUp := f.primaryDownAt.IsZero()
+	if err != nil {
+		f.primaryDownAt = time.Now()
+		return wasUp
+	}
+	f.primaryDownAt = time.Time{}
+	return !wasUp
+}
+
+func (f *fallbackBackend) getDebuggerURL() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.debuggerURL
+}
+
+func (f *fallbackBackend) jsonEndpoint(path string) string {
+	endpoint := *f.endpoint
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + path
+	endpoint.RawQuery, endpoint.Fragment = "", ""
+	return endpoint.String()
+}
+
+// resolve refreshes the fallback's debugger URL through /json/version
+// unless it was given as a ws:// URL. It is looked up on every failover
+// because the fallback may have restarted since it was last used.
+func (f *fallbackBackend) resolve(ctx context.Context, client *http.Client) error {
+	if f.static {
+		return nil
+	}
+	info, err := fetchVersion(ctx, client, f.jsonEndpoint("/json/version"))
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.debuggerURL = info.WebSocketDebuggerURL
+	f.version = info.Browser
+	f.mu.Unlock()
+	return nil
+}
+
+// dialShared connects a session without a browser of its own to the
+// primary Chromium, or to the fallback when the primary is down. The
+// primary gets half the dial window so the fallback can still be reached
+// after a primary that hangs.
+func (p *proxyServer) dialShared(ctx context.Context, sess *session, subprotocols []string) (*websocket.Conn, *http.Response, error) {
+	if p.fallback == nil {
+		if err := p.ensureDebuggerURL(ctx); err != nil {
+			return nil, nil, err
+		}
+		return p.dial(ctx, p.sessionDebuggerURL(sess), subprotocols)
+	}
+
+	var primaryErr error
+	if sess != nil && sess.onPrimary {
+		if err := p.ensureDebuggerURL(ctx); err != nil {
+			return nil, nil, err
+		}
+		return p.dial(ctx, p.sessionDebuggerURL(sess), subprotocols)
+	}
+	if (sess == nil || !sess.onFallback) && p.health.healthy() && p.fallback.primaryDue() {
+		primaryCtx, cancel := context.WithTimeout(ctx, requestTimeout/2)
+		primaryErr = p.ensureDebuggerURL(primaryCtx)
+		if primaryErr == nil {
+			conn, resp, err := p.dial(primaryCtx, p.sessionDebuggerURL(sess), subprotocols)
+			cancel()
+			// A handshake the primary answered, even with an error such as
+			// an unknown target, shows it is up.
+			if err == nil || resp != nil {
+				if p.fallback.markPrimary(nil) {
+					slog.Info("primary chromium reachable again, failing back", "event", "backend_failback", "backend", p.versionEndpoint())
+					p.notify(webhookEvent{Event: eventBackendFailback, Backend: p.versionEndpoint()})
+				}
+				return conn, resp, err
+			}
+			primaryErr = err
+		} else {
+			cancel()
+		}
+		if p.fallback.markPrimary(primaryErr) {
+			slog.Warn("primary chromium unreachable, failing over", "event", "backend_failover", "backend", p.versionEndpoint(), "fallback", p.fallback.endpoint.Redacted(), "error", primaryErr)
+			p.metrics.add("browserd_backend_failovers_total", nil, 1)
+			p.notify(webhookEvent{Event: eventBackendFailover, Backend: p.fallback.endpoint.Redacted(), Error: primaryErr.Error()})
+		}
+	}
+
+	if err := p.fallback.resolve(ctx, p.client); err != nil {
+		return nil, nil, fallbackError(primaryErr, err)
+	}
+	target := p.fallback.getDebuggerURL()
+	if sess != nil {
+		sess.onFallback = true
+		target = p.sessionDebuggerURL(sess)
+	}
+	conn, resp, err := p.dial(ctx, target, subprotocols)
+	if err != nil {
+		return nil, resp, fallbackError(primaryErr, err)
+	}
+	return conn, resp, nil
+}
+
+func fallbackError(primary, fallback error) error {
+	if primary == nil {
+		return fmt.Errorf("fallback: %w", fallback)
+	}
+	return fmt.Errorf("primary: %v; fallback: %w", primary, fallback)
+}
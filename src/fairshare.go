@@ -0,0 +1,171 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultHeavyMethods are the CDP commands -fair-share schedules: ones
+// that keep the browser busy for long enough that a burst of them from one
+// session holds up everyone else's commands.
+const defaultHeavyMethods = "DOMSnapshot.*,Page.captureScreenshot,Page.captureSnapshot,Page.printToPDF,Tracing.start,Tracing.end,HeapProfiler.takeHeapSnapshot,Accessibility.getFullAXTree,DOM.getFlattenedDocument"
+
+// fairScheduler interleaves the heavy commands of the sessions sharing a
+// browser. At most slots of them run at once; when one finishes, the slot
+// goes to the waiting session with the fewest heavy commands already
+// running, the longest-waiting one first among equals, so a session
+// firing screenshots in a loop takes turns with one that needs a single
+// snapshot instead of queueing it behind the whole loop. Other commands
+// aren't held, except behind a heavy command of their own session, whose
+// order the client relies on.
+type fairScheduler struct {
+	methods []string
+	slots   int
+
+	mu      sync.Mutex
+	running int
+	// active counts each session's heavy commands running.
+	active  map[*session]int
+	waiting []*fairWaiter
+}
+
+type fairWaiter struct {
+	sess    *session
+	granted chan struct{}
+}
+
+func newFairScheduler(slots int, methods []string) *fairScheduler {
+	return &fairScheduler{methods: methods, slots: slots, active: make(map[*session]int)}
+}
+
+// heavy reports whether method is one the scheduler takes turns with.
+func (f *fairScheduler) heavy(method string) bool {
+	return method != "" && matchesName(f.methods, method)
+}
+
+// acquire blocks until sess may run a heavy command, reporting how long
+// it waited, or false when done is closed first.
+func (f *fairScheduler) acquire(sess *session, done <-chan struct{}) (time.Duration, bool) {
+	f.mu.Lock()
+	if f.running < f.slots && len(f.waiting) == 0 {
+		f.running++
+		f.active[sess]++
+		f.mu.Unlock()
+		return 0, true
+	}
+	w := &fairWaiter{sess: sess, granted: make(chan struct{})}
+	f.waiting = append(f.waiting, w)
+	f.mu.Unlock()
+
+	start := time.Now()
+	select {
+	case <-w.granted:
+		return time.Since(start), true
+	case <-done:
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for i, waiting := range f.waiting {
+			if waiting == w {
+				f.waiting = append(f.waiting[:i], f.waiting[i+1:]...)
+				return 0, false
+			}
+		}
+		// Granted as the relay stopped; hand the slot on.
+		f.releaseLocked(sess)
+		return 0, false
+	}
+}
+
+// release frees a slot sess held and grants it to the next waiter.
+func (f *fairScheduler) release(sess *session) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.releaseLocked(sess)
+}
+
+func (f *fairScheduler) releaseLocked(sess *session) {
+	f.running--
+	if f.active[sess]--; f.active[sess] <= 0 {
+		delete(f.active, sess)
+	}
+	for f.running < f.slots && len(f.waiting) > 0 {
+		next := 0
+		for i, w := range f.waiting {
+			if f.active[w.sess] < f.active[f.waiting[next].sess] {
+				next = i
+			}
+		}
+		w := f.waiting[next]
+		f.waiting = append(f.waiting[:next], f.waiting[next+1:]...)
+		f.running++
+		f.active[w.sess]++
+		close(w.granted)
+	}
+}
+
+// waitTurn holds the client pump back until a heavy command in msg may be
+// sent, and remembers it so its response frees the slot. It reports
+// false when the relay stopped meanwhile.
+func (r *relay) waitTurn(msg *cdpMessage) bool {
+	if r.fair == nil || msg.ID == nil || !r.fair.heavy(msg.Method) {
+		return true
+	}
+	waited, ok := r.fair.acquire(r.sess, r.done)
+	if !ok {
+		return false
+	}
+	if r.onFairWait != nil {
+		r.onFairWait(msg.Method, waited)
+	}
+	key := commandKey{sessionID: msg.SessionID, id: *msg.ID}
+	r.fairMu.Lock()
+	if r.fairRunning[key] {
+		// A client reusing an ID it is still waiting on holds one slot.
+		r.fair.release(r.sess)
+	}
+	r.fairRunning[key] = true
+	r.fairMu.Unlock()
+	return true
+}
+
+// endTurn frees the slot of the heavy command msg answers, if it is one.
+func (r *relay) endTurn(msg *cdpMessage) {
+	if msg.ID == nil || msg.Method != "" {
+		return
+	}
+	r.endTurnFor(commandKey{sessionID: msg.SessionID, id: *msg.ID})
+}
+
+func (r *relay) endTurnFor(key commandKey) {
+	r.fairMu.Lock()
+	defer r.fairMu.Unlock()
+	if r.fairRunning[key] {
+		delete(r.fairRunning, key)
+		r.fair.release(r.sess)
+	}
+}
+
+// runningHeavy reports whether the session has heavy commands whose
+// responses must be looked for.
+func (r *relay) runningHeavy() bool {
+	if r.fair == nil {
+		return false
+	}
+	r.fairMu.Lock()
+	defer r.fairMu.Unlock()
+	return len(r.fairRunning) > 0
+}
+
+// endTurns frees the slots of heavy commands still running when the relay
+// ends, since their responses will never be read.
+func (r *relay) endTurns() {
+	if r.fair == nil {
+		return
+	}
+	r.fairMu.Lock()
+	defer r.fairMu.Unlock()
+	for key := range r.fairRunning {
+		delete(r.fairRunning, key)
+		r.fair.release(r.sess)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// proxyFetchPattern is what browserd itself intercepts on each page target
+// when request policies are active.
+var proxyFetchPattern = requestPattern{URLPattern: "*", RequestStage: "Request"}
+
+// requestPattern mirrors Fetch.RequestPattern.
+type requestPattern struct {
+	URLPattern   string `json:"urlPattern,omitempty"`
+	ResourceType string `json:"resourceType,omitempty"`
+	RequestStage string `json:"requestStage,omitempty"`
+}
+
+type fetchEnableParams struct {
+	Patterns           []requestPattern `json:"patterns,omitempty"`
+	HandleAuthRequests bool             `json:"handleAuthRequests,omitempty"`
+}
+
+// pausedRequest is the payload of Fetch.requestPaused.
+type pausedRequest struct {
+	RequestID string `json:"requestId"`
+	Request   struct {
+		URL     string            `json:"url"`
+		Method  string            `json:"method"`
+		Headers map[string]string `json:"headers"`
+	} `json:"request"`
+	ResourceType        string `json:"resourceType"`
+	ResponseStatusCode  *int   `json:"responseStatusCode,omitempty"`
+	ResponseErrorReason string `json:"responseErrorReason,omitempty"`
+}
+
+func (r *pausedRequest) requestStage() bool {
+	return r.ResponseStatusCode == nil && r.ResponseErrorReason == ""
+}
+
+// fetchDecision is the Fetch command browserd answers a paused request with.
+type fetchDecision struct {
+	method string
+	params map[string]any
+}
+
+// requestPolicy inspects a paused request and returns a decision, or nil to
+// leave it to later policies and, finally, the client.
+type requestPolicy func(req *pausedRequest) *fetchDecision
+
+func failRequest(reason string) *fetchDecision {
+	return &fetchDecision{method: "Fetch.failRequest", params: map[string]any{"errorReason": reason}}
+}
+
+// fetchEnableCommand is the init command that turns on interception for
+// browserd's own policies and the credentials it answers challenges with.
+func (r *relay) fetchEnableCommand() cdpCommand {
+	params, _ := json.Marshal(fetchEnableParams{Patterns: []requestPattern{proxyFetchPattern}, HandleAuthRequests: r.handlesAuth()})
+	return cdpCommand{Method: "Fetch.enable", Params: params}
+}
+
+// onRequestPaused applies the session's request policies. It reports
+// whether the event should still be forwarded to the client, which is the
+// case only when the client enabled Fetch for a matching pattern itself.
+// data is the event's frame.
+func (r *relay) onRequestPaused(msg cdpMessage, data []byte) bool {
+	var req pausedRequest
+	if err := json.Unmarshal(msg.Params, &req); err != nil {
+		return true
+	}
+	if !req.requestStage() || r.guard == nil || r.guard.decided(req.Request.URL) {
+		return r.decidePaused(msg, &req)
+	}
+
+	// The guard has to look the host up, which mustn't hold up the read
+	// loop. When the client may get the event, later frames are held back
+	// behind it so it still sees them in order.
+	slot := -1
+	if r.clientIntercepts(msg.SessionID, &req) {
+		slot = r.reserve()
+	}
+	go func() {
+		r.guard.check(req.Request.URL)
+		forward := r.decidePaused(msg, &req)
+		if slot < 0 {
+			return
+		}
+		if !forward {
+			data = nil
+		} else if len(r.middleware) > 0 {
+			f := relayFrame{sess: r.sess, dir: toClient, msgType: websocket.TextMessage, data: data}
+			if r.middleware.handle(&f) {
+				data = f.data
+			} else {
+				data = nil
+			}
+		}
+		r.fill(slot, data)
+	}()
+	return false
+}
+
+// decidePaused answers a paused request with the first policy decision,
+// or reports that the client gets it, or continues it.
+func (r *relay) decidePaused(msg cdpMessage, req *pausedRequest) bool {
+	if req.requestStage() {
+		for _, policy := range r.policies {
+			if decision := policy(req); decision != nil {
+				decision.params["requestId"] = req.RequestID
+				go r.send(msg.SessionID, decision.method, decision.params)
+				return false
+			}
+		}
+	}
+
+	if r.clientIntercepts(msg.SessionID, req) {
+		return true
+	}
+
+	method := "Fetch.continueRequest"
+	if !req.requestStage() {
+		method = "Fetch.continueResponse"
+	}
+	go r.send(msg.SessionID, method, map[string]any{"requestId": req.RequestID})
+	return false
+}
+
+// send issues a fire-and-forget command whose response is swallowed.
+func (r *relay) send(sessionID, method string, params map[string]any) {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if resp, err := r.call(ctx, sessionID, method, raw); err != nil {
+		r.sess.log.Warn("cdp command failed", "method", method, "error", err)
+	} else if len(resp.Error) > 0 {
+		r.sess.logf("%s returned error: %s", method, resp.Error)
+	}
+}
+
+// rewriteClientFetch keeps browserd's interception in place when the client
+// toggles Fetch itself: its patterns are recorded and merged with ours, and
+// a Fetch.disable becomes a Fetch.enable with only browserd's pattern.
+func (r *relay) rewriteClientFetch(msg *cdpMessage) bool {
+	switch msg.Method {
+	case "Fetch.enable":
+		var params fetchEnableParams
+		if len(msg.Params) > 0 {
+			if err := json.Unmarshal(msg.Params, &params); err != nil {
+				return false
+			}
+		}
+		patterns := params.Patterns
+		if len(patterns) == 0 {
+			patterns = []requestPattern{{URLPattern: "*"}}
+		}
+		r.fetchMu.Lock()
+		r.clientFetch[msg.SessionID] = patterns
+		r.clientAuth[msg.SessionID] = params.HandleAuthRequests
+		r.fetchMu.Unlock()
+
+		params.Patterns = append(append([]requestPattern(nil), patterns...), proxyFetchPattern)
+		params.HandleAuthRequests = params.HandleAuthRequests || r.handlesAuth()
+		msg.Params, _ = json.Marshal(params)
+		return true
+
+	case "Fetch.disable":
+		r.fetchMu.Lock()
+		delete(r.clientFetch, msg.SessionID)
+		delete(r.clientAuth, msg.SessionID)
+		r.fetchMu.Unlock()
+
+		cmd := r.fetchEnableCommand()
+		msg.Method, msg.Params = cmd.Method, cmd.Params
+		return true
+	}
+	return false
+}
+
+func (r *relay) clientIntercepts(sessionID string, req *pausedRequest) bool {
+	r.fetchMu.Lock()
+	patterns := r.clientFetch[sessionID]
+	r.fetchMu.Unlock()
+
+	for _, pattern := range patterns {
+		if pattern.matches(req) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p requestPattern) matches(req *pausedRequest) bool {
+	stage := p.RequestStage
+	if stage == "" {
+		stage = "Request"
+	}
+	if (stage == "Request") != req.requestStage() {
+		return false
+	}
+	if p.ResourceType != "" && p.ResourceType != req.ResourceType {
+		return false
+	}
+	urlPattern := p.URLPattern
+	if urlPattern == "" {
+		urlPattern = "*"
+	}
+	return wildcardMatch(urlPattern, req.Request.URL)
+}
+
+// wildcardMatch implements the Fetch urlPattern syntax: '*' matches any run
+// of characters, '?' a single character, and '\' escapes the next one.
+func wildcardMatch(pattern, s string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if !strings.ContainsAny(pattern, `*?\`) {
+		return pattern == s
+	}
+
+	px, sx := 0, 0
+	starPx, starSx := -1, 0
+	for sx < len(s) {
+		if px < len(pattern) {
+			switch c := pattern[px]; {
+			case c == '*':
+				starPx, starSx = px, sx
+				px++
+				continue
+			case c == '?':
+				px++
+				sx++
+				continue
+			case c == '\\' && px+1 < len(pattern):
+				if pattern[px+1] == s[sx] {
+					px += 2
+					sx++
+					continue
+				}
+			case c == s[sx]:
+				px++
+				sx++
+				continue
+			}
+		}
+		if starPx < 0 {
+			return false
+		}
+		starSx++
+		px, sx = starPx+1, starSx
+	}
+	for px < len(pattern) && pattern[px] == '*' {
+		px++
+	}
+	return px == len(pattern)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// flagProfile is one entry of the -flag-profiles file: Chromium flags a
+// session can ask for with ?flags=<name>. Omit names default flags to
+// leave out, such as --disable-gpu for a GPU profile, since Chromium has no
+// way to turn most of them off again later on the command line.
+type flagProfile struct {
+	name string
+	Args []string `json:"args"`
+	Omit []string `json:"omit,omitempty"`
+	// DNSResolver replaces -dns-resolver, and HostRules go before
+	// -host-rules, in the profile's browsers.
+	DNSResolver string   `json:"dnsResolver,omitempty"`
+	HostRules   []string `json:"hostRules,omitempty"`
+}
+
+// reservedFlags are set by browserd for every browser it launches and
+// can't be changed by a profile.
+var reservedFlags = []string{
+	"--remote-debugging-address",
+	"--remote-debugging-port",
+	"--user-data-dir",
+	"--host-resolver-rules",
+}
+
+// loadFlagProfiles reads a JSON object of profile names to flag profiles,
+// e.g. {"low-memory": {"args": ["--renderer-process-limit=1"]}}.
+func loadFlagProfiles(path string) (map[string]*flagProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var profiles map[string]*flagProfile
+	if err := unmarshalConfig(data, &profiles); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for name, profile := range profiles {
+		if !profileNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("parse %s: invalid profile name %q", path, name)
+		}
+		if profile == nil {
+			return nil, fmt.Errorf("parse %s: profile %q is empty", path, name)
+		}
+		for _, arg := range append(profile.Args, profile.Omit...) {
+			if !strings.HasPrefix(arg, "--") {
+				return nil, fmt.Errorf("parse %s: profile %q: %q is not a -- flag", path, name, arg)
+			}
+			for _, reserved := range reservedFlags {
+				if flagName(arg) == reserved {
+					return nil, fmt.Errorf("parse %s: profile %q can't set %s", path, name, reserved)
+				}
+			}
+		}
+		if profile.DNSResolver != "" {
+			if err := parseDNSResolver(profile.DNSResolver); err != nil {
+				return nil, fmt.Errorf("parse %s: profile %q: %w", path, name, err)
+			}
+		}
+		if len(profile.HostRules) > 0 {
+			if profile.HostRules, err = parseHostRules(strings.Join(profile.HostRules, ",")); err != nil {
+				return nil, fmt.Errorf("parse %s: profile %q: %w", path, name, err)
+			}
+		}
+		profile.name = name
+	}
+	return profiles, nil
+}
+
+// apply returns args without the omitted flags and with the profile's own
+// appended, its host rules ahead of those already in args.
+func (f *flagProfile) apply(args []string) []string {
+	if f == nil {
+		return args
+	}
+	hostRules := f.HostRules
+	out := make([]string, 0, len(args)+len(f.Args)+2)
+	for _, arg := range args {
+		omitted := false
+		for _, omit := range f.Omit {
+			if flagName(arg) == flagName(omit) {
+				omitted = true
+				break
+			}
+		}
+		if flagName(arg) == "--host-resolver-rules" {
+			hostRules = append(slices.Clone(hostRules), strings.TrimPrefix(arg, "--host-resolver-rules="))
+			omitted = true
+		}
+		if !omitted {
+			out = append(out, arg)
+		}
+	}
+	out = append(out, f.Args...)
+	out = append(out, dnsConfig{resolver: f.DNSResolver, hostRules: hostRules}.args()...)
+	return mergeFeatureFlags(out)
+}
+
+// flagName is a Chromium flag without its =value.
+func flagName(arg string) string {
+	name, _, _ := strings.Cut(arg, "=")
+	return name
+}
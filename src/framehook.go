@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// frameHookRestartDelay spaces out restarts of a hook that keeps
+	// exiting; frames in between are handled as failures.
+	frameHookRestartDelay = time.Second
+	frameHookMaxLine      = 64 << 20
+)
+
+// What -frame-hook-on-failure does with a frame the hook didn't answer.
+const (
+	frameHookForward = "forward"
+	frameHookDrop    = "drop"
+	frameHookClose   = "close"
+)
+
+// frameHookRequest is the line written to the hook for each text frame.
+type frameHookRequest struct {
+	ID        int64             `json:"id"`
+	Session   string            `json:"session"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Direction string            `json:"direction"`
+	Frame     string            `json:"frame"`
+}
+
+// frameHookReply is the hook's answer: "drop" drops the frame, anything
+// else forwards it, replaced by Frame when that is set.
+type frameHookReply struct {
+	ID     int64   `json:"id"`
+	Action string  `json:"action"`
+	Frame  *string `json:"frame"`
+}
+
+// frameHook is a middleware handing frames to an operator-supplied program
+// for -frame-hook. The program is started once and exchanges one JSON
+// object per line on stdin and stdout; replies are matched by id, so it
+// may answer out of order. A frame it hasn't answered within the budget,
+// like every frame while it isn't running, is handled as onFailure says:
+// forwarded unchanged, dropped, or dropped with its session closed.
+type frameHook struct {
+	command   []string
+	budget    time.Duration
+	onFailure string
+	metrics   *metricsRegistry
+
+	mu        sync.Mutex
+	stdin     *os.File
+	startedAt time.Time
+
+	nextID    atomic.Int64
+	pendingMu sync.Mutex
+	pending   map[int64]chan frameHookReply
+}
+
+func newFrameHook(command []string, budget time.Duration, onFailure string, metrics *metricsRegistry) (*frameHook, error) {
+	if len(command) == 0 {
+		return nil, errors.New("empty command")
+	}
+	if _, err := exec.LookPath(command[0]); err != nil {
+		return nil, err
+	}
+	if onFailure == "" {
+		onFailure = frameHookForward
+	}
+	switch onFailure {
+	case frameHookForward, frameHookDrop, frameHookClose:
+	default:
+		return nil, fmt.Errorf("unknown -frame-hook-on-failure %q: must be forward, drop or close", onFailure)
+	}
+	metrics.register("browserd_frame_hook_failures_total", metricCounter, "Frames -frame-hook failed to answer, by reason and what -frame-hook-on-failure did with them.")
+	metrics.register("browserd_frame_hook_dropped_total", metricCounter, "Frames -frame-hook dropped.")
+	return &frameHook{command: command, budget: budget, onFailure: onFailure, metrics: metrics, pending: make(map[int64]chan frameHookReply)}, nil
+}
+
+func (h *frameHook) handleFrame(f *relayFrame) bool {
+	if f.msgType != websocket.TextMessage {
+		return true
+	}
+	direction := "client"
+	if f.dir == toClient {
+		direction = "upstream"
+	}
+	req := frameHookRequest{ID: h.nextID.Add(1), Session: f.sess.id, Labels: f.sess.labels, Direction: direction, Frame: string(f.data)}
+	line, err := json.Marshal(req)
+	if err != nil {
+		return true
+	}
+
+	ch := make(chan frameHookReply, 1)
+	h.pendingMu.Lock()
+	h.pending[req.ID] = ch
+	h.pendingMu.Unlock()
+	defer func() {
+		h.pendingMu.Lock()
+		delete(h.pending, req.ID)
+		h.pendingMu.Unlock()
+	}()
+
+	if err := h.write(append(line, '\n')); err != nil {
+		return h.failed(f, "unavailable")
+	}
+
+	timer := time.NewTimer(h.budget)
+	defer timer.Stop()
+	select {
+	case reply := <-ch:
+		if reply.Action == "drop" {
+			h.metrics.add("browserd_frame_hook_dropped_total", nil, 1)
+			return false
+		}
+		if reply.Frame != nil {
+			f.data = []byte(*reply.Frame)
+		}
+		return true
+	case <-timer.C:
+		return h.failed(f, "timeout")
+	}
+}
+
+// failed counts a frame the hook didn't answer and reports whether to
+// forward it. Closing the session happens off the relay, which is in the
+// middle of the frame.
+func (h *frameHook) failed(f *relayFrame, reason string) bool {
+	h.metrics.add("browserd_frame_hook_failures_total", map[string]string{"reason": reason, "action": h.onFailure}, 1)
+	switch h.onFailure {
+	case frameHookDrop:
+		return false
+	case frameHookClose:
+		f.sess.log.Warn("closing session: frame hook failed", "event", "frame_hook_closed", "reason", reason)
+		go f.sess.disconnect(closeUpstreamUnavailable, "frame hook unavailable")
+		return false
+	}
+	return true
+}
+
+// write sends a request line, starting the hook first if it isn't running.
+func (h *frameHook) write(line []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stdin == nil {
+		if time.Since(h.startedAt) < frameHookRestartDelay {
+			return errors.New("frame hook restarting")
+		}
+		if err := h.startLocked(); err != nil {
+			slog.Error("failed to start frame hook", "event", "frame_hook_failed", "error", err)
+			return err
+		}
+	}
+	// A hook that stops reading must not stall every relay behind it.
+	_ = h.stdin.SetWriteDeadline(time.Now().Add(h.budget))
+	if _, err := h.stdin.Write(line); err != nil {
+		_ = h.stdin.Close()
+		h.stdin = nil
+		return err
+	}
+	return nil
+}
+
+func (h *frameHook) startLocked() error {
+	h.startedAt = time.Now()
+	cmd := exec.Command(h.command[0], h.command[1:]...)
+	cmd.Stderr = os.Stderr
+	// An os.Pipe rather than cmd.StdinPipe, so writes can time out.
+	reader, stdin, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = reader
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		_ = reader.Close()
+		_ = stdin.Close()
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		_ = reader.Close()
+		_ = stdin.Close()
+		return err
+	}
+	_ = reader.Close()
+	h.stdin = stdin
+	slog.Info("frame hook started", "event", "frame_hook_started", "pid", cmd.Process.Pid)
+
+	go func() {
+		h.readReplies(stdout)
+		err := cmd.Wait()
+		slog.Warn("frame hook exited", "event", "frame_hook_exited", "error", err)
+		h.mu.Lock()
+		if h.stdin == stdin {
+			h.stdin = nil
+		}
+		h.mu.Unlock()
+		_ = stdin.Close()
+	}()
+	return nil
+}
+
+func (h *frameHook) readReplies(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64<<10), frameHookMaxLine)
+	for scanner.Scan() {
+		var reply frameHookReply
+		if err := json.Unmarshal(scanner.Bytes(), &reply); err != nil {
+			// The frame it was meant for fails once its budget is up.
+			h.metrics.add("browserd_frame_hook_failures_total", map[string]string{"reason": "invalid"}, 1)
+			continue
+		}
+		h.pendingMu.Lock()
+		ch := h.pending[reply.ID]
+		h.pendingMu.Unlock()
+		if ch != nil {
+			select {
+			case ch <- reply:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestFrameHookFailureCloses(t *testing.T) {
+	// true exits at once, so every frame finds the hook down or unanswered.
+	h := newHarness(t, proxyConfig{frameHook: []string{"true"}, frameHookBudget: 50 * time.Millisecond, frameHookOnFailure: frameHookClose})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, _, err := h.connect(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.WriteJSON(map[string]any{"id": 1, "method": "Browser.getVersion"}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		var msg cdpMessage
+		if err = client.ReadJSON(&msg); err != nil {
+			break
+		}
+		if msg.ID != nil && *msg.ID == 1 {
+			t.Fatal("command reached the browser")
+		}
+	}
+	if !websocket.IsCloseError(err, closeUpstreamUnavailable) {
+		t.Fatalf("read: %v, want close %d", err, closeUpstreamUnavailable)
+	}
+}
+
+func TestFrameHookFailureDrops(t *testing.T) {
+	rt := newRelayTest(t, proxyConfig{frameHook: []string{"true"}, frameHookBudget: 50 * time.Millisecond, frameHookOnFailure: frameHookDrop}, nil)
+	rt.send(1, "Browser.getVersion", nil)
+	if msg, ok := rt.read(time.Second); ok {
+		t.Fatalf("got %+v, want the command dropped", msg)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+)
+
+// JSON-RPC error codes for client frames -validate-frames rejects.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+)
+
+// frameError is why a client frame was rejected, with as much of its id
+// and sessionId as could be read so the client can match the error up.
+type frameError struct {
+	id        *int64
+	sessionID string
+	code      int
+	reason    string
+}
+
+// validateFrame checks that a client frame is a CDP command Chromium can
+// parse: a JSON object with an integer id below the range browserd's own
+// commands use, a method name, and optionally object params and a string
+// sessionId. It returns nil for a valid frame.
+func validateFrame(msgType int, data []byte) *frameError {
+	if msgType != websocket.TextMessage {
+		return &frameError{code: rpcInvalidRequest, reason: "binary frames are not CDP commands"}
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil || fields == nil {
+		return &frameError{code: rpcParseError, reason: "frame is not a JSON object"}
+	}
+
+	fe := &frameError{code: rpcInvalidRequest}
+	if raw, ok := fields["sessionId"]; ok {
+		if err := json.Unmarshal(raw, &fe.sessionID); err != nil {
+			fe.reason = "sessionId must be a string"
+			return fe
+		}
+	}
+	var id int64
+	raw, ok := fields["id"]
+	switch {
+	case !ok:
+		fe.reason = "missing id"
+		return fe
+	case json.Unmarshal(raw, &id) != nil:
+		fe.reason = "id must be an integer"
+		return fe
+	case id < 0 || id >= injectedIDBase:
+		fe.reason = "id out of range"
+		return fe
+	}
+	fe.id = &id
+
+	var method string
+	if err := json.Unmarshal(fields["method"], &method); err != nil || method == "" {
+		fe.reason = "method must be a non-empty string"
+		return fe
+	}
+	if params, ok := fields["params"]; ok && !bytes.HasPrefix(bytes.TrimSpace(params), []byte("{")) {
+		fe.reason = "params must be an object"
+		return fe
+	}
+	return nil
+}
+
+// replyInvalid answers a rejected client frame with a JSON-RPC error.
+func (r *relay) replyInvalid(fe *frameError) error {
+	payload, _ := json.Marshal(map[string]any{"code": fe.code, "message": fe.reason})
+	reply, err := json.Marshal(cdpMessage{ID: fe.id, SessionID: fe.sessionID, Error: payload})
+	if err != nil {
+		return err
+	}
+	return r.writeClient(websocket.TextMessage, reply)
+}
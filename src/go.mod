@@ -3,3 +3,9 @@ module chromiumproxy
 go 1.25.4
 
 require github.com/gorilla/websocket v1.5.3
+
+require (
+	golang.org/x/crypto v0.55.0
+	golang.org/x/net v0.57.0 // indirect
+	golang.org/x/text v0.41.0 // indirect
+)
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gRPC status codes used by the admin service.
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcNotFound          = 5
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcUnauthenticated   = 16
+)
+
+const (
+	grpcAdminService  = "/browserd.admin.v1.Admin/"
+	maxGRPCMessageLen = 1 << 20
+)
+
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string {
+	return e.message
+}
+
+// serveGRPC serves the Admin service of proto/browserd/admin/v1/admin.proto
+// on ln over plaintext HTTP/2 until ctx is cancelled. The handful of
+// messages is encoded by hand, so browserd needs no protobuf or gRPC
+// modules; clients generated from the proto file work unchanged.
+func (p *proxyServer) serveGRPC(ctx context.Context, ln net.Listener) {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{
+		Handler:   http.HandlerFunc(p.handleGRPC),
+		Protocols: &protocols,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("grpc server shutdown error", "error", err)
+		}
+	}()
+
+	slog.Info("grpc admin api listening", "event", "listening", "addr", ln.Addr().String())
+	if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("grpc server failed", "error", err)
+	}
+}
+
+func (p *proxyServer) handleGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+
+	resp, err := p.callGRPC(r)
+	if err == nil {
+		frame := make([]byte, 5, 5+len(resp))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(resp)))
+		_, err = w.Write(append(frame, resp...))
+	}
+
+	code := grpcOK
+	var gerr *grpcError
+	if errors.As(err, &gerr) {
+		code = gerr.code
+		w.Header().Set("Grpc-Message", grpcPercentEncode(gerr.message))
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	p.metrics.add("browserd_grpc_requests_total", map[string]string{
+		"method": strings.TrimPrefix(r.URL.Path, grpcAdminService),
+		"code":   strconv.Itoa(code),
+	}, 1)
+}
+
+// callGRPC reads the single request message and runs the method.
+func (p *proxyServer) callGRPC(r *http.Request) ([]byte, error) {
+	if !p.authorizeAdmin(r) {
+		return nil, &grpcError{grpcUnauthenticated, "unauthorized"}
+	}
+	method, ok := strings.CutPrefix(r.URL.Path, grpcAdminService)
+	if !ok {
+		return nil, &grpcError{grpcUnimplemented, "unknown service"}
+	}
+	req, err := readGRPCMessage(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := parseProto(req)
+	if err != nil {
+		return nil, &grpcError{grpcInvalidArgument, err.Error()}
+	}
+
+	switch method {
+	case "ListSessions":
+		var resp []byte
+		for _, s := range p.allSessions() {
+			resp = appendMessageField(resp, 1, encodeSessionView(s.view()))
+		}
+		return resp, nil
+
+	case "KillSession":
+		var id string
+		for _, f := range fields {
+			if f.number == 1 && f.wire == wireBytes {
+				id = string(f.data)
+			}
+		}
+		sess := p.findSession(id)
+		if sess == nil {
+			return nil, &grpcError{grpcNotFound, "session not found"}
+		}
+		sess.log.Info("session killed via grpc", "operator_ip", clientIP(r.RemoteAddr))
+		sess.kill()
+		return nil, nil
+
+	case "Drain":
+		draining := false
+		for _, f := range fields {
+			if f.number == 1 && f.wire == wireVarint {
+				draining = f.value != 0
+			}
+		}
+		p.setDrained(draining)
+		slog.Info("drain set via grpc", "draining", draining, "operator_ip", clientIP(r.RemoteAddr))
+		var resp []byte
+		resp = appendBoolField(resp, 1, draining)
+		resp = appendIntField(resp, 2, int64(len(p.allSessions())))
+		return resp, nil
+
+	case "PoolStatus":
+		var resp []byte
+		if p.pool != nil {
+			ready, starting, assigned := p.pool.counts()
+			resp = appendIntField(resp, 1, int64(p.pool.size))
+			resp = appendIntField(resp, 2, int64(ready))
+			resp = appendIntField(resp, 3, int64(starting))
+			resp = appendIntField(resp, 4, int64(assigned))
+		}
+		return resp, nil
+	}
+	return nil, &grpcError{grpcUnimplemented, fmt.Sprintf("unknown method %q", method)}
+}
+
+// readGRPCMessage reads one length-prefixed message from a unary call.
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "missing request message"}
+	}
+	if prefix[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, "compressed messages are not supported"}
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxGRPCMessageLen {
+		return nil, &grpcError{grpcResourceExhausted, "request message too large"}
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "truncated request message"}
+	}
+	return msg, nil
+}
+
+// encodeSessionView encodes a browserd.admin.v1.Session.
+func encodeSessionView(v sessionView) []byte {
+	var b []byte
+	b = appendStringField(b, 1, v.ID)
+	b = appendStringField(b, 2, v.RemoteAddr)
+	b = appendTimestampField(b, 3, v.StartedAt)
+	keys := make([]string, 0, len(v.Labels))
+	for key := range v.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var entry []byte
+		entry = appendStringField(entry, 1, key)
+		entry = appendStringField(entry, 2, v.Labels[key])
+		b = appendMessageField(b, 4, entry)
+	}
+	b = appendStringField(b, 5, v.Proxy)
+	b = appendStringField(b, 6, v.Device)
+	b = appendBoolField(b, 7, v.Stealth)
+	b = appendBoolField(b, 8, v.Exclusive)
+	b = appendStringField(b, 9, v.Profile)
+	for _, target := range v.Targets {
+		b = appendTag(b, 10, wireBytes)
+		b = appendVarint(b, uint64(len(target)))
+		b = append(b, target...)
+	}
+	b = appendBoolField(b, 11, v.Fallback)
+	b = appendStringField(b, 12, v.Flags)
+	b = appendTimestampField(b, 13, v.LastActivity)
+	return b
+}
+
+// grpcPercentEncode escapes a grpc-message value as the gRPC spec asks.
+func grpcPercentEncode(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 0x20 && c <= 0x7e && c != '%' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
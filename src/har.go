@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HAR 1.2, as far as a session's Network events fill it in.
+type (
+	harLog struct {
+		Log harBody `json:"log"`
+	}
+	harBody struct {
+		Version string     `json:"version"`
+		Creator harCreator `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	}
+	harCreator struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	harEntry struct {
+		StartedDateTime time.Time   `json:"startedDateTime"`
+		Time            float64     `json:"time"`
+		Request         harRequest  `json:"request"`
+		Response        harResponse `json:"response"`
+		Cache           struct{}    `json:"cache"`
+		Timings         harTimings  `json:"timings"`
+		// Comment carries Chromium's errorText for failed requests.
+		Comment string `json:"comment,omitempty"`
+	}
+	harRequest struct {
+		Method      string      `json:"method"`
+		URL         string      `json:"url"`
+		HTTPVersion string      `json:"httpVersion"`
+		Cookies     []harPair   `json:"cookies"`
+		Headers     []harPair   `json:"headers"`
+		QueryString []harPair   `json:"queryString"`
+		PostData    *harPayload `json:"postData,omitempty"`
+		HeadersSize int         `json:"headersSize"`
+		BodySize    int         `json:"bodySize"`
+	}
+	harResponse struct {
+		Status      int        `json:"status"`
+		StatusText  string     `json:"statusText"`
+		HTTPVersion string     `json:"httpVersion"`
+		Cookies     []harPair  `json:"cookies"`
+		Headers     []harPair  `json:"headers"`
+		Content     harPayload `json:"content"`
+		RedirectURL string     `json:"redirectURL"`
+		HeadersSize int        `json:"headersSize"`
+		BodySize    int        `json:"bodySize"`
+	}
+	harPair struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	harPayload struct {
+		Size     int    `json:"size"`
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text,omitempty"`
+	}
+	harTimings struct {
+		Send    float64 `json:"send"`
+		Wait    float64 `json:"wait"`
+		Receive float64 `json:"receive"`
+	}
+)
+
+// cdpResponse is the part of a Network.Response a HAR entry needs.
+type cdpResponse struct {
+	URL        string            `json:"url"`
+	Status     int               `json:"status"`
+	StatusText string            `json:"statusText"`
+	Headers    map[string]string `json:"headers"`
+	MimeType   string            `json:"mimeType"`
+	Protocol   string            `json:"protocol"`
+}
+
+// harFromFrames builds a HAR from the Network events among a session's
+// recorded frames. Only requests made while the client had the Network
+// domain enabled appear, and bodies are never included: the events don't
+// carry them.
+func harFromFrames(frames []tapFrame) harLog {
+	type pending struct {
+		entry     *harEntry
+		timestamp float64
+		responded float64
+	}
+	var entries []*harEntry
+	requests := make(map[string]*pending)
+
+	finish := func(req *pending, timestamp float64) {
+		if req.responded > 0 {
+			req.entry.Timings.Wait = max(0, (req.responded-req.timestamp)*1000)
+			req.entry.Timings.Receive = max(0, (timestamp-req.responded)*1000)
+		} else {
+			req.entry.Timings.Wait = max(0, (timestamp-req.timestamp)*1000)
+		}
+		req.entry.Time = req.entry.Timings.Wait + req.entry.Timings.Receive
+	}
+	respond := func(req *pending, resp cdpResponse, timestamp float64) {
+		req.responded = timestamp
+		req.entry.Response = harResponse{
+			Status:      resp.Status,
+			StatusText:  resp.StatusText,
+			HTTPVersion: harHTTPVersion(resp.Protocol),
+			Cookies:     []harPair{},
+			Headers:     harHeaders(resp.Headers),
+			Content:     harPayload{Size: -1, MimeType: resp.MimeType},
+			RedirectURL: headerValue(resp.Headers, "Location"),
+			HeadersSize: -1,
+			BodySize:    -1,
+		}
+	}
+
+	for _, frame := range frames {
+		if frame.Direction != "upstream" || frame.Frame == nil {
+			continue
+		}
+		var msg cdpMessage
+		if json.Unmarshal(frame.Frame, &msg) != nil || !strings.HasPrefix(msg.Method, "Network.") {
+			continue
+		}
+		var params struct {
+			RequestID string  `json:"requestId"`
+			Timestamp float64 `json:"timestamp"`
+			WallTime  float64 `json:"wallTime"`
+			Request   struct {
+				URL      string            `json:"url"`
+				Method   string            `json:"method"`
+				Headers  map[string]string `json:"headers"`
+				PostData string            `json:"postData"`
+			} `json:"request"`
+			RedirectResponse  *cdpResponse `json:"redirectResponse"`
+			Response          cdpResponse  `json:"response"`
+			EncodedDataLength float64      `json:"encodedDataLength"`
+			ErrorText         string       `json:"errorText"`
+		}
+		if json.Unmarshal(msg.Params, &params) != nil {
+			continue
+		}
+		key := msg.SessionID + "/" + params.RequestID
+		req := requests[key]
+
+		switch msg.Method {
+		case "Network.requestWillBeSent":
+			// A redirect reuses the request ID: the hop so far is its
+			// own entry.
+			if req != nil && params.RedirectResponse != nil {
+				respond(req, *params.RedirectResponse, params.Timestamp)
+				finish(req, params.Timestamp)
+			}
+			started := frame.Time
+			if params.WallTime > 0 {
+				started = time.UnixMilli(int64(params.WallTime * 1000)).UTC()
+			}
+			entry := &harEntry{
+				StartedDateTime: started,
+				Request: harRequest{
+					Method:      params.Request.Method,
+					URL:         params.Request.URL,
+					HTTPVersion: "HTTP/1.1",
+					Cookies:     []harPair{},
+					Headers:     harHeaders(params.Request.Headers),
+					QueryString: harQuery(params.Request.URL),
+					HeadersSize: -1,
+					BodySize:    len(params.Request.PostData),
+				},
+				Response: harResponse{Cookies: []harPair{}, Headers: []harPair{}, Content: harPayload{Size: -1}, HeadersSize: -1, BodySize: -1},
+			}
+			if params.Request.PostData != "" {
+				entry.Request.PostData = &harPayload{
+					Size:     len(params.Request.PostData),
+					MimeType: headerValue(params.Request.Headers, "Content-Type"),
+					Text:     params.Request.PostData,
+				}
+			}
+			entries = append(entries, entry)
+			requests[key] = &pending{entry: entry, timestamp: params.Timestamp}
+		case "Network.responseReceived":
+			if req != nil {
+				respond(req, params.Response, params.Timestamp)
+			}
+		case "Network.loadingFinished":
+			if req != nil {
+				req.entry.Response.BodySize = int(params.EncodedDataLength)
+				finish(req, params.Timestamp)
+				delete(requests, key)
+			}
+		case "Network.loadingFailed":
+			if req != nil {
+				req.entry.Comment = params.ErrorText
+				finish(req, params.Timestamp)
+				delete(requests, key)
+			}
+		}
+	}
+
+	har := harLog{Log: harBody{
+		Version: "1.2",
+		Creator: harCreator{Name: "browserd", Version: "1"},
+		Entries: make([]harEntry, 0, len(entries)),
+	}}
+	for _, entry := range entries {
+		har.Log.Entries = append(har.Log.Entries, *entry)
+	}
+	return har
+}
+
+// harHTTPVersion maps Chromium's protocol names to HAR's.
+func harHTTPVersion(protocol string) string {
+	switch protocol {
+	case "h2":
+		return "HTTP/2"
+	case "h3":
+		return "HTTP/3"
+	case "":
+		return "HTTP/1.1"
+	}
+	return strings.ToUpper(protocol)
+}
+
+// harHeaders lists headers by name, for output that doesn't vary between
+// runs.
+func harHeaders(headers map[string]string) []harPair {
+	pairs := make([]harPair, 0, len(headers))
+	for name, value := range headers {
+		pairs = append(pairs, harPair{Name: name, Value: value})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Name < pairs[j].Name })
+	return pairs
+}
+
+// headerValue looks a header up in CDP's headers object, whose names keep
+// the case they were sent with.
+func headerValue(headers map[string]string, name string) string {
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+func harQuery(raw string) []harPair {
+	pairs := []harPair{}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return pairs
+	}
+	for name, values := range u.Query() {
+		for _, value := range values {
+			pairs = append(pairs, harPair{Name: name, Value: value})
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].Name < pairs[j].Name })
+	return pairs
+}
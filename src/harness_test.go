@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"chromiumproxy/cdptest"
+
+	"github.com/gorilla/websocket"
+)
+
+// harness is a proxyServer running in-process against a cdptest.Server,
+// so relay behavior can be exercised without a browser binary. It listens
+// on a Unix socket, which needs no free port.
+type harness struct {
+	proxy    *proxyServer
+	chromium *cdptest.Server
+	socket   string
+	client   *http.Client
+	dialer   websocket.Dialer
+	dial     func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	cancel context.CancelFunc
+	done   chan error
+}
+
+// startHarness starts a proxyServer configured by cfg against chromium,
+// with its socket in dir. cfg's endpoint and listeners are replaced; the
+// certificate of a single listener in cfg is kept, serving TLS on the
+// socket.
+func startHarness(cfg proxyConfig, chromium *cdptest.Server, dir string) (*harness, error) {
+	cfg.chromiumEndpoint = chromium.URL()
+	socket := filepath.Join(dir, "browserd.sock")
+	spec := listenSpec{network: "unix", addr: socket}
+	if len(cfg.listen) == 1 {
+		spec.certFile, spec.keyFile = cfg.listen[0].certFile, cfg.listen[0].keyFile
+	}
+	cfg.listen = []listenSpec{spec}
+	proxy, err := newProxyServer(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socket)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &harness{
+		proxy:    proxy,
+		chromium: chromium,
+		socket:   socket,
+		client:   &http.Client{Transport: &http.Transport{DialContext: dial}},
+		dialer:   websocket.Dialer{NetDialContext: dial, HandshakeTimeout: requestTimeout},
+		dial:     dial,
+		cancel:   cancel,
+		done:     make(chan error, 1),
+	}
+	go func() { h.done <- proxy.start(ctx) }()
+
+	// start returns only on failure; otherwise wait for the socket.
+	deadline := time.Now().Add(requestTimeout)
+	for {
+		conn, err := net.Dial("unix", socket)
+		if err == nil {
+			_ = conn.Close()
+			return h, nil
+		}
+		select {
+		case err := <-h.done:
+			cancel()
+			return nil, fmt.Errorf("start: %w", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			h.close()
+			return nil, errors.New("proxy did not start listening")
+		}
+	}
+}
+
+// newHarness starts a harness configured by cfg against a fresh
+// cdptest.Server, stopping both when t ends.
+func newHarness(t *testing.T, cfg proxyConfig) *harness {
+	t.Helper()
+	chromium := cdptest.NewServer()
+	t.Cleanup(chromium.Close)
+	h, err := startHarness(cfg, chromium, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = h.close() })
+	return h
+}
+
+// url returns the http:// URL of path on the proxy. The host is only a
+// placeholder; requests go through the socket.
+func (h *harness) url(path string) string {
+	return "http://browserd" + path
+}
+
+// connect opens a client WebSocket to path on the proxy, such as "/" for a
+// browser session or "/devtools/page/<id>".
+func (h *harness) connect(ctx context.Context, path string) (*websocket.Conn, *http.Response, error) {
+	return h.dialer.DialContext(ctx, "ws://browserd"+path, nil)
+}
+
+// close stops the proxy and waits for it, leaving chromium running.
+func (h *harness) close() error {
+	h.cancel()
+	select {
+	case err := <-h.done:
+		return err
+	case <-time.After(10 * time.Second):
+		return errors.New("proxy did not stop")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// errorResponse is the body of every HTTP error browserd answers, so
+// clients can act on Code and Retryable instead of parsing Message.
+type errorResponse struct {
+	Code      string         `json:"code"`
+	Message   string         `json:"message"`
+	Retryable bool           `json:"retryable"`
+	Details   map[string]any `json:"details,omitempty"`
+}
+
+// Codes more specific than their status's.
+const (
+	errorCodeDraining          = "draining"
+	errorCodeUpstreamUnhealthy = "upstream_unhealthy"
+	errorCodeOverloaded        = "overloaded"
+	errorCodeScriptError       = "script_error"
+	errorCodeNavigationBlocked = "navigation_blocked"
+)
+
+// writeError answers with an error whose code is derived from status.
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeErrorCode(w, status, "", message, nil)
+}
+
+// writeErrorCode answers with an error carrying code, or the status's code
+// if it is empty, and details. The error is retryable when the same
+// request may succeed later or on another replica.
+func writeErrorCode(w http.ResponseWriter, status int, code, message string, details map[string]any) {
+	if code == "" {
+		code = statusErrorCode(status)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	writeJSON(w, status, errorResponse{
+		Code:      code,
+		Message:   message,
+		Retryable: retryableStatus(status),
+		Details:   details,
+	})
+}
+
+// statusErrorCode turns a status text into a code: "Bad Gateway" becomes
+// "bad_gateway".
+func statusErrorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.ReplaceAll(strings.ToLower(text), " ", "_")
+}
+
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
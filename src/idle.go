@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// reapIdle closes sessions whose client hasn't sent a CDP command for
+// -idle-timeout. WebSocket pings don't count: a client that only keeps
+// its socket alive is still idle.
+func (p *proxyServer) reapIdle(ctx context.Context) {
+	interval := min(max(p.idleTimeout/4, time.Second), 30*time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, sess := range p.sessions.list() {
+			if time.Since(sess.lastActive()) < p.idleTimeout {
+				continue
+			}
+			if sess.idled.CompareAndSwap(false, true) {
+				sess.disconnect(closeIdle, "idle timeout")
+			}
+		}
+	}
+}
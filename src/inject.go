@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// newDocumentScript builds the init command that installs source in every
+// document a page target loads.
+func newDocumentScript(source string) cdpCommand {
+	params, _ := json.Marshal(map[string]any{"source": source})
+	return cdpCommand{Method: "Page.addScriptToEvaluateOnNewDocument", Params: params}
+}
+
+// loadInjectedScripts turns script files and an inline snippet into init
+// commands, in that order.
+func loadInjectedScripts(files []string, inline string) ([]cdpCommand, error) {
+	var commands []cdpCommand
+	for _, path := range files {
+		source, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, newDocumentScript(string(source)))
+	}
+	if inline != "" {
+		commands = append(commands, newDocumentScript(inline))
+	}
+	return commands, nil
+}
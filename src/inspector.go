@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// Errors ending a connection made straight to a page target that was
+// lost. The client has already been closed with a code telling why.
+var (
+	errTargetTakenOver = errors.New("page target taken over by another debugger")
+	errTargetCrashed   = errors.New("page target crashed")
+)
+
+// Kinds of target loss, as the reason label of
+// browserd_targets_lost_total.
+const (
+	targetLostDevtools = "replaced_with_devtools"
+	targetLostCrashed  = "crashed"
+	targetLostOther    = "detached"
+)
+
+// onInspectorEvent handles Inspector.detached and Inspector.targetCrashed,
+// which Chromium sends when a target's debugging session is taken away:
+// by DevTools or another client attaching to it, or by its renderer
+// dying. A target attached through a flattened session is just gone and
+// the client sees the event as usual. A connection made straight to the
+// page is useless from then on, so the error to end it with, once the
+// event is forwarded, is returned, along with the close code and reason
+// to tell the client.
+func (r *relay) onInspectorEvent(msg cdpMessage) (lost error, code int, reason string) {
+	kind, detail := targetLostCrashed, "target crashed"
+	if msg.Method == "Inspector.detached" {
+		var params struct {
+			Reason string `json:"reason"`
+		}
+		_ = json.Unmarshal(msg.Params, &params)
+		detail = params.Reason
+		switch {
+		case params.Reason == "replaced_with_devtools":
+			kind = targetLostDevtools
+		case strings.Contains(strings.ToLower(params.Reason), "render process gone"):
+			kind = targetLostCrashed
+		default:
+			kind = targetLostOther
+		}
+	}
+
+	targetID := r.sess.targetFor(msg.SessionID)
+	r.sess.log.Warn("page target lost", "event", "target_lost", "reason", kind, "detail", detail, "target_id", targetID, "cdp_session", msg.SessionID)
+	r.sess.logf("target %s lost: %s", targetID, detail)
+	if r.onTargetLost != nil {
+		r.onTargetLost(kind)
+	}
+	if msg.SessionID != "" {
+		return nil, 0, ""
+	}
+	switch kind {
+	case targetLostDevtools:
+		return errTargetTakenOver, closeTargetTakenOver, "target taken over by another debugger"
+	case targetLostCrashed:
+		return errTargetCrashed, closeUpstreamLost, "target crashed"
+	}
+	return nil, 0, ""
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// cdpServerError is the JSON-RPC error code Chromium uses for failed calls.
+const cdpServerError = -32000
+
+// Commands taking a browserContextId that must be owned by the session.
+// When the value is true, an omitted ID defaults to the session's context.
+var contextDefaultingMethods = map[string]bool{
+	"Target.createTarget":          true,
+	"Storage.getCookies":           true,
+	"Storage.setCookies":           true,
+	"Storage.clearCookies":         true,
+	"Browser.setDownloadBehavior":  true,
+	"Browser.grantPermissions":     true,
+	"Browser.resetPermissions":     true,
+	"Browser.setPermission":        true,
+	"Target.disposeBrowserContext": false,
+}
+
+// Commands whose targetId parameter must name one of the session's targets.
+var targetScopedMethods = map[string]bool{
+	"Target.attachToTarget":         true,
+	"Target.closeTarget":            true,
+	"Target.activateTarget":         true,
+	"Target.exposeDevToolsProtocol": true,
+	"Target.getTargetInfo":          true,
+}
+
+// Browser-level commands that would escape any per-session boundary.
+var isolationDeniedMethods = map[string]bool{
+	"Target.attachToBrowserTarget": true,
+	"Browser.close":                true,
+	"Browser.crash":                true,
+	"Browser.crashGpuProcess":      true,
+}
+
+// Commands that act on the whole browser's storage when sent on the
+// browser connection rather than a page's session, having no context to
+// scope them to.
+var browserWideMethods = map[string]bool{
+	"Storage.clearDataForOrigin":     true,
+	"Storage.clearDataForStorageKey": true,
+}
+
+type targetInfoPayload struct {
+	TargetID         string `json:"targetId"`
+	Type             string `json:"type"`
+	BrowserContextID string `json:"browserContextId"`
+}
+
+// isolation tracks the browser contexts, targets and flattened CDP sessions
+// a client owns when strict isolation is on.
+type isolation struct {
+	mu       sync.Mutex
+	contexts map[string]bool
+	targets  map[string]bool
+	sessions map[string]bool
+
+	// calls maps in-flight browser-level client command IDs to their
+	// method, for the responses isolation needs to inspect or filter.
+	calls map[int64]string
+}
+
+func newIsolation() *isolation {
+	return &isolation{
+		contexts: make(map[string]bool),
+		targets:  make(map[string]bool),
+		sessions: make(map[string]bool),
+		calls:    make(map[int64]string),
+	}
+}
+
+func (iso *isolation) ownsContext(id string) bool {
+	iso.mu.Lock()
+	defer iso.mu.Unlock()
+	return iso.contexts[id]
+}
+
+func (iso *isolation) ownsSession(id string) bool {
+	iso.mu.Lock()
+	defer iso.mu.Unlock()
+	return iso.sessions[id]
+}
+
+// observeTarget records a target if it lives in an owned context and
+// reports whether it does.
+func (iso *isolation) observeTarget(info targetInfoPayload) bool {
+	iso.mu.Lock()
+	defer iso.mu.Unlock()
+	if iso.contexts[info.BrowserContextID] {
+		iso.targets[info.TargetID] = true
+		return true
+	}
+	return iso.targets[info.TargetID]
+}
+
+// checkClient enforces isolation on a client command. It returns an error
+// message to send back instead of forwarding, and may rewrite msg.
+func (r *relay) checkClient(msg *cdpMessage) (string, bool) {
+	iso := r.isolation
+	if msg.Method == "" || msg.ID == nil {
+		return "", false
+	}
+	if msg.SessionID != "" && !iso.ownsSession(msg.SessionID) {
+		return "session does not belong to this client", false
+	}
+	if isolationDeniedMethods[msg.Method] || msg.SessionID == "" && browserWideMethods[msg.Method] {
+		return msg.Method + " is not allowed under strict isolation", false
+	}
+
+	var params map[string]any
+	if len(msg.Params) > 0 {
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return "invalid params", false
+		}
+	}
+	if params == nil {
+		params = make(map[string]any)
+	}
+	rewritten := false
+
+	if defaulting, ok := contextDefaultingMethods[msg.Method]; ok {
+		contextID, _ := params["browserContextId"].(string)
+		switch {
+		case contextID == "" && defaulting && r.contextID == "":
+			// Without the session's context to default to, the command
+			// would apply to the whole browser.
+			return msg.Method + " needs a browserContextId under strict isolation", false
+		case contextID == "" && defaulting:
+			params["browserContextId"] = r.contextID
+			rewritten = true
+		case !iso.ownsContext(contextID):
+			return "browser context does not belong to this client", false
+		}
+	}
+
+	if targetScopedMethods[msg.Method] {
+		targetID, _ := params["targetId"].(string)
+		if !r.ownsTarget(targetID) {
+			return "target does not belong to this client", false
+		}
+	}
+
+	if msg.SessionID == "" {
+		switch msg.Method {
+		case "Target.createBrowserContext", "Target.createTarget", "Target.getTargets", "Target.getBrowserContexts":
+			iso.mu.Lock()
+			iso.calls[*msg.ID] = msg.Method
+			iso.mu.Unlock()
+		}
+	}
+
+	if rewritten {
+		msg.Params, _ = json.Marshal(params)
+	}
+	return "", rewritten
+}
+
+// ownsTarget checks a target ID against the owned set, asking Chromium for
+// targets the relay hasn't observed yet.
+func (r *relay) ownsTarget(targetID string) bool {
+	iso := r.isolation
+	iso.mu.Lock()
+	owned := iso.targets[targetID]
+	iso.mu.Unlock()
+	if owned || targetID == "" {
+		return owned
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	params, _ := json.Marshal(map[string]string{"targetId": targetID})
+	resp, err := r.call(ctx, "", "Target.getTargetInfo", params)
+	if err != nil || len(resp.Error) > 0 {
+		return false
+	}
+	var result struct {
+		TargetInfo targetInfoPayload `json:"targetInfo"`
+	}
+	if err := json.Unmarshal(resp.Result, &result); err != nil {
+		return false
+	}
+	return iso.observeTarget(result.TargetInfo)
+}
+
+// filterUpstream applies isolation to an upstream frame. It returns false
+// to drop the frame, and may replace data with a filtered version.
+func (r *relay) filterUpstream(msg *cdpMessage, data *[]byte) bool {
+	iso := r.isolation
+
+	if msg.ID != nil && msg.SessionID == "" {
+		iso.mu.Lock()
+		method, ok := iso.calls[*msg.ID]
+		delete(iso.calls, *msg.ID)
+		iso.mu.Unlock()
+		if ok && len(msg.Result) > 0 {
+			r.inspectResult(method, msg, data)
+		}
+		return true
+	}
+
+	if msg.SessionID != "" && !iso.ownsSession(msg.SessionID) {
+		return false
+	}
+
+	switch msg.Method {
+	case "Target.attachedToTarget":
+		var params struct {
+			SessionID  string            `json:"sessionId"`
+			TargetInfo targetInfoPayload `json:"targetInfo"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return false
+		}
+		if !iso.observeTarget(params.TargetInfo) {
+			// Auto-attach reaches every target in the browser; detach from
+			// other clients' targets without telling this client.
+			go r.send(msg.SessionID, "Target.detachFromTarget", map[string]any{"sessionId": params.SessionID})
+			return false
+		}
+		iso.mu.Lock()
+		iso.sessions[params.SessionID] = true
+		iso.mu.Unlock()
+
+	case "Target.targetCreated", "Target.targetInfoChanged":
+		var params struct {
+			TargetInfo targetInfoPayload `json:"targetInfo"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return false
+		}
+		return iso.observeTarget(params.TargetInfo)
+
+	case "Target.targetDestroyed", "Target.targetCrashed":
+		var params struct {
+			TargetID string `json:"targetId"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return false
+		}
+		iso.mu.Lock()
+		owned := iso.targets[params.TargetID]
+		delete(iso.targets, params.TargetID)
+		iso.mu.Unlock()
+		return owned
+
+	case "Target.detachedFromTarget":
+		var params struct {
+			SessionID string `json:"sessionId"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return false
+		}
+		iso.mu.Lock()
+		owned := iso.sessions[params.SessionID]
+		delete(iso.sessions, params.SessionID)
+		iso.mu.Unlock()
+		return owned
+	}
+	return true
+}
+
+// inspectResult records ownership from command results and strips other
+// clients' contexts and targets from list responses.
+func (r *relay) inspectResult(method string, msg *cdpMessage, data *[]byte) {
+	iso := r.isolation
+
+	switch method {
+	case "Target.createBrowserContext":
+		var result struct {
+			BrowserContextID string `json:"browserContextId"`
+		}
+		if json.Unmarshal(msg.Result, &result) == nil && result.BrowserContextID != "" {
+			iso.mu.Lock()
+			iso.contexts[result.BrowserContextID] = true
+			iso.mu.Unlock()
+		}
+
+	case "Target.createTarget":
+		var result struct {
+			TargetID string `json:"targetId"`
+		}
+		if json.Unmarshal(msg.Result, &result) == nil && result.TargetID != "" {
+			iso.mu.Lock()
+			iso.targets[result.TargetID] = true
+			iso.mu.Unlock()
+		}
+
+	case "Target.getTargets":
+		var result struct {
+			TargetInfos []json.RawMessage `json:"targetInfos"`
+		}
+		if json.Unmarshal(msg.Result, &result) != nil {
+			return
+		}
+		owned := make([]json.RawMessage, 0, len(result.TargetInfos))
+		for _, raw := range result.TargetInfos {
+			var info targetInfoPayload
+			if json.Unmarshal(raw, &info) == nil && iso.observeTarget(info) {
+				owned = append(owned, raw)
+			}
+		}
+		r.replaceResult(msg, data, map[string]any{"targetInfos": owned})
+
+	case "Target.getBrowserContexts":
+		iso.mu.Lock()
+		ids := make([]string, 0, len(iso.contexts))
+		for id := range iso.contexts {
+			ids = append(ids, id)
+		}
+		iso.mu.Unlock()
+		r.replaceResult(msg, data, map[string]any{"browserContextIds": ids})
+	}
+}
+
+func (r *relay) replaceResult(msg *cdpMessage, data *[]byte, result any) {
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+	msg.Result = raw
+	if encoded, err := json.Marshal(msg); err == nil {
+		*data = encoded
+	}
+}
+
+// replyError answers a client command with a CDP error instead of
+// forwarding it.
+func (r *relay) replyError(msg *cdpMessage, message string) error {
+	payload, _ := json.Marshal(map[string]any{"code": cdpServerError, "message": message})
+	reply, err := json.Marshal(cdpMessage{ID: msg.ID, SessionID: msg.SessionID, Error: payload})
+	if err != nil {
+		return err
+	}
+	return r.writeClient(websocket.TextMessage, reply)
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxJobTasks caps the tasks of one POST /api/jobs.
+const maxJobTasks = 100
+
+// Job task types.
+const (
+	jobTaskContent    = "content"
+	jobTaskScreenshot = "screenshot"
+	jobTaskEvaluate   = "evaluate"
+)
+
+// Job and task states.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobOK        = "ok"
+	jobFailed    = "error"
+	jobCancelled = "cancelled"
+)
+
+// jobRequest is the body of POST /api/jobs.
+type jobRequest struct {
+	Tasks []jobTask `json:"tasks"`
+	// Concurrency lowers -job-concurrency for this job.
+	Concurrency int `json:"concurrency"`
+}
+
+// jobTask is one rendering of a job: the fields of /api/content, plus
+// fullPage for screenshots and expression and awaitPromise for evaluate.
+type jobTask struct {
+	Type string `json:"type"`
+	contentRequest
+	FullPage     bool   `json:"fullPage"`
+	Expression   string `json:"expression"`
+	AwaitPromise bool   `json:"awaitPromise"`
+
+	emulation []cdpCommand
+}
+
+// job is a batch of tasks run in the background, with its results kept in
+// the job's temp directory for -temp-retention once it is done.
+type job struct {
+	id     string
+	dir    string
+	cancel context.CancelFunc
+	// apiKey names the -api-keys key that created the job, if any; only
+	// it and the admin credentials may see the job.
+	apiKey string
+
+	mu       sync.Mutex
+	created  time.Time
+	finished time.Time
+	tasks    []*jobTaskState
+}
+
+type jobTaskState struct {
+	task        jobTask
+	status      string
+	err         string
+	contentType string
+	started     time.Time
+	finished    time.Time
+}
+
+// jobView is how GET /api/jobs/{id} reports a job.
+type jobView struct {
+	ID         string         `json:"id"`
+	Status     string         `json:"status"`
+	CreatedAt  time.Time      `json:"createdAt"`
+	FinishedAt *time.Time     `json:"finishedAt,omitempty"`
+	Counts     map[string]int `json:"counts"`
+	Tasks      []jobTaskView  `json:"tasks"`
+}
+
+type jobTaskView struct {
+	Index      int        `json:"index"`
+	Type       string     `json:"type"`
+	URL        string     `json:"url"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	// Result is where an ok task's result is served.
+	Result string `json:"result,omitempty"`
+}
+
+// jobStore holds the jobs of a proxy until their results expire.
+type jobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+func (s *jobStore) get(id string) *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jobs[id]
+}
+
+func (s *jobStore) add(j *job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[j.id] = j
+}
+
+func (s *jobStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, id)
+}
+
+// validate checks a task and prepares its emulation.
+func (t *jobTask) validate() error {
+	switch t.Type {
+	case jobTaskContent, jobTaskScreenshot:
+	case jobTaskEvaluate:
+		if t.Expression == "" {
+			return errors.New("expression is required")
+		}
+	default:
+		return errors.New("type must be content, screenshot or evaluate")
+	}
+	var err error
+	t.emulation, err = t.contentRequest.emulation()
+	return err
+}
+
+// handleCreateJob serves POST /api/jobs: it validates every task, answers
+// 202 with the job's ID and runs the tasks in the background.
+func (p *proxyServer) handleCreateJob(w http.ResponseWriter, r *http.Request) {
+	if !p.authorize(r) {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if p.draining.Load() {
+		writeErrorCode(w, http.StatusServiceUnavailable, errorCodeDraining, "draining", nil)
+		return
+	}
+
+	var req jobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		p.writeBodyError(w, err)
+		return
+	}
+	if len(req.Tasks) == 0 || len(req.Tasks) > maxJobTasks {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("a job needs between 1 and %d tasks", maxJobTasks))
+		return
+	}
+	for i := range req.Tasks {
+		if err := req.Tasks[i].validate(); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("task %d: %v", i, err))
+			return
+		}
+		if reason := p.refuseNavigation(r, req.Tasks[i].URL); reason != "" {
+			writeErrorCode(w, http.StatusForbidden, errorCodeNavigationBlocked, fmt.Sprintf("task %d: %s", i, reason), nil)
+			return
+		}
+	}
+	concurrency := p.jobConcurrency
+	if req.Concurrency > 0 && req.Concurrency < concurrency {
+		concurrency = req.Concurrency
+	}
+
+	id := newSessionID()
+	dir, err := p.temp.jobDir(id)
+	if err != nil {
+		slog.Error("failed to create job directory", "job_id", id, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to create job")
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{id: id, dir: dir, cancel: cancel, apiKey: p.callerKey(r), created: time.Now()}
+	for _, task := range req.Tasks {
+		j.tasks = append(j.tasks, &jobTaskState{task: task, status: jobQueued})
+	}
+	p.jobs.add(j)
+	slog.Info("job created", "event", "job_created", "job_id", id, "tasks", len(j.tasks), "concurrency", concurrency, "client_ip", clientIP(r.RemoteAddr))
+	go p.runJob(ctx, j, concurrency)
+
+	w.Header().Set("Location", "/api/jobs/"+id)
+	writeJSON(w, http.StatusAccepted, j.view())
+}
+
+// runJob runs a job's tasks, at most concurrency at a time, each taking a
+// -max-api-requests slot, and expires the job -temp-retention after.
+func (p *proxyServer) runJob(ctx context.Context, j *job, concurrency int) {
+	defer j.cancel()
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, state := range j.tasks {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			p.runJobTask(ctx, j, i, state)
+		}()
+	}
+	wg.Wait()
+
+	j.mu.Lock()
+	j.finished = time.Now()
+	counts := j.countsLocked()
+	for _, state := range j.tasks {
+		if state.status == jobQueued {
+			state.status = jobCancelled
+		}
+	}
+	j.mu.Unlock()
+	slog.Info("job finished", "event", "job_finished", "job_id", j.id, "ok", counts[jobOK], "failed", counts[jobFailed], "duration", time.Since(j.created).Round(time.Millisecond).String())
+
+	time.AfterFunc(p.temp.retention, func() {
+		p.jobs.remove(j.id)
+		p.temp.remove(j.dir)
+	})
+}
+
+func (p *proxyServer) runJobTask(ctx context.Context, j *job, index int, state *jobTaskState) {
+	task := state.task
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout(task.Timeout))
+	defer cancel()
+
+	contentType, result, err := func() (string, []byte, error) {
+		if err := p.waitAPI(ctx); err != nil {
+			return "", nil, err
+		}
+		defer p.releaseAPI()
+
+		j.mu.Lock()
+		state.status, state.started = jobRunning, time.Now()
+		j.mu.Unlock()
+
+		page, err := p.loadPage(ctx, task.contentRequest, task.emulation)
+		if err != nil {
+			return "", nil, err
+		}
+		defer page.close()
+		switch task.Type {
+		case jobTaskScreenshot:
+			data, err := page.screenshot(ctx, task.FullPage)
+			return "image/png", data, err
+		case jobTaskEvaluate:
+			value, err := page.evaluate(ctx, task.Expression, task.AwaitPromise)
+			if err != nil {
+				return "", nil, err
+			}
+			data, err := json.Marshal(value)
+			return "application/json", data, err
+		}
+		html, err := page.content(ctx)
+		return "text/html; charset=utf-8", []byte(html), err
+	}()
+	if err == nil {
+		err = os.WriteFile(filepath.Join(j.dir, strconv.Itoa(index)), result, 0o644)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	state.finished = time.Now()
+	switch {
+	case err == nil:
+		state.status, state.contentType = jobOK, contentType
+	case errors.Is(err, context.Canceled):
+		state.status = jobCancelled
+	default:
+		state.status, state.err = jobFailed, err.Error()
+	}
+	p.metrics.add("browserd_job_tasks_total", map[string]string{"type": task.Type, "status": state.status}, 1)
+}
+
+func (j *job) countsLocked() map[string]int {
+	counts := map[string]int{}
+	for _, state := range j.tasks {
+		counts[state.status]++
+	}
+	return counts
+}
+
+func (j *job) view() jobView {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	view := jobView{ID: j.id, Status: jobDone, CreatedAt: j.created, Counts: j.countsLocked()}
+	if j.finished.IsZero() {
+		view.Status = jobRunning
+		if view.Counts[jobQueued] == len(j.tasks) {
+			view.Status = jobQueued
+		}
+	} else {
+		view.FinishedAt = &j.finished
+	}
+	for i, state := range j.tasks {
+		tv := jobTaskView{Index: i, Type: state.task.Type, URL: state.task.URL, Status: state.status, Error: state.err}
+		if !state.started.IsZero() {
+			started := state.started
+			tv.StartedAt = &started
+		}
+		if !state.finished.IsZero() {
+			finished := state.finished
+			tv.FinishedAt = &finished
+		}
+		if state.status == jobOK {
+			tv.Result = fmt.Sprintf("/api/jobs/%s/tasks/%d/result", j.id, i)
+		}
+		view.Tasks = append(view.Tasks, tv)
+	}
+	return view
+}
+
+// lookupJob authorizes a request for a job and finds it, answering the
+// request itself when it can't. Like a session, a job created with an API
+// key is only found for that key or the admin credentials.
+func (p *proxyServer) lookupJob(w http.ResponseWriter, r *http.Request) *job {
+	if !p.authorize(r) {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return nil
+	}
+	j := p.jobs.get(r.PathValue("id"))
+	if j == nil || (j.apiKey != p.callerKey(r) && !(p.adminAuth.enabled() && p.authorizeAdmin(r))) {
+		writeError(w, http.StatusNotFound, "job not found")
+		return nil
+	}
+	return j
+}
+
+// handleJob serves GET /api/jobs/{id}, the progress of a job.
+func (p *proxyServer) handleJob(w http.ResponseWriter, r *http.Request) {
+	if j := p.lookupJob(w, r); j != nil {
+		writeJSON(w, http.StatusOK, j.view())
+	}
+}
+
+// handleCancelJob serves DELETE /api/jobs/{id}: tasks not yet finished are
+// cancelled, and those done keep their results.
+func (p *proxyServer) handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	j := p.lookupJob(w, r)
+	if j == nil {
+		return
+	}
+	j.cancel()
+	writeJSON(w, http.StatusOK, j.view())
+}
+
+// handleJobResult serves GET /api/jobs/{id}/tasks/{n}/result, the result
+// of a task that succeeded.
+func (p *proxyServer) handleJobResult(w http.ResponseWriter, r *http.Request) {
+	j := p.lookupJob(w, r)
+	if j == nil {
+		return
+	}
+	index, err := strconv.Atoi(r.PathValue("n"))
+	if err != nil || index < 0 || index >= len(j.tasks) {
+		writeError(w, http.StatusNotFound, "task not found")
+		return
+	}
+	j.mu.Lock()
+	status, contentType := j.tasks[index].status, j.tasks[index].contentType
+	j.mu.Unlock()
+	if status != jobOK {
+		writeError(w, http.StatusConflict, "task is "+status)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeFile(w, r, filepath.Join(j.dir, strconv.Itoa(index)))
+}
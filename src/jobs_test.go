@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestJobsBelongToTheirKey(t *testing.T) {
+	h := newHarness(t, proxyConfig{
+		apiKeysFile: writeAPIKeys(t, `{"alpha": {"key": "k-alpha"}, "beta": {"key": "k-beta"}}`),
+		adminAuth:   adminAuth{token: "admin-secret"},
+	})
+	do := func(method, path, token, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, h.url(path), strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := h.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := do(http.MethodPost, "/api/jobs", "k-alpha", `{"tasks": [{"type": "content", "url": "https://example.com"}]}`)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("create: status %d", resp.StatusCode)
+	}
+	job := resp.Header.Get("Location")
+	for _, tc := range []struct {
+		token string
+		want  int
+	}{
+		{"k-alpha", http.StatusOK},
+		{"k-beta", http.StatusNotFound},
+		{"", http.StatusUnauthorized},
+	} {
+		if resp := do(http.MethodGet, job, tc.token, ""); resp.StatusCode != tc.want {
+			t.Errorf("GET as %q: status %d, want %d", tc.token, resp.StatusCode, tc.want)
+		}
+	}
+	if resp := do(http.MethodDelete, job, "k-beta", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("DELETE as another key: status %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodGet, job+"/tasks/0/result", "k-beta", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("result as another key: status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,71 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"strconv"
+)
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journaldSink writes log records to the systemd journal over its native
+// datagram protocol, so each one keeps its priority.
+type journaldSink struct {
+	conn *net.UnixConn
+}
+
+func openJournald() (*journaldSink, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldSink{conn: conn}, nil
+}
+
+func (j *journaldSink) Write(p []byte) (int, error) {
+	return len(p), j.writeRecord(slog.LevelInfo, bytes.TrimSuffix(p, []byte("\n")))
+}
+
+func (j *journaldSink) writeRecord(level slog.Level, line []byte) error {
+	var buf bytes.Buffer
+	journalField(&buf, "PRIORITY", []byte(strconv.Itoa(journalPriority(level))))
+	journalField(&buf, "SYSLOG_IDENTIFIER", []byte("browserd"))
+	journalField(&buf, "MESSAGE", line)
+	_, err := j.conn.Write(buf.Bytes())
+	return err
+}
+
+// journalField appends one field, using the length-prefixed form for
+// values that contain a newline.
+func journalField(buf *bytes.Buffer, key string, value []byte) {
+	buf.WriteString(key)
+	if bytes.IndexByte(value, '\n') < 0 {
+		buf.WriteByte('=')
+		buf.Write(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.Write(value)
+	buf.WriteByte('\n')
+}
+
+// journalPriority maps a level to a syslog priority: err, warning, info
+// or debug.
+func journalPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	default:
+		return 7
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Bounds on what one session may set on its browser.
+const (
+	maxLaunchOverrides     = 16
+	maxLaunchOverrideValue = 1024
+)
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// launchAllowlist is what clients may set on the browser launched for
+// their session: environment variable names, from -session-env-allow, and
+// Chromium flag names, from -session-args-allow. Both may use wildcards.
+type launchAllowlist struct {
+	env  []string
+	args []string
+}
+
+func (a launchAllowlist) enabled() bool {
+	return len(a.env) > 0 || len(a.args) > 0
+}
+
+// parseLaunchAllowlist checks the comma-separated allowlists, refusing
+// flags browserd sets itself.
+func parseLaunchAllowlist(env, args string) (launchAllowlist, error) {
+	a := launchAllowlist{env: splitList(env), args: splitList(args)}
+	for _, name := range a.args {
+		if !strings.HasPrefix(name, "--") || strings.Contains(name, "=") {
+			return a, fmt.Errorf("%q is not a -- flag name", name)
+		}
+		for _, reserved := range reservedFlags {
+			if wildcardMatch(name, reserved) {
+				return a, fmt.Errorf("%s would allow %s, which browserd sets", name, reserved)
+			}
+		}
+	}
+	return a, nil
+}
+
+// launchOverrides are the environment variables, as NAME=value, and
+// Chromium flags a session set on its browser.
+type launchOverrides struct {
+	env  []string
+	args []string
+}
+
+// parseLaunchOverrides reads ?env=NAME=value and ?arg=--flag=value, each
+// of which may be repeated, checking them against allow. It returns nil
+// when the client set neither.
+func parseLaunchOverrides(query url.Values, allow launchAllowlist) (*launchOverrides, error) {
+	env, args := query["env"], query["arg"]
+	if len(env) == 0 && len(args) == 0 {
+		return nil, nil
+	}
+	if !allow.enabled() {
+		return nil, errors.New("?env=, ?arg= and launch args require -session-env-allow or -session-args-allow")
+	}
+	if len(env)+len(args) > maxLaunchOverrides {
+		return nil, fmt.Errorf("at most %d ?env= and ?arg= values", maxLaunchOverrides)
+	}
+	o := &launchOverrides{}
+	for _, raw := range env {
+		name, _, ok := strings.Cut(raw, "=")
+		if !ok || !envNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid env %q: want NAME=value", raw)
+		}
+		if !matchesName(allow.env, name) {
+			return nil, fmt.Errorf("environment variable %s is not allowed", name)
+		}
+		if err := checkOverrideValue(raw); err != nil {
+			return nil, fmt.Errorf("env %s: %w", name, err)
+		}
+		o.env = append(o.env, raw)
+	}
+	for _, raw := range args {
+		name := flagName(raw)
+		if !strings.HasPrefix(name, "--") {
+			return nil, fmt.Errorf("invalid arg %q: want --flag or --flag=value", raw)
+		}
+		if !matchesName(allow.args, name) || slices.Contains(reservedFlags, name) {
+			return nil, fmt.Errorf("flag %s is not allowed", name)
+		}
+		if err := checkOverrideValue(raw); err != nil {
+			return nil, fmt.Errorf("arg %s: %w", name, err)
+		}
+		o.args = append(o.args, raw)
+	}
+	return o, nil
+}
+
+func matchesName(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if wildcardMatch(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkOverrideValue(raw string) error {
+	if len(raw) > maxLaunchOverrideValue {
+		return fmt.Errorf("longer than %d characters", maxLaunchOverrideValue)
+	}
+	if strings.ContainsFunc(raw, unicode.IsControl) {
+		return errors.New("contains control characters")
+	}
+	return nil
+}
+
+// apply returns args with the session's flags in place of any of the same
+// name, except --enable-features, whose features are merged.
+func (o *launchOverrides) apply(args []string) []string {
+	if o == nil {
+		return args
+	}
+	out := slices.DeleteFunc(slices.Clone(args), func(arg string) bool {
+		name := flagName(arg)
+		return name != "--enable-features" && slices.ContainsFunc(o.args, func(set string) bool { return flagName(set) == name })
+	})
+	return mergeFeatureFlags(append(out, o.args...))
+}
+
+// environ returns env with the session's variables added, which take
+// precedence over any of the same name.
+func (o *launchOverrides) environ(env []string) []string {
+	if o == nil {
+		return env
+	}
+	return append(env, o.env...)
+}
+
+// envNames are the names of the session's variables, whose values aren't
+// shown in case they hold credentials.
+func (o *launchOverrides) envNames() []string {
+	var names []string
+	for _, kv := range o.env {
+		name, _, _ := strings.Cut(kv, "=")
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// listenSpec is one -listen value: host:port for TCP on whatever families
+// the host resolves to, or a URL choosing the network explicitly:
+// tcp://, tcp4:// or tcp6://host:port, unix:///path/to/socket, or on
+// Windows npipe:////./pipe/name for the named pipe \\.\pipe\name. A URL
+// may carry ?cert=&key= to serve that listener over TLS, or ?acme to serve
+// it over TLS with the certificate from -acme-domains.
+type listenSpec struct {
+	network  string
+	addr     string
+	certFile string
+	keyFile  string
+	acme     bool
+}
+
+func parseListenSpec(raw string) (listenSpec, error) {
+	if !strings.Contains(raw, "://") {
+		return listenSpec{network: "tcp", addr: raw}, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return listenSpec{}, err
+	}
+	spec := listenSpec{network: u.Scheme, certFile: u.Query().Get("cert"), keyFile: u.Query().Get("key"), acme: u.Query().Has("acme")}
+	switch u.Scheme {
+	case "tcp", "tcp4", "tcp6":
+		spec.addr = u.Host
+	case "unix":
+		spec.addr = u.Path
+	case "npipe":
+		path := u.Path
+		if u.Host != "" {
+			path = "//" + u.Host + u.Path
+		}
+		spec.addr = strings.ReplaceAll(path, "/", `\`)
+		if name, ok := strings.CutPrefix(spec.addr, `\\.\pipe\`); !ok || name == "" {
+			return listenSpec{}, fmt.Errorf(`%q: a named pipe must be \\.\pipe\<name>`, raw)
+		}
+	default:
+		return listenSpec{}, fmt.Errorf("%q: network must be tcp, tcp4, tcp6, unix or npipe", raw)
+	}
+	if spec.addr == "" {
+		return listenSpec{}, fmt.Errorf("%q: missing address", raw)
+	}
+	if (spec.certFile == "") != (spec.keyFile == "") {
+		return listenSpec{}, fmt.Errorf("%q: cert and key must be set together", raw)
+	}
+	if spec.acme && spec.certFile != "" {
+		return listenSpec{}, fmt.Errorf("%q: acme can't be combined with cert and key", raw)
+	}
+	return spec, nil
+}
+
+func (s listenSpec) String() string {
+	if s.network == "tcp" && s.certFile == "" && !s.acme {
+		return s.addr
+	}
+	if s.certFile != "" || s.acme {
+		return s.network + "+tls://" + s.addr
+	}
+	return s.network + "://" + s.addr
+}
+
+// listenOptions harden a client listener against being exhausted.
+type listenOptions struct {
+	// keepAlive is the TCP keepalive period; negative turns keepalives off.
+	keepAlive time.Duration
+	// maxConns, when positive, caps the connections open at once, and
+	// onConn is told of each change.
+	maxConns int
+	onConn   func(delta int)
+	// clientCAs, when set, verifies the client certificates TLS
+	// listeners ask for, or require when requireCert is set.
+	clientCAs   *x509.CertPool
+	requireCert bool
+}
+
+// listen opens the listener, wrapped in TLS when the spec has a
+// certificate or uses acme's. A socket file left behind by an earlier run
+// is replaced.
+func (s listenSpec) listen(acme *acmeManager, opts listenOptions) (net.Listener, error) {
+	var config *tls.Config
+	if s.acme {
+		config = acme.tlsConfig()
+	}
+	if s.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		// WebSocket upgrades need HTTP/1.1.
+		config = &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"http/1.1"}}
+	}
+	if s.network == "unix" {
+		if info, err := os.Stat(s.addr); err == nil && info.Mode().Type() == fs.ModeSocket {
+			_ = os.Remove(s.addr)
+		} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	var ln net.Listener
+	var err error
+	if s.network == "npipe" {
+		ln, err = listenNamedPipe(s.addr)
+	} else {
+		lc := net.ListenConfig{KeepAlive: opts.keepAlive}
+		ln, err = lc.Listen(context.Background(), s.network, s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if opts.maxConns > 0 {
+		// Counted before TLS, so a handshake that never finishes holds
+		// a slot too.
+		ln = newLimitListener(ln, s.String(), opts.maxConns, opts.onConn)
+	}
+	if config != nil {
+		if opts.clientCAs != nil {
+			// Unless one is required, a client without a certificate may
+			// still use another -auth method.
+			config = config.Clone()
+			config.ClientCAs, config.ClientAuth = opts.clientCAs, tls.VerifyClientCertIfGiven
+			if opts.requireCert {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		}
+		ln = tls.NewListener(ln, config)
+	}
+	return ln, nil
+}
+
+// listenFlag collects -listen, which may be repeated or comma-separated.
+// Setting it replaces the default.
+type listenFlag struct {
+	values []string
+	set    bool
+}
+
+func (f *listenFlag) String() string {
+	return strings.Join(f.values, ",")
+}
+
+func (f *listenFlag) Set(value string) error {
+	if !f.set {
+		f.values, f.set = nil, true
+	}
+	f.values = append(f.values, splitList(value)...)
+	return nil
+}
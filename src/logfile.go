@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const logFileTimeFormat = "20060102T150405.000"
+
+// logRotation configures -log-file: the file is rotated once it grows past
+// maxSize or has been written for longer than maxAge, and at most
+// maxBackups rotated files are kept. Zero disables each limit.
+type logRotation struct {
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+}
+
+// rotatingFile is an io.Writer appending to path. Rotated files are renamed
+// to <name>-<time><ext> next to it, e.g. browserd-20260102T150405.000.log.
+type rotatingFile struct {
+	path   string
+	policy logRotation
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func openRotatingFile(path string, policy logRotation) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	r := &rotatingFile{path: path, policy: policy}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file, r.size, r.openedAt = f, info.Size(), time.Now()
+	return nil
+}
+
+// Write appends one log record, rotating first if it would cross a limit.
+// A failed rotation keeps writing to the current file rather than losing
+// records.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.due(len(p)) {
+		if err := r.rotate(); err != nil && r.file == nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) due(next int) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.policy.maxSize > 0 && r.size+int64(next) > r.policy.maxSize {
+		return true
+	}
+	return r.policy.maxAge > 0 && time.Since(r.openedAt) >= r.policy.maxAge
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	r.file = nil
+	ext := filepath.Ext(r.path)
+	rotated := strings.TrimSuffix(r.path, ext) + "-" + time.Now().Format(logFileTimeFormat) + ext
+	renameErr := os.Rename(r.path, rotated)
+	if err := r.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	r.prune()
+	return nil
+}
+
+// prune removes the oldest rotated files beyond maxBackups.
+func (r *rotatingFile) prune() {
+	if r.policy.maxBackups <= 0 {
+		return
+	}
+	ext := filepath.Ext(r.path)
+	backups, _ := filepath.Glob(strings.TrimSuffix(r.path, ext) + "-*" + ext)
+	if len(backups) <= r.policy.maxBackups {
+		return
+	}
+	// The timestamp suffix sorts chronologically.
+	sort.Strings(backups)
+	for _, name := range backups[:len(backups)-r.policy.maxBackups] {
+		_ = os.Remove(name)
+	}
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+)
+
+// logSink is a log destination that records each line's severity itself,
+// such as syslog or the systemd journal.
+type logSink interface {
+	writeRecord(level slog.Level, line []byte) error
+}
+
+// setupLogging installs the process-wide structured logger writing to out.
+// Output from the standard log package, such as net/http's, goes through
+// it too. When out is a logSink, records are passed on one at a time with
+// their level and without a timestamp, which the sink adds.
+func setupLogging(level, format string, out io.Writer) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	sink, isSink := out.(logSink)
+	var sw *sinkWriter
+	if isSink {
+		sw = &sinkWriter{sink: sink}
+		out = sw
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		}
+	}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "json":
+		handler = slog.NewJSONHandler(out, opts)
+	case "text":
+		handler = slog.NewTextHandler(out, opts)
+	default:
+		return fmt.Errorf("unknown format %q (want json or text)", format)
+	}
+	if isSink {
+		handler = &sinkHandler{Handler: handler, w: sw}
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// sinkHandler hands the level of the record being formatted to the
+// sinkWriter its inner handler writes the line to.
+type sinkHandler struct {
+	slog.Handler
+	w *sinkWriter
+}
+
+func (h *sinkHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.w.mu.Lock()
+	defer h.w.mu.Unlock()
+	h.w.level = r.Level
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *sinkHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &sinkHandler{Handler: h.Handler.WithAttrs(attrs), w: h.w}
+}
+
+func (h *sinkHandler) WithGroup(name string) slog.Handler {
+	return &sinkHandler{Handler: h.Handler.WithGroup(name), w: h.w}
+}
+
+type sinkWriter struct {
+	sink logSink
+
+	mu    sync.Mutex
+	level slog.Level
+}
+
+// Write is called once per record, with mu held by sinkHandler.Handle.
+func (w *sinkWriter) Write(p []byte) (int, error) {
+	return len(p), w.sink.writeRecord(w.level, bytes.TrimSuffix(p, []byte("\n")))
+}
+
+// openLogOutput returns the writer for -log-output.
+func openLogOutput(output, syslogAddr string) (io.Writer, error) {
+	var (
+		w   io.Writer
+		err error
+	)
+	switch output {
+	case "syslog":
+		w, err = openSyslog(syslogAddr)
+	case "journald":
+		w, err = openJournald()
+	default:
+		return nil, fmt.Errorf("unknown output %q (want stderr, syslog or journald)", output)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// clientIP strips the port from a remote address.
+func clientIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
@@ -2,16 +2,26 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -22,6 +32,10 @@ const (
 	defaultDebugURL = "http://127.0.0.1:9222"
 	defaultListen   = ":9223"
 	requestTimeout  = 5 * time.Second
+	// chromiumWaitInterval is how often -wait-for-chromium polls.
+	chromiumWaitInterval = 250 * time.Millisecond
+
+	defaultUserDataDir = "/home/chromiumuser/user-data"
 )
 
 type versionInfo struct {
@@ -30,19 +44,487 @@ type versionInfo struct {
 	WebSocketDebuggerURL string `json:"webSocketDebuggerUrl"`
 }
 
+type proxyConfig struct {
+	chromiumEndpoint string
+	// listen are the client listeners; empty means defaultListen unless
+	// there is a tunnel.
+	listen []listenSpec
+
+	// tunnelHub, when set, is a hub WebSocket URL browserd dials out to
+	// and receives client connections through, authenticating with
+	// tunnelToken and naming itself tunnelName.
+	tunnelHub   string
+	tunnelToken string
+	tunnelName  string
+
+	// clusterRedis, when set, registers the replica and its sessions in
+	// Redis, as clusterID reachable at clusterURL, under clusterPrefix
+	// with keys expiring after clusterTTL.
+	clusterRedis  string
+	clusterID     string
+	clusterURL    string
+	clusterPrefix string
+	clusterTTL    time.Duration
+
+	// chromiumFallback, when set, is a second Chromium endpoint used while
+	// chromiumEndpoint can't be reached.
+	chromiumFallback string
+
+	// dialWindow bounds how long a client waits while its upstream dial is
+	// retried; 0 fails on the first error.
+	dialWindow time.Duration
+	// preconnect keeps a standing connection to Chromium for the next
+	// session to take.
+	preconnect bool
+	// upstreamClient tunes requests to Chromium's /json endpoints.
+	upstreamClient upstreamClientConfig
+
+	// crashDir, when set, collects crash minidumps and logs into one
+	// directory per incident, keeping at most crashMaxIncidents.
+	crashDir          string
+	crashMaxIncidents int
+
+	// chromiumLogLines is how many lines of supervised browser output are
+	// kept for /admin/chromium/logs; 0 passes the output through as is.
+	chromiumLogLines int
+
+	// waitChromium, when set, holds startup until Chromium answers, for at
+	// most this long.
+	waitChromium time.Duration
+
+	// debuggerHost and debuggerPort, when set, replace the host and port of
+	// the webSocketDebuggerUrl reported by Chromium before it is dialed.
+	debuggerHost string
+	debuggerPort string
+	// upstreamHost, when set, is sent as the Host header of requests and
+	// handshakes to Chromium.
+	upstreamHost string
+	// upstreamHeaders are added to every request and handshake to
+	// Chromium, for hosted browsers or an authenticating proxy in front.
+	upstreamHeaders http.Header
+
+	// acme issues certificates for ?acme listeners.
+	acme acmeConfig
+
+	// apiKeysFile names the -api-keys file of named client keys with their
+	// own quotas, and apiKeyState where their usage is kept.
+	apiKeysFile string
+	apiKeyState string
+
+	// token, when set, must be supplied by clients as ?token= or an
+	// Authorization bearer header, unless auth picks other methods.
+	token string
+	auth  authConfig
+
+	// adminAuth protects the operational endpoints.
+	adminAuth adminAuth
+
+	// metricLabels lists the session label keys exported as metric labels.
+	metricLabels []string
+
+	// sessionLogDir, when set, receives one log file per session.
+	sessionLogDir string
+	// record keeps every session's CDP traffic in its temp directory.
+	record bool
+	// errorScreenshots captures the pages of sessions that end with an
+	// error into their temp directories.
+	errorScreenshots bool
+
+	// dumpDir, when set, receives the SIGUSR1 diagnostic dumps instead of
+	// the log.
+	dumpDir string
+
+	// grpcAddr, when set, serves the gRPC admin API.
+	grpcAddr string
+
+	// adminAddr, when set, moves the operational endpoints off the client
+	// listener onto this address, adding pprof.
+	adminAddr string
+
+	// chromiumBin enables supervised mode: browserd launches and restarts
+	// Chromium itself, listening on the port from chromiumEndpoint.
+	chromiumBin  string
+	chromiumArgs []string
+	// chromiumPipe talks to the supervised Chromium over
+	// --remote-debugging-pipe, so it opens no debugging port.
+	chromiumPipe bool
+	userDataDir  string
+	limits       resourceLimits
+	// extensions are unpacked extension directories loaded into the
+	// supervised Chromium.
+	extensions []string
+	// dns pins the name resolution of supervised browsers.
+	dns dnsConfig
+	// headful runs the supervised Chromium with a window on a managed
+	// Xvfb display instead of headless.
+	headful       bool
+	xvfbBin       string
+	displayNumber int
+	displaySize   displaySize
+	// vncAddr enables x11vnc on the headful display.
+	vncAddr     string
+	vncPassword string
+	x11vncBin   string
+
+	// warmPoolSize browsers are kept ready besides the shared one for
+	// sessions that ask for a browser of their own, debugging on ports
+	// from warmPoolBasePort up.
+	warmPoolSize     int
+	warmPoolBasePort int
+	// warmPoolReuse resets exclusive sessions' browsers for the next
+	// session instead of stopping them.
+	warmPoolReuse bool
+	// chromiumBuilds are the binaries warm pool and profile browsers are
+	// launched from, by weight, when there are more than -chromium-bin.
+	chromiumBuilds []*chromiumBuild
+	// profilesDir holds the named persistent profiles sessions can pick
+	// with ?profile=.
+	profilesDir string
+
+	// flagProfiles are named sets of Chromium flags sessions can ask for
+	// with ?flags=, each getting a browser launched with them.
+	flagProfiles map[string]*flagProfile
+	// launchAllow is what sessions may set on a browser launched for them
+	// with ?env= and ?arg=.
+	launchAllow launchAllowlist
+
+	// tempDir holds browserd's scratch files; session artifacts are kept
+	// for tempRetention after the session ends.
+	tempDir       string
+	tempRetention time.Duration
+	// artifactStore, when set, is where the artifacts of ended sessions
+	// are copied, for as long as artifactRetention gives each type.
+	artifactStore     string
+	artifactRetention map[string]time.Duration
+
+	// recycle configures resource monitoring and automatic recycling.
+	recycle recyclePolicy
+	// maintenanceSchedule, when set, opens a maintenance window lasting
+	// up to maintenanceWindow in which the supervised browser is
+	// recycled once its sessions have ended.
+	maintenanceSchedule *cronSchedule
+	maintenanceWindow   time.Duration
+	// browserMetricsInterval is how often every browser's CPU, memory,
+	// targets and JS heap are exported to /metrics; 0 turns it off.
+	browserMetricsInterval time.Duration
+
+	// probe configures active health checks of the Chromium backend.
+	probe probePolicy
+
+	// hiddenTargets lists target types removed from proxied /json/list.
+	hiddenTargets []string
+
+	// devtoolsFrontend, when set, is served at /devtools/ (see
+	// newDevtoolsFrontend) and linked from /json/list.
+	devtoolsFrontend string
+
+	// initCommands are sent to every page target before the client sees it.
+	initCommands []cdpCommand
+
+	// blockList, when set, aborts matching requests on every page target.
+	blockList *blockList
+
+	// urlPolicy, when set, limits the URLs clients can navigate to.
+	urlPolicy *urlPolicy
+
+	// networkGuard, when set, fails page requests to private addresses.
+	networkGuard *networkGuard
+
+	// interceptRules are applied to every page target's requests before
+	// the block list.
+	interceptRules []interceptRule
+
+	// anomalyRules flag suspicious client CDP usage.
+	anomalyRules []anomalyRule
+
+	// siteCredentials are injected into the requests of the sites they
+	// match.
+	siteCredentials siteCredentials
+
+	// strictIsolation gives each session its own browser context and
+	// rejects CDP commands that reach outside it.
+	strictIsolation bool
+
+	// allowSessionProxy lets clients pick an egress proxy with ?proxy=.
+	allowSessionProxy bool
+
+	// device is the preset emulated when a client doesn't pass ?device=.
+	device string
+	// network is the profile emulated when a client doesn't pass
+	// ?network=.
+	network string
+	// screencast caps every session's screencasts; clients may tighten it.
+	screencast screencastCap
+	// permissions are granted and denied in every session's browser
+	// context, on top of which clients may pass their own.
+	permissions *permissionPolicy
+
+	// stealth turns on stealth mode for every session.
+	stealth bool
+
+	// webhookURLs receive session lifecycle and browser restart events,
+	// signed with webhookSecret when it is set.
+	webhookURLs   []string
+	webhookSecret string
+
+	// statsd, when set, pushes the metrics to a StatsD agent as well.
+	statsdAddr     string
+	statsdPrefix   string
+	statsdTags     []string
+	statsdInterval time.Duration
+
+	// maxSessions and maxAPIRequests cap concurrent CDP sessions and HTTP
+	// API requests; clients over the limit are told to retry after
+	// retryAfter.
+	maxSessions    int
+	maxAPIRequests int
+	retryAfter     time.Duration
+	// renderCacheTTL, when set, caches /api/content responses for that
+	// long, up to renderCacheSize bytes, in memory or in renderCacheDir.
+	renderCacheTTL  time.Duration
+	renderCacheSize int64
+	renderCacheDir  string
+	// jobConcurrency is how many tasks of a POST /api/jobs run at once.
+	jobConcurrency int
+	// scaleTargetSessions is the session count /scale reports as full
+	// when there is no maxSessions.
+	scaleTargetSessions int
+	// admissionWait is how long a connection over maxSessions is queued
+	// for a slot, and priorityAging how long a queued connection waits
+	// before moving up a priority class. tokenPriority is the class of
+	// clients that don't use an API key.
+	admissionWait time.Duration
+	priorityAging time.Duration
+	tokenPriority int
+
+	// maxMessageSize caps WebSocket messages read from clients and from
+	// Chromium alike; 0 means no limit.
+	maxMessageSize int64
+
+	// maxUploadSize caps a POST /api/sessions/{id}/files body; 0 means no
+	// limit.
+	maxUploadSize int64
+	// maxRequestSize caps the bodies of the other HTTP API and /json
+	// requests, and maxHeaderSize the headers of every client request; 0
+	// means no limit and Go's default respectively.
+	maxRequestSize int64
+	maxHeaderSize  int64
+	// maxConnections caps the connections open at once on each client
+	// listener, 0 meaning no limit; tcpKeepAlive is their TCP keepalive
+	// period, negative for none; headerTimeout bounds reading a request's
+	// headers.
+	maxConnections int
+	tcpKeepAlive   time.Duration
+	headerTimeout  time.Duration
+	// headers is the security headers added to HTTP responses.
+	headers headerPolicy
+
+	// middleware is the chain every relayed frame passes through.
+	middleware middlewareChain
+
+	// frameHook, when set, is a program every relayed text frame is handed
+	// to after the middleware, answering within frameHookBudget.
+	frameHook       []string
+	frameHookBudget time.Duration
+	// frameHookOnFailure is what happens to a frame the hook didn't
+	// answer: forward, drop or close.
+	frameHookOnFailure string
+
+	// protocolShims, when set, translates the CDP of current clients for
+	// older browsers (see protocolShims).
+	protocolShims *protocolCompat
+
+	// validateFrames rejects client frames that aren't well-formed CDP
+	// commands instead of forwarding them.
+	validateFrames bool
+
+	// debuggerRefresh is how often /json/version is polled in the
+	// background; 0 only looks it up when a dial needs it.
+	debuggerRefresh time.Duration
+	// idleTimeout, when set, closes sessions whose client sent no CDP
+	// command for that long.
+	idleTimeout time.Duration
+
+	// commandTimeout, when set, fails client commands Chromium hasn't
+	// answered within it; killHungTargets also closes their target.
+	commandTimeout  time.Duration
+	killHungTargets bool
+
+	// reconnectWindow, when set, is how long a session that lost the
+	// shared browser waits for it to come back, buffering up to
+	// reconnectBuffer client frames meanwhile.
+	reconnectWindow time.Duration
+	reconnectBuffer int
+
+	// maxCommandRate, when set, caps the CDP frames a client sends per
+	// second, allowing bursts of commandBurst.
+	maxCommandRate float64
+	commandBurst   int
+
+	// fairShare, when set, caps the fairMethods commands running at once on
+	// the shared browser, taking turns between sessions.
+	fairShare   int
+	fairMethods []string
+
+	// pools are the -pools named pools, served under /pools/<name>/.
+	pools map[string]*poolSpec
+	// metrics, when set, is recorded into instead of a new registry, as
+	// by a named pool.
+	metrics *metricsRegistry
+}
+
 type proxyServer struct {
 	chromiumURL *url.URL
-	listenAddr  string
+	listen      []listenSpec
+	tunnel      *tunnelAgent
+	cluster     *clusterRegistry
+
+	debuggerHost    string
+	debuggerPort    string
+	upstreamHost    string
+	upstreamHeaders http.Header
+
+	// staticDebugger is set when -chromium points at a ws:// debugger URL,
+	// in which case /json/version discovery is skipped entirely.
+	staticDebugger bool
+
+	auths             []authenticator
+	clientCAs         *x509.CertPool
+	requireClientCert bool
+	apiKeys           *apiKeyStore
+	acme              *acmeManager
+	adminAuth         adminAuth
+
+	sessions      *sessionRegistry
+	metrics       *metricsRegistry
+	sessionLogDir string
+	record        bool
+	recordings    *recordingIndex
+	artifacts     *artifactArchive
+	dumpDir       string
+	grpcAddr      string
+	adminAddr     string
+	// errorScreenshots is set by -error-screenshots.
+	errorScreenshots bool
+
+	supervisor *supervisor
+	temp       *tempStore
+	pool       *warmPool
+	recycle    recyclePolicy
+	// maintenanceSchedule and maintenanceWindow are the scheduled
+	// recycles of the supervised browser, if any.
+	maintenanceSchedule *cronSchedule
+	maintenanceWindow   time.Duration
+	health              *backendHealth
+	// browserMetricsInterval is cfg.browserMetricsInterval.
+	browserMetricsInterval time.Duration
+	targetFilter           targetFilter
+	frontend               http.Handler
+	initCommands           []cdpCommand
+	blockList              *blockList
+	urlPolicy              *urlPolicy
+	networkGuard           *networkGuard
+	rules                  []interceptRule
+	anomalyRules           []anomalyRule
+	siteCredentials        siteCredentials
+	isolate                bool
+	allowProxy             bool
+	device                 string
+	network                string
+	screencast             screencastCap
+	permissions            *permissionPolicy
+	stealth                bool
+	maxSessions            int
+	maxMessage             int64
+	maxUpload              int64
+	maxRequest             int64
+	maxHeader              int64
+	maxConnections         int
+	tcpKeepAlive           time.Duration
+	headerTimeout          time.Duration
+	headers                headerPolicy
+	cmdTimeout             time.Duration
+	idleTimeout            time.Duration
+	validateFrames         bool
+	middleware             middlewareChain
+	compat                 *protocolCompat
+	killHung               bool
+	reconnectWindow        time.Duration
+	reconnectBuffer        int
+	commandRate            float64
+	commandBurst           int
+	fairShare              *fairScheduler
+	sessionSlots           atomic.Int64
+	admission              *admissionQueue
+	tokenPriority          int
+	scaleTarget            int
+	apiSlots               chan struct{}
+	renderCache            *renderCache
+	jobs                   *jobStore
+	jobConcurrency         int
+	retryAfter             time.Duration
+	webhooks               *webhookNotifier
+	events                 *eventBroker
+	statsd                 *statsdSink
+
+	// namedPools are the -pools proxies, each serving /pools/<name>/;
+	// poolName is set on those.
+	namedPools map[string]*proxyServer
+	poolName   string
+
+	// dialing counts sessions waiting on their upstream dial, and
+	// browserRSS is the supervised browser's last sampled RSS, for /scale.
+	dialing    atomic.Int64
+	browserRSS atomic.Int64
+
+	// draining makes the proxy refuse new sessions while existing ones
+	// finish. It is set while recycling, ahead of a browser recycle, or
+	// drained, by an operator through /admin/drain or gRPC.
+	draining  atomic.Bool
+	recycling atomic.Bool
+	drained   atomic.Bool
+	// recycleMu keeps resource and scheduled recycles from overlapping.
+	// maintenanceDone is closed when the running maintenance window, if
+	// any, closes.
+	recycleMu       sync.Mutex
+	maintenanceDone atomic.Pointer[chan struct{}]
 
 	upgrader websocket.Upgrader
 	dialer   websocket.Dialer
 	client   *http.Client
 
+	// fallback takes new sessions while the primary Chromium is down.
+	fallback *fallbackBackend
+
+	dialWindow   time.Duration
+	preconnect   *preconnector
+	waitChromium time.Duration
+
+	// chromiumLogs keeps the recent output of supervised browsers.
+	chromiumLogs *chromiumLogs
+	crashes      *crashCollector
+
+	// protocol caches Chromium's /json/protocol descriptor.
+	protocol protocolCache
+
+	// debuggerRefresh is how often the debugger URL is refreshed in the
+	// background, and refreshNow asks for a refresh straight away.
+	debuggerRefresh time.Duration
+	refreshNow      chan struct{}
+
 	mu          sync.RWMutex
 	debuggerURL string
+	// lastDebuggerURL survives resetDebuggerURL, so a browser coming back
+	// with a new URL is seen as a new generation.
+	lastDebuggerURL string
+	generation      int64
+	// browserVersion is the Browser string of the primary's
+	// /json/version, for -protocol-shims auto.
+	browserVersion string
 }
 
-func newProxyServer(chromiumEndpoint, listenAddr string) (*proxyServer, error) {
+func newProxyServer(cfg proxyConfig) (*proxyServer, error) {
+	chromiumEndpoint := cfg.chromiumEndpoint
 	if chromiumEndpoint == "" {
 		chromiumEndpoint = defaultDebugURL
 	}
@@ -52,17 +534,104 @@ func newProxyServer(chromiumEndpoint, listenAddr string) (*proxyServer, error) {
 		return nil, err
 	}
 
-	if parsed.Scheme == "" {
+	switch parsed.Scheme {
+	case "":
 		return nil, errors.New("chromium debugger URL must include scheme (e.g. http://)")
+	case "http", "https", "ws", "wss":
+	default:
+		return nil, errors.New("chromium debugger URL scheme must be http, https, ws or wss")
+	}
+
+	listen := cfg.listen
+	if len(listen) == 0 && cfg.tunnelHub == "" {
+		listen = []listenSpec{{network: "tcp", addr: defaultListen}}
+	}
+
+	if cfg.sessionLogDir != "" {
+		if err := os.MkdirAll(cfg.sessionLogDir, 0o755); err != nil {
+			return nil, err
+		}
 	}
 
-	if listenAddr == "" {
-		listenAddr = defaultListen
+	if cfg.debuggerPort != "" {
+		if port, err := strconv.Atoi(cfg.debuggerPort); err != nil || port < 1 || port > 65535 {
+			return nil, errors.New("debugger port override must be a number between 1 and 65535")
+		}
+	}
+
+	temp, err := newTempStore(cfg.tempDir, cfg.tempRetention)
+	if err != nil {
+		return nil, fmt.Errorf("temp dir: %w", err)
+	}
+
+	if cfg.metrics == nil {
+		cfg.metrics = newMetricsRegistry(cfg.metricLabels)
 	}
 
 	server := &proxyServer{
-		chromiumURL: parsed,
-		listenAddr:  listenAddr,
+		chromiumURL:            parsed,
+		listen:                 listen,
+		debuggerHost:           cfg.debuggerHost,
+		debuggerPort:           cfg.debuggerPort,
+		upstreamHost:           cfg.upstreamHost,
+		upstreamHeaders:        cfg.upstreamHeaders,
+		adminAuth:              cfg.adminAuth,
+		sessions:               newSessionRegistry(),
+		metrics:                cfg.metrics,
+		sessionLogDir:          cfg.sessionLogDir,
+		record:                 cfg.record,
+		dumpDir:                cfg.dumpDir,
+		grpcAddr:               cfg.grpcAddr,
+		adminAddr:              cfg.adminAddr,
+		temp:                   temp,
+		recycle:                cfg.recycle,
+		maintenanceSchedule:    cfg.maintenanceSchedule,
+		maintenanceWindow:      cfg.maintenanceWindow,
+		browserMetricsInterval: cfg.browserMetricsInterval,
+		targetFilter:           newTargetFilter(cfg.hiddenTargets),
+		initCommands:           cfg.initCommands,
+		blockList:              cfg.blockList,
+		urlPolicy:              cfg.urlPolicy,
+		networkGuard:           cfg.networkGuard,
+		rules:                  cfg.interceptRules,
+		anomalyRules:           cfg.anomalyRules,
+		siteCredentials:        cfg.siteCredentials,
+		isolate:                cfg.strictIsolation,
+		allowProxy:             cfg.allowSessionProxy,
+		device:                 cfg.device,
+		network:                cfg.network,
+		screencast:             cfg.screencast,
+		permissions:            cfg.permissions,
+		stealth:                cfg.stealth,
+		maxSessions:            cfg.maxSessions,
+		scaleTarget:            cfg.scaleTargetSessions,
+		maxMessage:             cfg.maxMessageSize,
+		maxUpload:              cfg.maxUploadSize,
+		maxRequest:             cfg.maxRequestSize,
+		maxHeader:              cfg.maxHeaderSize,
+		maxConnections:         cfg.maxConnections,
+		tcpKeepAlive:           cfg.tcpKeepAlive,
+		headerTimeout:          cfg.headerTimeout,
+		headers:                cfg.headers,
+		jobs:                   &jobStore{jobs: make(map[string]*job)},
+		jobConcurrency:         cfg.jobConcurrency,
+		cmdTimeout:             cfg.commandTimeout,
+		idleTimeout:            cfg.idleTimeout,
+		debuggerRefresh:        cfg.debuggerRefresh,
+		refreshNow:             make(chan struct{}, 1),
+		validateFrames:         cfg.validateFrames,
+		middleware:             cfg.middleware,
+		compat:                 cfg.protocolShims,
+		killHung:               cfg.killHungTargets,
+		reconnectWindow:        cfg.reconnectWindow,
+		reconnectBuffer:        cfg.reconnectBuffer,
+		commandRate:            cfg.maxCommandRate,
+		commandBurst:           cfg.commandBurst,
+		retryAfter:             cfg.retryAfter,
+		admission:              &admissionQueue{wait: cfg.admissionWait, aging: cfg.priorityAging},
+		tokenPriority:          cfg.tokenPriority,
+		dialWindow:             cfg.dialWindow,
+		waitChromium:           cfg.waitChromium,
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool { return true },
 		},
@@ -71,29 +640,297 @@ func newProxyServer(chromiumEndpoint, listenAddr string) (*proxyServer, error) {
 			HandshakeTimeout: requestTimeout,
 		},
 		client: &http.Client{
-			Timeout: requestTimeout,
+			Timeout: cfg.upstreamClient.timeout,
 		},
 	}
+	var upstreamDial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	if parsed.Scheme == "ws" || parsed.Scheme == "wss" {
+		debuggerURL, err := server.rewriteDebuggerURL(parsed.String())
+		if err != nil {
+			return nil, err
+		}
+		server.staticDebugger = true
+		server.debuggerURL = debuggerURL
+	} else {
+		server.metrics.register("browserd_upstream_generation", metricGauge, "Debugger URLs seen so far; it goes up each time Chromium comes back with a new one.")
+		server.metrics.register("browserd_upstream_changes_total", metricCounter, "Times the debugger URL reported by Chromium changed.")
+	}
+
+	server.metrics.register("browserd_api_requests_total", metricCounter, "HTTP API requests by endpoint and outcome.")
+	server.metrics.register("browserd_rejected_total", metricCounter, "Sessions and API requests turned away by a concurrency limit.")
+	server.metrics.register("browserd_launch_options_ignored_total", metricCounter, "Sessions whose browserless launch= payload had options browserd doesn't apply.")
+	if cfg.maxSessions > 0 && cfg.admissionWait > 0 {
+		server.metrics.register("browserd_admission_queue", metricGauge, "Connections waiting for a session slot, by priority class.")
+	}
+	server.metrics.register("browserd_draining", metricGauge, "1 while the replica refuses new sessions, for a recycle or an operator drain.")
+	server.metrics.register("browserd_scale_pressure", metricGauge, "Highest utilization across this replica's limits, as served on /scale; 1 is full.")
+	server.metrics.register("browserd_session_taps", metricGauge, "Observers connected to session traffic taps.")
+	server.metrics.register("browserd_tap_dropped_frames_total", metricCounter, "Frames session tap observers missed by falling behind.")
+	server.metrics.register("browserd_goroutines", metricGauge, "Goroutines in the process, sampled when metrics are read.")
+	server.metrics.register("browserd_relay_goroutines", metricGauge, "Goroutines relaying session traffic, two per connected session.")
+	server.metrics.register("browserd_relay_buffered_frames", metricGauge, "Frames waiting in relay buffers, by queue (held or reconnect).")
+	server.metrics.register("browserd_relay_queued_frames_total", metricCounter, "Frames that went through a relay buffer, by queue.")
+	server.metrics.register("browserd_relay_queue_wait_seconds_total", metricCounter, "Time frames spent in relay buffers, by queue.")
+	server.metrics.register("browserd_heap_bytes", metricGauge, "Bytes of allocated heap objects, sampled when metrics are read.")
+	server.metrics.register("browserd_gc_cycles_total", metricCounter, "Completed garbage collection cycles, sampled when metrics are read.")
+	server.metrics.register("browserd_gc_pause_seconds_total", metricCounter, "Time the garbage collector stopped the process, sampled when metrics are read.")
+	server.metrics.register("browserd_gc_last_pause_seconds", metricGauge, "Duration of the last garbage collection pause, sampled when metrics are read.")
+	server.metrics.register("browserd_targets_lost_total", metricCounter, "Page targets whose debugging session Chromium took away, by reason: replaced_with_devtools, crashed or detached.")
+	server.metrics.register("browserd_relay_stuck_total", metricCounter, "Sessions whose relay goroutines were still running after both connections closed.")
+	if cfg.maxMessageSize > 0 {
+		server.metrics.register("browserd_oversized_messages_total", metricCounter, "Sessions ended by a message over -max-message-size, by the side that sent it.")
+	}
+	if len(cfg.frameHook) > 0 {
+		hook, err := newFrameHook(cfg.frameHook, cfg.frameHookBudget, cfg.frameHookOnFailure, server.metrics)
+		if err != nil {
+			return nil, fmt.Errorf("frame hook: %w", err)
+		}
+		server.middleware = append(server.middleware, hook)
+	}
+	if cfg.protocolShims != nil {
+		server.middleware = append(server.middleware, compatMiddleware{})
+	}
+	if cfg.clusterRedis != "" {
+		if server.cluster, err = newClusterRegistry(cfg.clusterRedis, cfg.clusterPrefix, cfg.clusterID, cfg.clusterURL, cfg.clusterTTL, server.metrics); err != nil {
+			return nil, fmt.Errorf("cluster redis: %w", err)
+		}
+	}
+	if cfg.tunnelHub != "" {
+		server.tunnel = newTunnelAgent(cfg.tunnelHub, cfg.tunnelToken, cfg.tunnelName, server.metrics)
+	}
+	if cfg.validateFrames {
+		server.metrics.register("browserd_invalid_frames_total", metricCounter, "Client frames -validate-frames rejected.")
+	}
+	if cfg.idleTimeout > 0 {
+		server.metrics.register("browserd_idle_sessions_closed_total", metricCounter, "Sessions closed by -idle-timeout.")
+	}
+	if cfg.maxCommandRate > 0 {
+		server.metrics.register("browserd_throttled_commands_total", metricCounter, "Client frames held back by -max-command-rate.")
+	}
+	if cfg.fairShare > 0 {
+		server.fairShare = newFairScheduler(cfg.fairShare, cfg.fairMethods)
+		server.metrics.register("browserd_fair_share_commands_total", metricCounter, "Heavy commands scheduled by -fair-share, by whether they waited for a turn.")
+		server.metrics.register("browserd_fair_share_wait_seconds_total", metricCounter, "Time heavy commands waited for a -fair-share turn.")
+	}
+	if cfg.commandTimeout > 0 {
+		server.metrics.register("browserd_command_timeouts_total", metricCounter, "Client commands answered with a timeout error by -command-timeout, by method.")
+	}
+	if len(cfg.anomalyRules) > 0 {
+		server.metrics.register("browserd_anomalies_total", metricCounter, "Anomaly rules fired by client commands, by rule and action.")
+	}
+	server.metrics.register("browserd_screencast_capped_total", metricCounter, "Page.startScreencast commands rewritten (kind=command) and screencast frames dropped (kind=frame) to stay within a session's screencast cap.")
+	if cfg.reconnectWindow > 0 {
+		server.metrics.register("browserd_upstream_reconnects_total", metricCounter, "Sessions that lost the shared browser and tried to reconnect within -reconnect-window, by result.")
+		server.metrics.register("browserd_session_migrations_total", metricCounter, "Idle sessions POST /admin/migrate tried to move to another backend, by result.")
+	}
+	if cfg.grpcAddr != "" {
+		server.metrics.register("browserd_grpc_requests_total", metricCounter, "gRPC admin API calls by method and status code.")
+	}
+	if cfg.maxAPIRequests > 0 {
+		server.apiSlots = make(chan struct{}, cfg.maxAPIRequests)
+	}
+	server.metrics.register("browserd_job_tasks_total", metricCounter, "Tasks of /api/jobs batches that finished, by type and status.")
+	if cfg.renderCacheTTL > 0 {
+		if server.renderCache, err = newRenderCache(cfg.renderCacheTTL, cfg.renderCacheSize, cfg.renderCacheDir, server.metrics); err != nil {
+			return nil, fmt.Errorf("render cache: %w", err)
+		}
+	}
+
+	if cfg.statsdAddr != "" {
+		if server.statsd, err = newStatsdSink(cfg.statsdAddr, cfg.statsdPrefix, cfg.statsdTags, cfg.statsdInterval, server.metrics); err != nil {
+			return nil, err
+		}
+		server.statsd.sample = server.sampleRuntime
+	}
+
+	if len(cfg.webhookURLs) > 0 {
+		server.webhooks = newWebhookNotifier(cfg.webhookURLs, cfg.webhookSecret, server.metrics)
+	}
+	server.events = newEventBroker(server.metrics)
+
+	if cfg.chromiumFallback != "" {
+		if server.fallback, err = newFallbackBackend(cfg.chromiumFallback); err != nil {
+			return nil, fmt.Errorf("chromium fallback: %w", err)
+		}
+		server.metrics.register("browserd_backend_failovers_total", metricCounter, "Times new sessions were switched to -chromium-fallback.")
+	}
+	if cfg.maxConnections > 0 {
+		server.metrics.register("browserd_open_connections", metricGauge, "Client connections open on each listener with -max-connections.")
+		server.metrics.register("browserd_refused_connections_total", metricCounter, "Client connections closed on accept because their listener was at -max-connections.")
+	}
+	if cfg.maxRequestSize > 0 {
+		server.metrics.register("browserd_oversized_requests_total", metricCounter, "HTTP API and /json requests refused with 413 for a body over -max-request-size.")
+	}
+	server.metrics.register("browserd_upstream_dial_retries_total", metricCounter, "Upstream dials retried after a transient failure.")
+	server.metrics.register("browserd_session_annotations_total", metricCounter, "Annotations added to sessions, by author (client or operator).")
+	if cfg.upstreamClient.retries > 0 {
+		server.metrics.register("browserd_upstream_request_retries_total", metricCounter, "Requests to Chromium's /json endpoints retried, by reason: error or the status.")
+	}
+	if cfg.record {
+		server.recordings = newRecordingIndex()
+	}
+	if cfg.errorScreenshots {
+		server.errorScreenshots = true
+		server.metrics.register("browserd_error_screenshots_total", metricCounter, "Pages of failed sessions captured by -error-screenshots, by result (ok or error).")
+	}
+	if cfg.artifactStore != "" {
+		store, err := newArtifactStore(cfg.artifactStore)
+		if err != nil {
+			return nil, fmt.Errorf("artifact store: %w", err)
+		}
+		server.artifacts = newArtifactArchive(store, cfg.artifactRetention, server.metrics)
+	}
+	if cfg.preconnect {
+		server.preconnect = newPreconnector()
+		server.metrics.register("browserd_preconnect_requests_total", metricCounter, "Upstream dials that found a current -preconnect connection (hit) or not (miss).")
+		server.metrics.register("browserd_preconnect_failures_total", metricCounter, "Standing -preconnect connections that failed to dial.")
+	}
+
+	if cfg.devtoolsFrontend != "" {
+		if server.frontend, err = newDevtoolsFrontend(cfg.devtoolsFrontend, cfg.headers); err != nil {
+			return nil, fmt.Errorf("devtools frontend: %w", err)
+		}
+	}
+
+	if cfg.blockList != nil {
+		server.metrics.register("browserd_blocked_requests_total", metricCounter, "Requests aborted by the ad and tracker block list.")
+	}
+	if cfg.networkGuard != nil {
+		server.metrics.register("browserd_private_network_blocked_total", metricCounter, "Page requests to private addresses failed by -block-private-networks.")
+	}
+	for _, spec := range listen {
+		if spec.acme && server.acme == nil {
+			if server.acme, err = newACMEManager(cfg.acme, server.metrics); err != nil {
+				return nil, fmt.Errorf("acme: %w", err)
+			}
+		}
+	}
+	if server.auths, server.clientCAs, err = newAuthenticators(cfg.token, cfg.auth); err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+	server.requireClientCert = cfg.auth.requireCert
+	if cfg.apiKeysFile != "" {
+		if server.apiKeys, err = loadAPIKeys(cfg.apiKeysFile, cfg.apiKeyState, server.metrics); err != nil {
+			return nil, fmt.Errorf("api keys: %w", err)
+		}
+		if server.clientCAs == nil && server.apiKeys.certificateBound() {
+			return nil, errors.New("api keys: keys bound to certificates need -client-ca")
+		}
+	}
+	if cfg.urlPolicy != nil {
+		server.metrics.register("browserd_blocked_navigations_total", metricCounter, "Page.navigate and Target.createTarget calls refused by -url-allow or -url-deny.")
+	}
+
+	if cfg.probe.enabled() {
+		server.health = newBackendHealth(cfg.probe)
+		server.metrics.register("browserd_chromium_up", metricGauge, "Whether the health prober currently considers Chromium reachable.")
+		server.metrics.register("browserd_chromium_probe_failures_total", metricCounter, "Failed Chromium health probes.")
+	}
+
+	if cfg.recycle.enabled() {
+		server.metrics.register("browserd_chromium_open_targets", metricGauge, "Open Chromium targets as reported by /json/list.")
+		server.metrics.register("browserd_chromium_rss_bytes", metricGauge, "Resident memory of the supervised Chromium process tree.")
+		server.metrics.register("browserd_chromium_recycles_total", metricCounter, "Times Chromium was recycled for exceeding a resource threshold.")
+	}
+	if cfg.maintenanceSchedule != nil {
+		server.metrics.register("browserd_maintenance_recycles_total", metricCounter, "Times Chromium was recycled in a maintenance window.")
+		server.metrics.register("browserd_maintenance_skipped_total", metricCounter, "Maintenance windows that ended with sessions still active, without a recycle.")
+	}
+
+	if cfg.browserMetricsInterval > 0 {
+		server.metrics.register("browserd_browser_cpu_seconds_total", metricCounter, "CPU time used by each browser's processes, from SystemInfo.getProcessInfo.")
+		server.metrics.register("browserd_browser_rss_bytes", metricGauge, "Resident memory of each supervised browser's process tree.")
+		server.metrics.register("browserd_browser_targets", metricGauge, "Open targets in each browser.")
+		server.metrics.register("browserd_browser_js_heap_used_bytes", metricGauge, "JS heap in use across each browser's pages.")
+		server.metrics.register("browserd_browser_js_heap_total_bytes", metricGauge, "JS heap allocated across each browser's pages.")
+	}
+
+	if cfg.chromiumBin != "" {
+		if server.staticDebugger {
+			return nil, errors.New("supervised mode requires an http:// chromium endpoint")
+		}
+		if cfg.chromiumLogLines > 0 {
+			server.chromiumLogs = newChromiumLogs(cfg.chromiumLogLines)
+		}
+		sup, err := newSupervisor(cfg, parsed, server.metrics, server.chromiumLogs)
+		if err != nil {
+			return nil, err
+		}
+		sup.onRestart = server.browserRestarted
+		if cfg.crashDir != "" {
+			if server.crashes, err = newCrashCollector(cfg.crashDir, cfg.crashMaxIncidents, server.chromiumLogs, server.metrics, server.notify); err != nil {
+				return nil, fmt.Errorf("crash dir: %w", err)
+			}
+		}
+		if cfg.chromiumPipe {
+			sup.pipe = newCDPPipe(parsed.Host)
+			dial := sup.pipe.dialContext((&net.Dialer{}).DialContext)
+			server.dialer.NetDialContext = dial
+			upstreamDial = dial
+		}
+		server.supervisor = sup
+		if cfg.warmPoolSize > 0 || cfg.profilesDir != "" || len(cfg.flagProfiles) > 0 || cfg.launchAllow.enabled() {
+			server.pool = newWarmPool(cfg, sup, temp.poolDir(), server.metrics)
+		}
+	}
+	server.client.Transport = cfg.upstreamClient.newTransport(upstreamDial)
+	if cfg.upstreamHost != "" || len(cfg.upstreamHeaders) > 0 {
+		server.client.Transport = upstreamTransport{host: cfg.upstreamHost, header: cfg.upstreamHeaders, next: server.client.Transport}
+	}
+	if cfg.upstreamClient.retries > 0 {
+		server.client.Transport = &retryTransport{cfg: cfg.upstreamClient, metrics: server.metrics, next: server.client.Transport}
+	}
+
+	if len(cfg.pools) > 0 {
+		server.namedPools = make(map[string]*proxyServer, len(cfg.pools))
+		for name, spec := range cfg.pools {
+			if server.namedPools[name], err = server.newNamedPool(name, spec, cfg); err != nil {
+				return nil, fmt.Errorf("pool %s: %w", name, err)
+			}
+		}
+	}
 
 	return server, nil
 }
 
 func (p *proxyServer) versionEndpoint() string {
-	versionURL := *p.chromiumURL
-	cleanPath := strings.TrimSuffix(versionURL.Path, "/")
-	versionURL.Path = cleanPath + "/json/version"
-	versionURL.RawQuery = ""
-	versionURL.Fragment = ""
-	return versionURL.String()
+	return p.jsonEndpoint("/json/version")
+}
+
+// jsonEndpoint resolves one of Chromium's /json HTTP endpoints.
+func (p *proxyServer) jsonEndpoint(path string) string {
+	endpoint := *p.chromiumURL
+	cleanPath := strings.TrimSuffix(endpoint.Path, "/")
+	endpoint.Path = cleanPath + path
+	endpoint.RawQuery = ""
+	endpoint.Fragment = ""
+	return endpoint.String()
 }
 
 func (p *proxyServer) fetchVersionInfo(ctx context.Context) (*versionInfo, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.versionEndpoint(), nil)
+	info, err := fetchVersion(ctx, p.client, p.versionEndpoint())
+	if err != nil {
+		return nil, err
+	}
+
+	debuggerURL, err := p.rewriteDebuggerURL(info.WebSocketDebuggerURL)
 	if err != nil {
 		return nil, err
 	}
+	info.WebSocketDebuggerURL = debuggerURL
 
-	resp, err := p.client.Do(req)
+	return info, nil
+}
+
+// fetchVersion reads a Chromium's /json/version at endpoint.
+func fetchVersion(ctx context.Context, client *http.Client, endpoint string) (*versionInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -111,28 +948,100 @@ func (p *proxyServer) fetchVersionInfo(ctx context.Context) (*versionInfo, error
 	if info.WebSocketDebuggerURL == "" {
 		return nil, errors.New("chromium /json/version response missing webSocketDebuggerUrl")
 	}
-
+	info.WebSocketDebuggerURL = restoreDebuggerHost(info.WebSocketDebuggerURL, resp.Request)
 	return &info, nil
 }
 
-func (p *proxyServer) ensureDebuggerURL(ctx context.Context) error {
-	if current := p.getDebuggerURL(); current != "" {
-		return nil
+// rewriteDebuggerURL applies the configured host/port overrides to the
+// debugger URL reported by Chromium, keeping its scheme, path and query.
+func (p *proxyServer) rewriteDebuggerURL(raw string) (string, error) {
+	if p.debuggerHost == "" && p.debuggerPort == "" {
+		return raw, nil
 	}
 
-	info, err := p.fetchVersionInfo(ctx)
+	parsed, err := url.Parse(raw)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	host := parsed.Hostname()
+	port := parsed.Port()
+	if p.debuggerHost != "" {
+		host = p.debuggerHost
+	}
+	if p.debuggerPort != "" {
+		port = p.debuggerPort
+	}
+
+	if port == "" {
+		parsed.Host = host
+	} else {
+		parsed.Host = net.JoinHostPort(host, port)
+	}
+	return parsed.String(), nil
+}
+
+func (p *proxyServer) ensureDebuggerURL(ctx context.Context) error {
+	if current := p.getDebuggerURL(); current != "" {
+		return nil
 	}
 
-	debuggerURL := info.WebSocketDebuggerURL
+	return p.refreshDebuggerURL(ctx)
+}
 
+// resetDebuggerURL forgets the cached debugger URL so the next dial
+// rediscovers it, e.g. after the supervised browser restarted.
+func (p *proxyServer) resetDebuggerURL() {
 	p.mu.Lock()
-	p.debuggerURL = debuggerURL
+	p.debuggerURL = ""
 	p.mu.Unlock()
+}
 
-	log.Printf("Chromium debugger endpoint set to %s", debuggerURL)
-	return nil
+// waitForChromium polls Chromium until it answers or -wait-for-chromium
+// runs out, so the listener is only opened once sessions can be served.
+func (p *proxyServer) waitForChromium(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, p.waitChromium)
+	defer cancel()
+
+	slog.Info("waiting for chromium", "backend", p.versionEndpoint(), "timeout", p.waitChromium.String())
+	for {
+		var err error
+		if p.staticDebugger {
+			var conn *websocket.Conn
+			if conn, _, err = p.dialer.DialContext(ctx, p.getDebuggerURL(), p.upstreamHeader()); err == nil {
+				_ = conn.Close()
+			}
+		} else {
+			err = p.ensureDebuggerURL(ctx)
+		}
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("chromium not ready after %s: %w", p.waitChromium, err)
+		case <-time.After(chromiumWaitInterval):
+		}
+	}
+}
+
+// browserRestarted is called by the supervisor before it relaunches Chromium.
+func (p *proxyServer) browserRestarted(recycled bool, err error) {
+	p.resetDebuggerURL()
+	p.requestRefresh()
+	p.preconnect.refresh()
+	p.protocol.reset()
+	if !recycled && p.crashes != nil {
+		p.crashes.collect(crashBrowserExited, "main", err)
+	}
+	event := webhookEvent{Event: eventBrowserRestarted, Reason: "exited"}
+	if recycled {
+		event.Reason = "recycled"
+	} else if err != nil {
+		event.Error = err.Error()
+	}
+	p.notify(event)
 }
 
 func (p *proxyServer) getDebuggerURL() string {
@@ -141,44 +1050,71 @@ func (p *proxyServer) getDebuggerURL() string {
 	return p.debuggerURL
 }
 
-func (p *proxyServer) dialBackend(ctx context.Context, subprotocol string) (*websocket.Conn, *http.Response, error) {
-	if err := p.ensureDebuggerURL(ctx); err != nil {
-		return nil, nil, err
+// dialSession connects to the browser sess runs in: its own warm pool
+// browser if it has one, the shared Chromium otherwise.
+func (p *proxyServer) dialSession(ctx context.Context, sess *session, subprotocols []string) (*websocket.Conn, *http.Response, error) {
+	if sess == nil || sess.browser == nil {
+		return p.dialShared(ctx, sess, subprotocols)
 	}
-	target := p.getDebuggerURL()
+	return p.dial(ctx, p.sessionDebuggerURL(sess), subprotocols)
+}
 
-	header := http.Header{}
-	if subprotocol != "" {
-		header.Set("Sec-WebSocket-Protocol", subprotocol)
+// sessionDebuggerURL is the debugger URL dialSession uses for sess, with
+// the path and query the client connected to, if it asked for one.
+func (p *proxyServer) sessionDebuggerURL(sess *session) string {
+	target := p.getDebuggerURL()
+	switch {
+	case sess == nil:
+		return target
+	case sess.browser != nil:
+		target = sess.browser.debuggerURL
+	case sess.onFallback:
+		target = p.fallback.getDebuggerURL()
+	case sess.migrated.Load() != nil:
+		// The browser id in the session's path went with the old backend.
+		return sess.migrated.Load().getDebuggerURL()
 	}
+	if sess.upstreamPath == "" {
+		return target
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+	u.Path, u.RawPath, u.RawQuery = sess.upstreamPath, "", sess.upstreamQuery
+	return u.String()
+}
 
-	conn, resp, err := p.dialer.DialContext(ctx, target, header)
+// dial connects to target offering subprotocols, in the client's order of
+// preference.
+func (p *proxyServer) dial(ctx context.Context, target string, subprotocols []string) (*websocket.Conn, *http.Response, error) {
+	dialer := p.dialer
+	dialer.Subprotocols = subprotocols
+	conn, resp, err := dialer.DialContext(ctx, target, p.upstreamHeader())
 	return conn, resp, err
 }
 
 func (p *proxyServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
 	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
 	defer cancel()
 
+	if p.staticDebugger {
+		p.handleStaticHealth(ctx, w)
+		return
+	}
+
 	info, err := p.fetchVersionInfo(ctx)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		writeError(w, http.StatusServiceUnavailable, err.Error())
 		return
 	}
 
-	p.mu.Lock()
-	previous := p.debuggerURL
-	p.debuggerURL = info.WebSocketDebuggerURL
-	p.mu.Unlock()
-
-	if previous != info.WebSocketDebuggerURL {
-		log.Printf("Chromium debugger endpoint updated to %s", info.WebSocketDebuggerURL)
-	}
+	p.setDebuggerURL(info.WebSocketDebuggerURL)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -189,121 +1125,1472 @@ func (p *proxyServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 		"protocolVersion":      info.ProtocolVersion,
 	}
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Failed to encode health response: %v", err)
+		slog.Warn("failed to encode health response", "error", err)
 	}
 }
 
-func (p *proxyServer) handleProxy(w http.ResponseWriter, r *http.Request) {
-	if websocket.IsWebSocketUpgrade(r) {
-		p.serveWebSocket(w, r)
-		return
-	}
-
-	http.NotFound(w, r)
-}
+// handleStaticHealth checks a directly configured ws:// debugger URL by
+// completing a WebSocket handshake, since there is no /json/version to query.
+func (p *proxyServer) handleStaticHealth(ctx context.Context, w http.ResponseWriter) {
+	debuggerURL := p.getDebuggerURL()
 
-func (p *proxyServer) serveWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := p.upgrader.Upgrade(w, r, nil)
+	conn, _, err := p.dialer.DialContext(ctx, debuggerURL, p.upstreamHeader())
 	if err != nil {
-		log.Printf("Failed to upgrade incoming connection: %v", err)
+		writeError(w, http.StatusServiceUnavailable, err.Error())
 		return
 	}
-	defer conn.Close()
-
-	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
-	defer cancel()
+	_ = conn.Close()
 
-	backendConn, _, err := p.dialBackend(ctx, conn.Subprotocol())
-	if err != nil {
-		log.Printf("Failed to connect to Chromium debugger: %v", err)
-		_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "upstream unavailable"), time.Now().Add(time.Second))
-		return
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	response := map[string]string{
+		"status":               "ok",
+		"webSocketDebuggerUrl": debuggerURL,
 	}
-	defer backendConn.Close()
-
-	errCh := make(chan error, 2)
-
-	go mirrorWebsocket(errCh, backendConn, conn)
-	go mirrorWebsocket(errCh, conn, backendConn)
-
-	err = <-errCh
-	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) && err != nil {
-		log.Printf("Proxy connection closed with error: %v", err)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		slog.Warn("failed to encode health response", "error", err)
 	}
 }
 
-func mirrorWebsocket(errCh chan<- error, dst, src *websocket.Conn) {
-	for {
-		msgType, data, err := src.ReadMessage()
-		if err != nil {
-			errCh <- err
+func (p *proxyServer) handleProxy(w http.ResponseWriter, r *http.Request) {
+	if websocket.IsWebSocketUpgrade(r) {
+		key, ok := p.authenticate(r)
+		if !ok {
+			p.refuseUnauthorized(w, r)
 			return
 		}
 
-		if err := dst.WriteMessage(msgType, data); err != nil {
-			errCh <- err
+		if p.draining.Load() && (!p.awaitMaintenance(r.Context()) || p.draining.Load()) {
+			_ = p.closeUpgrade(w, r, nil, closeDraining, "draining")
 			return
 		}
-	}
-}
-
-func (p *proxyServer) start(ctx context.Context) error {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/healthz", p.handleHealth)
-	mux.HandleFunc("/", p.handleProxy)
-
-	server := &http.Server{
-		Addr:    p.listenAddr,
-		Handler: mux,
-	}
-
-	go func() {
-		<-ctx.Done()
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		if err := server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Printf("HTTP server shutdown error: %v", err)
+		priority := p.tokenPriority
+		if key != nil {
+			priority = key.priority
+		}
+		if !p.acquireSession(r.Context(), priority) {
+			p.rejectOverloaded(w, r, reasonMaxSessions)
+			return
+		}
+		defer p.releaseSession()
+		if key != nil {
+			release, reason := p.apiKeys.acquire(key)
+			if reason != "" {
+				p.rejectOverloaded(w, r, reason)
+				return
+			}
+			defer release()
 		}
-	}()
-
-	log.Printf("Chromium proxy listening on %s", p.listenAddr)
-	if err := p.ensureDebuggerURL(ctx); err != nil {
-		log.Printf("Initial debugger URL fetch failed: %v", err)
-	}
 
-	err := server.ListenAndServe()
-	if errors.Is(err, http.ErrServerClosed) {
-		return nil
+		launch, err := parseLaunchOptions(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if launch != nil && len(launch.ignored) > 0 {
+			slog.Info("ignoring unsupported launch options", "event", "launch_options_ignored", "options", launch.ignored, "client_ip", clientIP(r.RemoteAddr))
+			p.metrics.add("browserd_launch_options_ignored_total", nil, 1)
+		}
+		labels, err := parseSessionLabels(r.URL.Query())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if key != nil {
+			for name, value := range key.Labels {
+				labels[name] = value
+			}
+		}
+
+		proxy, err := parseEgressProxy(r.URL.Query())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if proxy != nil && !p.allowProxy {
+			writeError(w, http.StatusForbidden, "per-session proxies are disabled")
+			return
+		}
+
+		device, err := parseDevice(r.URL.Query(), p.device)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		network, err := parseNetworkProfile(r.URL.Query(), p.network)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		emulation, err := parseEmulation(r.URL.Query())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		screencast, err := parseScreencastCap(r.URL.Query(), p.screencast)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		permissions, err := parsePermissions(r.URL.Query(), p.permissions)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var flags *flagProfile
+		if name := r.URL.Query().Get("flags"); name != "" {
+			if p.pool == nil || len(p.pool.flagProfiles) == 0 {
+				writeError(w, http.StatusBadRequest, "flag profiles require -flag-profiles")
+				return
+			}
+			if flags = p.pool.flagProfiles[name]; flags == nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown flag profile %q", name))
+				return
+			}
+		}
+
+		var allow launchAllowlist
+		if p.pool != nil {
+			allow = p.pool.launchAllow
+		}
+		query := r.URL.Query()
+		if launch != nil && len(launch.Args) > 0 {
+			// browserless's launch args are ?arg= values by another name.
+			query["arg"] = append(query["arg"], launch.Args...)
+		}
+		overrides, err := parseLaunchOverrides(query, allow)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var browser *pooledBrowser
+		if queryFlag(r.URL.Query(), "exclusive") && flags == nil && overrides == nil {
+			if p.pool == nil || p.pool.size == 0 {
+				writeError(w, http.StatusBadRequest, "exclusive sessions require -warm-pool")
+				return
+			}
+			if browser = p.pool.take(); browser == nil {
+				p.rejectOverloaded(w, r, reasonWarmPoolEmpty)
+				return
+			}
+			// Stopping the browser takes a moment; don't hold up the handler.
+			defer func() { go p.releaseExclusive(browser) }()
+		} else if name := r.URL.Query().Get("profile"); name != "" || flags != nil || overrides != nil {
+			// A flag profile or the session's own ?env= and ?arg= need a
+			// browser launched with them, on the named profile if there
+			// is one.
+			if name != "" && (p.pool == nil || p.pool.profilesDir == "") {
+				writeError(w, http.StatusBadRequest, "named profiles require -profiles-dir")
+				return
+			}
+			if name != "" && !profileNamePattern.MatchString(name) {
+				writeError(w, http.StatusBadRequest, "invalid profile name")
+				return
+			}
+			b, err := p.pool.openProfile(r.Context(), name, flags, overrides)
+			if errors.Is(err, errProfileInUse) {
+				writeError(w, http.StatusConflict, err.Error())
+				return
+			}
+			if err != nil {
+				slog.Error("failed to launch browser for profile", "profile", name, "flags", r.URL.Query().Get("flags"), "client_ip", clientIP(r.RemoteAddr), "error", err)
+				writeError(w, http.StatusServiceUnavailable, "failed to launch browser for profile")
+				return
+			}
+			browser = b
+			defer func() { go p.pool.release(browser) }()
+		}
+
+		if browser == nil && p.hiddenTarget(r.Context(), r.URL.Path) {
+			writeError(w, http.StatusNotFound, "target not found")
+			return
+		}
+
+		sess := newSession(r.RemoteAddr, labels)
+		sess.browser = browser
+		if key != nil {
+			sess.apiKey = key.name
+			sess.maxDuration = key.maxDuration
+		}
+		sess.temp = p.temp
+		sess.pool = p.poolName
+		sess.proxy = proxy
+		sess.device = device
+		sess.emulation = emulation
+		sess.network = network
+		sess.screencast = screencast
+		sess.permissions = permissions
+		sess.stealth = p.stealth || (launch != nil && launch.Stealth) || queryFlag(r.URL.Query(), "stealth")
+		if strings.HasPrefix(r.URL.Path, "/devtools/") {
+			// A client addressing a specific browser or page target gets
+			// exactly that, not the endpoint /json/version reports.
+			sess.upstreamPath = r.URL.Path
+			if p.fallback != nil && browser == nil {
+				sess.upstreamPath = routeTarget(sess, r.URL.Path)
+			}
+			sess.upstreamQuery = forwardedQuery(r.URL.Query())
+		}
+		p.serveWebSocket(w, r, sess)
+		return
+	}
+
+	if p.frontend != nil && strings.HasPrefix(r.URL.Path, "/devtools/") {
+		p.frontend.ServeHTTP(w, r)
+		return
+	}
+
+	writeError(w, http.StatusNotFound, "not found")
+}
+
+func (p *proxyServer) serveWebSocket(w http.ResponseWriter, r *http.Request, sess *session) {
+	if p.artifacts != nil {
+		// Deferred first so it runs once the log and recording are closed.
+		defer p.archiveSession(sess)
+	}
+	if p.sessionLogDir != "" {
+		if err := sess.openLog(p.sessionLogDir); err != nil {
+			sess.log.Warn("failed to open session log file", "error", err)
+		}
+		defer sess.closeLog()
+	}
+	if p.record {
+		if err := sess.startRecording(p.recordings); err != nil {
+			sess.log.Warn("failed to start session recording", "event", "recording_failed", "error", err)
+		}
+		defer sess.stopRecording()
+	}
+	sess.logf("session %s accepted from %s labels=%v", sess.id, sess.remoteAddr, sess.labels)
+	if sess.proxy != nil {
+		sess.logf("egress proxy %s", sess.proxy.Redacted())
+	}
+
+	if !p.health.healthy() && p.fallback == nil {
+		// Fail fast rather than waiting on a backend the prober knows is down.
+		sess.logf("rejected: chromium unhealthy")
+		p.refuseWebSocket(w, r, sess, closeUpstreamUnavailable, "upstream unhealthy")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), max(p.dialWindow, requestTimeout))
+	defer cancel()
+
+	// The upstream is dialed before the client's upgrade is answered so
+	// the client can be told the subprotocol the upstream accepted.
+	requested := websocket.Subprotocols(r)
+	p.dialing.Add(1)
+	backendConn, _, err := p.dialWithRetry(ctx, sess, requested)
+	p.dialing.Add(-1)
+	if err != nil {
+		sess.log.Error("failed to connect to chromium debugger", "event", "upstream_dial_failed", "backend", p.sessionDebuggerURL(sess), "error", err)
+		sess.logf("upstream dial failed: %v", err)
+		p.notify(p.sessionEvent(eventSessionError, sess, err))
+		p.refuseWebSocket(w, r, sess, closeUpstreamUnavailable, "upstream unavailable")
+		return
+	}
+	defer backendConn.Close()
+	if p.compat != nil {
+		if sess.compat = p.compat.forSession(p.sessionBrowserVersion(sess)); sess.compat != nil {
+			sess.logf("protocol shims %v", sess.compat.names())
+		}
+	}
+
+	var header http.Header
+	if subprotocol := backendConn.Subprotocol(); subprotocol != "" {
+		if !slices.Contains(requested, subprotocol) {
+			sess.log.Error("upstream selected a subprotocol the client did not offer", "event", "upstream_dial_failed", "subprotocol", subprotocol)
+			sess.logf("upstream selected unrequested subprotocol %q", subprotocol)
+			p.refuseWebSocket(w, r, sess, closeProtocolError, "upstream subprotocol mismatch")
+			return
+		}
+		header = http.Header{"Sec-Websocket-Protocol": {subprotocol}}
+	}
+	conn, err := p.upgrader.Upgrade(w, r, header)
+	if err != nil {
+		sess.log.Warn("failed to upgrade incoming connection", "error", err)
+		return
+	}
+	defer conn.Close()
+	if p.maxMessage > 0 {
+		conn.SetReadLimit(p.maxMessage)
+		backendConn.SetReadLimit(p.maxMessage)
+	}
+
+	if p.supervisor != nil && sess.browser == nil {
+		p.supervisor.countSession()
+	}
+	debuggerURL := p.sessionDebuggerURL(sess)
+	pageTarget := strings.Contains(debuggerURL, "/devtools/page/")
+	if pageTarget {
+		sess.addTarget("", path.Base(debuggerURL))
+	}
+	opts := p.relayOptions(sess)
+	if p.reconnectWindow > 0 && sess.browser == nil && p.fallback == nil {
+		// Only the shared browser is restarted in place; a warm pool
+		// browser is replaced, and a fallback session has moved on.
+		subprotocol := backendConn.Subprotocol()
+		opts.redial = func(ctx context.Context) (*websocket.Conn, error) {
+			return p.redialShared(ctx, sess, subprotocol)
+		}
+		opts.reconnectWindow, opts.reconnectBuffer = p.reconnectWindow, p.reconnectBuffer
+		opts.onReconnect = func(result string) {
+			p.metrics.add("browserd_upstream_reconnects_total", map[string]string{"result": result}, 1)
+		}
+	}
+	rl := newRelay(sess, conn, backendConn, opts)
+	if opts.redial != nil && !pageTarget {
+		sess.migrate = p.migrateHook(sess, rl, backendConn.Subprotocol())
+	}
+
+	disconnect := func(code int, reason string) {
+		if p.errorScreenshots {
+			// Before the connections close, taking the session's pages
+			// with them.
+			p.captureErrorScreenshots(sess, reason)
+		}
+		_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+		conn.Close()
+		rl.currentUpstream().Close()
+	}
+	sess.disconnectFunc.Store(&disconnect)
+	if sess.maxDuration > 0 {
+		// Counted from the start, so time spent admitting and connecting
+		// the session is part of it.
+		limit := time.AfterFunc(sess.maxDuration-time.Since(sess.startedAt), func() {
+			sess.log.Info("session reached its API key's duration limit", "event", "session_duration_limit", "limit", sess.maxDuration.String())
+			sess.disconnect(closeSessionLimit, "session duration limit")
+		})
+		defer limit.Stop()
+	}
+	metricLabels := p.metrics.sessionLabels(sess.labels)
+	p.sessions.add(sess)
+	if p.cluster != nil {
+		p.cluster.sessionStarted(sess.id)
+	}
+	p.metrics.add("browserd_sessions_total", metricLabels, 1)
+	p.metrics.add("browserd_active_sessions", metricLabels, 1)
+	if sess.browser != nil && sess.browser.build != "" {
+		p.metrics.add("browserd_build_sessions_total", sess.browser.buildLabels(), 1)
+	}
+	sess.log.Info("session started", "event", "session_started", "backend", p.sessionDebuggerURL(sess), "labels", sess.labels)
+	sess.logf("connected to upstream %s", backendConn.RemoteAddr())
+	p.notify(p.sessionEvent(eventSessionStarted, sess, nil))
+	defer func() {
+		close(sess.ended)
+		p.sessions.remove(sess.id)
+		if p.cluster != nil {
+			p.cluster.sessionEnded(sess.id)
+		}
+		p.metrics.add("browserd_active_sessions", metricLabels, -1)
+		p.countTraffic(sess, metricLabels)
+		duration := time.Since(sess.startedAt).Round(time.Millisecond)
+		sess.log.Info("session ended", "event", "session_ended", "duration", duration.String())
+		sess.logf("session ended after %s", duration)
+		p.temp.sessionEnded(sess.id)
+		p.notify(p.sessionEvent(eventSessionEnded, sess, nil))
+	}()
+
+	err = rl.run(pageTarget)
+	if errors.Is(err, errClientMessageTooBig) || errors.Is(err, errUpstreamMessageTooBig) {
+		side := "client"
+		if errors.Is(err, errUpstreamMessageTooBig) {
+			side = "upstream"
+		}
+		p.metrics.add("browserd_oversized_messages_total", map[string]string{"side": side}, 1)
+		p.countBuildError(sess)
+		sess.log.Warn("message too big, closing session", "event", "message_too_big", "side", side, "limit_bytes", p.maxMessage)
+		sess.logf("closed: %v (limit %d bytes)", err, p.maxMessage)
+		p.notify(p.sessionEvent(eventSessionError, sess, err))
+	} else if errors.Is(err, errTargetTakenOver) || errors.Is(err, errTargetCrashed) {
+		if errors.Is(err, errTargetCrashed) {
+			p.countBuildError(sess)
+		}
+		sess.logf("closed: %v", err)
+		p.notify(p.sessionEvent(eventSessionError, sess, err))
+	} else if errors.Is(err, errAnomalyTerminated) {
+		sess.log.Warn("session terminated for anomalous CDP usage", "event", "session_terminated")
+		sess.logf("closed: %v", err)
+	} else if sess.killed.Load() {
+		sess.log.Info("session terminated", "event", "session_terminated")
+		sess.logf("session terminated by an operator")
+	} else if sess.idled.Load() {
+		p.metrics.add("browserd_idle_sessions_closed_total", nil, 1)
+		sess.log.Info("session closed for inactivity", "event", "session_idle", "last_activity", sess.lastActive().UTC().Format(time.RFC3339))
+		sess.logf("closed after %s without client commands", p.idleTimeout)
+	} else if !websocket.IsCloseError(err, websocket.CloseNormalClosure) && err != nil {
+		sess.log.Warn("proxy connection closed with error", "event", "session_error", "error", err)
+		p.countBuildError(sess)
+		sess.logf("connection closed with error: %v", err)
+		p.notify(p.sessionEvent(eventSessionError, sess, err))
+	}
+}
+
+// refuseWebSocket closes the session's client with code and reason before
+// it starts.
+func (p *proxyServer) refuseWebSocket(w http.ResponseWriter, r *http.Request, sess *session, code int, reason string) {
+	if err := p.closeUpgrade(w, r, nil, code, reason); err != nil {
+		sess.log.Warn("failed to upgrade incoming connection", "error", err)
+	}
+}
+
+// sessionEvent builds a webhook event describing sess. Stats are included
+// once the session is connected. Without webhooks or /admin/events
+// subscribers the work is skipped.
+func (p *proxyServer) sessionEvent(name string, sess *session, err error) webhookEvent {
+	if p.webhooks == nil && !p.events.active() {
+		return webhookEvent{Event: name}
+	}
+	view := sess.view()
+	event := webhookEvent{Event: name, Session: &view}
+	if name != eventSessionStarted {
+		event.Stats = sess.tally()
+		event.Screenshots = sess.screenshots
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	return event
+}
+
+// relayOptions assembles the CDP behaviour applied to a session's relay.
+func (p *proxyServer) relayOptions(sess *session) relayOptions {
+	opts := relayOptions{init: p.initCommands, isolate: p.isolate, hidden: p.targetFilter, middleware: p.middleware, proxy: sess.proxy, stealth: sess.stealth, siteCredentials: p.siteCredentials, permissions: sess.permissions}
+	opts.onPump = func(delta float64) {
+		p.metrics.add("browserd_relay_goroutines", nil, delta)
+	}
+	opts.onStuck = func() {
+		p.metrics.add("browserd_relay_stuck_total", nil, 1)
+	}
+	opts.onQueue = func(queue string, delta int, wait time.Duration) {
+		labels := map[string]string{"queue": queue}
+		p.metrics.add("browserd_relay_buffered_frames", labels, float64(delta))
+		if delta < 0 {
+			p.metrics.add("browserd_relay_queued_frames_total", labels, 1)
+			p.metrics.add("browserd_relay_queue_wait_seconds_total", labels, wait.Seconds())
+		}
+	}
+	opts.onTargetLost = func(kind string) {
+		p.metrics.add("browserd_targets_lost_total", map[string]string{"reason": kind}, 1)
+	}
+	if sess.screencast.enabled() {
+		opts.screencast = sess.screencast
+		var logged atomic.Bool
+		opts.onScreencastCapped = func(kind string) {
+			p.metrics.add("browserd_screencast_capped_total", map[string]string{"kind": kind}, 1)
+			if kind == "command" && logged.CompareAndSwap(false, true) {
+				sess.log.Info("screencast capped", "event", "screencast_capped", "max_fps", sess.screencast.MaxFPS, "max_quality", sess.screencast.MaxQuality, "max_width", sess.screencast.MaxWidth, "max_height", sess.screencast.MaxHeight)
+				sess.logf("capped screencast to %+v", sess.screencast)
+			}
+		}
+	}
+	if p.validateFrames {
+		opts.onInvalidFrame = func(reason string) {
+			p.metrics.add("browserd_invalid_frames_total", nil, 1)
+			sess.log.Warn("invalid client frame rejected", "event", "invalid_frame", "reason", reason)
+			sess.logf("rejected invalid frame: %s", reason)
+		}
+	}
+	if p.errorScreenshots {
+		opts.onFailure = func(err error) {
+			p.captureErrorScreenshots(sess, err.Error())
+		}
+	}
+	if p.cmdTimeout > 0 {
+		opts.commandTimeout, opts.killHung = p.cmdTimeout, p.killHung
+		opts.onCommandTimeout = func(method, targetID string) {
+			p.metrics.add("browserd_command_timeouts_total", map[string]string{"method": method}, 1)
+			sess.log.Warn("command timed out", "event", "command_timeout", "method", method, "timeout", p.cmdTimeout.String(), "closed_target", targetID)
+			sess.logf("%s timed out after %s", method, p.cmdTimeout)
+		}
+	}
+	if p.commandRate > 0 {
+		opts.commandRate, opts.commandBurst = p.commandRate, p.commandBurst
+		var logged atomic.Bool
+		opts.onThrottled = func() {
+			p.metrics.add("browserd_throttled_commands_total", nil, 1)
+			if logged.CompareAndSwap(false, true) {
+				sess.log.Warn("client commands throttled", "event", "commands_throttled", "rate", p.commandRate)
+				sess.logf("throttled to %g commands a second", p.commandRate)
+			}
+		}
+	}
+	if p.fairShare != nil && sess.browser == nil && !sess.onFallback {
+		// Sessions with a browser of their own have no one to take turns with.
+		opts.fair = p.fairShare
+		opts.onFairWait = func(method string, waited time.Duration) {
+			waitedLabel := "false"
+			if waited > 0 {
+				waitedLabel = "true"
+				p.metrics.add("browserd_fair_share_wait_seconds_total", nil, waited.Seconds())
+				sess.log.Debug("heavy command waited for its turn", "event", "fair_share_wait", "method", method, "waited", waited.String())
+			}
+			p.metrics.add("browserd_fair_share_commands_total", map[string]string{"waited": waitedLabel}, 1)
+		}
+	}
+	if sess.device != "" || sess.emulation != nil || sess.network != "" {
+		// Operator init commands run after the preset and the client's
+		// overrides so they can refine them.
+		var commands []cdpCommand
+		if sess.device != "" {
+			commands = devicePresets[sess.device].commands()
+		}
+		if sess.emulation != nil {
+			commands = append(commands, sess.emulation.commands()...)
+		}
+		if sess.network != "" {
+			commands = append(commands, networkProfiles[sess.network].command())
+		}
+		opts.init = append(commands, p.initCommands...)
+	}
+	if p.networkGuard != nil {
+		// Checked before the operator's rules so none can redirect or
+		// rewrite a request past it.
+		opts.guard = p.networkGuard
+		opts.policies = append(opts.policies, p.networkGuard.policy(func(req *pausedRequest, reason string) {
+			p.metrics.add("browserd_private_network_blocked_total", nil, 1)
+			sess.log.Warn("request to private network blocked", "event", "private_network_blocked", "url", req.Request.URL, "reason", reason)
+			sess.logf("blocked %s: %s", req.Request.URL, reason)
+		}))
+	}
+	if len(p.rules) > 0 {
+		opts.policies = append(opts.policies, interceptPolicy(p.rules))
+	}
+	if p.blockList != nil {
+		block := p.blockList.policy()
+		opts.policies = append(opts.policies, func(req *pausedRequest) *fetchDecision {
+			decision := block(req)
+			if decision != nil {
+				p.metrics.add("browserd_blocked_requests_total", nil, 1)
+				sess.logf("blocked %s", req.Request.URL)
+			}
+			return decision
+		})
+	}
+	if len(p.siteCredentials) > 0 {
+		// Last, so requests blocked or answered by the policies above
+		// never carry a token.
+		opts.policies = append(opts.policies, p.siteCredentials.bearerPolicy(func(req *pausedRequest) {
+			sess.logf("added bearer token to %s", req.Request.URL)
+		}))
+	}
+	if len(p.anomalyRules) > 0 {
+		opts.anomalies = newAnomalyWatch(p.anomalyRules, func(rule *anomalyRule, method string, seen int) {
+			p.metrics.add("browserd_anomalies_total", map[string]string{"rule": rule.Name, "action": rule.Action}, 1)
+			sess.log.Warn("anomalous CDP usage", "event", "anomaly_detected", "rule", rule.Name, "method", method, "count", seen, "action", rule.Action)
+			sess.logf("anomaly %s after %d matching commands (last %s), action %s", rule.Name, seen, method, rule.Action)
+			event := p.sessionEvent(eventSessionAnomaly, sess, nil)
+			event.Reason = rule.Name
+			p.notify(event)
+		})
+	}
+	if p.urlPolicy != nil {
+		opts.navigationPolicy = func(raw string) string {
+			reason := p.urlPolicy.check(raw)
+			if reason != "" {
+				p.metrics.add("browserd_blocked_navigations_total", nil, 1)
+				sess.log.Warn("navigation refused", "event", "navigation_blocked", "url", raw, "reason", reason)
+				sess.logf("refused navigation to %s: %s", raw, reason)
+			}
+			return reason
+		}
+	}
+	return opts
+}
+
+// handleClient registers the client endpoints on mux: the /json
+// endpoints, the HTTP API and, last, the WebSocket proxy, each behind the
+// API key capability it needs.
+func (p *proxyServer) handleClient(mux *http.ServeMux) {
+	cdp := func(h http.HandlerFunc) http.HandlerFunc { return p.requireCapability(capabilityCDP, h) }
+	render := func(h http.HandlerFunc) http.HandlerFunc { return p.requireCapability(capabilityRender, h) }
+
+	mux.HandleFunc("/json/list", cdp(p.limitRequest(p.handleJSONList)))
+	mux.HandleFunc("/json", cdp(p.limitRequest(p.handleJSONList)))
+	mux.HandleFunc("/json/protocol", cdp(p.limitRequest(p.handleJSONProtocol)))
+	mux.HandleFunc("/json/new", cdp(p.limitRequest(p.handleJSONNew)))
+	mux.HandleFunc("/json/close/{id}", cdp(p.limitRequest(p.handleJSONClose)))
+	mux.HandleFunc("GET /api/sessions/{id}/screencast", cdp(p.handleScreencast))
+	mux.HandleFunc("POST /api/sessions/{id}/trace", cdp(p.limitRequest(p.handleTrace)))
+	// Uploads have -max-upload-size instead.
+	mux.HandleFunc("POST /api/sessions/{id}/files", cdp(p.handleUpload))
+	mux.HandleFunc("GET /api/sessions/{id}/state", cdp(p.handleExportState))
+	mux.HandleFunc("POST /api/sessions/{id}/state", cdp(p.limitRequest(p.handleImportState)))
+	mux.HandleFunc("GET /api/sessions/{id}/annotations", cdp(p.handleAnnotations(false)))
+	mux.HandleFunc("POST /api/sessions/{id}/annotations", cdp(p.limitRequest(p.handleAnnotations(false))))
+	mux.HandleFunc("POST /api/evaluate", cdp(p.limitRequest(p.handleEvaluate)))
+	mux.HandleFunc("POST /api/content", render(p.limitRequest(p.handleContent)))
+	mux.HandleFunc("POST /api/jobs", render(p.limitRequest(p.handleCreateJob)))
+	mux.HandleFunc("GET /api/jobs/{id}", render(p.handleJob))
+	mux.HandleFunc("DELETE /api/jobs/{id}", render(p.handleCancelJob))
+	mux.HandleFunc("GET /api/jobs/{id}/tasks/{n}/result", render(p.handleJobResult))
+	if p.supervisor != nil && p.supervisor.vnc != nil {
+		mux.HandleFunc("/vnc", cdp(p.handleVNC))
+	}
+	mux.HandleFunc("/", cdp(p.handleProxy))
+}
+
+// listenOptions are the hardening settings of the client listener spec.
+func (p *proxyServer) listenOptions(spec listenSpec) listenOptions {
+	opts := listenOptions{keepAlive: p.tcpKeepAlive, maxConns: p.maxConnections, clientCAs: p.clientCAs, requireCert: p.requireClientCert}
+	labels := map[string]string{"listener": spec.String()}
+	opts.onConn = func(delta int) {
+		if delta == 0 {
+			p.metrics.add("browserd_refused_connections_total", labels, 1)
+			return
+		}
+		p.metrics.add("browserd_open_connections", labels, float64(delta))
+	}
+	return opts
+}
+
+func (p *proxyServer) start(ctx context.Context) error {
+	if p.grpcAddr != "" {
+		ln, err := net.Listen("tcp", p.grpcAddr)
+		if err != nil {
+			return fmt.Errorf("grpc listener: %w", err)
+		}
+		go p.serveGRPC(ctx, ln)
+	}
+
+	mux := http.NewServeMux()
+	// /healthz stays on the client listener for load balancers either way.
+	mux.HandleFunc("/healthz", p.handleHealthz())
+	mux.HandleFunc("/readyz", p.handleReadyz)
+	if p.adminAddr != "" {
+		ln, err := net.Listen("tcp", p.adminAddr)
+		if err != nil {
+			return fmt.Errorf("admin listener: %w", err)
+		}
+		go p.serveAdmin(ctx, ln)
+	} else {
+		p.handleAdmin(mux)
+	}
+	if p.cluster != nil {
+		mux.HandleFunc("GET /cluster/sessions/{id}", p.handleClusterSession)
+	}
+	p.handlePools(mux)
+	p.handleClient(mux)
+
+	server := &http.Server{Handler: p.headers.secure(mux), MaxHeaderBytes: int(p.maxHeader), ReadHeaderTimeout: p.headerTimeout}
+
+	// The supervisor and pool below run until ctx ends, which has to
+	// happen before their deferred waits if start fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	supervisorDone := make(chan struct{})
+	if p.supervisor != nil {
+		go func() {
+			defer close(supervisorDone)
+			p.supervisor.run(ctx)
+		}()
+	} else {
+		close(supervisorDone)
+	}
+	defer func() {
+		cancel()
+		<-supervisorDone
+	}()
+
+	if p.waitChromium > 0 {
+		if err := p.waitForChromium(ctx); err != nil {
+			return err
+		}
+	}
+
+	if p.recycle.enabled() {
+		go p.monitorResources(ctx)
+	}
+	if p.maintenanceSchedule != nil && p.supervisor != nil {
+		go p.runMaintenance(ctx)
+	}
+	if p.browserMetricsInterval > 0 {
+		go p.collectBrowserMetrics(ctx)
+	}
+	p.temp.sweepStartup()
+	if p.recordings != nil {
+		p.recordings.load(p.temp)
+	}
+	go p.watchDumpSignal(ctx)
+	go p.trackPressure(ctx)
+	go p.collectTemp(ctx)
+	if p.artifacts != nil {
+		go p.artifacts.runExpiry(ctx)
+	}
+	if p.pool != nil {
+		poolDone := make(chan struct{})
+		go func() {
+			defer close(poolDone)
+			p.pool.run(ctx)
+		}()
+		defer func() {
+			cancel()
+			<-poolDone
+		}()
+	}
+	if p.health != nil {
+		go p.monitorBackend(ctx)
 	}
-	return err
+	if p.webhooks != nil {
+		go p.webhooks.run(ctx)
+	}
+	if p.crashes != nil {
+		go p.crashes.run(ctx)
+	}
+	if p.idleTimeout > 0 {
+		go p.reapIdle(ctx)
+	}
+	if !p.staticDebugger && p.debuggerRefresh > 0 {
+		go p.refreshDebuggerURLs(ctx)
+	}
+	if p.cluster != nil {
+		go p.runCluster(ctx)
+	}
+	if p.preconnect != nil {
+		go p.runPreconnect(ctx)
+	}
+	if p.statsd != nil {
+		go p.statsd.run(ctx)
+	}
+	for _, pool := range p.namedPools {
+		go pool.runNamedPool(ctx)
+	}
+	if len(p.namedPools) > 0 {
+		slog.Info("serving named pools", "pools", p.poolNames())
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("http server shutdown error", "error", err)
+		}
+	}()
+
+	if p.acme != nil {
+		if p.acme.cfg.httpListen != "" {
+			ln, err := net.Listen("tcp", p.acme.cfg.httpListen)
+			if err != nil {
+				return fmt.Errorf("acme http listener: %w", err)
+			}
+			go p.acme.serveHTTP(ctx, ln)
+		}
+		go p.acme.run(ctx)
+	}
+
+	listeners := make([]net.Listener, 0, len(p.listen))
+	for _, spec := range p.listen {
+		ln, err := spec.listen(p.acme, p.listenOptions(spec))
+		if err != nil {
+			for _, ln := range listeners {
+				_ = ln.Close()
+			}
+			return fmt.Errorf("listen %s: %w", spec, err)
+		}
+		listeners = append(listeners, ln)
+		slog.Info("chromium proxy listening", "event", "listening", "addr", spec.String())
+	}
+	if p.tunnel != nil {
+		go p.tunnel.run(ctx)
+		listeners = append(listeners, p.tunnel)
+	}
+	if p.staticDebugger {
+		slog.Info("using static chromium debugger endpoint", "backend", p.getDebuggerURL())
+	} else if err := p.ensureDebuggerURL(ctx); err != nil {
+		slog.Warn("initial debugger url fetch failed", "backend", p.versionEndpoint(), "error", err)
+	}
+
+	// Every listener serves until shutdown; the first to fail otherwise
+	// ends start, and with it the others.
+	errCh := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func() { errCh <- server.Serve(ln) }()
+	}
+	for range listeners {
+		if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+	p.artifacts.wait()
+	return nil
 }
 
 func main() {
+	// browserd install [flags] and browserd uninstall manage the Windows
+	// service; the flags given to install are the ones the service runs
+	// with. browserd doctor [flags] checks what the flags would start
+	// instead of serving.
+	doctor := false
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "doctor":
+			doctor = true
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		case "install":
+			if err := installService(os.Args[2:]); err != nil {
+				log.Fatalf("Failed to install the service: %v", err)
+			}
+			return
+		case "uninstall":
+			if err := uninstallService(); err != nil {
+				log.Fatalf("Failed to uninstall the service: %v", err)
+			}
+			return
+		}
+	}
+
 	var (
-		chromiumAddr string
-		listenAddr   string
+		cfg          proxyConfig
+		metricLabels string
+		chromiumArgs string
+		extensions   string
+		hostRules    string
+		authMethods  string
+		certSubjects string
+		displaySize  string
+		memoryLimit  string
+		maxMessage   string
+		maxUpload    string
+		maxRequest   string
+		artifactKeep string
+		maxHeader    string
+		renderCache  string
+		cpuLimit     float64
+		recycleRSS   string
+		maintenance  string
+		hideTargets  string
+		initFile     string
+		scriptFiles  string
+		scriptInline string
+		blockLists   string
+		urlAllow     string
+		urlDeny      string
+		middleware   string
+		shims        string
+		frameHook    string
+		blockPrivate bool
+		winService   bool
+		privateAllow string
+		oidc         oidcConfig
+		acmeDomains  string
+		oidcGroups   string
+		rulesFile    string
+		credsFile    string
+		anomalyFile  string
+		tokenPrio    string
+		grantPerms   string
+		denyPerms    string
+		screencastSz string
+		flagsFile    string
+		envAllow     string
+		argsAllow    string
+		fairMethods  string
+		poolsFile    string
+		poolBuilds   string
+		poolWeights  string
+		upstreamHdrs string
+		webhookURLs  string
+		statsdTags   string
+		logLevel     string
+		logFormat    string
+		logOutput    string
+		syslogAddr   string
+		logFile      string
+		logMaxSize   string
+		logRotation  logRotation
 	)
 
-	flag.StringVar(&chromiumAddr, "chromium", getEnv("CHROMIUM_REMOTE_DEBUGGING_URL", defaultDebugURL), "Chromium remote debugging HTTP endpoint (e.g. http://127.0.0.1:9222)")
-	flag.StringVar(&listenAddr, "listen", getEnv("LISTEN_ADDR", defaultListen), "Address to listen for incoming WebSocket connections")
+	flag.StringVar(&cfg.chromiumEndpoint, "chromium", getEnv("CHROMIUM_REMOTE_DEBUGGING_URL", defaultDebugURL), "Chromium remote debugging HTTP endpoint (e.g. http://127.0.0.1:9222) or a ws:// debugger URL")
+	flag.StringVar(&poolsFile, "pools", getEnv("POOLS_FILE", ""), "JSON file of named pools, each with its own Chromium endpoint, limits and session defaults, served under /pools/<name>/")
+	flag.StringVar(&cfg.chromiumFallback, "chromium-fallback", getEnv("CHROMIUM_FALLBACK_URL", ""), "Second Chromium endpoint (http:// or ws://) new sessions use while -chromium can't be reached")
+	flag.BoolVar(&cfg.preconnect, "preconnect", getEnvBool("PRECONNECT", false), "Keep a standing connection to Chromium so the next session doesn't wait for discovery and the handshake")
+	flag.DurationVar(&cfg.dialWindow, "dial-retry-window", getEnvDuration("DIAL_RETRY_WINDOW", 10*time.Second), "How long a client's upstream dial is retried with backoff, e.g. while Chromium restarts; 0 disables retries")
+	flag.DurationVar(&cfg.upstreamClient.timeout, "upstream-timeout", getEnvDuration("UPSTREAM_TIMEOUT", requestTimeout), "Deadline for a request to Chromium's /json endpoints, retries included; 0 leaves it to the caller")
+	flag.DurationVar(&cfg.upstreamClient.attempt, "upstream-attempt-timeout", getEnvDuration("UPSTREAM_ATTEMPT_TIMEOUT", 0), "Deadline for each try of a /json request, so a hung one leaves time to retry; 0 uses -upstream-timeout")
+	flag.IntVar(&cfg.upstreamClient.retries, "upstream-retries", getEnvInt("UPSTREAM_RETRIES", 2), "How often a /json GET that failed without an answer, or with 502, 503 or 504, is retried; 0 disables retries")
+	flag.DurationVar(&cfg.upstreamClient.backoff, "upstream-retry-backoff", getEnvDuration("UPSTREAM_RETRY_BACKOFF", 100*time.Millisecond), "Wait before the first /json retry, doubling up to 2s, with jitter")
+	flag.IntVar(&cfg.upstreamClient.maxIdleConns, "upstream-max-idle-conns", getEnvInt("UPSTREAM_MAX_IDLE_CONNS", 4), "Idle connections to Chromium kept for reuse by /json requests; 0 opens one per request")
+	flag.DurationVar(&cfg.upstreamClient.idleTimeout, "upstream-idle-timeout", getEnvDuration("UPSTREAM_IDLE_TIMEOUT", 90*time.Second), "How long an idle /json connection is kept")
+	flag.DurationVar(&cfg.waitChromium, "wait-for-chromium", getEnvDuration("WAIT_FOR_CHROMIUM", 0), "Wait up to this long at startup for Chromium to answer before listening, and exit if it doesn't; 0 starts listening straight away")
+	listen := &listenFlag{values: splitList(getEnv("LISTEN_ADDR", defaultListen))}
+	flag.Var(listen, "listen", "Address to listen for incoming WebSocket connections: host:port, tcp4://, tcp6://, unix:///path or npipe:////./pipe/name on Windows, with ?cert=&key= for TLS; repeat or comma-separate for several")
+	flag.StringVar(&cfg.debuggerHost, "debugger-host", getEnv("DEBUGGER_HOST", ""), "Override the host of the webSocketDebuggerUrl reported by Chromium")
+	flag.StringVar(&cfg.debuggerPort, "debugger-port", getEnv("DEBUGGER_PORT", ""), "Override the port of the webSocketDebuggerUrl reported by Chromium")
+	flag.StringVar(&cfg.upstreamHost, "chromium-host-header", getEnv("CHROMIUM_HOST_HEADER", ""), "Host header sent to Chromium, e.g. localhost when -chromium uses a DNS name Chromium would reject")
+	flag.StringVar(&upstreamHdrs, "chromium-headers", getEnv("CHROMIUM_HEADERS", ""), "Comma-separated \"Name: value\" headers added to every request and WebSocket handshake to Chromium, e.g. Authorization for a hosted browser service")
+	flag.StringVar(&cfg.token, "token", getEnv("TOKEN", ""), "Token clients must pass as ?token= or an Authorization bearer header")
+	flag.StringVar(&authMethods, "auth", getEnv("AUTH", ""), "Comma-separated ways clients may authenticate, any one sufficing: token, mtls, signed-url or callout; empty means token when -token is set")
+	flag.StringVar(&cfg.auth.clientCA, "client-ca", getEnv("CLIENT_CA", ""), "PEM file of the CAs client certificates must chain to, for -auth mtls and certificate-bound -api-keys on TLS listeners")
+	flag.StringVar(&certSubjects, "client-cert-subjects", getEnv("CLIENT_CERT_SUBJECTS", ""), "Comma-separated wildcards one of a client certificate's common name or SANs must match; empty accepts any from -client-ca")
+	flag.BoolVar(&cfg.auth.requireCert, "require-client-cert", getEnvBool("REQUIRE_CLIENT_CERT", false), "Refuse TLS handshakes from clients without a certificate from -client-ca")
+	flag.StringVar(&cfg.auth.signingKey, "url-signing-key", getEnv("URL_SIGNING_KEY", ""), "HMAC key verifying ?expires=&signature= URLs, for -auth signed-url")
+	flag.StringVar(&cfg.auth.callout, "auth-callout", getEnv("AUTH_CALLOUT", ""), "URL asked whether to admit each client request, for -auth callout; 2xx admits and 401 or 403 refuses")
+	flag.StringVar(&acmeDomains, "acme-domains", getEnv("ACME_DOMAINS", ""), "Comma-separated public hostnames to get a certificate for over ACME, for ?acme listeners")
+	flag.StringVar(&cfg.acme.email, "acme-email", getEnv("ACME_EMAIL", ""), "Contact email for the ACME account")
+	flag.StringVar(&cfg.acme.directory, "acme-directory", getEnv("ACME_DIRECTORY", letsEncryptDirectory), "ACME directory URL of the certificate authority")
+	flag.StringVar(&cfg.acme.cacheDir, "acme-cache", getEnv("ACME_CACHE", filepath.Join(stateDir(), "acme")), "Directory keeping the ACME account key and certificates across restarts")
+	flag.StringVar(&cfg.acme.httpListen, "acme-http-listen", getEnv("ACME_HTTP_LISTEN", ""), "Answer ACME HTTP-01 challenges on this address (e.g. :80) instead of TLS-ALPN-01 on the ?acme listeners")
+	flag.StringVar(&cfg.apiKeysFile, "api-keys", getEnv("API_KEYS", ""), "JSON file of named client API keys, each with its own session quotas")
+	flag.StringVar(&cfg.apiKeyState, "api-key-state", getEnv("API_KEY_STATE", ""), "File keeping API key usage across restarts, so monthly quotas hold")
+	flag.StringVar(&cfg.adminAuth.token, "admin-token", getEnv("ADMIN_TOKEN", ""), "Bearer token required on /admin/*, /metrics and the gRPC admin service")
+	flag.StringVar(&cfg.adminAuth.user, "admin-user", getEnv("ADMIN_USER", ""), "Basic auth user accepted on /admin/*, /metrics and the gRPC admin service, with -admin-password")
+	flag.StringVar(&cfg.adminAuth.password, "admin-password", getEnv("ADMIN_PASSWORD", ""), "Basic auth password for -admin-user")
+	flag.StringVar(&oidc.issuer, "oidc-issuer", getEnv("OIDC_ISSUER", ""), "OpenID Connect issuer URL people sign in to the admin endpoints with")
+	flag.StringVar(&oidc.clientID, "oidc-client-id", getEnv("OIDC_CLIENT_ID", ""), "OpenID Connect client ID")
+	flag.StringVar(&oidc.clientSecret, "oidc-client-secret", getEnv("OIDC_CLIENT_SECRET", ""), "OpenID Connect client secret")
+	flag.StringVar(&oidc.redirectURL, "oidc-redirect-url", getEnv("OIDC_REDIRECT_URL", ""), "External URL of /admin/oidc/callback, as registered with the provider")
+	flag.StringVar(&oidcGroups, "oidc-groups", getEnv("OIDC_GROUPS", ""), "Comma-separated groups allowed to sign in; empty allows anyone the provider authenticates")
+	flag.StringVar(&oidc.groupsClaim, "oidc-groups-claim", getEnv("OIDC_GROUPS_CLAIM", "groups"), "ID token claim listing the user's groups")
+	flag.BoolVar(&cfg.adminAuth.healthz, "admin-auth-healthz", getEnvBool("ADMIN_AUTH_HEALTHZ", false), "Require the admin credentials on /healthz too")
+	flag.StringVar(&metricLabels, "metric-labels", getEnv("METRIC_LABELS", ""), "Comma-separated session label keys to export as metric labels (e.g. team,env)")
+	flag.StringVar(&logLevel, "log-level", getEnv("LOG_LEVEL", "info"), "Minimum level of log records: debug, info, warn or error")
+	flag.StringVar(&logFormat, "log-format", getEnv("LOG_FORMAT", "json"), "Log record format: json or text")
+	flag.StringVar(&logOutput, "log-output", getEnv("LOG_OUTPUT", "stderr"), "Where logs go: stderr, syslog or journald (Linux); -log-file overrides stderr")
+	flag.StringVar(&syslogAddr, "syslog-addr", getEnv("SYSLOG_ADDR", ""), "Remote syslog server for -log-output syslog (udp://host:514 or tcp://host:514); empty uses the local daemon")
+	flag.StringVar(&logFile, "log-file", getEnv("LOG_FILE", ""), "Write logs to this file instead of stderr, rotating it by size and age")
+	flag.StringVar(&logMaxSize, "log-max-size", getEnv("LOG_MAX_SIZE", "100M"), "Rotate -log-file once it grows past this size (e.g. 100M); 0 disables")
+	flag.DurationVar(&logRotation.maxAge, "log-max-age", getEnvDuration("LOG_MAX_AGE", 24*time.Hour), "Rotate -log-file after it has been written for this long; 0 disables")
+	flag.IntVar(&logRotation.maxBackups, "log-max-files", getEnvInt("LOG_MAX_FILES", 7), "Rotated log files to keep; 0 keeps all")
+	flag.StringVar(&cfg.sessionLogDir, "session-log-dir", getEnv("SESSION_LOG_DIR", ""), "Directory for per-session log files named by session ID")
+	flag.BoolVar(&cfg.record, "record", getEnvBool("RECORD", false), "Record every session's CDP traffic in its temp directory, for /admin/recordings")
+	flag.BoolVar(&cfg.errorScreenshots, "error-screenshots", getEnvBool("ERROR_SCREENSHOTS", false), "Screenshot the pages of a session that ends with an error into its temp directory, and list them in its webhook events")
+	flag.StringVar(&cfg.dumpDir, "dump-dir", getEnv("DUMP_DIR", ""), "Write SIGUSR1 diagnostic dumps to files in this directory instead of the log")
+	flag.StringVar(&cfg.clusterRedis, "cluster-redis", getEnv("CLUSTER_REDIS", ""), "redis://[:password@]host:port[/db] to share sessions and capacity with other replicas through")
+	flag.StringVar(&cfg.clusterID, "cluster-id", getEnv("CLUSTER_ID", ""), "This replica's ID in the cluster; defaults to the hostname")
+	flag.StringVar(&cfg.clusterURL, "cluster-advertise", getEnv("CLUSTER_ADVERTISE", ""), "Base URL other replicas redirect to for this replica's sessions, e.g. http://10.0.0.5:9223")
+	flag.StringVar(&cfg.clusterPrefix, "cluster-prefix", getEnv("CLUSTER_PREFIX", "browserd:"), "Prefix of the cluster's Redis keys")
+	flag.DurationVar(&cfg.clusterTTL, "cluster-ttl", getEnvDuration("CLUSTER_TTL", 15*time.Second), "How long a replica and its sessions stay registered without a heartbeat")
+	flag.StringVar(&cfg.tunnelHub, "tunnel-hub", getEnv("TUNNEL_HUB", ""), "Hub ws:// or wss:// URL to dial out to and receive client connections through, for browsers without inbound ports")
+	flag.StringVar(&cfg.tunnelToken, "tunnel-token", getEnv("TUNNEL_TOKEN", ""), "Bearer token presented to -tunnel-hub")
+	flag.StringVar(&cfg.tunnelName, "tunnel-name", getEnv("TUNNEL_NAME", ""), "Name this instance reports to -tunnel-hub; defaults to the hostname")
+	flag.StringVar(&cfg.adminAddr, "admin-listen", getEnv("ADMIN_LISTEN", ""), "Serve /admin/*, /metrics and pprof on this address, e.g. 127.0.0.1:9225, instead of the client listener")
+	flag.StringVar(&cfg.grpcAddr, "grpc-listen", getEnv("GRPC_LISTEN", ""), "Serve the gRPC admin API (proto/browserd/admin/v1/admin.proto) on this address, e.g. :9224")
+	flag.StringVar(&cfg.chromiumBin, "chromium-bin", getEnv("CHROMIUM_BIN", ""), "Launch and supervise this Chromium binary instead of connecting to an external one")
+	flag.StringVar(&chromiumArgs, "chromium-args", getEnv("CHROMIUM_ARGS", ""), "Extra space-separated flags for the supervised Chromium")
+	flag.StringVar(&cfg.dns.resolver, "dns-resolver", getEnv("DNS_RESOLVER", ""), "DNS-over-HTTPS URL template supervised browsers resolve every host through, with no fallback to the system resolver, e.g. https://dns.internal/dns-query")
+	flag.StringVar(&hostRules, "host-rules", getEnv("HOST_RULES", ""), "Comma-separated Chromium host resolver rules for supervised browsers, e.g. 'MAP *.internal 10.0.0.5, EXCLUDE localhost'")
+	flag.StringVar(&extensions, "chromium-extensions", getEnv("CHROMIUM_EXTENSIONS", ""), "Comma-separated unpacked extension directories to load into the supervised Chromium")
+	flag.BoolVar(&cfg.chromiumPipe, "chromium-pipe", getEnvBool("CHROMIUM_PIPE", false), "Talk to the supervised Chromium over --remote-debugging-pipe instead of a debugging port")
+	flag.BoolVar(&cfg.headful, "headful", getEnvBool("HEADFUL", false), "Run the supervised Chromium headful on a managed Xvfb display")
+	flag.StringVar(&cfg.xvfbBin, "xvfb-bin", getEnv("XVFB_BIN", "Xvfb"), "Xvfb binary used for -headful")
+	flag.IntVar(&cfg.displayNumber, "display-number", getEnvInt("DISPLAY_NUMBER", 99), "X display number of the managed Xvfb server")
+	flag.StringVar(&displaySize, "display-size", getEnv("DISPLAY_SIZE", "1920x1080x24"), "Geometry of the managed Xvfb screen and Chromium window (WIDTHxHEIGHT[xDEPTH])")
+	flag.StringVar(&cfg.vncAddr, "vnc-listen", getEnv("VNC_LISTEN", ""), "Serve the -headful display over VNC on this address (e.g. 127.0.0.1:5900) and noVNC at /vnc")
+	flag.StringVar(&cfg.vncPassword, "vnc-password", getEnv("VNC_PASSWORD", ""), "Password VNC viewers must enter")
+	flag.StringVar(&cfg.x11vncBin, "x11vnc-bin", getEnv("X11VNC_BIN", "x11vnc"), "x11vnc binary used for -vnc-listen")
+	flag.StringVar(&cfg.userDataDir, "user-data-dir", getEnv("CHROMIUM_USER_DATA_DIR", defaultUserDataDir), "User data directory for the supervised Chromium")
+	flag.IntVar(&cfg.warmPoolSize, "warm-pool", getEnvInt("WARM_POOL", 0), "Keep this many extra supervised browsers ready for ?exclusive sessions")
+	flag.StringVar(&poolBuilds, "warm-pool-builds", getEnv("WARM_POOL_BUILDS", ""), "Comma-separated name=path Chromium binaries warm pool and profile browsers are also launched from, besides -chromium-bin (named default)")
+	flag.StringVar(&poolWeights, "warm-pool-weights", getEnv("WARM_POOL_WEIGHTS", ""), "Comma-separated name=weight shares of new pool browsers per build, e.g. default=95,canary=5; unlisted builds weigh 1")
+	flag.BoolVar(&cfg.warmPoolReuse, "warm-pool-reuse", getEnvBool("WARM_POOL_REUSE", false), "Reset the browser of an ?exclusive session when it ends and keep it for the next one instead of stopping it")
+	flag.IntVar(&cfg.warmPoolBasePort, "warm-pool-base-port", getEnvInt("WARM_POOL_BASE_PORT", 9300), "First remote debugging port used by warm pool browsers")
+	flag.StringVar(&flagsFile, "flag-profiles", getEnv("FLAG_PROFILES", ""), "JSON file of named Chromium flag sets clients can pick with ?flags=")
+	flag.StringVar(&envAllow, "session-env-allow", getEnv("SESSION_ENV_ALLOW", ""), "Comma-separated environment variable names, wildcards allowed, clients may set with ?env=NAME=value on a browser launched for their session")
+	flag.StringVar(&argsAllow, "session-args-allow", getEnv("SESSION_ARGS_ALLOW", ""), "Comma-separated Chromium flag names, wildcards allowed, clients may set with ?arg=--flag=value on a browser launched for their session")
+	flag.IntVar(&cfg.chromiumLogLines, "chromium-log-lines", getEnvInt("CHROMIUM_LOG_LINES", 1000), "In supervised mode, log Chromium's output through browserd's logger and keep this many recent lines for /admin/chromium/logs; 0 passes it through untouched")
+	flag.StringVar(&cfg.crashDir, "crash-dir", getEnv("CRASH_DIR", ""), "In supervised mode, enable Chromium's crash reporter and collect minidumps and recent output per crash into this directory")
+	flag.IntVar(&cfg.crashMaxIncidents, "crash-max-incidents", getEnvInt("CRASH_MAX_INCIDENTS", 20), "Crash incidents kept in -crash-dir; 0 keeps all")
+	flag.StringVar(&cfg.profilesDir, "profiles-dir", getEnv("PROFILES_DIR", ""), "Directory of named persistent profiles clients can pick with ?profile=")
+	flag.StringVar(&cfg.tempDir, "temp-dir", getEnv("TEMP_DIR", filepath.Join(os.TempDir(), "browserd")), "Directory for scratch files such as warm pool profiles and session downloads")
+	flag.DurationVar(&cfg.tempRetention, "temp-retention", getEnvDuration("TEMP_RETENTION", time.Hour), "How long a session's downloads are kept after it ends")
+	flag.StringVar(&cfg.artifactStore, "artifact-store", getEnv("ARTIFACT_STORE", ""), "Copy the artifacts of ended sessions to this directory, s3://bucket/prefix or gs://bucket/prefix, so they outlive -temp-retention and the replica")
+	flag.StringVar(&artifactKeep, "artifact-retention", getEnv("ARTIFACT_RETENTION", "recording=168h,har=168h,download=168h,bundle=168h,screenshot=168h,annotations=168h"), "Comma-separated type=duration artifact types -artifact-store keeps and for how long (recording, har, download, bundle, screenshot, annotations); 0 keeps them for good")
+	flag.StringVar(&memoryLimit, "chromium-memory-limit", getEnv("CHROMIUM_MEMORY_LIMIT", ""), "Memory limit for the supervised Chromium (e.g. 2G), enforced via cgroup v2")
+	flag.Float64Var(&cpuLimit, "chromium-cpu-limit", getEnvFloat("CHROMIUM_CPU_LIMIT", 0), "CPU limit in cores for the supervised Chromium (e.g. 1.5), enforced via cgroup v2")
+	flag.DurationVar(&cfg.recycle.interval, "monitor-interval", getEnvDuration("MONITOR_INTERVAL", 30*time.Second), "How often to sample Chromium resource usage for recycling")
+	flag.DurationVar(&cfg.browserMetricsInterval, "browser-metrics-interval", getEnvDuration("BROWSER_METRICS_INTERVAL", 0), "How often to export each browser's CPU, RSS, open targets and JS heap to /metrics (0 disables)")
+	flag.StringVar(&recycleRSS, "recycle-max-rss", getEnv("RECYCLE_MAX_RSS", ""), "Recycle the supervised Chromium when its RSS exceeds this size (e.g. 3G)")
+	flag.IntVar(&cfg.recycle.maxTargets, "recycle-max-targets", getEnvInt("RECYCLE_MAX_TARGETS", 0), "Recycle Chromium when more than this many targets are open")
+	flag.IntVar(&cfg.recycle.maxSessions, "recycle-max-sessions", getEnvInt("RECYCLE_MAX_SESSIONS", 0), "Recycle the supervised Chromium after it has served this many sessions")
+	flag.DurationVar(&cfg.recycle.maxAge, "recycle-max-age", getEnvDuration("RECYCLE_MAX_AGE", 0), "Recycle the supervised Chromium once it has been running this long (e.g. 6h)")
+	flag.DurationVar(&cfg.recycle.drainTimeout, "recycle-drain-timeout", getEnvDuration("RECYCLE_DRAIN_TIMEOUT", time.Minute), "How long to wait for sessions to finish before recycling")
+	flag.StringVar(&maintenance, "maintenance-schedule", getEnv("MAINTENANCE_SCHEDULE", ""), "Crontab schedule, in local time, of maintenance windows in which the supervised Chromium is drained and recycled (e.g. \"0 3 * * *\" or @daily)")
+	flag.DurationVar(&cfg.maintenanceWindow, "maintenance-window", getEnvDuration("MAINTENANCE_WINDOW", 30*time.Minute), "How long a maintenance window waits for sessions to end before giving up on the recycle")
+	flag.DurationVar(&cfg.probe.interval, "probe-interval", getEnvDuration("PROBE_INTERVAL", 0), "Probe Chromium's /json/version this often and fail new sessions fast while it is down; 0 disables")
+	flag.IntVar(&cfg.probe.unhealthyAfter, "probe-unhealthy-after", getEnvInt("PROBE_UNHEALTHY_AFTER", 3), "Consecutive failed probes before Chromium is marked unhealthy")
+	flag.IntVar(&cfg.probe.healthyAfter, "probe-healthy-after", getEnvInt("PROBE_HEALTHY_AFTER", 2), "Consecutive successful probes before an unhealthy Chromium is used again")
+	flag.StringVar(&cfg.devtoolsFrontend, "devtools-frontend", getEnv("DEVTOOLS_FRONTEND", ""), "Serve the DevTools UI at /devtools/inspector.html from this devtools-frontend directory or http(s) base URL")
+	flag.StringVar(&hideTargets, "hide-targets", getEnv("HIDE_TARGETS", ""), "Comma-separated target types to hide from /json/list (e.g. service_worker,extension,devtools)")
+	flag.StringVar(&initFile, "init-commands", getEnv("INIT_COMMANDS", ""), "JSON file of CDP commands sent to every page target before the client takes over")
+	flag.StringVar(&scriptFiles, "inject-script-files", getEnv("INJECT_SCRIPT_FILES", ""), "Comma-separated JS files installed via Page.addScriptToEvaluateOnNewDocument on every page target")
+	flag.StringVar(&scriptInline, "inject-script", getEnv("INJECT_SCRIPT", ""), "Inline JS snippet installed on every page target after -inject-script-files")
+	flag.StringVar(&urlAllow, "url-allow", getEnv("URL_ALLOW", ""), "Comma-separated schemes (https:), URL wildcards, hosts (*.example.com) or CIDRs clients may navigate to; empty allows all")
+	flag.StringVar(&urlDeny, "url-deny", getEnv("URL_DENY", ""), "Comma-separated schemes (file:, chrome:), URL wildcards, hosts or CIDRs clients may not navigate to")
+	flag.StringVar(&shims, "protocol-shims", getEnv("PROTOCOL_SHIMS", ""), "Comma-separated CDP compatibility shims for older browsers (script-on-load, download-behavior, frame-navigation, layout-metrics), or auto to pick them by each browser's version")
+	flag.StringVar(&frameHook, "frame-hook", getEnv("FRAME_HOOK", ""), "Program, with space-separated arguments, every relayed text frame is handed to as a JSON line, to forward, rewrite or drop")
+	flag.DurationVar(&cfg.frameHookBudget, "frame-hook-budget", getEnvDuration("FRAME_HOOK_BUDGET", 50*time.Millisecond), "How long -frame-hook may take to answer for a frame before -frame-hook-on-failure applies")
+	flag.StringVar(&cfg.frameHookOnFailure, "frame-hook-on-failure", getEnv("FRAME_HOOK_ON_FAILURE", frameHookForward), "What to do with a frame -frame-hook didn't answer in time or while it was down: forward, drop, or close the session")
+	flag.StringVar(&middleware, "middleware", getEnv("MIDDLEWARE", ""), "Comma-separated middleware every relayed frame passes through, in order (audit)")
+	flag.BoolVar(&blockPrivate, "block-private-networks", getEnvBool("BLOCK_PRIVATE_NETWORKS", false), "Fail page requests to loopback, private, link-local and metadata addresses")
+	flag.StringVar(&privateAllow, "private-network-allow", getEnv("PRIVATE_NETWORK_ALLOW", ""), "Comma-separated addresses or CIDRs exempt from -block-private-networks")
+	flag.StringVar(&blockLists, "block-lists", getEnv("BLOCK_LISTS", ""), "Comma-separated EasyList-style filter list files or URLs; matching requests are aborted")
+	flag.StringVar(&rulesFile, "intercept-rules", getEnv("INTERCEPT_RULES", ""), "JSON file of request interception rules (block, redirect, headers, fulfill)")
+	flag.StringVar(&anomalyFile, "anomaly-rules", getEnv("ANOMALY_RULES", ""), "JSON file of rules flagging suspicious client CDP usage, such as cookie dumps or chrome:// navigation, to alert on or terminate")
+	flag.StringVar(&credsFile, "site-credentials", getEnv("SITE_CREDENTIALS", ""), "JSON file of per-site basic auth credentials and bearer tokens injected into sessions' requests")
+	flag.BoolVar(&cfg.strictIsolation, "strict-isolation", getEnvBool("STRICT_ISOLATION", false), "Give each session its own browser context and reject CDP commands outside it")
+	flag.BoolVar(&cfg.allowSessionProxy, "allow-session-proxy", getEnvBool("ALLOW_SESSION_PROXY", false), "Let clients route a session through an HTTP or SOCKS proxy with ?proxy=")
+	flag.StringVar(&cfg.device, "device", getEnv("DEVICE", ""), "Device preset emulated on every page target unless the client passes ?device= (iphone-14, pixel-7, desktop-1080p)")
+	flag.StringVar(&cfg.network, "network", getEnv("NETWORK", ""), "Network profile emulated on every page target unless the client passes ?network= (3g-fast, 3g-slow, offline, 1mbps-capped)")
+	flag.IntVar(&cfg.screencast.MaxFPS, "screencast-max-fps", getEnvInt("SCREENCAST_MAX_FPS", 0), "Most screencast frames a second written to each page's client; 0 is unlimited")
+	flag.IntVar(&cfg.screencast.MaxQuality, "screencast-max-quality", getEnvInt("SCREENCAST_MAX_QUALITY", 0), "Highest JPEG quality, 1-100, a client's Page.startScreencast may ask for; PNG screencasts become JPEG; 0 is unlimited")
+	flag.StringVar(&screencastSz, "screencast-max-size", getEnv("SCREENCAST_MAX_SIZE", ""), "Largest WIDTHxHEIGHT screencast frame a client may ask for, e.g. 1280x720; empty is unlimited")
+	flag.StringVar(&grantPerms, "grant-permissions", getEnv("GRANT_PERMISSIONS", ""), "Comma-separated permissions granted in every session's browser context (e.g. clipboard-read,notifications)")
+	flag.StringVar(&denyPerms, "deny-permissions", getEnv("DENY_PERMISSIONS", ""), "Comma-separated permissions denied in every session's browser context (e.g. geolocation); clients can't grant them")
+	flag.BoolVar(&cfg.stealth, "stealth", getEnvBool("STEALTH", false), "Patch common automation tells (navigator.webdriver, headless user agent, plugins) on every page target")
+	flag.StringVar(&webhookURLs, "webhook-urls", getEnv("WEBHOOK_URLS", ""), "Comma-separated URLs POSTed a JSON event on session start, end and error and on browser restarts")
+	flag.StringVar(&cfg.webhookSecret, "webhook-secret", getEnv("WEBHOOK_SECRET", ""), "Sign webhook bodies with HMAC-SHA256 in the X-Browserd-Signature header")
+	flag.StringVar(&cfg.statsdAddr, "statsd", getEnv("STATSD_ADDR", ""), "Also push metrics to this StatsD/DogStatsD agent (host:port, UDP)")
+	flag.StringVar(&cfg.statsdPrefix, "statsd-prefix", getEnv("STATSD_PREFIX", ""), "Prefix prepended to StatsD metric names (e.g. browserd.)")
+	flag.StringVar(&statsdTags, "statsd-tags", getEnv("STATSD_TAGS", ""), "Comma-separated DogStatsD tags added to every metric (e.g. env:prod,region:eu)")
+	flag.DurationVar(&cfg.statsdInterval, "statsd-interval", getEnvDuration("STATSD_INTERVAL", 10*time.Second), "How often metrics are pushed to -statsd")
+	flag.IntVar(&cfg.maxSessions, "max-sessions", getEnvInt("MAX_SESSIONS", 0), "Maximum concurrent CDP sessions; 0 means unlimited")
+	flag.IntVar(&cfg.maxAPIRequests, "max-api-requests", getEnvInt("MAX_API_REQUESTS", 0), "Maximum concurrent /api/evaluate and /api/content requests; 0 means unlimited")
+	flag.StringVar(&maxMessage, "max-message-size", getEnv("MAX_MESSAGE_SIZE", ""), "Close a session with 1009 when either side sends a WebSocket message larger than this (e.g. 64M); empty means no limit")
+	flag.IntVar(&cfg.jobConcurrency, "job-concurrency", getEnvInt("JOB_CONCURRENCY", 4), "Tasks of one POST /api/jobs batch run at once, each also taking a -max-api-requests slot")
+	flag.DurationVar(&cfg.renderCacheTTL, "render-cache-ttl", getEnvDuration("RENDER_CACHE_TTL", 0), "Cache /api/content responses by URL and options for this long (e.g. 10m); 0 disables the cache")
+	flag.StringVar(&renderCache, "render-cache-size", getEnv("RENDER_CACHE_SIZE", "256M"), "Largest total size of cached /api/content responses (e.g. 256M)")
+	flag.StringVar(&cfg.renderCacheDir, "render-cache-dir", getEnv("RENDER_CACHE_DIR", ""), "Keep cached responses in this directory instead of memory; it is emptied at startup")
+	flag.StringVar(&maxUpload, "max-upload-size", getEnv("MAX_UPLOAD_SIZE", "100M"), "Largest request POST /api/sessions/<id>/files accepts (e.g. 100M); 0 means no limit")
+	flag.StringVar(&maxRequest, "max-request-size", getEnv("MAX_REQUEST_SIZE", "10M"), "Largest request body the other HTTP API and /json endpoints accept, answering 413 beyond it; 0 means no limit")
+	flag.StringVar(&maxHeader, "max-header-size", getEnv("MAX_HEADER_SIZE", "1M"), "Largest request headers a client may send, answering 431 beyond them")
+	flag.IntVar(&cfg.maxConnections, "max-connections", getEnvInt("MAX_CONNECTIONS", 0), "Connections each client listener keeps open at once, closing new ones beyond it; 0 means no limit")
+	flag.DurationVar(&cfg.tcpKeepAlive, "tcp-keepalive", getEnvDuration("TCP_KEEPALIVE", 15*time.Second), "TCP keepalive period of client connections, so dead peers are noticed; 0 turns keepalives off")
+	flag.DurationVar(&cfg.headerTimeout, "header-timeout", getEnvDuration("HEADER_TIMEOUT", 10*time.Second), "How long a client may take to send a request's headers before its connection is closed; 0 means no limit")
+	flag.BoolVar(&cfg.headers.enabled, "security-headers", getEnvBool("SECURITY_HEADERS", true), "Send X-Content-Type-Options, Referrer-Policy and a frame-ancestors Content-Security-Policy on HTTP responses")
+	flag.StringVar(&cfg.headers.frameAncestors, "frame-ancestors", getEnv("FRAME_ANCESTORS", "'self'"), "CSP frame-ancestors sources allowed to embed browserd's pages, such as the DevTools frontend, e.g. 'none' or https://dash.example.com")
+	flag.DurationVar(&cfg.headers.hstsMaxAge, "hsts-max-age", getEnvDuration("HSTS_MAX_AGE", 180*24*time.Hour), "Strict-Transport-Security max-age sent on responses over TLS; 0 sends none")
+	flag.BoolVar(&cfg.headers.hideServer, "hide-server-header", getEnvBool("HIDE_SERVER_HEADER", false), "Drop Server, Via and X-Powered-By from proxied responses and browserd's name from the admin realm")
+	flag.BoolVar(&cfg.validateFrames, "validate-frames", getEnvBool("VALIDATE_FRAMES", false), "Answer client frames that aren't well-formed CDP commands with a JSON-RPC error instead of forwarding them")
+	flag.DurationVar(&cfg.debuggerRefresh, "debugger-refresh", getEnvDuration("DEBUGGER_REFRESH", 10*time.Second), "How often the debugger URL is refreshed from /json/version in the background; 0 looks it up only when a dial needs it")
+	flag.DurationVar(&cfg.idleTimeout, "idle-timeout", getEnvDuration("IDLE_TIMEOUT", 0), "Close sessions whose client sent no CDP command for this long, pings aside; 0 never does")
+	flag.DurationVar(&cfg.commandTimeout, "command-timeout", getEnvDuration("COMMAND_TIMEOUT", 0), "Answer client commands Chromium hasn't responded to within this long with an error; 0 waits forever")
+	flag.BoolVar(&cfg.killHungTargets, "kill-hung-targets", getEnvBool("KILL_HUNG_TARGETS", false), "With -command-timeout, also close the target a timed-out command was running in")
+	flag.DurationVar(&cfg.reconnectWindow, "reconnect-window", getEnvDuration("RECONNECT_WINDOW", 0), "How long a session that lost the shared browser, e.g. to a supervised restart, waits for it to come back before closing; 0 closes it straight away")
+	flag.IntVar(&cfg.reconnectBuffer, "reconnect-buffer", getEnvInt("RECONNECT_BUFFER", 100), "Client frames held while a session reconnects; a client sending more is closed")
+	flag.Float64Var(&cfg.maxCommandRate, "max-command-rate", getEnvFloat("MAX_COMMAND_RATE", 0), "CDP commands a session may send per second before further ones are delayed; 0 is unlimited")
+	flag.IntVar(&cfg.commandBurst, "command-burst", getEnvInt("COMMAND_BURST", 0), "Commands a session may send at once above -max-command-rate; 0 allows one second's worth")
+	flag.IntVar(&cfg.fairShare, "fair-share", getEnvInt("FAIR_SHARE", 0), "Heavy CDP commands, such as screenshots and DOM snapshots, run at once on the shared browser, taking turns between sessions; 0 doesn't schedule them")
+	flag.StringVar(&fairMethods, "fair-share-methods", getEnv("FAIR_SHARE_METHODS", defaultHeavyMethods), "Comma-separated CDP methods, which may use wildcards, that -fair-share schedules")
+	flag.IntVar(&cfg.scaleTargetSessions, "scale-target-sessions", getEnvInt("SCALE_TARGET_SESSIONS", 0), "Sessions at which /scale reports this replica as full when -max-sessions isn't set")
+	flag.DurationVar(&cfg.admissionWait, "admission-wait", getEnvDuration("ADMISSION_WAIT", 0), "How long a connection over -max-sessions waits for a slot, highest priority class first; 0 rejects it straight away")
+	flag.DurationVar(&cfg.priorityAging, "priority-aging", getEnvDuration("PRIORITY_AGING", 30*time.Second), "Queued connections move up a priority class for every this long they wait; 0 turns aging off")
+	flag.StringVar(&tokenPrio, "token-priority", getEnv("TOKEN_PRIORITY", "normal"), "Admission priority class (low, normal, high) of clients using -token or no credential")
+	flag.DurationVar(&cfg.retryAfter, "retry-after", getEnvDuration("RETRY_AFTER", 5*time.Second), "Retry hint given to clients rejected by -max-sessions or -max-api-requests")
+	flag.BoolVar(&winService, "windows-service", false, "Run under the Windows service control manager; set by browserd install")
 	flag.Parse()
 
-	server, err := newProxyServer(chromiumAddr, listenAddr)
+	var logOut io.Writer = os.Stderr
+	if logOutput != "stderr" {
+		if logFile != "" {
+			log.Fatalf("-log-file cannot be combined with -log-output %s", logOutput)
+		}
+		out, err := openLogOutput(logOutput, syslogAddr)
+		if err != nil {
+			log.Fatalf("Invalid -log-output: %v", err)
+		}
+		logOut = out
+	}
+	if logFile != "" {
+		var err error
+		if logRotation.maxSize, err = parseByteSize(logMaxSize); err != nil {
+			log.Fatalf("Invalid -log-max-size: %v", err)
+		}
+		file, err := openRotatingFile(logFile, logRotation)
+		if err != nil {
+			log.Fatalf("Failed to open log file: %v", err)
+		}
+		defer file.Close()
+		logOut = file
+	}
+	if err := setupLogging(logLevel, logFormat, logOut); err != nil {
+		log.Fatalf("Invalid -log-level or -log-format: %v", err)
+	}
+	if len(invalidEnv) > 0 {
+		log.Fatalf("Invalid environment: %s can't be parsed", strings.Join(invalidEnv, ", "))
+	}
+	cfg.metricLabels = splitList(metricLabels)
+	cfg.hiddenTargets = splitList(hideTargets)
+	cfg.chromiumArgs = strings.Fields(chromiumArgs)
+	cfg.webhookURLs = splitList(webhookURLs)
+	cfg.statsdTags = splitList(statsdTags)
+	for _, raw := range cfg.webhookURLs {
+		if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("Invalid -webhook-urls: %q is not an http(s) URL", raw)
+		}
+	}
+	memoryBytes, err := parseByteSize(memoryLimit)
+	if err != nil {
+		log.Fatalf("Invalid -chromium-memory-limit: %v", err)
+	}
+	if cfg.upstreamHeaders, err = parseUpstreamHeaders(splitList(upstreamHdrs)); err != nil {
+		log.Fatalf("Invalid -chromium-headers: %v", err)
+	}
+	cfg.limits = resourceLimits{memoryBytes: memoryBytes, cpuCores: cpuLimit}
+	if cfg.maxMessageSize, err = parseByteSize(maxMessage); err != nil {
+		log.Fatalf("Invalid -max-message-size: %v", err)
+	}
+	if u := cfg.upstreamClient; u.timeout < 0 || u.attempt < 0 || u.retries < 0 || u.backoff < 0 || u.maxIdleConns < 0 || u.idleTimeout < 0 {
+		log.Fatalf("Invalid -upstream-*: must not be negative")
+	}
+	cfg.fairMethods = splitList(fairMethods)
+	if cfg.fairShare < 0 {
+		log.Fatalf("Invalid -fair-share: must not be negative")
+	}
+	if cfg.fairShare > 0 && len(cfg.fairMethods) == 0 {
+		log.Fatalf("-fair-share requires -fair-share-methods")
+	}
+	if cfg.maxCommandRate < 0 || cfg.commandBurst < 0 {
+		log.Fatalf("Invalid -max-command-rate or -command-burst: can't be negative")
+	}
+	if cfg.reconnectWindow < 0 || cfg.reconnectBuffer < 1 {
+		log.Fatalf("Invalid -reconnect-window or -reconnect-buffer: the window can't be negative and the buffer must hold a frame")
+	}
+	if cfg.maxUploadSize, err = parseByteSize(maxUpload); err != nil {
+		log.Fatalf("Invalid -max-upload-size: %v", err)
+	}
+	if cfg.maxRequestSize, err = parseByteSize(maxRequest); err != nil {
+		log.Fatalf("Invalid -max-request-size: %v", err)
+	}
+	if cfg.maxHeaderSize, err = parseByteSize(maxHeader); err != nil || cfg.maxHeaderSize <= 0 {
+		log.Fatalf("Invalid -max-header-size: must be a positive size")
+	}
+	cfg.auth.clientSubjects = splitList(certSubjects)
+	if cfg.auth.requireCert && cfg.auth.clientCA == "" {
+		log.Fatalf("Invalid -require-client-cert: needs -client-ca")
+	}
+	if cfg.auth.methods, err = parseAuthMethods(authMethods, cfg); err != nil {
+		log.Fatalf("Invalid -auth: %v", err)
+	}
+	if cfg.maxConnections < 0 {
+		log.Fatalf("Invalid -max-connections: must not be negative")
+	}
+	if cfg.tcpKeepAlive < 0 || cfg.headerTimeout < 0 {
+		log.Fatalf("Invalid -tcp-keepalive or -header-timeout: must not be negative")
+	}
+	if cfg.tcpKeepAlive == 0 {
+		// net.ListenConfig takes 0 as its default period.
+		cfg.tcpKeepAlive = -1
+	}
+	if cfg.artifactRetention, err = parseArtifactRetention(splitList(artifactKeep)); err != nil {
+		log.Fatalf("Invalid -artifact-retention: %v", err)
+	}
+	if err := cfg.headers.validate(); err != nil {
+		log.Fatalf("Invalid -frame-ancestors: %v", err)
+	}
+	if cfg.headers.hstsMaxAge < 0 {
+		log.Fatalf("Invalid -hsts-max-age: must not be negative")
+	}
+	if cfg.killHungTargets && cfg.commandTimeout <= 0 {
+		log.Fatalf("-kill-hung-targets requires -command-timeout")
+	}
+	if cfg.warmPoolReuse && cfg.warmPoolSize <= 0 {
+		log.Fatalf("-warm-pool-reuse requires -warm-pool")
+	}
+	if cfg.jobConcurrency < 1 {
+		log.Fatalf("Invalid -job-concurrency: must be at least 1")
+	}
+	if cfg.renderCacheSize, err = parseByteSize(renderCache); err != nil || (cfg.renderCacheTTL > 0 && cfg.renderCacheSize <= 0) {
+		log.Fatalf("Invalid -render-cache-size: %q", renderCache)
+	}
+	if cfg.recycle.maxRSS, err = parseByteSize(recycleRSS); err != nil {
+		log.Fatalf("Invalid -recycle-max-rss: %v", err)
+	}
+	if cfg.probe.unhealthyAfter < 1 || cfg.probe.healthyAfter < 1 {
+		log.Fatalf("-probe-unhealthy-after and -probe-healthy-after must be at least 1")
+	}
+	if cfg.displaySize, err = parseDisplaySize(displaySize); err != nil {
+		log.Fatalf("Invalid -display-size: %v", err)
+	}
+	if cfg.headful && cfg.chromiumBin == "" {
+		log.Fatalf("-headful requires supervised mode (-chromium-bin)")
+	}
+	if cfg.warmPoolSize > 0 {
+		if cfg.chromiumBin == "" {
+			log.Fatalf("-warm-pool requires supervised mode (-chromium-bin)")
+		}
+		if cfg.warmPoolBasePort < 1 || cfg.warmPoolBasePort+cfg.warmPoolSize > 65535 {
+			log.Fatalf("Invalid -warm-pool-base-port: %d", cfg.warmPoolBasePort)
+		}
+	}
+	if cfg.profilesDir != "" && cfg.chromiumBin == "" {
+		log.Fatalf("-profiles-dir requires supervised mode (-chromium-bin)")
+	}
+	if poolBuilds != "" || poolWeights != "" {
+		if cfg.chromiumBin == "" {
+			log.Fatalf("-warm-pool-builds requires supervised mode (-chromium-bin)")
+		}
+		if cfg.chromiumBuilds, err = parseBuilds(cfg.chromiumBin, splitList(poolBuilds), splitList(poolWeights)); err != nil {
+			log.Fatalf("Invalid -warm-pool-builds or -warm-pool-weights: %v", err)
+		}
+	}
+	if cfg.chromiumPipe {
+		if cfg.chromiumBin == "" {
+			log.Fatalf("-chromium-pipe requires supervised mode (-chromium-bin)")
+		}
+		if cfg.warmPoolSize > 0 || cfg.profilesDir != "" || flagsFile != "" || envAllow != "" || argsAllow != "" {
+			log.Fatalf("-chromium-pipe can't be combined with -warm-pool, -profiles-dir, -flag-profiles or -session-env-allow and -session-args-allow")
+		}
+	}
+	if cfg.crashDir != "" && cfg.chromiumBin == "" {
+		log.Fatalf("-crash-dir requires supervised mode (-chromium-bin)")
+	}
+	if maintenance != "" {
+		if cfg.chromiumBin == "" {
+			log.Fatalf("-maintenance-schedule requires supervised mode (-chromium-bin)")
+		}
+		if cfg.maintenanceSchedule, err = parseCronSchedule(maintenance); err != nil {
+			log.Fatalf("Invalid -maintenance-schedule: %v", err)
+		}
+		if cfg.maintenanceWindow <= 0 {
+			log.Fatalf("Invalid -maintenance-window: must be positive")
+		}
+	}
+	if poolsFile != "" {
+		if cfg.pools, err = loadPools(poolsFile); err != nil {
+			log.Fatalf("Failed to load pools: %v", err)
+		}
+	}
+	if flagsFile != "" {
+		if cfg.chromiumBin == "" {
+			log.Fatalf("-flag-profiles requires supervised mode (-chromium-bin)")
+		}
+		if cfg.flagProfiles, err = loadFlagProfiles(flagsFile); err != nil {
+			log.Fatalf("Failed to load flag profiles: %v", err)
+		}
+	}
+	if envAllow != "" || argsAllow != "" {
+		if cfg.chromiumBin == "" {
+			log.Fatalf("-session-env-allow and -session-args-allow require supervised mode (-chromium-bin)")
+		}
+		if cfg.launchAllow, err = parseLaunchAllowlist(envAllow, argsAllow); err != nil {
+			log.Fatalf("Invalid -session-args-allow: %v", err)
+		}
+	}
+	if cfg.vncAddr != "" {
+		if !cfg.headful {
+			log.Fatalf("-vnc-listen requires -headful")
+		}
+		if err := validateVNCAddr(cfg.vncAddr); err != nil {
+			log.Fatalf("Invalid -vnc-listen: %v", err)
+		}
+	}
+	if cfg.dns.resolver != "" || hostRules != "" {
+		if cfg.chromiumBin == "" {
+			log.Fatalf("-dns-resolver and -host-rules require supervised mode (-chromium-bin)")
+		}
+		if cfg.dns.resolver != "" {
+			if err := parseDNSResolver(cfg.dns.resolver); err != nil {
+				log.Fatalf("Invalid -dns-resolver: %v", err)
+			}
+		}
+		if hostRules != "" {
+			if cfg.dns.hostRules, err = parseHostRules(hostRules); err != nil {
+				log.Fatalf("Invalid -host-rules: %v", err)
+			}
+		}
+	}
+	if extensions != "" {
+		if cfg.chromiumBin == "" {
+			log.Fatalf("-chromium-extensions requires supervised mode (-chromium-bin)")
+		}
+		if cfg.extensions, err = resolveExtensions(splitList(extensions)); err != nil {
+			log.Fatalf("Invalid -chromium-extensions: %v", err)
+		}
+	}
+	if cfg.device, err = lookupDevice(cfg.device); err != nil {
+		log.Fatalf("Invalid -device: %v", err)
+	}
+	if cfg.network, err = lookupNetworkProfile(cfg.network); err != nil {
+		log.Fatalf("Invalid -network: %v", err)
+	}
+	if cfg.screencast.MaxFPS < 0 || cfg.screencast.MaxQuality < 0 || cfg.screencast.MaxQuality > 100 {
+		log.Fatalf("Invalid -screencast-max-fps or -screencast-max-quality: must be 0 to turn off, or positive and a quality of at most 100")
+	}
+	if screencastSz != "" {
+		if cfg.screencast.MaxWidth, cfg.screencast.MaxHeight, err = parseScreencastSize(screencastSz); err != nil {
+			log.Fatalf("Invalid -screencast-max-size: %v", err)
+		}
+	}
+	if cfg.tokenPriority, err = parsePriority(tokenPrio); err != nil {
+		log.Fatalf("Invalid -token-priority: %v", err)
+	}
+	if cfg.permissions, err = newPermissionPolicy(splitList(grantPerms), splitList(denyPerms)); err != nil {
+		log.Fatalf("Invalid -grant-permissions or -deny-permissions: %v", err)
+	}
+	if initFile != "" {
+		if cfg.initCommands, err = loadCDPCommands(initFile); err != nil {
+			log.Fatalf("Failed to load init commands: %v", err)
+		}
+	}
+	scripts, err := loadInjectedScripts(splitList(scriptFiles), scriptInline)
+	if err != nil {
+		log.Fatalf("Failed to load injected scripts: %v", err)
+	}
+	cfg.initCommands = append(cfg.initCommands, scripts...)
+	if cfg.urlPolicy, err = parseURLPolicy(splitList(urlAllow), splitList(urlDeny)); err != nil {
+		log.Fatalf("Invalid -url-allow or -url-deny: %v", err)
+	}
+	if cfg.middleware, err = parseMiddleware(splitList(middleware)); err != nil {
+		log.Fatalf("Invalid -middleware: %v", err)
+	}
+	if cfg.protocolShims, err = parseProtocolShims(splitList(shims)); err != nil {
+		log.Fatalf("Invalid -protocol-shims: %v", err)
+	}
+	cfg.frameHook = strings.Fields(frameHook)
+	cfg.acme.domains = splitList(acmeDomains)
+	usesACME := false
+	for _, raw := range listen.values {
+		spec, err := parseListenSpec(raw)
+		if err != nil {
+			log.Fatalf("Invalid -listen: %v", err)
+		}
+		cfg.listen = append(cfg.listen, spec)
+		usesACME = usesACME || spec.acme
+	}
+	if len(cfg.acme.domains) > 0 && !usesACME {
+		log.Fatalf("-acme-domains needs a -listen with ?acme, e.g. -listen 'tcp://:443?acme'")
+	}
+	if cfg.tunnelHub != "" {
+		if u, err := url.Parse(cfg.tunnelHub); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") {
+			log.Fatalf("Invalid -tunnel-hub: must be a ws:// or wss:// URL")
+		}
+	} else if len(cfg.listen) == 0 {
+		log.Fatalf("-listen is empty and there is no -tunnel-hub to take clients")
+	}
+	if (cfg.adminAuth.user == "") != (cfg.adminAuth.password == "") {
+		log.Fatalf("-admin-user and -admin-password must be set together")
+	}
+	if oidc.issuer != "" {
+		oidc.groups = splitList(oidcGroups)
+		if cfg.adminAuth.oidc, err = newOIDCAuth(oidc); err != nil {
+			log.Fatalf("Invalid OIDC configuration: %v", err)
+		}
+	}
+	if cfg.adminAuth.healthz && !cfg.adminAuth.enabled() {
+		log.Fatalf("-admin-auth-healthz requires -admin-token, -admin-user or -oidc-issuer")
+	}
+	if len(cfg.frameHook) > 0 && cfg.frameHookBudget <= 0 {
+		log.Fatalf("Invalid -frame-hook-budget: must be positive")
+	}
+	if blockPrivate {
+		if cfg.networkGuard, err = newNetworkGuard(splitList(privateAllow)); err != nil {
+			log.Fatalf("Invalid -private-network-allow: %v", err)
+		}
+	}
+	if sources := splitList(blockLists); len(sources) > 0 {
+		loadCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		cfg.blockList, err = loadBlockLists(loadCtx, http.DefaultClient, sources)
+		cancel()
+		if err != nil {
+			log.Fatalf("Failed to load block lists: %v", err)
+		}
+		slog.Info("loaded block rules", "rules", cfg.blockList.size(), "skipped", cfg.blockList.skipped)
+	}
+	if rulesFile != "" {
+		if cfg.interceptRules, err = loadInterceptRules(rulesFile); err != nil {
+			log.Fatalf("Failed to load intercept rules: %v", err)
+		}
+	}
+	if anomalyFile != "" {
+		if cfg.anomalyRules, err = loadAnomalyRules(anomalyFile); err != nil {
+			log.Fatalf("Failed to load anomaly rules: %v", err)
+		}
+	}
+	if credsFile != "" {
+		if cfg.siteCredentials, err = loadSiteCredentials(credsFile); err != nil {
+			log.Fatalf("Failed to load site credentials: %v", err)
+		}
+	}
+
+	if doctor {
+		os.Exit(runDoctor(cfg, os.Stdout))
+	}
+
+	server, err := newProxyServer(cfg)
 	if err != nil {
 		log.Fatalf("Failed to create proxy server: %v", err)
 	}
 
+	// On Windows, Ctrl+C arrives as SIGINT, and closing the console,
+	// logging off or shutting down as SIGTERM.
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
+	if winService {
+		if err := runWindowsService(ctx, server.start); err != nil {
+			log.Fatalf("Service exited with error: %v", err)
+		}
+		return
+	}
 	if err := server.start(ctx); err != nil {
 		log.Fatalf("Server exited with error: %v", err)
 	}
 }
 
+// splitList parses a comma-separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	var out []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// invalidEnv names the environment variables whose values the getEnv
+// helpers couldn't parse; main refuses to start with any.
+var invalidEnv []string
+
 func getEnv(key, fallback string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
 	}
 	return fallback
 }
+
+func getEnvBool(key string, fallback bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.ParseBool(value); err == nil {
+			return parsed
+		}
+		invalidEnv = append(invalidEnv, key)
+	}
+	return fallback
+}
+
+func getEnvInt(key string, fallback int) int {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			return parsed
+		}
+		invalidEnv = append(invalidEnv, key)
+	}
+	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil {
+			return parsed
+		}
+		invalidEnv = append(invalidEnv, key)
+	}
+	return fallback
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+			return parsed
+		}
+		invalidEnv = append(invalidEnv, key)
+	}
+	return fallback
+}
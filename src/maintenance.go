@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a -maintenance-schedule: the five fields of a crontab
+// line, minute, hour, day of month, month and day of week, each a set of
+// the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow []bool
+	// domAny and dowAny record a "*" field: as in cron, when both day
+	// fields are restricted a day matching either one matches.
+	domAny, dowAny bool
+}
+
+var cronShortcuts = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+// parseCronSchedule reads a crontab schedule such as "30 3 * * 1-5" or
+// "@daily". Fields take *, numbers, a-b ranges, /step and comma lists;
+// day of week 7 is Sunday, like 0.
+func parseCronSchedule(spec string) (*cronSchedule, error) {
+	if expanded, ok := cronShortcuts[strings.TrimSpace(spec)]; ok {
+		spec = expanded
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%q: want 5 fields, got %d", spec, len(fields))
+	}
+	s := &cronSchedule{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	var err error
+	for i, target := range []struct {
+		set      *[]bool
+		min, max int
+	}{{&s.minute, 0, 59}, {&s.hour, 0, 23}, {&s.dom, 1, 31}, {&s.month, 1, 12}, {&s.dow, 0, 7}} {
+		if *target.set, err = parseCronField(fields[i], target.min, target.max); err != nil {
+			return nil, fmt.Errorf("%q: %w", spec, err)
+		}
+	}
+	if s.dow[7] {
+		s.dow[0] = true
+	}
+	if s.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("%q never matches", spec)
+	}
+	return s, nil
+}
+
+func parseCronField(field string, min, max int) ([]bool, error) {
+	set := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			rng, step = part[:i], n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(from); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(to); err != nil {
+					return nil, fmt.Errorf("invalid value %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+			if lo < min || hi > max || lo > hi {
+				return nil, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// next returns the first minute after t the schedule matches, in t's
+// location, or the zero time if none comes within five years.
+func (s *cronSchedule) next(t time.Time) time.Time {
+	limit := t.AddDate(5, 0, 0)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for t.Before(limit) {
+		switch {
+		case !s.month[t.Month()]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !s.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !s.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	dom, dow := s.dom[t.Day()], s.dow[t.Weekday()]
+	switch {
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// runMaintenance opens a maintenance window on every -maintenance-schedule
+// match until ctx ends.
+func (p *proxyServer) runMaintenance(ctx context.Context) {
+	for {
+		next := p.maintenanceSchedule.next(time.Now())
+		if next.IsZero() {
+			slog.Warn("maintenance schedule never matches again", "event", "maintenance_unscheduled")
+			return
+		}
+		slog.Info("next maintenance window scheduled", "event", "maintenance_scheduled", "at", next.Format(time.RFC3339))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+		p.maintain(ctx)
+	}
+}
+
+// maintain drains the replica and recycles the supervised browser once
+// its last session has ended. Sessions are never cut short: if some are
+// still running when -maintenance-window runs out, the recycle is skipped
+// until the next window. With -admission-wait, connections arriving
+// meanwhile wait for the window to close rather than being refused.
+func (p *proxyServer) maintain(ctx context.Context) {
+	p.recycleMu.Lock()
+	defer p.recycleMu.Unlock()
+
+	done := make(chan struct{})
+	p.maintenanceDone.Store(&done)
+	defer func() {
+		p.setDraining(false)
+		p.maintenanceDone.Store(nil)
+		close(done)
+	}()
+
+	start := time.Now()
+	slog.Info("maintenance window started", "event", "maintenance_started", "active_sessions", len(p.sessions.list()), "window", p.maintenanceWindow.String())
+	p.drainSessions(ctx, p.maintenanceWindow)
+	if ctx.Err() != nil {
+		return
+	}
+	if remaining := len(p.sessions.list()); remaining > 0 {
+		slog.Warn("maintenance window ended with sessions still active; chromium not recycled", "event", "maintenance_skipped", "active_sessions", remaining)
+		p.metrics.add("browserd_maintenance_skipped_total", nil, 1)
+		return
+	}
+	p.supervisor.restart()
+	slog.Info("maintenance window finished; chromium recycled", "event", "maintenance_finished", "duration", time.Since(start).Round(time.Millisecond).String())
+	p.metrics.add("browserd_maintenance_recycles_total", nil, 1)
+}
+
+// awaitMaintenance holds a connection that arrives during a maintenance
+// window for up to -admission-wait, reporting whether the window closed
+// in time.
+func (p *proxyServer) awaitMaintenance(ctx context.Context) bool {
+	done := p.maintenanceDone.Load()
+	if done == nil || p.admission.wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(p.admission.wait)
+	defer timer.Stop()
+	select {
+	case <-*done:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return false
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metricCounter = "counter"
+	metricGauge   = "gauge"
+
+	// maxLabelValuesPerKey caps how many distinct values of one session label
+	// are exported before further values are folded into "other".
+	maxLabelValuesPerKey = 50
+	overflowLabelValue   = "other"
+)
+
+// metricsRegistry is a minimal Prometheus text-format registry. It keeps
+// the proxy free of a client library while covering counters and gauges.
+type metricsRegistry struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+
+	// labelKeys lists the session labels exported as metric labels.
+	labelKeys []string
+	seen      map[string]map[string]bool
+
+	// parent, when set, holds the series: this registry records into it
+	// with constLabels added, as for a named pool.
+	parent      *metricsRegistry
+	constLabels map[string]string
+}
+
+type metricFamily struct {
+	name   string
+	help   string
+	kind   string
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels string
+	// pairs holds the labels unformatted, for sinks other than /metrics.
+	pairs map[string]string
+	value float64
+}
+
+func newMetricsRegistry(labelKeys []string) *metricsRegistry {
+	m := &metricsRegistry{
+		families:  make(map[string]*metricFamily),
+		labelKeys: labelKeys,
+		seen:      make(map[string]map[string]bool),
+	}
+
+	m.register("browserd_sessions_total", metricCounter, "Client sessions accepted by the proxy.")
+	m.register("browserd_active_sessions", metricGauge, "Client sessions currently being proxied.")
+	m.register("browserd_relayed_messages_total", metricCounter, "Messages relayed by ended sessions, by the side that sent them.")
+	m.register("browserd_relayed_bytes_total", metricCounter, "Bytes relayed by ended sessions, by the side that sent them.")
+	return m
+}
+
+// withLabels returns a registry recording into m with labels added to
+// every series.
+func (m *metricsRegistry) withLabels(labels map[string]string) *metricsRegistry {
+	return &metricsRegistry{parent: m, constLabels: labels}
+}
+
+// labelled adds the constant labels to labels.
+func (m *metricsRegistry) labelled(labels map[string]string) map[string]string {
+	out := make(map[string]string, len(labels)+len(m.constLabels))
+	for name, value := range labels {
+		out[name] = value
+	}
+	for name, value := range m.constLabels {
+		out[name] = value
+	}
+	return out
+}
+
+func (m *metricsRegistry) register(name, kind, help string) {
+	if m.parent != nil {
+		// The family may have series from the replica or other pools.
+		m.parent.mu.Lock()
+		defer m.parent.mu.Unlock()
+		if _, ok := m.parent.families[name]; !ok {
+			m.parent.families[name] = &metricFamily{name: name, help: help, kind: kind, series: make(map[string]*metricSeries)}
+		}
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.families[name] = &metricFamily{name: name, help: help, kind: kind, series: make(map[string]*metricSeries)}
+}
+
+func (m *metricsRegistry) add(name string, labels map[string]string, delta float64) {
+	if m.parent != nil {
+		m.parent.add(name, m.labelled(labels), delta)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	family, ok := m.families[name]
+	if !ok {
+		return
+	}
+	key := formatLabels(labels)
+	series, ok := family.series[key]
+	if !ok {
+		series = newMetricSeries(key, labels)
+		family.series[key] = series
+	}
+	series.value += delta
+}
+
+func (m *metricsRegistry) set(name string, labels map[string]string, value float64) {
+	if m.parent != nil {
+		m.parent.set(name, m.labelled(labels), value)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	family, ok := m.families[name]
+	if !ok {
+		return
+	}
+	key := formatLabels(labels)
+	series, ok := family.series[key]
+	if !ok {
+		series = newMetricSeries(key, labels)
+		family.series[key] = series
+	}
+	series.value = value
+}
+
+// remove drops one series, for labels that stopped existing.
+func (m *metricsRegistry) remove(name string, labels map[string]string) {
+	if m.parent != nil {
+		m.parent.remove(name, m.labelled(labels))
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if family, ok := m.families[name]; ok {
+		delete(family.series, formatLabels(labels))
+	}
+}
+
+func newMetricSeries(key string, labels map[string]string) *metricSeries {
+	pairs := make(map[string]string, len(labels))
+	for name, value := range labels {
+		pairs[name] = value
+	}
+	return &metricSeries{labels: key, pairs: pairs}
+}
+
+// sessionLabels projects a session's labels onto the configured metric
+// label keys, applying the per-key cardinality guard.
+func (m *metricsRegistry) sessionLabels(labels map[string]string) map[string]string {
+	if m.parent != nil {
+		return m.parent.sessionLabels(labels)
+	}
+	if len(m.labelKeys) == 0 {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make(map[string]string, len(m.labelKeys))
+	for _, key := range m.labelKeys {
+		value := labels[key]
+		seen := m.seen[key]
+		if seen == nil {
+			seen = make(map[string]bool)
+			m.seen[key] = seen
+		}
+		if !seen[value] {
+			if len(seen) >= maxLabelValuesPerKey {
+				value = overflowLabelValue
+			} else {
+				seen[value] = true
+			}
+		}
+		out[key] = value
+	}
+	return out
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, key+"="+strconv.Quote(labels[key]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (m *metricsRegistry) writeTo(w io.Writer) {
+	if m.parent != nil {
+		m.parent.writeTo(w)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		family := m.families[name]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s%s %s\n", family.name, key, strconv.FormatFloat(family.series[key].value, 'g', -1, 64))
+		}
+	}
+}
+
+// metricSample is one series as seen by each.
+type metricSample struct {
+	name   string
+	kind   string
+	key    string
+	labels map[string]string
+	value  float64
+}
+
+// each calls fn for every series, in the order /metrics lists them.
+func (m *metricsRegistry) each(fn func(metricSample)) {
+	if m.parent != nil {
+		m.parent.each(fn)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		family := m.families[name]
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			series := family.series[key]
+			fn(metricSample{name: name, kind: family.kind, key: key, labels: series.pairs, value: series.value})
+		}
+	}
+}
+
+func (p *proxyServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	p.sampleRuntime()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	p.metrics.writeTo(w)
+}
+
+// sampleRuntime refreshes the metrics read from the Go runtime rather than
+// kept up to date.
+func (p *proxyServer) sampleRuntime() {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	p.metrics.set("browserd_goroutines", nil, float64(runtime.NumGoroutine()))
+	p.metrics.set("browserd_heap_bytes", nil, float64(mem.HeapAlloc))
+	p.metrics.set("browserd_gc_cycles_total", nil, float64(mem.NumGC))
+	p.metrics.set("browserd_gc_pause_seconds_total", nil, time.Duration(mem.PauseTotalNs).Seconds())
+	var last time.Duration
+	if mem.NumGC > 0 {
+		last = time.Duration(mem.PauseNs[(mem.NumGC+255)%256])
+	}
+	p.metrics.set("browserd_gc_last_pause_seconds", nil, last.Seconds())
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// frameDirection is which way a relayed frame travels.
+type frameDirection int
+
+const (
+	toUpstream frameDirection = iota
+	toClient
+)
+
+// relayFrame is a frame passing through a middleware chain. Middleware may
+// replace data to forward a different frame.
+type relayFrame struct {
+	sess    *session
+	dir     frameDirection
+	msgType int
+	data    []byte
+}
+
+// messageMiddleware inspects the frames a relay forwards. Client frames
+// reach the chain as the client sent them, before browserd's own checks
+// and rewrites; upstream frames once browserd has consumed its own
+// responses and events, as the client would receive them.
+type messageMiddleware interface {
+	// handleFrame returns false to drop the frame.
+	handleFrame(f *relayFrame) bool
+}
+
+// middlewareChain runs middleware in -middleware order; the first to drop
+// a frame ends it.
+type middlewareChain []messageMiddleware
+
+func (c middlewareChain) handle(f *relayFrame) bool {
+	for _, m := range c {
+		if !m.handleFrame(f) {
+			return false
+		}
+	}
+	return true
+}
+
+// middlewares are the middleware -middleware can name.
+var middlewares = map[string]func() messageMiddleware{
+	"audit": func() messageMiddleware { return auditMiddleware{} },
+}
+
+func parseMiddleware(names []string) (middlewareChain, error) {
+	var chain middlewareChain
+	for _, name := range names {
+		newMiddleware, ok := middlewares[name]
+		if !ok {
+			known := make([]string, 0, len(middlewares))
+			for name := range middlewares {
+				known = append(known, name)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("unknown middleware %q (known: %s)", name, strings.Join(known, ", "))
+		}
+		chain = append(chain, newMiddleware())
+	}
+	return chain, nil
+}
+
+// auditMiddleware writes every client command, and every error the
+// upstream answers one with, to the session log.
+type auditMiddleware struct{}
+
+func (auditMiddleware) handleFrame(f *relayFrame) bool {
+	if f.msgType != websocket.TextMessage {
+		return true
+	}
+	var msg cdpMessage
+	if err := json.Unmarshal(f.data, &msg); err != nil || msg.ID == nil {
+		return true
+	}
+	switch {
+	case f.dir == toUpstream && msg.Method != "":
+		f.sess.logf("command %d %s session=%q", *msg.ID, msg.Method, msg.SessionID)
+	case f.dir == toClient && len(msg.Error) > 0:
+		f.sess.logf("command %d failed: %s", *msg.ID, msg.Error)
+	}
+	return true
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// defaultMigrateIdle is how long a session must have sent no commands for
+// POST /admin/migrate to move it, unless the request says otherwise.
+const defaultMigrateIdle = 30 * time.Second
+
+// errSessionBusy refuses to migrate a session that isn't idle: it has
+// commands in flight, or its upstream is already being replaced.
+var errSessionBusy = errors.New("session is busy")
+
+// migrateRequest is the body of POST /admin/migrate.
+type migrateRequest struct {
+	// To is the backend to move sessions to: an http(s):// endpoint whose
+	// /json/version is looked up, or a ws(s):// debugger URL.
+	To string `json:"to"`
+	// Idle is how long a session must have sent no commands; 30s when
+	// empty.
+	Idle string `json:"idle,omitempty"`
+	// Sessions limits the migration to these session IDs.
+	Sessions []string `json:"sessions,omitempty"`
+}
+
+type migrateResponse struct {
+	Migrated []string `json:"migrated"`
+	// Skipped gives the reason each session that wasn't moved stayed.
+	Skipped map[string]string `json:"skipped"`
+}
+
+// handleMigrate answers POST /admin/migrate by moving the idle sessions on
+// the shared browser to another backend, one at a time, so the old one can
+// be drained for an upgrade. Each session's browser context and setup are
+// recreated there, its cookies and localStorage restored and its pages
+// reopened; the client sees its old pages detach and new ones attach.
+func (p *proxyServer) handleMigrate(w http.ResponseWriter, r *http.Request) {
+	var req migrateRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		p.writeBodyError(w, err)
+		return
+	}
+	to, err := newFallbackBackend(req.To)
+	if err != nil || to.endpoint.Host == "" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid backend %q", req.To))
+		return
+	}
+	idle := defaultMigrateIdle
+	if req.Idle != "" {
+		if idle, err = time.ParseDuration(req.Idle); err != nil || idle < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid idle %q", req.Idle))
+			return
+		}
+	}
+	if err := to.resolve(r.Context(), p.client); err != nil {
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("backend %s: %v", to.endpoint.Redacted(), err))
+		return
+	}
+
+	sessions := p.allSessions()
+	if len(req.Sessions) > 0 {
+		sessions = sessions[:0]
+		for _, id := range req.Sessions {
+			if sess := p.sessions.get(id); sess != nil {
+				sessions = append(sessions, sess)
+			}
+		}
+	}
+	resp := migrateResponse{Migrated: []string{}, Skipped: make(map[string]string)}
+	for _, sess := range sessions {
+		switch {
+		case sess.migrate == nil:
+			resp.Skipped[sess.id] = "not on the shared browser, or -reconnect-window is off"
+		case time.Since(sess.lastActive()) < idle:
+			resp.Skipped[sess.id] = "not idle"
+		default:
+			ctx, cancel := context.WithTimeout(r.Context(), defaultAPITimeout)
+			err := sess.migrate(ctx, to)
+			cancel()
+			if err != nil {
+				resp.Skipped[sess.id] = err.Error()
+				continue
+			}
+			resp.Migrated = append(resp.Migrated, sess.id)
+		}
+	}
+	slog.Info("sessions migrated via admin api", "event", "migrate", "backend", to.endpoint.Redacted(), "migrated", len(resp.Migrated), "skipped", len(resp.Skipped), "operator_ip", clientIP(r.RemoteAddr))
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// migratedContext is a browser context of a session being migrated, with
+// the state and pages it had on the old backend.
+type migratedContext struct {
+	// id is the context the client knows.
+	id      string
+	cookies []stateCookie
+	origins []stateStorage
+	urls    []string
+}
+
+// migrateSession moves sess, relayed by r, to the backend to. Client frames
+// are buffered from the start; once the session's pages and their state
+// are read from the old backend, the new one is dialed and takes over the
+// relay's upstream, and the session is restored there as after a
+// reconnect. A session that fails before the switch stays where it was;
+// one that can't be restored after it ends.
+func (p *proxyServer) migrateSession(ctx context.Context, sess *session, r *relay, to *fallbackBackend, subprotocol string) error {
+	rc := r.reconnect
+	rc.swapMu.Lock()
+	defer rc.swapMu.Unlock()
+	if !rc.pause() {
+		return errSessionBusy
+	}
+	started := time.Now()
+
+	old, contexts, err := p.exportSession(ctx, sess, rc)
+	if old != nil {
+		defer old.close()
+	}
+	if err != nil {
+		r.flushBuffered()
+		p.metrics.add("browserd_session_migrations_total", map[string]string{"result": "failed"}, 1)
+		return fmt.Errorf("read session state: %w", err)
+	}
+	var subprotocols []string
+	if subprotocol != "" {
+		subprotocols = []string{subprotocol}
+	}
+	conn, _, err := p.dial(ctx, to.getDebuggerURL(), subprotocols)
+	if err != nil {
+		r.flushBuffered()
+		p.metrics.add("browserd_session_migrations_total", map[string]string{"result": "failed"}, 1)
+		return fmt.Errorf("dial %s: %w", to.endpoint.Redacted(), err)
+	}
+	if p.maxMessage > 0 {
+		conn.SetReadLimit(p.maxMessage)
+	}
+
+	closedTargets := sess.pageTargets()
+	r.swapUpstream(conn)
+	sess.migrated.Store(to)
+	r.detachTargets()
+	replayed, err := r.restoreSetup()
+	if err != nil {
+		p.metrics.add("browserd_session_migrations_total", map[string]string{"result": "failed"}, 1)
+		sess.log.Warn("failed to restore migrated session", "event", "session_migrate_failed", "error", err)
+		sess.logf("failed to restore session after migrating: %v", err)
+		r.abandonUpstream()
+		return fmt.Errorf("restore session: %w", err)
+	}
+	pages := 0
+	for _, mc := range contexts {
+		if err := p.importContext(ctx, to, rc, mc); err != nil {
+			// The session goes on; only these pages aren't back.
+			sess.log.Warn("failed to restore pages of migrated session", "browser_context_id", mc.id, "error", err)
+			sess.logf("restoring pages of context %q failed: %v", mc.id, err)
+			continue
+		}
+		pages += len(mc.urls)
+	}
+	buffered := r.flushBuffered()
+	if old != nil {
+		// Pages outside the session's own context outlive its connection.
+		for _, targetID := range closedTargets {
+			_, _ = old.call(ctx, "", "Target.closeTarget", map[string]any{"targetId": targetID})
+		}
+	}
+
+	p.metrics.add("browserd_session_migrations_total", map[string]string{"result": "ok"}, 1)
+	sess.log.Info("session migrated", "event", "session_migrated", "backend", to.endpoint.Redacted(), "duration", time.Since(started).Round(time.Millisecond).String(), "replayed", replayed, "pages", pages, "buffered", buffered)
+	sess.logf("migrated to %s after %s, replayed %d setup commands, reopened %d pages and sent %d buffered frames", to.endpoint.Redacted(), time.Since(started).Round(time.Millisecond), replayed, pages, buffered)
+	return nil
+}
+
+// exportSession reads the URL, browser context, cookies and localStorage
+// of each page of sess over a connection of its own to the old backend,
+// which is returned for closing the pages once they have moved.
+func (p *proxyServer) exportSession(ctx context.Context, sess *session, rc *reconnector) (*cdpClient, []*migratedContext, error) {
+	targets := sess.pageTargets()
+	if len(targets) == 0 {
+		return nil, nil, nil
+	}
+	conn, _, err := p.dial(ctx, p.currentDebuggerURL(sess), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	client := newCDPClient(conn)
+
+	var contexts []*migratedContext
+	byID := make(map[string]*migratedContext)
+	for _, targetID := range targets {
+		result, err := client.call(ctx, "", "Target.getTargetInfo", map[string]any{"targetId": targetID})
+		if err != nil {
+			// The page may have closed since; skip it.
+			continue
+		}
+		var info struct {
+			TargetInfo struct {
+				URL              string `json:"url"`
+				BrowserContextID string `json:"browserContextId"`
+			} `json:"targetInfo"`
+		}
+		if err := json.Unmarshal(result, &info); err != nil {
+			return client, nil, err
+		}
+		page := &apiPage{client: client}
+		if page.sessionID, err = client.attach(ctx, targetID); err != nil {
+			continue
+		}
+
+		id := rc.clientID(info.TargetInfo.BrowserContextID)
+		mc := byID[id]
+		if mc == nil {
+			mc = &migratedContext{id: id}
+			if mc.cookies, err = page.cookies(ctx); err != nil {
+				return client, nil, err
+			}
+			byID[id] = mc
+			contexts = append(contexts, mc)
+		}
+		mc.urls = append(mc.urls, info.TargetInfo.URL)
+		storage, err := page.localStorage(ctx)
+		if err != nil {
+			return client, nil, err
+		}
+		if storage == nil {
+			continue
+		}
+		if u, err := url.Parse(storage.Origin); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+		// Pages of one origin share their localStorage.
+		mc.origins = slices.DeleteFunc(mc.origins, func(o stateStorage) bool { return o.Origin == storage.Origin })
+		mc.origins = append(mc.origins, *storage)
+	}
+	return client, contexts, nil
+}
+
+// importContext restores a context's cookies and localStorage on the new
+// backend, through importState on a page opened for it, and then reopens
+// its pages, which the client's replayed target discovery reports.
+func (p *proxyServer) importContext(ctx context.Context, to *fallbackBackend, rc *reconnector, mc *migratedContext) error {
+	conn, _, err := p.dial(ctx, to.getDebuggerURL(), nil)
+	if err != nil {
+		return err
+	}
+	page := &apiPage{client: newCDPClient(conn)}
+	defer page.close()
+
+	params := map[string]any{"url": "about:blank"}
+	// Contexts the session didn't create, such as the default one, aren't
+	// recreated; their pages open in the new backend's default context.
+	if id, ok := rc.upstreamID(mc.id); ok {
+		params["browserContextId"] = id
+	}
+	result, err := page.client.call(ctx, "", "Target.createTarget", params)
+	if err != nil {
+		return err
+	}
+	var target struct {
+		TargetID string `json:"targetId"`
+	}
+	if err := json.Unmarshal(result, &target); err != nil {
+		return err
+	}
+	if page.sessionID, err = page.client.attach(ctx, target.TargetID); err != nil {
+		return err
+	}
+	if err := page.importState(ctx, target.TargetID, &stateBundle{Cookies: mc.cookies, Origins: mc.origins}); err != nil {
+		return err
+	}
+
+	// The page opened for the import becomes the first of the context's.
+	if mc.urls[0] != "about:blank" {
+		if _, err := page.client.call(ctx, page.sessionID, "Page.navigate", map[string]any{"url": mc.urls[0]}); err != nil {
+			return err
+		}
+	}
+	for _, u := range mc.urls[1:] {
+		params["url"] = u
+		if _, err := page.client.call(ctx, "", "Target.createTarget", params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pause starts buffering client frames for a migration, unless commands
+// are in flight, the upstream is already being replaced or the session is
+// closing.
+func (rc *reconnector) pause() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.reconnecting || rc.closing || len(rc.inFlight) > 0 {
+		return false
+	}
+	rc.reconnecting = true
+	return true
+}
+
+// clientID is the browser context ID the client knows for id, one of the
+// current upstream's.
+func (rc *reconnector) clientID(id string) string {
+	rc.aliasMu.RLock()
+	defer rc.aliasMu.RUnlock()
+	if client, ok := rc.reverse[id]; ok {
+		return client
+	}
+	return id
+}
+
+// upstreamID is the current upstream's recreation of the browser context
+// the client knows as id, if it was recreated.
+func (rc *reconnector) upstreamID(id string) (string, bool) {
+	rc.aliasMu.RLock()
+	defer rc.aliasMu.RUnlock()
+	current, ok := rc.aliases[id]
+	return current, ok
+}
+
+// migrateHook lets POST /admin/migrate move a session relayed by r.
+func (p *proxyServer) migrateHook(sess *session, r *relay, subprotocol string) func(ctx context.Context, to *fallbackBackend) error {
+	return func(ctx context.Context, to *fallbackBackend) error {
+		return p.migrateSession(ctx, sess, r, to, subprotocol)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const drainPollInterval = time.Second
+
+// recyclePolicy configures when the resource monitor recycles Chromium.
+type recyclePolicy struct {
+	interval     time.Duration
+	maxRSS       int64
+	maxTargets   int
+	drainTimeout time.Duration
+	// maxSessions and maxAge retire a supervised browser after it served
+	// that many sessions or has been running that long.
+	maxSessions int
+	maxAge      time.Duration
+}
+
+func (r recyclePolicy) enabled() bool {
+	return r.interval > 0 && (r.maxRSS > 0 || r.maxTargets > 0 || r.maxSessions > 0 || r.maxAge > 0)
+}
+
+// monitorResources samples the browser's RSS and open target count and
+// recycles it once either exceeds the configured threshold.
+func (p *proxyServer) monitorResources(ctx context.Context) {
+	ticker := time.NewTicker(p.recycle.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reason := p.checkResources(ctx)
+		if reason == "" {
+			continue
+		}
+
+		if p.supervisor == nil {
+			slog.Warn("chromium exceeded a recycle threshold; recycling requires supervised mode", "reason", reason)
+			continue
+		}
+
+		slog.Info("recycling chromium", "event", "browser_recycle", "reason", reason)
+		p.metrics.add("browserd_chromium_recycles_total", nil, 1)
+		p.recycleMu.Lock()
+		p.drainSessions(ctx, p.recycle.drainTimeout)
+		p.supervisor.restart()
+		p.setDraining(false)
+		p.recycleMu.Unlock()
+	}
+}
+
+// checkResources returns a non-empty reason when a threshold is exceeded.
+func (p *proxyServer) checkResources(ctx context.Context) string {
+	reqCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	if targets, err := p.fetchRawTargets(reqCtx); err != nil {
+		slog.Warn("failed to list chromium targets", "error", err)
+	} else {
+		p.metrics.set("browserd_chromium_open_targets", nil, float64(len(targets)))
+		if p.recycle.maxTargets > 0 && len(targets) > p.recycle.maxTargets {
+			return fmt.Sprintf("%d open targets (limit %d)", len(targets), p.recycle.maxTargets)
+		}
+	}
+
+	if p.supervisor == nil {
+		return ""
+	}
+	pid, startedAt, sessions := p.supervisor.usage()
+	if pid == 0 {
+		return ""
+	}
+	if p.recycle.maxSessions > 0 && sessions >= p.recycle.maxSessions {
+		return fmt.Sprintf("%d sessions served (limit %d)", sessions, p.recycle.maxSessions)
+	}
+	if age := time.Since(startedAt); p.recycle.maxAge > 0 && age > p.recycle.maxAge {
+		return fmt.Sprintf("running for %s (limit %s)", age.Round(time.Second), p.recycle.maxAge)
+	}
+	rss, err := processTreeRSS(pid)
+	if err != nil {
+		slog.Warn("failed to read chromium rss", "error", err)
+		return ""
+	}
+	p.metrics.set("browserd_chromium_rss_bytes", nil, float64(rss))
+	if p.recycle.maxRSS > 0 && rss > p.recycle.maxRSS {
+		return fmt.Sprintf("RSS %d bytes (limit %d)", rss, p.recycle.maxRSS)
+	}
+	return ""
+}
+
+// drainSessions stops admitting new sessions and waits for active ones to
+// finish, giving up after timeout.
+func (p *proxyServer) drainSessions(ctx context.Context, timeout time.Duration) {
+	p.setDraining(true)
+
+	deadline := time.Now().Add(timeout)
+	for len(p.sessions.list()) > 0 && time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(drainPollInterval):
+		}
+	}
+	if remaining := len(p.sessions.list()); remaining > 0 {
+		slog.Warn("drain timed out", "active_sessions", remaining)
+	}
+}
+
+// setDraining starts or ends the drain around a recycle. New sessions stay
+// refused afterwards while an operator has drained the replica.
+func (p *proxyServer) setDraining(draining bool) {
+	p.recycling.Store(draining)
+	p.updateDraining()
+}
+
+// setDrained starts or ends an operator drain, which lasts until undone
+// and covers the named pools too.
+func (p *proxyServer) setDrained(drained bool) {
+	p.drained.Store(drained)
+	p.updateDraining()
+	for _, pool := range p.namedPools {
+		pool.setDrained(drained)
+	}
+}
+
+func (p *proxyServer) updateDraining() {
+	draining := p.recycling.Load() || p.drained.Load()
+	p.draining.Store(draining)
+	value := 0.0
+	if draining {
+		value = 1
+	}
+	p.metrics.set("browserd_draining", nil, value)
+}
+
+// processTreeRSS sums the resident set size of pid and all its descendants
+// using /proc, which covers Chromium's renderer and utility processes.
+func processTreeRSS(pid int) (int64, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+
+	children := make(map[int][]int)
+	for _, entry := range entries {
+		child, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// The command name may contain spaces, so parse after its closing paren.
+		fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+		if len(fields) < 2 {
+			continue
+		}
+		parent, _ := strconv.Atoi(fields[1])
+		children[parent] = append(children[parent], child)
+	}
+
+	var total int64
+	pageSize := int64(os.Getpagesize())
+	queue := []int{pid}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = append(queue[1:], children[current]...)
+
+		statm, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(current), "statm"))
+		if err != nil {
+			continue
+		}
+		fields := strings.Fields(string(statm))
+		if len(fields) < 2 {
+			continue
+		}
+		pages, _ := strconv.ParseInt(fields[1], 10, 64)
+		total += pages * pageSize
+	}
+	return total, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// networkProfile is a named set of network conditions applied to every
+// page target of a session with Network.emulateNetworkConditions.
+// Throughputs are in bytes per second; 0 leaves them unthrottled.
+type networkProfile struct {
+	Offline            bool
+	Latency            float64
+	DownloadThroughput float64
+	UploadThroughput   float64
+}
+
+// networkProfiles follow the DevTools throttling presets.
+var networkProfiles = map[string]networkProfile{
+	"3g-fast": {
+		Latency:            562.5,
+		DownloadThroughput: 1.6 * 1000 * 1000 / 8 * 0.9,
+		UploadThroughput:   750 * 1000 / 8 * 0.9,
+	},
+	"3g-slow": {
+		Latency:            2000,
+		DownloadThroughput: 500 * 1000 / 8 * 0.8,
+		UploadThroughput:   500 * 1000 / 8 * 0.8,
+	},
+	"offline": {
+		Offline: true,
+	},
+	"1mbps-capped": {
+		DownloadThroughput: 1000 * 1000 / 8,
+		UploadThroughput:   1000 * 1000 / 8,
+	},
+}
+
+// command returns the init command that applies the profile.
+func (n networkProfile) command() cdpCommand {
+	// -1 disables throttling in that direction.
+	throughput := func(v float64) float64 {
+		if v == 0 {
+			return -1
+		}
+		return v
+	}
+	params, _ := json.Marshal(map[string]any{
+		"offline":            n.Offline,
+		"latency":            n.Latency,
+		"downloadThroughput": throughput(n.DownloadThroughput),
+		"uploadThroughput":   throughput(n.UploadThroughput),
+	})
+	return cdpCommand{Method: "Network.emulateNetworkConditions", Params: params}
+}
+
+// lookupNetworkProfile validates a profile name; the empty name means no
+// throttling.
+func lookupNetworkProfile(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return "", nil
+	}
+	if _, ok := networkProfiles[name]; !ok {
+		names := make([]string, 0, len(networkProfiles))
+		for known := range networkProfiles {
+			names = append(names, known)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("unknown network profile %q (known: %s)", name, strings.Join(names, ", "))
+	}
+	return name, nil
+}
+
+// parseNetworkProfile reads the ?network= parameter, falling back to the
+// configured default profile.
+func parseNetworkProfile(query url.Values, fallback string) (string, error) {
+	if raw, ok := query["network"]; ok && len(raw) > 0 {
+		return lookupNetworkProfile(raw[0])
+	}
+	return fallback, nil
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func listenNamedPipe(string) (net.Listener, error) {
+	return nil, errors.New("named pipes are only available on Windows")
+}
@@ -0,0 +1,165 @@
+//go:build windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32 = syscall.NewLazyDLL("kernel32.dll")
+
+	procCreateNamedPipe     = kernel32.NewProc("CreateNamedPipeW")
+	procConnectNamedPipe    = kernel32.NewProc("ConnectNamedPipe")
+	procDisconnectNamedPipe = kernel32.NewProc("DisconnectNamedPipe")
+	procCreateEvent         = kernel32.NewProc("CreateEventW")
+	procGetOverlappedResult = kernel32.NewProc("GetOverlappedResult")
+)
+
+const (
+	pipeAccessDuplex          = 0x3
+	fileFlagFirstPipeInstance = 0x80000
+	fileFlagOverlapped        = 0x40000000
+	pipeUnlimitedInstances    = 255
+	pipeBufferSize            = 64 << 10
+
+	errorPipeConnected = syscall.Errno(535)
+	errorNoData        = syscall.Errno(232)
+)
+
+// npipeListener accepts connections on a named pipe. Accept waits for a
+// client on one instance of the pipe and creates the next once one
+// connected. Instances are overlapped, so the os.File each connection is
+// served through reads and writes at the same time.
+type npipeListener struct {
+	path string
+
+	mu     sync.Mutex
+	next   syscall.Handle
+	closed bool
+}
+
+func listenNamedPipe(path string) (net.Listener, error) {
+	h, err := createPipeInstance(path, true)
+	if err != nil {
+		return nil, err
+	}
+	return &npipeListener{path: path, next: h}, nil
+}
+
+// createPipeInstance creates an instance of the pipe. The first one fails
+// if another process already serves the pipe.
+func createPipeInstance(path string, first bool) (syscall.Handle, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	mode := uintptr(pipeAccessDuplex | fileFlagOverlapped)
+	if first {
+		mode |= fileFlagFirstPipeInstance
+	}
+	r, _, err := procCreateNamedPipe.Call(uintptr(unsafe.Pointer(name)), mode, 0, pipeUnlimitedInstances, pipeBufferSize, pipeBufferSize, 0, 0)
+	if h := syscall.Handle(r); h != syscall.InvalidHandle {
+		return h, nil
+	}
+	return 0, err
+}
+
+func (l *npipeListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	h, closed := l.next, l.closed
+	l.mu.Unlock()
+	if closed {
+		return nil, net.ErrClosed
+	}
+	for {
+		err := connectPipe(h)
+		if err == nil {
+			break
+		}
+		l.mu.Lock()
+		closed := l.closed
+		l.mu.Unlock()
+		if closed {
+			return nil, net.ErrClosed
+		}
+		// A client that gave up before it was accepted leaves the
+		// instance to be reused.
+		if err != errorNoData {
+			return nil, &os.PathError{Op: "accept", Path: l.path, Err: err}
+		}
+		_, _, _ = procDisconnectNamedPipe.Call(uintptr(h))
+	}
+
+	next, err := createPipeInstance(l.path, false)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err != nil || l.closed {
+		_ = syscall.CloseHandle(h)
+		if err == nil {
+			_ = syscall.CloseHandle(next)
+			err = net.ErrClosed
+		}
+		return nil, err
+	}
+	l.next = next
+	return &npipeConn{File: os.NewFile(uintptr(h), l.path), addr: npipeAddr(l.path)}, nil
+}
+
+// connectPipe waits for a client to open the pipe instance h.
+func connectPipe(h syscall.Handle) error {
+	event, _, err := procCreateEvent.Call(0, 1, 0, 0)
+	if event == 0 {
+		return err
+	}
+	defer syscall.CloseHandle(syscall.Handle(event))
+	overlapped := &syscall.Overlapped{HEvent: syscall.Handle(event)}
+	if r, _, err := procConnectNamedPipe.Call(uintptr(h), uintptr(unsafe.Pointer(overlapped))); r == 0 {
+		switch err {
+		case errorPipeConnected:
+		case syscall.ERROR_IO_PENDING:
+			var n uint32
+			if r, _, err := procGetOverlappedResult.Call(uintptr(h), uintptr(unsafe.Pointer(overlapped)), uintptr(unsafe.Pointer(&n)), 1); r == 0 {
+				return err
+			}
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops accepting connections, cancelling a pending Accept.
+// Connections already accepted are left open.
+func (l *npipeListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	_ = syscall.CancelIoEx(l.next, nil)
+	return syscall.CloseHandle(l.next)
+}
+
+func (l *npipeListener) Addr() net.Addr {
+	return npipeAddr(l.path)
+}
+
+// npipeConn is an accepted connection of a named pipe.
+type npipeConn struct {
+	*os.File
+	addr npipeAddr
+}
+
+func (c *npipeConn) LocalAddr() net.Addr  { return c.addr }
+func (c *npipeConn) RemoteAddr() net.Addr { return c.addr }
+
+type npipeAddr string
+
+func (a npipeAddr) Network() string { return "npipe" }
+func (a npipeAddr) String() string  { return string(a) }
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcSessionCookie = "browserd_admin"
+	oidcStateCookie   = "browserd_oidc_state"
+	// oidcSessionTTL is how long a login lasts, however long the ID token
+	// would have.
+	oidcSessionTTL = 8 * time.Hour
+	oidcStateTTL   = 10 * time.Minute
+	// oidcJWKSRefresh limits refetching the provider's keys for an ID
+	// token signed with a key browserd hasn't seen.
+	oidcJWKSRefresh = time.Minute
+)
+
+// oidcConfig configures single sign-on for the admin endpoints.
+type oidcConfig struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	// redirectURL is the externally reachable /admin/oidc/callback.
+	redirectURL string
+	// groups, when set, are the groups allowed in; groupsClaim is the ID
+	// token claim listing a user's groups.
+	groups      []string
+	groupsClaim string
+}
+
+// oidcAuth signs people in to the admin endpoints with an OpenID Connect
+// provider through the authorization code flow. A successful login sets a
+// signed cookie that authorizeAdmin accepts next to the admin token and
+// basic auth, which machine clients keep using.
+type oidcAuth struct {
+	cfg    oidcConfig
+	client *http.Client
+	// cookieKey signs the session and state cookies. It is derived from
+	// the client secret so every replica accepts the others' logins; each
+	// cookie's MAC also covers its name, so one can't stand in for the
+	// other.
+	cookieKey []byte
+	secure    bool
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+type oidcDiscovery struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcLogin is what the session cookie carries.
+type oidcLogin struct {
+	Subject string `json:"sub"`
+	Email   string `json:"email,omitempty"`
+	Expires int64  `json:"exp"`
+}
+
+// oidcState ties a callback to the login that started it.
+type oidcState struct {
+	State   string `json:"state"`
+	Nonce   string `json:"nonce"`
+	Next    string `json:"next"`
+	Expires int64  `json:"exp"`
+}
+
+func newOIDCAuth(cfg oidcConfig) (*oidcAuth, error) {
+	if cfg.clientID == "" || cfg.clientSecret == "" || cfg.redirectURL == "" {
+		return nil, errors.New("-oidc-issuer requires -oidc-client-id, -oidc-client-secret and -oidc-redirect-url")
+	}
+	redirect, err := url.Parse(cfg.redirectURL)
+	if err != nil || redirect.Host == "" {
+		return nil, fmt.Errorf("invalid -oidc-redirect-url %q", cfg.redirectURL)
+	}
+	if cfg.groupsClaim == "" {
+		cfg.groupsClaim = "groups"
+	}
+	key := sha256.Sum256([]byte("browserd admin session\x00" + cfg.clientSecret))
+	return &oidcAuth{
+		cfg:       cfg,
+		client:    &http.Client{Timeout: requestTimeout},
+		cookieKey: key[:],
+		secure:    redirect.Scheme == "https",
+	}, nil
+}
+
+// authorized reports whether r carries a valid login cookie.
+func (o *oidcAuth) authorized(r *http.Request) bool {
+	cookie, err := r.Cookie(oidcSessionCookie)
+	if err != nil {
+		return false
+	}
+	var login oidcLogin
+	return o.open(oidcSessionCookie, cookie.Value, &login) && login.Subject != "" && time.Now().Unix() < login.Expires
+}
+
+// seal signs v into a value for the cookie name; open verifies and
+// decodes one.
+func (o *oidcAuth) seal(name string, v any) string {
+	data, _ := json.Marshal(v)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + o.mac(name, payload)
+}
+
+func (o *oidcAuth) open(name, value string, v any) bool {
+	payload, sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return false
+	}
+	want := o.mac(name, payload)
+	if subtle.ConstantTimeCompare([]byte(sig), []byte(want)) != 1 {
+		return false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	return err == nil && json.Unmarshal(data, v) == nil
+}
+
+func (o *oidcAuth) mac(name, payload string) string {
+	mac := hmac.New(sha256.New, o.cookieKey)
+	mac.Write([]byte(name + "\x00" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (o *oidcAuth) setCookie(w http.ResponseWriter, name, value string, ttl time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(ttl / time.Second),
+		HttpOnly: true,
+		Secure:   o.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// discover fetches the provider's endpoints once.
+func (o *oidcAuth) discover(ctx context.Context) (*oidcDiscovery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.discovery != nil {
+		return o.discovery, nil
+	}
+	var d oidcDiscovery
+	if err := o.getJSON(ctx, strings.TrimSuffix(o.cfg.issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("discovery: provider metadata is missing endpoints")
+	}
+	o.discovery = &d
+	return o.discovery, nil
+}
+
+func (o *oidcAuth) getJSON(ctx context.Context, endpoint string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// handleLogin sends the browser to the provider, remembering where it
+// was going in the state cookie.
+func (o *oidcAuth) handleLogin(w http.ResponseWriter, r *http.Request) {
+	d, err := o.discover(r.Context())
+	if err != nil {
+		slog.Warn("oidc login failed", "event", "oidc_error", "error", err)
+		http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	next := r.URL.Query().Get("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/admin/sessions"
+	}
+	state := oidcState{State: randomToken(), Nonce: randomToken(), Next: next, Expires: time.Now().Add(oidcStateTTL).Unix()}
+	o.setCookie(w, oidcStateCookie, o.seal(oidcStateCookie, state), oidcStateTTL)
+
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {o.cfg.clientID},
+		"redirect_uri":  {o.cfg.redirectURL},
+		"scope":         {"openid email profile"},
+		"state":         {state.State},
+		"nonce":         {state.Nonce},
+	}
+	target := d.AuthorizationEndpoint + "?" + query.Encode()
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		target = d.AuthorizationEndpoint + "&" + query.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// handleCallback exchanges the code for an ID token, checks it and the
+// user's groups, and signs the user in.
+func (o *oidcAuth) handleCallback(w http.ResponseWriter, r *http.Request) {
+	var state oidcState
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || !o.open(oidcStateCookie, cookie.Value, &state) || time.Now().Unix() > state.Expires ||
+		subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("state")), []byte(state.State)) != 1 {
+		http.Error(w, "login expired or was started elsewhere; try again", http.StatusBadRequest)
+		return
+	}
+	o.setCookie(w, oidcStateCookie, "", -time.Second)
+	if e := r.URL.Query().Get("error"); e != "" {
+		http.Error(w, "login failed: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := o.exchange(r.Context(), r.URL.Query().Get("code"), state.Nonce)
+	if err != nil {
+		slog.Warn("oidc login rejected", "event", "oidc_error", "error", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	email, _ := claims["email"].(string)
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		slog.Warn("oidc login rejected", "event", "oidc_error", "error", "id token has no subject")
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	if len(o.cfg.groups) > 0 && !slices.ContainsFunc(claimStrings(claims[o.cfg.groupsClaim]), func(g string) bool { return slices.Contains(o.cfg.groups, g) }) {
+		slog.Warn("oidc login denied: not in an allowed group", "event", "oidc_denied", "subject", subject, "email", email)
+		http.Error(w, "forbidden: not in an allowed group", http.StatusForbidden)
+		return
+	}
+
+	login := oidcLogin{Subject: subject, Email: email, Expires: time.Now().Add(oidcSessionTTL).Unix()}
+	o.setCookie(w, oidcSessionCookie, o.seal(oidcSessionCookie, login), oidcSessionTTL)
+	slog.Info("admin signed in", "event", "oidc_login", "subject", subject, "email", email, "client_ip", clientIP(r.RemoteAddr))
+	http.Redirect(w, r, state.Next, http.StatusFound)
+}
+
+func (o *oidcAuth) handleLogout(w http.ResponseWriter, r *http.Request) {
+	o.setCookie(w, oidcSessionCookie, "", -time.Second)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// exchange redeems code at the token endpoint and returns the verified
+// claims of the ID token.
+func (o *oidcAuth) exchange(ctx context.Context, code, nonce string) (map[string]any, error) {
+	d, err := o.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {o.cfg.redirectURL},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.cfg.clientID), url.QueryEscape(o.cfg.clientSecret))
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil || tokens.IDToken == "" {
+		return nil, errors.New("token endpoint returned no id_token")
+	}
+
+	claims, err := o.verify(ctx, tokens.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != strings.TrimSuffix(o.cfg.issuer, "/") {
+		return nil, fmt.Errorf("id token issued by %q", iss)
+	}
+	if !slices.Contains(claimStrings(claims["aud"]), o.cfg.clientID) {
+		return nil, errors.New("id token is for another client")
+	}
+	if exp, _ := claims["exp"].(float64); time.Now().Unix() >= int64(exp) {
+		return nil, errors.New("id token expired")
+	}
+	if got, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(got), []byte(nonce)) != 1 {
+		return nil, errors.New("id token nonce mismatch")
+	}
+	return claims, nil
+}
+
+// verify checks an ID token's RS256 or ES256 signature against the
+// provider's published keys and returns its claims.
+func (o *oidcAuth) verify(ctx context.Context, token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("id token header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed id token signature")
+	}
+	key, err := o.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errors.New("invalid id token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errors.New("invalid id token signature")
+		}
+	default:
+		return nil, errors.New("unsupported id token key")
+	}
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("id token claims: %w", err)
+	}
+	return claims, nil
+}
+
+// key returns the provider's signing key kid, refetching the key set for
+// one it doesn't know, as providers rotate them.
+func (o *oidcAuth) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	d, err := o.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if key, ok := o.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(o.fetchedAt) < oidcJWKSRefresh {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	o.fetchedAt = time.Now()
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := o.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+	o.keys = make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch {
+		case k.Kty == "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN == nil && errE == nil {
+				o.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX == nil && errY == nil {
+				o.keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			}
+		}
+	}
+	if key, ok := o.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// claimStrings reads a claim that may be one string or a list of them,
+// as aud and groups can be.
+func claimStrings(claim any) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
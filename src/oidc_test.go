@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestOIDC(t *testing.T) *oidcAuth {
+	t.Helper()
+	issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(oidcDiscovery{
+			AuthorizationEndpoint: "https://idp.example/authorize",
+			TokenEndpoint:         "https://idp.example/token",
+			JWKSURI:               "https://idp.example/jwks",
+		})
+	}))
+	t.Cleanup(issuer.Close)
+	o, err := newOIDCAuth(oidcConfig{
+		issuer:       issuer.URL,
+		clientID:     "browserd",
+		clientSecret: "secret",
+		redirectURL:  "http://browserd/admin/oidc/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestOIDCStateCookieIsNotALogin(t *testing.T) {
+	o := newTestOIDC(t)
+	h := newHarness(t, proxyConfig{adminAuth: adminAuth{oidc: o}})
+	client := &http.Client{
+		Transport:     h.client.Transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	resp, err := client.Get(h.url("/admin/login"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	var state *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == oidcStateCookie {
+			state = c
+		}
+	}
+	if state == nil {
+		t.Fatalf("login set no state cookie (status %d)", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, h.url("/admin/sessions"), nil)
+	req.AddCookie(&http.Cookie{Name: oidcSessionCookie, Value: state.Value})
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("replayed state cookie: status %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestOIDCLoginCookie(t *testing.T) {
+	o := newTestOIDC(t)
+	expires := time.Now().Add(time.Minute).Unix()
+	for _, tc := range []struct {
+		name  string
+		value string
+		want  bool
+	}{
+		{"login", o.seal(oidcSessionCookie, oidcLogin{Subject: "alice", Expires: expires}), true},
+		{"no subject", o.seal(oidcSessionCookie, oidcLogin{Expires: expires}), false},
+		{"expired", o.seal(oidcSessionCookie, oidcLogin{Subject: "alice", Expires: time.Now().Add(-time.Minute).Unix()}), false},
+		{"sealed as state", o.seal(oidcStateCookie, oidcLogin{Subject: "alice", Expires: expires}), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/admin/sessions", nil)
+			r.AddCookie(&http.Cookie{Name: oidcSessionCookie, Value: tc.value})
+			if got := o.authorized(r); got != tc.want {
+				t.Fatalf("authorized = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
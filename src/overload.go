@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Rejection reasons, as reported to clients and in metrics.
+const (
+	reasonMaxSessions    = "max_sessions"
+	reasonMaxAPIRequests = "max_api_requests"
+	reasonWarmPoolEmpty  = "warm_pool_empty"
+)
+
+// overloadReason is the machine-readable close reason for WebSocket clients.
+type overloadReason struct {
+	Reason     string `json:"reason"`
+	RetryAfter int    `json:"retryAfter"`
+}
+
+// acquireAPI reserves one of the -max-api-requests slots without waiting.
+func (p *proxyServer) acquireAPI() bool {
+	if p.apiSlots == nil {
+		return true
+	}
+	select {
+	case p.apiSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitAPI reserves a -max-api-requests slot, waiting for one to free up
+// until ctx ends.
+func (p *proxyServer) waitAPI(ctx context.Context) error {
+	if p.apiSlots == nil {
+		return nil
+	}
+	select {
+	case p.apiSlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *proxyServer) releaseAPI() {
+	if p.apiSlots != nil {
+		<-p.apiSlots
+	}
+}
+
+// rejectOverloaded turns a client away with a hint on when to retry:
+// 429 with Retry-After for HTTP, and for WebSocket upgrades a completed
+// handshake followed by a closeOverloaded frame carrying a JSON reason,
+// since most CDP clients only surface close frames.
+func (p *proxyServer) rejectOverloaded(w http.ResponseWriter, r *http.Request, reason string) {
+	retryAfter := int(p.retryAfter.Round(time.Second) / time.Second)
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	p.metrics.add("browserd_rejected_total", map[string]string{"reason": reason}, 1)
+	slog.Warn("rejected over limit", "event", "rejected", "path", r.URL.Path, "client_ip", clientIP(r.RemoteAddr), "reason", reason)
+
+	header := http.Header{"Retry-After": {strconv.Itoa(retryAfter)}}
+	if !websocket.IsWebSocketUpgrade(r) {
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+		writeErrorCode(w, http.StatusTooManyRequests, errorCodeOverloaded, "too many requests: "+reason, map[string]any{"reason": reason, "retryAfter": retryAfter})
+		return
+	}
+
+	payload, _ := json.Marshal(overloadReason{Reason: reason, RetryAfter: retryAfter})
+	_ = p.closeUpgrade(w, r, header, closeOverloaded, string(payload))
+}
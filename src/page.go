@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAPITimeout = 30 * time.Second
+	maxAPITimeout     = 2 * time.Minute
+)
+
+var errPageDebugger = errors.New("browserd is proxying a single page target; new pages can't be opened")
+
+// apiPage is a page driven by browserd's HTTP APIs, either opened for the
+// request in a throwaway browser context or borrowed from a live session.
+type apiPage struct {
+	client    *cdpClient
+	sessionID string
+
+	// targetID and contextID are set for pages browserd opened itself and
+	// must clean up.
+	targetID  string
+	contextID string
+}
+
+// openPage creates a blank page in a fresh browser context.
+func (p *proxyServer) openPage(ctx context.Context) (*apiPage, error) {
+	if strings.Contains(p.getDebuggerURL(), "/devtools/page/") {
+		return nil, errPageDebugger
+	}
+	client, err := p.dialCDP(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	page := &apiPage{client: client}
+
+	result, err := client.call(ctx, "", "Target.createBrowserContext", map[string]any{"disposeOnDetach": true})
+	if err != nil {
+		page.close()
+		return nil, err
+	}
+	var browserContext struct {
+		BrowserContextID string `json:"browserContextId"`
+	}
+	_ = json.Unmarshal(result, &browserContext)
+	page.contextID = browserContext.BrowserContextID
+
+	result, err = client.call(ctx, "", "Target.createTarget", map[string]any{"url": "about:blank", "browserContextId": page.contextID})
+	if err != nil {
+		page.close()
+		return nil, err
+	}
+	var target struct {
+		TargetID string `json:"targetId"`
+	}
+	_ = json.Unmarshal(result, &target)
+	page.targetID = target.TargetID
+
+	if page.sessionID, err = client.attach(ctx, page.targetID); err != nil {
+		page.close()
+		return nil, err
+	}
+	if p.networkGuard != nil {
+		if err := p.guardPage(ctx, page); err != nil {
+			page.close()
+			return nil, err
+		}
+	}
+	if _, err := client.call(ctx, page.sessionID, "Page.enable", nil); err != nil {
+		page.close()
+		return nil, err
+	}
+	return page, nil
+}
+
+// guardPage puts the page's requests through -block-private-networks, as
+// the relay does for client sessions, so the render APIs can't be pointed
+// at the network browserd runs in through a redirect or a subresource.
+func (p *proxyServer) guardPage(ctx context.Context, page *apiPage) error {
+	policy := p.networkGuard.policy(func(req *pausedRequest, reason string) {
+		p.metrics.add("browserd_private_network_blocked_total", nil, 1)
+		slog.Warn("request to private network blocked", "event", "private_network_blocked", "url", req.Request.URL, "reason", reason)
+	})
+	page.client.setIntercept(func(msg cdpMessage) bool {
+		if msg.Method != "Fetch.requestPaused" || msg.SessionID != page.sessionID {
+			return false
+		}
+		var req pausedRequest
+		if err := json.Unmarshal(msg.Params, &req); err != nil {
+			return false
+		}
+		// The guard may resolve the host, which mustn't hold up the read
+		// loop the answer comes back on.
+		go func() {
+			decision := policy(&req)
+			if decision == nil {
+				decision = &fetchDecision{method: "Fetch.continueRequest", params: map[string]any{}}
+			}
+			decision.params["requestId"] = req.RequestID
+			ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+			defer cancel()
+			_, _ = page.client.call(ctx, page.sessionID, decision.method, decision.params)
+		}()
+		return true
+	})
+	_, err := page.client.call(ctx, page.sessionID, "Fetch.enable", fetchEnableParams{Patterns: []requestPattern{proxyFetchPattern}})
+	return err
+}
+
+// attachPage borrows one of a live session's page targets. The page is left
+// as it is when the request is done.
+func (p *proxyServer) attachPage(ctx context.Context, sess *session, targetID string) (*apiPage, error) {
+	client, err := p.dialCDP(ctx, sess)
+	if err != nil {
+		return nil, err
+	}
+	page := &apiPage{client: client}
+	if !strings.Contains(p.sessionDebuggerURL(sess), "/devtools/page/") {
+		if page.sessionID, err = client.attach(ctx, targetID); err != nil {
+			page.close()
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// Navigation wait conditions.
+const (
+	waitLoad             = "load"
+	waitDOMContentLoaded = "domcontentloaded"
+	waitNetworkIdle      = "networkidle"
+)
+
+func validWaitUntil(waitUntil string) bool {
+	switch waitUntil {
+	case waitLoad, waitDOMContentLoaded, waitNetworkIdle:
+		return true
+	}
+	return false
+}
+
+// navigate loads url and waits for the given condition.
+func (pg *apiPage) navigate(ctx context.Context, url, waitUntil string) error {
+	if waitUntil == waitNetworkIdle {
+		if _, err := pg.client.call(ctx, pg.sessionID, "Page.setLifecycleEventsEnabled", map[string]any{"enabled": true}); err != nil {
+			return err
+		}
+	}
+
+	result, err := pg.client.call(ctx, pg.sessionID, "Page.navigate", map[string]any{"url": url})
+	if err != nil {
+		return err
+	}
+	var nav struct {
+		FrameID   string `json:"frameId"`
+		LoaderID  string `json:"loaderId"`
+		ErrorText string `json:"errorText"`
+	}
+	if err := json.Unmarshal(result, &nav); err == nil && nav.ErrorText != "" {
+		return fmt.Errorf("navigation failed: %s", nav.ErrorText)
+	}
+
+	switch waitUntil {
+	case waitDOMContentLoaded:
+		_, err = pg.client.waitEvent(ctx, pg.sessionID, "Page.domContentEventFired")
+	case waitNetworkIdle:
+		for {
+			var ev cdpMessage
+			if ev, err = pg.client.waitEvent(ctx, pg.sessionID, "Page.lifecycleEvent"); err != nil {
+				break
+			}
+			var lifecycle struct {
+				FrameID  string `json:"frameId"`
+				LoaderID string `json:"loaderId"`
+				Name     string `json:"name"`
+			}
+			if json.Unmarshal(ev.Params, &lifecycle) == nil && lifecycle.Name == "networkIdle" &&
+				lifecycle.FrameID == nav.FrameID && (nav.LoaderID == "" || lifecycle.LoaderID == nav.LoaderID) {
+				break
+			}
+		}
+	default:
+		_, err = pg.client.waitEvent(ctx, pg.sessionID, "Page.loadEventFired")
+	}
+	return err
+}
+
+// waitForSelector polls until selector matches an element.
+func (pg *apiPage) waitForSelector(ctx context.Context, selector string) error {
+	quoted, _ := json.Marshal(selector)
+	expression := "document.querySelector(" + string(quoted) + ") !== null"
+	for {
+		result, err := pg.evaluate(ctx, expression, false)
+		if err != nil {
+			return err
+		}
+		if string(result.Value) == "true" {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for selector %s: %w", selector, ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// run sends init-style commands, such as an emulated viewport, to the page.
+func (pg *apiPage) run(ctx context.Context, commands []cdpCommand) error {
+	for _, cmd := range commands {
+		if _, err := pg.client.call(ctx, pg.sessionID, cmd.Method, cmd.Params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remoteObject is the part of Runtime.RemoteObject the APIs return.
+type remoteObject struct {
+	Type                string          `json:"type"`
+	Subtype             string          `json:"subtype,omitempty"`
+	Value               json.RawMessage `json:"value,omitempty"`
+	UnserializableValue string          `json:"unserializableValue,omitempty"`
+	Description         string          `json:"description,omitempty"`
+}
+
+// scriptError is a JavaScript exception thrown by an evaluated expression.
+type scriptError struct {
+	message string
+}
+
+func (e *scriptError) Error() string {
+	return e.message
+}
+
+// evaluate runs expression in the page and returns its value by value.
+func (pg *apiPage) evaluate(ctx context.Context, expression string, awaitPromise bool) (*remoteObject, error) {
+	result, err := pg.client.call(ctx, pg.sessionID, "Runtime.evaluate", map[string]any{
+		"expression":    expression,
+		"returnByValue": true,
+		"awaitPromise":  awaitPromise,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var evaluated struct {
+		Result           remoteObject `json:"result"`
+		ExceptionDetails *struct {
+			Text      string        `json:"text"`
+			Exception *remoteObject `json:"exception"`
+		} `json:"exceptionDetails"`
+	}
+	if err := json.Unmarshal(result, &evaluated); err != nil {
+		return nil, err
+	}
+	if details := evaluated.ExceptionDetails; details != nil {
+		message := details.Text
+		if details.Exception != nil && details.Exception.Description != "" {
+			message = details.Exception.Description
+		}
+		return nil, &scriptError{message: message}
+	}
+	return &evaluated.Result, nil
+}
+
+// screenshot captures the page as PNG: its viewport, or with fullPage
+// everything it has scrolled out of view too.
+func (pg *apiPage) screenshot(ctx context.Context, fullPage bool) ([]byte, error) {
+	result, err := pg.client.call(ctx, pg.sessionID, "Page.captureScreenshot", map[string]any{"format": "png", "captureBeyondViewport": fullPage})
+	if err != nil {
+		return nil, err
+	}
+	var shot struct {
+		Data string `json:"data"`
+	}
+	if err := json.Unmarshal(result, &shot); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(shot.Data)
+}
+
+// close disposes of what openPage created and drops the connection.
+func (pg *apiPage) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if pg.targetID != "" {
+		_, _ = pg.client.call(ctx, "", "Target.closeTarget", map[string]any{"targetId": pg.targetID})
+	}
+	if pg.contextID != "" {
+		_, _ = pg.client.call(ctx, "", "Target.disposeBrowserContext", map[string]any{"browserContextId": pg.contextID})
+	}
+	pg.client.close()
+}
+
+// apiTimeout reads a request's timeout in milliseconds, applying the
+// default and the cap.
+func apiTimeout(ms int) time.Duration {
+	if ms <= 0 {
+		return defaultAPITimeout
+	}
+	return min(time.Duration(ms)*time.Millisecond, maxAPITimeout)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// permissionTypes maps the permission names a policy takes, as used by
+// Browser.setPermission, to the Browser.grantPermissions types that grant
+// them.
+var permissionTypes = map[string][]string{
+	"accelerometer":        {"sensors"},
+	"ambient-light-sensor": {"sensors"},
+	"background-sync":      {"backgroundSync"},
+	"camera":               {"videoCapture"},
+	"clipboard-read":       {"clipboardReadWrite"},
+	"clipboard-write":      {"clipboardReadWrite", "clipboardSanitizedWrite"},
+	"display-capture":      {"displayCapture"},
+	"geolocation":          {"geolocation"},
+	"gyroscope":            {"sensors"},
+	"idle-detection":       {"idleDetection"},
+	"local-fonts":          {"localFonts"},
+	"magnetometer":         {"sensors"},
+	"microphone":           {"audioCapture"},
+	"midi":                 {"midi"},
+	"nfc":                  {"nfc"},
+	"notifications":        {"notifications"},
+	"payment-handler":      {"paymentHandler"},
+	"persistent-storage":   {"durableStorage"},
+	"screen-wake-lock":     {"wakeLockScreen"},
+	"storage-access":       {"storageAccess"},
+	"window-management":    {"windowManagement"},
+}
+
+// permissionPolicy is the set of permissions granted and denied in a
+// session's browser context, for every origin. The client can't change
+// them: commands that would are refused, and a reset is followed by the
+// policy being applied again.
+type permissionPolicy struct {
+	Grant []string `json:"grant,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// newPermissionPolicy validates grant and deny, returning nil when both
+// are empty.
+func newPermissionPolicy(grant, deny []string) (*permissionPolicy, error) {
+	if len(grant) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	policy := &permissionPolicy{}
+	for _, name := range grant {
+		if err := checkPermissionName(name); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(policy.Grant, name) {
+			policy.Grant = append(policy.Grant, name)
+		}
+	}
+	for _, name := range deny {
+		if err := checkPermissionName(name); err != nil {
+			return nil, err
+		}
+		if slices.Contains(policy.Grant, name) {
+			return nil, fmt.Errorf("permission %q is both granted and denied", name)
+		}
+		if !slices.Contains(policy.Deny, name) {
+			policy.Deny = append(policy.Deny, name)
+		}
+	}
+	return policy, nil
+}
+
+func checkPermissionName(name string) error {
+	if _, ok := permissionTypes[name]; ok {
+		return nil
+	}
+	names := make([]string, 0, len(permissionTypes))
+	for known := range permissionTypes {
+		names = append(names, known)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("unknown permission %q (known: %s)", name, strings.Join(names, ", "))
+}
+
+// parsePermissions reads ?grant-permissions= and ?deny-permissions= on top
+// of the configured policy. A client may deny what the operator grants but
+// not grant what the operator denies.
+func parsePermissions(query url.Values, base *permissionPolicy) (*permissionPolicy, error) {
+	grant, deny := splitList(query.Get("grant-permissions")), splitList(query.Get("deny-permissions"))
+	if len(grant) == 0 && len(deny) == 0 {
+		return base, nil
+	}
+	if base != nil {
+		for _, name := range grant {
+			if slices.Contains(base.Deny, name) {
+				return nil, fmt.Errorf("permission %q is denied by the server", name)
+			}
+		}
+		for _, name := range base.Grant {
+			if !slices.Contains(deny, name) {
+				grant = append(grant, name)
+			}
+		}
+		deny = append(deny, base.Deny...)
+	}
+	return newPermissionPolicy(grant, deny)
+}
+
+// setting returns "granted" or "denied" for a permission the policy
+// covers, or "".
+func (pp *permissionPolicy) setting(name string) string {
+	switch {
+	case slices.Contains(pp.Grant, name):
+		return "granted"
+	case slices.Contains(pp.Deny, name):
+		return "denied"
+	}
+	return ""
+}
+
+// applyPermissions sets every permission of the policy in the session's
+// browser context.
+func (r *relay) applyPermissions() error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	pp := r.permissions
+	for _, name := range append(append([]string(nil), pp.Grant...), pp.Deny...) {
+		params, _ := json.Marshal(map[string]any{
+			"permission":       map[string]string{"name": name},
+			"setting":          pp.setting(name),
+			"browserContextId": r.contextID,
+		})
+		resp, err := r.call(ctx, "", "Browser.setPermission", params)
+		if err != nil {
+			return fmt.Errorf("set %s: %w", name, err)
+		}
+		if len(resp.Error) > 0 {
+			return fmt.Errorf("set %s: %s", name, resp.Error)
+		}
+	}
+	return nil
+}
+
+// checkPermissions refuses client permission commands that contradict the
+// session's policy, returning why. reapply is set for commands that reset
+// permissions the policy covers, after which it has to be applied again.
+func (r *relay) checkPermissions(msg *cdpMessage) (reason string, reapply bool) {
+	if msg.ID == nil || msg.SessionID != "" {
+		return "", false
+	}
+	pp := r.permissions
+	switch msg.Method {
+	case "Browser.setPermission":
+		var params struct {
+			Permission struct {
+				Name string `json:"name"`
+			} `json:"permission"`
+			Setting string `json:"setting"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return "", false
+		}
+		if setting := pp.setting(params.Permission.Name); setting != "" && setting != params.Setting {
+			return fmt.Sprintf("permission %s is %s by browserd policy", params.Permission.Name, setting), false
+		}
+	case "Browser.grantPermissions":
+		var params struct {
+			Permissions []string `json:"permissions"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return "", false
+		}
+		for _, name := range pp.Deny {
+			for _, granted := range params.Permissions {
+				if slices.Contains(permissionTypes[name], granted) {
+					return fmt.Sprintf("permission %s is denied by browserd policy", name), false
+				}
+			}
+		}
+		// Granting resets every permission not listed.
+		return "", true
+	case "Browser.resetPermissions":
+		return "", true
+	}
+	return "", false
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// pipeMaxMessage bounds one message read from Chromium's pipe.
+const pipeMaxMessage = 256 << 20
+
+var errPipeDown = errors.New("chromium pipe is not connected")
+
+// cdpPipe bridges a supervised Chromium started with
+// --remote-debugging-pipe, which reads commands from fd 3 and writes
+// replies and events to fd 4 as NUL-terminated JSON, to the rest of
+// browserd. A pipe is a single CDP connection, so each WebSocket gets a
+// flattened session on it of its own: a browser session from
+// Target.attachToBrowserTarget, or one attached to the page it asked for.
+// IDs are rewritten so replies find their way back.
+//
+// Those WebSockets, and the /json endpoints, are served by an in-memory
+// HTTP server reached by dialing addr, which browserd's dialers route here
+// instead of to the network. Nothing listens on a debugging port.
+type cdpPipe struct {
+	addr  string
+	conns chan net.Conn
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	out      *os.File
+	nextID   int64
+	pending  map[int64]pipeRoute
+	sessions map[string]*pipeClient
+	clients  map[*pipeClient]struct{}
+	// child holds the ends of the pipes for a browser being started.
+	child []*os.File
+	own   []*os.File
+}
+
+// pipeRoute is where the reply to a rewritten command goes: back to a
+// client under its own ID, or to an internal call.
+type pipeRoute struct {
+	client *pipeClient
+	id     int64
+	reply  chan cdpMessage
+}
+
+type pipeClient struct {
+	conn    *websocket.Conn
+	root    string
+	writeMu sync.Mutex
+}
+
+func newCDPPipe(addr string) *cdpPipe {
+	p := &cdpPipe{
+		addr:     addr,
+		conns:    make(chan net.Conn),
+		pending:  make(map[int64]pipeRoute),
+		sessions: make(map[string]*pipeClient),
+		clients:  make(map[*pipeClient]struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/json/version", p.handleVersion)
+	mux.HandleFunc("/json/list", p.handleList)
+	mux.HandleFunc("/json", p.handleList)
+	mux.HandleFunc("/json/new", p.handleNew)
+	mux.HandleFunc("/json/close/{id}", p.handleClose)
+	mux.HandleFunc("/devtools/browser", p.handleWebSocket)
+	mux.HandleFunc("/devtools/browser/", p.handleWebSocket)
+	mux.HandleFunc("/devtools/page/{id}", p.handleWebSocket)
+	go func() { _ = (&http.Server{Handler: mux}).Serve(pipeListener{p}) }()
+	return p
+}
+
+// dialContext routes dials of addr to the in-memory server and passes
+// others to next.
+func (p *cdpPipe) dialContext(next func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr != p.addr {
+			return next(ctx, network, addr)
+		}
+		client, server := net.Pipe()
+		select {
+		case p.conns <- server:
+			return client, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// pipeListener hands dialed connections to the in-memory server.
+type pipeListener struct{ p *cdpPipe }
+
+func (l pipeListener) Accept() (net.Conn, error) { return <-l.p.conns, nil }
+func (l pipeListener) Close() error              { return nil }
+func (l pipeListener) Addr() net.Addr            { return tunnelAddr(l.p.addr) }
+
+// attach gives cmd the pipes as fds 3 and 4. Once the browser has started,
+// connect starts talking to it.
+func (p *cdpPipe) attach(cmd *exec.Cmd) (connect func(), err error) {
+	commands, toChromium, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	fromChromium, replies, err := os.Pipe()
+	if err != nil {
+		_ = commands.Close()
+		_ = toChromium.Close()
+		return nil, err
+	}
+	cmd.ExtraFiles = []*os.File{commands, replies}
+
+	p.mu.Lock()
+	// A browser that failed to start leaves its pipes behind.
+	closeFiles(p.child)
+	closeFiles(p.own)
+	p.child = []*os.File{commands, replies}
+	p.own = []*os.File{toChromium, fromChromium}
+	p.mu.Unlock()
+
+	return func() {
+		p.mu.Lock()
+		closeFiles(p.child)
+		p.child, p.own = nil, nil
+		p.out = toChromium
+		p.mu.Unlock()
+		go p.read(fromChromium, toChromium)
+	}, nil
+}
+
+// discard closes the pipes attach made for a browser that didn't start.
+func (p *cdpPipe) discard() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	closeFiles(p.child)
+	closeFiles(p.own)
+	p.child, p.own = nil, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		_ = f.Close()
+	}
+}
+
+// read dispatches Chromium's messages until the browser exits, then ends
+// every client connected through it.
+func (p *cdpPipe) read(in, out *os.File) {
+	r := bufio.NewReaderSize(in, 1<<20)
+	for {
+		data, err := r.ReadSlice(0)
+		if errors.Is(err, bufio.ErrBufferFull) {
+			// Large messages, such as screenshots, span several reads.
+			buf := append([]byte(nil), data...)
+			for errors.Is(err, bufio.ErrBufferFull) && len(buf) < pipeMaxMessage {
+				data, err = r.ReadSlice(0)
+				buf = append(buf, data...)
+			}
+			data = buf
+		}
+		if err != nil {
+			break
+		}
+		p.dispatch(data[:len(data)-1])
+	}
+	_ = in.Close()
+
+	p.mu.Lock()
+	if p.out != out {
+		p.mu.Unlock()
+		return
+	}
+	p.out = nil
+	_ = out.Close()
+	clients := p.clients
+	pending := p.pending
+	p.clients = make(map[*pipeClient]struct{})
+	p.sessions = make(map[string]*pipeClient)
+	p.pending = make(map[int64]pipeRoute)
+	p.mu.Unlock()
+
+	for _, route := range pending {
+		if route.reply != nil {
+			close(route.reply)
+		}
+	}
+	for c := range clients {
+		_ = c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeUpstreamLost, "browser exited"), time.Now().Add(time.Second))
+		_ = c.conn.Close()
+	}
+}
+
+func (p *cdpPipe) dispatch(data []byte) {
+	var msg cdpMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return
+	}
+	if msg.ID != nil {
+		p.mu.Lock()
+		route, ok := p.pending[*msg.ID]
+		delete(p.pending, *msg.ID)
+		p.mu.Unlock()
+		switch {
+		case route.reply != nil:
+			route.reply <- msg
+		case ok && route.client != nil:
+			id := route.id
+			msg.ID = &id
+			route.client.deliver(msg)
+		}
+		return
+	}
+
+	// Events only ever arrive on the clients' sessions; browserd enables
+	// nothing on the pipe's own.
+	p.mu.Lock()
+	client := p.sessions[msg.SessionID]
+	if client != nil && (msg.Method == "Target.attachedToTarget" || msg.Method == "Target.detachedFromTarget") {
+		var params struct {
+			SessionID string `json:"sessionId"`
+		}
+		if json.Unmarshal(msg.Params, &params) == nil && params.SessionID != "" {
+			if msg.Method == "Target.attachedToTarget" {
+				p.sessions[params.SessionID] = client
+			} else {
+				delete(p.sessions, params.SessionID)
+			}
+		}
+	}
+	p.mu.Unlock()
+	if client != nil {
+		client.deliver(msg)
+	}
+}
+
+// deliver writes a message to the client, which sees its own session as
+// the root one.
+func (c *pipeClient) deliver(msg cdpMessage) {
+	if msg.SessionID == c.root {
+		msg.SessionID = ""
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// send writes msg to Chromium under a fresh ID, routing the reply.
+func (p *cdpPipe) send(msg cdpMessage, route pipeRoute) error {
+	p.mu.Lock()
+	out := p.out
+	if out == nil {
+		p.mu.Unlock()
+		return errPipeDown
+	}
+	p.nextID++
+	id := p.nextID
+	p.pending[id] = route
+	p.mu.Unlock()
+
+	msg.ID = &id
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	if _, err := out.Write(append(data, 0)); err != nil {
+		p.mu.Lock()
+		delete(p.pending, id)
+		p.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// call runs a command for browserd itself.
+func (p *cdpPipe) call(ctx context.Context, sessionID, method string, params any) (json.RawMessage, error) {
+	var raw json.RawMessage
+	if params != nil {
+		var err error
+		if raw, err = json.Marshal(params); err != nil {
+			return nil, err
+		}
+	}
+	reply := make(chan cdpMessage, 1)
+	if err := p.send(cdpMessage{Method: method, SessionID: sessionID, Params: raw}, pipeRoute{reply: reply}); err != nil {
+		return nil, err
+	}
+	select {
+	case msg, ok := <-reply:
+		if !ok {
+			return nil, errPipeDown
+		}
+		if len(msg.Error) > 0 {
+			return nil, errors.New(method + ": " + string(msg.Error))
+		}
+		return msg.Result, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *cdpPipe) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+	var result json.RawMessage
+	var err error
+	if targetID := r.PathValue("id"); targetID != "" {
+		result, err = p.call(ctx, "", "Target.attachToTarget", map[string]any{"targetId": targetID, "flatten": true})
+	} else {
+		result, err = p.call(ctx, "", "Target.attachToBrowserTarget", nil)
+	}
+	var attached struct {
+		SessionID string `json:"sessionId"`
+	}
+	if err == nil {
+		err = json.Unmarshal(result, &attached)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		_ = p.send(cdpMessage{Method: "Target.detachFromTarget", Params: mustJSON(map[string]string{"sessionId": attached.SessionID})}, pipeRoute{})
+		return
+	}
+	conn.SetReadLimit(pipeMaxMessage)
+	c := &pipeClient{conn: conn, root: attached.SessionID}
+	p.mu.Lock()
+	p.sessions[c.root] = c
+	p.clients[c] = struct{}{}
+	p.mu.Unlock()
+	defer p.disconnect(c)
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg cdpMessage
+		if err := json.Unmarshal(data, &msg); err != nil || msg.ID == nil {
+			continue
+		}
+		if msg.SessionID == "" {
+			msg.SessionID = c.root
+		} else {
+			p.mu.Lock()
+			owner := p.sessions[msg.SessionID]
+			p.mu.Unlock()
+			if owner != c {
+				payload, _ := json.Marshal(map[string]any{"code": cdpServerError, "message": "session not found"})
+				c.deliver(cdpMessage{ID: msg.ID, SessionID: msg.SessionID, Error: payload})
+				continue
+			}
+		}
+		if err := p.send(msg, pipeRoute{client: c, id: *msg.ID}); err != nil {
+			return
+		}
+	}
+}
+
+// disconnect forgets a client and detaches its session.
+func (p *cdpPipe) disconnect(c *pipeClient) {
+	_ = c.conn.Close()
+	p.mu.Lock()
+	_, connected := p.clients[c]
+	delete(p.clients, c)
+	for id, owner := range p.sessions {
+		if owner == c {
+			delete(p.sessions, id)
+		}
+	}
+	p.mu.Unlock()
+	if connected {
+		_ = p.send(cdpMessage{Method: "Target.detachFromTarget", Params: mustJSON(map[string]string{"sessionId": c.root})}, pipeRoute{})
+	}
+}
+
+func mustJSON(v any) json.RawMessage {
+	data, _ := json.Marshal(v)
+	return data
+}
+
+// handleVersion answers /json/version from Browser.getVersion.
+func (p *cdpPipe) handleVersion(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+	result, err := p.call(ctx, "", "Browser.getVersion", nil)
+	var version struct {
+		ProtocolVersion string `json:"protocolVersion"`
+		Product         string `json:"product"`
+		Revision        string `json:"revision"`
+		UserAgent       string `json:"userAgent"`
+		JSVersion       string `json:"jsVersion"`
+	}
+	if err == nil {
+		err = json.Unmarshal(result, &version)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"Browser":              version.Product,
+		"Protocol-Version":     version.ProtocolVersion,
+		"User-Agent":           version.UserAgent,
+		"V8-Version":           version.JSVersion,
+		"WebKit-Version":       version.Revision,
+		"webSocketDebuggerUrl": "ws://" + r.Host + "/devtools/browser/pipe",
+	})
+}
+
+// handleList answers /json/list from Target.getTargets.
+func (p *cdpPipe) handleList(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+	result, err := p.call(ctx, "", "Target.getTargets", nil)
+	var targets struct {
+		TargetInfos []struct {
+			TargetID string `json:"targetId"`
+			Type     string `json:"type"`
+			Title    string `json:"title"`
+			URL      string `json:"url"`
+		} `json:"targetInfos"`
+	}
+	if err == nil {
+		err = json.Unmarshal(result, &targets)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	list := make([]map[string]string, 0, len(targets.TargetInfos))
+	for _, t := range targets.TargetInfos {
+		if t.Type == "browser" || strings.HasPrefix(t.Type, "tab") {
+			continue
+		}
+		list = append(list, map[string]string{
+			"description":          "",
+			"id":                   t.TargetID,
+			"title":                t.Title,
+			"type":                 t.Type,
+			"url":                  t.URL,
+			"webSocketDebuggerUrl": "ws://" + r.Host + "/devtools/page/" + t.TargetID,
+		})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleNew answers /json/new with Target.createTarget, opening the URL in
+// the raw query or about:blank.
+func (p *cdpPipe) handleNew(w http.ResponseWriter, r *http.Request) {
+	target, err := url.QueryUnescape(r.URL.RawQuery)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid URL")
+		return
+	}
+	if target == "" {
+		target = "about:blank"
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+	result, err := p.call(ctx, "", "Target.createTarget", map[string]string{"url": target})
+	var created struct {
+		TargetID string `json:"targetId"`
+	}
+	if err == nil {
+		err = json.Unmarshal(result, &created)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"description":          "",
+		"id":                   created.TargetID,
+		"title":                "",
+		"type":                 "page",
+		"url":                  target,
+		"webSocketDebuggerUrl": "ws://" + r.Host + "/devtools/page/" + created.TargetID,
+	})
+}
+
+// handleClose answers /json/close/{id} with Target.closeTarget.
+func (p *cdpPipe) handleClose(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+	if _, err := p.call(ctx, "", "Target.closeTarget", map[string]string{"targetId": r.PathValue("id")}); err != nil {
+		writeError(w, http.StatusNotFound, "No such target id: "+r.PathValue("id"))
+		return
+	}
+	_, _ = io.WriteString(w, "Target is closing")
+}
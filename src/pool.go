@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// profileNamePattern keeps ?profile= names to safe directory names.
+var profileNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,63}$`)
+
+const (
+	warmPoolReadyTimeout = 30 * time.Second
+	warmPoolPollInterval = 200 * time.Millisecond
+)
+
+// pooledBrowser is a Chromium instance of the warm pool, each with its own
+// debugging port and throwaway profile, or a browser launched on demand
+// for a named persistent profile or flag profile.
+type pooledBrowser struct {
+	port    int
+	profile string
+	flags   string
+	// overrides are the ?env= and ?arg= it was launched with, if any.
+	overrides   *launchOverrides
+	userDataDir string
+	debuggerURL string
+	// version is the Browser string of its /json/version, and build the
+	// -warm-pool-builds entry it was launched from.
+	version string
+	build   string
+	cmd     *exec.Cmd
+	exited  chan struct{}
+	// lent is set while an ?exclusive session with -warm-pool-reuse has it.
+	lent bool
+}
+
+// warmPool keeps size ready Chromium instances besides the shared
+// supervised browser. A session asking for ?exclusive takes one for
+// itself; when the session ends the browser is thrown away and a
+// replacement is launched in the background. Sessions asking for a named
+// ?profile get a browser launched on demand on that profile's directory,
+// and those asking for ?flags one launched with that flag profile.
+//
+// With reuse, an exclusive session's browser is reset and returned to
+// the ready list instead, and size counts the browsers lent out too.
+type warmPool struct {
+	cfg         proxyConfig
+	display     *virtualDisplay
+	size        int
+	basePort    int
+	profilesDir string
+	tempDir     string
+	// flagProfiles are the -flag-profiles sessions can pick with ?flags=.
+	flagProfiles map[string]*flagProfile
+	// launchAllow is what sessions may set with ?env= and ?arg=.
+	launchAllow launchAllowlist
+	client      *http.Client
+	metrics     *metricsRegistry
+	logs        *chromiumLogs
+	// builds are the -warm-pool-builds browsers are launched from, if any.
+	builds []*chromiumBuild
+	reuse  bool
+
+	mu       sync.Mutex
+	ready    []*pooledBrowser
+	starting int
+	lent     int
+	ports    map[int]bool
+	wake     chan struct{}
+	// assigned holds the browsers sessions are using, and profiles the
+	// named profiles in use, so two sessions never run browsers on the
+	// same directory.
+	assigned map[*pooledBrowser]bool
+	profiles map[string]bool
+}
+
+func newWarmPool(cfg proxyConfig, sup *supervisor, tempDir string, metrics *metricsRegistry) *warmPool {
+	metrics.register("browserd_warm_pool_ready", metricGauge, "Warm pool browsers ready to be assigned.")
+	metrics.register("browserd_warm_pool_assigned_total", metricCounter, "Warm pool browsers assigned to sessions.")
+	metrics.register("browserd_warm_pool_launch_failures_total", metricCounter, "Warm pool browsers that failed to start.")
+	metrics.register("browserd_profile_sessions_total", metricCounter, "Sessions run on a named persistent profile.")
+	if len(cfg.chromiumBuilds) > 0 {
+		metrics.register("browserd_build_sessions_total", metricCounter, "Sessions run in a warm pool or profile browser, by build and browser version.")
+		metrics.register("browserd_build_session_errors_total", metricCounter, "Such sessions that ended with an error, by build and browser version.")
+	}
+	if cfg.warmPoolReuse {
+		metrics.register("browserd_warm_pool_resets_total", metricCounter, "Warm pool browsers reset and reused after a session.")
+		metrics.register("browserd_warm_pool_reset_failures_total", metricCounter, "Warm pool browsers stopped because they failed to reset.")
+	}
+	if len(cfg.flagProfiles) > 0 {
+		metrics.register("browserd_flag_profile_sessions_total", metricCounter, "Sessions run in a browser launched with a flag profile, by profile.")
+	}
+	if cfg.launchAllow.enabled() {
+		metrics.register("browserd_launch_override_sessions_total", metricCounter, "Sessions run in a browser launched with their own ?env= or ?arg=.")
+	}
+	return &warmPool{
+		cfg:          cfg,
+		display:      sup.display,
+		logs:         sup.logs,
+		size:         cfg.warmPoolSize,
+		basePort:     cfg.warmPoolBasePort,
+		profilesDir:  cfg.profilesDir,
+		flagProfiles: cfg.flagProfiles,
+		launchAllow:  cfg.launchAllow,
+		builds:       cfg.chromiumBuilds,
+		reuse:        cfg.warmPoolReuse,
+		tempDir:      tempDir,
+		client:       &http.Client{Timeout: requestTimeout},
+		metrics:      metrics,
+		ports:        make(map[int]bool),
+		wake:         make(chan struct{}, 1),
+		assigned:     make(map[*pooledBrowser]bool),
+		profiles:     make(map[string]bool),
+	}
+}
+
+// run keeps the pool topped up until ctx is cancelled, then stops every
+// browser, including those sessions are still using.
+func (w *warmPool) run(ctx context.Context) {
+	for {
+		w.fill(ctx)
+		select {
+		case <-ctx.Done():
+			w.mu.Lock()
+			browsers := w.ready
+			w.ready = nil
+			for b := range w.assigned {
+				browsers = append(browsers, b)
+			}
+			w.mu.Unlock()
+			for _, b := range browsers {
+				w.discard(b)
+			}
+			return
+		case <-w.wake:
+		}
+	}
+}
+
+func (w *warmPool) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// fill starts enough browsers to bring ready, starting and lent up to
+// size.
+func (w *warmPool) fill(ctx context.Context) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for len(w.ready)+w.starting+w.lent < w.size {
+		w.starting++
+		go w.launch(ctx, w.reservePortLocked())
+	}
+}
+
+func (w *warmPool) reservePortLocked() int {
+	port := w.basePort
+	for w.ports[port] {
+		port++
+	}
+	w.ports[port] = true
+	return port
+}
+
+// launch starts one browser and adds it to the ready list once its
+// debugger answers. On failure start has already freed the port.
+func (w *warmPool) launch(ctx context.Context, port int) {
+	b, err := w.start(ctx, port, "", nil, nil)
+
+	w.mu.Lock()
+	w.starting--
+	if err == nil {
+		w.ready = append(w.ready, b)
+		w.metrics.set("browserd_warm_pool_ready", nil, float64(len(w.ready)))
+	}
+	w.mu.Unlock()
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Error("warm pool browser failed to start", "event", "pool_launch_failed", "port", port, "error", err)
+		w.metrics.add("browserd_warm_pool_launch_failures_total", nil, 1)
+		// Don't spin on a broken binary or flags.
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(supervisorMinBackoff):
+		}
+	}
+	w.signal()
+}
+
+// start launches a browser on port, with the named profile's directory or
+// a fresh temporary one when profile is empty, and the flags adjusted by
+// flags and then overrides when they are set.
+func (w *warmPool) start(ctx context.Context, port int, profile string, flags *flagProfile, overrides *launchOverrides) (*pooledBrowser, error) {
+	if w.display != nil {
+		if err := w.display.ensure(); err != nil {
+			w.freePort(port)
+			return nil, fmt.Errorf("start virtual display: %w", err)
+		}
+	}
+	var dir string
+	var err error
+	if profile != "" {
+		dir = filepath.Join(w.profilesDir, profile)
+		err = os.MkdirAll(dir, 0o755)
+	} else {
+		dir, err = os.MkdirTemp(w.tempDir, "browser-")
+	}
+	if err != nil {
+		w.freePort(port)
+		return nil, err
+	}
+
+	build := w.pickBuild()
+	cmd := exec.Command(build.bin, overrides.apply(flags.apply(chromiumArgs(w.cfg, strconv.Itoa(port), dir)))...)
+	started := w.logs.attach(cmd, "pool-"+strconv.Itoa(port))
+	if w.display != nil {
+		cmd.Env = append(os.Environ(), "DISPLAY="+w.display.name())
+	}
+	if overrides != nil {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = overrides.environ(cmd.Env)
+	}
+	if err := cmd.Start(); err != nil {
+		if profile == "" {
+			_ = os.RemoveAll(dir)
+		}
+		w.freePort(port)
+		return nil, err
+	}
+
+	started(cmd.Process.Pid)
+
+	b := &pooledBrowser{port: port, profile: profile, build: build.name, overrides: overrides, userDataDir: dir, cmd: cmd, exited: make(chan struct{})}
+	if flags != nil {
+		b.flags = flags.name
+	}
+	go w.watch(b)
+
+	if b.debuggerURL, err = w.waitReady(ctx, b); err != nil {
+		w.discard(b)
+		return nil, err
+	}
+	slog.Info("warm pool browser ready", "event", "pool_browser_ready", "port", port, "pid", cmd.Process.Pid, "profile", profile, "flags", b.flags, "build", b.build, "version", b.version)
+	return b, nil
+}
+
+// watch reaps the process and drops it from the ready list if it dies
+// before anyone took it.
+func (w *warmPool) watch(b *pooledBrowser) {
+	_ = b.cmd.Wait()
+	close(b.exited)
+
+	w.mu.Lock()
+	removed := false
+	for i, ready := range w.ready {
+		if ready == b {
+			w.ready = append(w.ready[:i], w.ready[i+1:]...)
+			w.metrics.set("browserd_warm_pool_ready", nil, float64(len(w.ready)))
+			removed = true
+			break
+		}
+	}
+	w.mu.Unlock()
+	if removed {
+		slog.Warn("idle warm pool browser exited", "event", "pool_browser_exited", "port", b.port)
+		w.cleanup(b)
+		w.signal()
+	}
+}
+
+// waitReady polls the browser's /json/version for its debugger URL.
+func (w *warmPool) waitReady(ctx context.Context, b *pooledBrowser) (string, error) {
+	endpoint := fmt.Sprintf("http://127.0.0.1:%d/json/version", b.port)
+	deadline := time.Now().Add(warmPoolReadyTimeout)
+	for time.Now().Before(deadline) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return "", err
+		}
+		if resp, err := w.client.Do(req); err == nil {
+			var info versionInfo
+			err = json.NewDecoder(resp.Body).Decode(&info)
+			resp.Body.Close()
+			if err == nil && info.WebSocketDebuggerURL != "" {
+				b.version = info.Browser
+				return info.WebSocketDebuggerURL, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-b.exited:
+			return "", errors.New("exited before its debugger was ready")
+		case <-time.After(warmPoolPollInterval):
+		}
+	}
+	return "", errors.New("debugger not ready in time")
+}
+
+// take assigns a ready browser, or returns nil when none is ready.
+func (w *warmPool) take() *pooledBrowser {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.ready) == 0 {
+		return nil
+	}
+	b := w.ready[0]
+	w.ready = w.ready[1:]
+	w.assigned[b] = true
+	if w.reuse {
+		b.lent = true
+		w.lent++
+	}
+	w.metrics.set("browserd_warm_pool_ready", nil, float64(len(w.ready)))
+	w.metrics.add("browserd_warm_pool_assigned_total", nil, 1)
+	w.signal()
+	return b
+}
+
+// giveBack returns a lent browser, reset by its session's end, to the
+// ready list.
+func (w *warmPool) giveBack(b *pooledBrowser) {
+	w.mu.Lock()
+	delete(w.assigned, b)
+	b.lent = false
+	w.lent--
+	w.ready = append(w.ready, b)
+	w.metrics.set("browserd_warm_pool_ready", nil, float64(len(w.ready)))
+	w.mu.Unlock()
+}
+
+var errProfileInUse = errors.New("profile is in use by another session")
+
+// openProfile launches a browser on the named persistent profile, which
+// stays locked until the browser is released, or on a throwaway one when
+// name is empty. flags and overrides, if set, adjust its Chromium flags
+// and environment.
+func (w *warmPool) openProfile(ctx context.Context, name string, flags *flagProfile, overrides *launchOverrides) (*pooledBrowser, error) {
+	w.mu.Lock()
+	if name != "" {
+		if w.profiles[name] {
+			w.mu.Unlock()
+			return nil, errProfileInUse
+		}
+		w.profiles[name] = true
+	}
+	port := w.reservePortLocked()
+	w.mu.Unlock()
+
+	b, err := w.start(ctx, port, name, flags, overrides)
+	w.mu.Lock()
+	if err != nil {
+		if name != "" {
+			delete(w.profiles, name)
+		}
+	} else {
+		w.assigned[b] = true
+	}
+	w.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if name != "" {
+		w.metrics.add("browserd_profile_sessions_total", nil, 1)
+	}
+	if flags != nil {
+		w.metrics.add("browserd_flag_profile_sessions_total", map[string]string{"profile": flags.name}, 1)
+	}
+	if overrides != nil {
+		w.metrics.add("browserd_launch_override_sessions_total", nil, 1)
+	}
+	return b, nil
+}
+
+// release stops the browser of a session that has ended and unlocks its
+// profile.
+func (w *warmPool) release(b *pooledBrowser) {
+	w.discard(b)
+	w.mu.Lock()
+	delete(w.assigned, b)
+	if b.profile != "" {
+		delete(w.profiles, b.profile)
+	}
+	if b.lent {
+		b.lent = false
+		w.lent--
+	}
+	w.mu.Unlock()
+	w.signal()
+}
+
+// discard stops a browser and frees its port and profile.
+func (w *warmPool) discard(b *pooledBrowser) {
+	terminate(b.cmd.Process)
+	select {
+	case <-b.exited:
+	case <-time.After(supervisorStopTimeout):
+		_ = b.cmd.Process.Kill()
+		<-b.exited
+	}
+	w.cleanup(b)
+}
+
+// cleanup frees the browser's port and deletes its profile unless it is a
+// named one.
+func (w *warmPool) cleanup(b *pooledBrowser) {
+	if b.profile == "" {
+		if err := os.RemoveAll(b.userDataDir); err != nil {
+			slog.Warn("failed to remove warm pool profile", "dir", b.userDataDir, "error", err)
+		}
+	}
+	w.freePort(b.port)
+}
+
+func (w *warmPool) freePort(port int) {
+	w.mu.Lock()
+	delete(w.ports, port)
+	w.mu.Unlock()
+}
+
+// browsers lists the running browsers, ready and assigned.
+func (w *warmPool) browsers() []*pooledBrowser {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	browsers := append([]*pooledBrowser(nil), w.ready...)
+	for b := range w.assigned {
+		browsers = append(browsers, b)
+	}
+	return browsers
+}
+
+// counts reports how many browsers are ready, starting and assigned.
+func (w *warmPool) counts() (ready, starting, assigned int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.ready), w.starting, len(w.assigned)
+}
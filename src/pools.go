@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// poolSpec is one entry of the -pools file: a fleet of browsers clients
+// reach under /pools/<name>/, with a backend, limits and session defaults
+// of its own. Settings it leaves out are taken from the flags, except the
+// backend's, which are never inherited.
+type poolSpec struct {
+	Chromium         string       `json:"chromium"`
+	ChromiumFallback string       `json:"chromiumFallback,omitempty"`
+	HostHeader       string       `json:"hostHeader,omitempty"`
+	Headers          []string     `json:"headers,omitempty"`
+	MaxSessions      *int         `json:"maxSessions,omitempty"`
+	MaxAPIRequests   *int         `json:"maxApiRequests,omitempty"`
+	IdleTimeout      string       `json:"idleTimeout,omitempty"`
+	InitCommands     []cdpCommand `json:"initCommands,omitempty"`
+	Device           *string      `json:"device,omitempty"`
+	Stealth          *bool        `json:"stealth,omitempty"`
+
+	headers     http.Header
+	idleTimeout time.Duration
+}
+
+// loadPools reads a JSON object of pool names to pool specs, e.g.
+// {"stealth": {"chromium": "http://chromium-stealth:9222", "stealth": true}}.
+func loadPools(path string) (map[string]*poolSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pools map[string]*poolSpec
+	if err := unmarshalConfig(data, &pools); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for name, spec := range pools {
+		if !profileNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("parse %s: invalid pool name %q", path, name)
+		}
+		if spec == nil || spec.Chromium == "" {
+			return nil, fmt.Errorf("parse %s: pool %q has no chromium", path, name)
+		}
+		if spec.headers, err = parseUpstreamHeaders(spec.Headers); err != nil {
+			return nil, fmt.Errorf("parse %s: pool %q: %w", path, name, err)
+		}
+		if spec.IdleTimeout != "" {
+			if spec.idleTimeout, err = time.ParseDuration(spec.IdleTimeout); err != nil || spec.idleTimeout < 0 {
+				return nil, fmt.Errorf("parse %s: pool %q: invalid idleTimeout %q", path, name, spec.IdleTimeout)
+			}
+		}
+		for i, cmd := range spec.InitCommands {
+			if cmd.Method == "" {
+				return nil, fmt.Errorf("parse %s: pool %q: init command %d has no method", path, name, i)
+			}
+		}
+		if spec.Device != nil {
+			if *spec.Device, err = lookupDevice(*spec.Device); err != nil {
+				return nil, fmt.Errorf("parse %s: pool %q: %w", path, name, err)
+			}
+		}
+		for _, limit := range []*int{spec.MaxSessions, spec.MaxAPIRequests} {
+			if limit != nil && *limit < 0 {
+				return nil, fmt.Errorf("parse %s: pool %q: limits can't be negative", path, name)
+			}
+		}
+	}
+	return pools, nil
+}
+
+// config derives the pool's configuration from the replica's. What runs
+// once per replica, such as listeners, the cluster registry, webhooks and
+// a supervised Chromium, stays with the replica.
+func (spec *poolSpec) config(base proxyConfig) proxyConfig {
+	cfg := base
+	cfg.listen = nil
+	cfg.tunnelHub = ""
+	cfg.clusterRedis = ""
+	cfg.acme = acmeConfig{}
+	cfg.grpcAddr = ""
+	cfg.adminAddr = ""
+	cfg.apiKeysFile = ""
+	cfg.webhookURLs = nil
+	cfg.statsdAddr = ""
+	cfg.artifactStore = ""
+	cfg.frameHook = nil
+	cfg.waitChromium = 0
+	cfg.pools = nil
+
+	cfg.chromiumBin = ""
+	cfg.dns = dnsConfig{}
+	cfg.chromiumPipe = false
+	cfg.chromiumLogLines = 0
+	cfg.crashDir = ""
+	cfg.warmPoolSize = 0
+	cfg.profilesDir = ""
+	cfg.flagProfiles = nil
+	cfg.launchAllow = launchAllowlist{}
+	cfg.chromiumBuilds = nil
+	cfg.recycle = recyclePolicy{}
+	cfg.maintenanceSchedule = nil
+	cfg.browserMetricsInterval = 0
+
+	cfg.chromiumEndpoint = spec.Chromium
+	cfg.chromiumFallback = spec.ChromiumFallback
+	cfg.upstreamHost = spec.HostHeader
+	cfg.upstreamHeaders = spec.headers
+	cfg.debuggerHost, cfg.debuggerPort = "", ""
+
+	if spec.MaxSessions != nil {
+		cfg.maxSessions = *spec.MaxSessions
+	}
+	if spec.MaxAPIRequests != nil {
+		cfg.maxAPIRequests = *spec.MaxAPIRequests
+	}
+	if spec.IdleTimeout != "" {
+		cfg.idleTimeout = spec.idleTimeout
+	}
+	if spec.InitCommands != nil {
+		cfg.initCommands = spec.InitCommands
+	}
+	if spec.Device != nil {
+		cfg.device = *spec.Device
+	}
+	if spec.Stealth != nil {
+		cfg.stealth = *spec.Stealth
+	}
+	return cfg
+}
+
+// newNamedPool builds the proxy serving a named pool. Its metrics carry a
+// pool label, and it shares the replica's API keys, temp and artifact
+// stores, frame middleware, webhooks and event stream.
+func (p *proxyServer) newNamedPool(name string, spec *poolSpec, base proxyConfig) (*proxyServer, error) {
+	cfg := spec.config(base)
+	cfg.metrics = p.metrics.withLabels(map[string]string{"pool": name})
+	if cfg.renderCacheDir != "" {
+		// Another backend renders differently, so the pool caches apart.
+		cfg.renderCacheDir = filepath.Join(cfg.renderCacheDir, "pools", name)
+	}
+	pool, err := newProxyServer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	pool.poolName = name
+	pool.apiKeys = p.apiKeys
+	pool.temp = p.temp
+	pool.recordings = p.recordings
+	pool.artifacts = p.artifacts
+	pool.middleware = p.middleware
+	pool.webhooks = p.webhooks
+	pool.events = p.events
+	return pool, nil
+}
+
+// handlePools routes /pools/<name>/ to each named pool, with the pool's
+// own /healthz and /readyz.
+func (p *proxyServer) handlePools(mux *http.ServeMux) {
+	for name, pool := range p.namedPools {
+		poolMux := http.NewServeMux()
+		poolMux.HandleFunc("/healthz", pool.handleHealthz())
+		poolMux.HandleFunc("/readyz", pool.handleReadyz)
+		pool.handleClient(poolMux)
+		prefix := "/pools/" + name
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, poolMux))
+	}
+}
+
+// runNamedPool runs the background work of a named pool until ctx ends.
+func (p *proxyServer) runNamedPool(ctx context.Context) {
+	if p.health != nil {
+		go p.monitorBackend(ctx)
+	}
+	if p.idleTimeout > 0 {
+		go p.reapIdle(ctx)
+	}
+	if p.preconnect != nil {
+		go p.runPreconnect(ctx)
+	}
+	if p.staticDebugger {
+		return
+	}
+	if p.debuggerRefresh > 0 {
+		go p.refreshDebuggerURLs(ctx)
+	}
+	if err := p.ensureDebuggerURL(ctx); err != nil {
+		slog.Warn("initial debugger url fetch failed", "pool", p.poolName, "backend", p.versionEndpoint(), "error", err)
+	}
+}
+
+// allSessions lists the sessions of the replica and its named pools, in
+// start order.
+func (p *proxyServer) allSessions() []*session {
+	sessions := p.sessions.list()
+	if len(p.namedPools) == 0 {
+		return sessions
+	}
+	for _, pool := range p.namedPools {
+		sessions = append(sessions, pool.sessions.list()...)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].startedAt.Before(sessions[j].startedAt) })
+	return sessions
+}
+
+// findSession looks a session up in the replica and its named pools.
+func (p *proxyServer) findSession(id string) *session {
+	if sess := p.sessions.get(id); sess != nil {
+		return sess
+	}
+	for _, pool := range p.namedPools {
+		if sess := pool.sessions.get(id); sess != nil {
+			return sess
+		}
+	}
+	return nil
+}
+
+// sessionOwner returns the proxy serving sess: the replica's own, or that
+// of its named pool.
+func (p *proxyServer) sessionOwner(sess *session) *proxyServer {
+	if pool := p.namedPools[sess.pool]; pool != nil {
+		return pool
+	}
+	return p
+}
+
+// poolNames returns the named pools in order, for logs.
+func (p *proxyServer) poolNames() string {
+	names := make([]string, 0, len(p.namedPools))
+	for name := range p.namedPools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// preconnectMaxAge is how long a standing connection is kept before
+	// it is replaced, so one left idle is never old enough for a load
+	// balancer or NAT in between to have dropped it.
+	preconnectMaxAge = time.Minute
+	// preconnectRetry is the wait after a standing connection failed to
+	// dial.
+	preconnectRetry = 5 * time.Second
+)
+
+// preconnector keeps a standing connection to Chromium's browser endpoint
+// for -preconnect, so the first session after an idle period skips
+// discovery and the handshake. The connection goes to the first session
+// that can use it and a new one is dialed in the background.
+type preconnector struct {
+	wake chan struct{}
+
+	mu   sync.Mutex
+	conn *websocket.Conn
+	// generation is the upstream generation conn was dialed in; a
+	// connection from before a browser restart is never handed out.
+	generation int64
+	dialed     time.Time
+}
+
+func newPreconnector() *preconnector {
+	return &preconnector{wake: make(chan struct{}, 1)}
+}
+
+// refresh drops the standing connection and has runPreconnect dial a new
+// one, e.g. once the browser restarted.
+func (c *preconnector) refresh() {
+	if c == nil {
+		return
+	}
+	c.drop()
+	c.poke()
+}
+
+func (c *preconnector) poke() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *preconnector) drop() {
+	c.mu.Lock()
+	conn := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+	if conn != nil {
+		_ = conn.Close()
+	}
+}
+
+// runPreconnect keeps a standing connection until ctx ends, replacing it
+// every preconnectMaxAge and whenever it is taken or refreshed.
+func (p *proxyServer) runPreconnect(ctx context.Context) {
+	c := p.preconnect
+	defer c.drop()
+	for {
+		wait := preconnectMaxAge
+		if err := p.preconnectOnce(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Debug("standing upstream connection failed", "event", "preconnect_failed", "backend", p.versionEndpoint(), "error", err)
+			p.metrics.add("browserd_preconnect_failures_total", nil, 1)
+			wait = preconnectRetry
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-c.wake:
+			timer.Stop()
+		}
+	}
+}
+
+// preconnectOnce replaces the standing connection with a new one. While
+// the health prober has the backend down there is none.
+func (p *proxyServer) preconnectOnce(ctx context.Context) error {
+	c := p.preconnect
+	if !p.health.healthy() {
+		c.drop()
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	if err := p.ensureDebuggerURL(ctx); err != nil {
+		return err
+	}
+	p.mu.RLock()
+	target, generation := p.debuggerURL, p.generation
+	p.mu.RUnlock()
+	conn, _, err := p.dial(ctx, target, nil)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	old := c.conn
+	c.conn, c.generation, c.dialed = conn, generation, time.Now()
+	c.mu.Unlock()
+	if old != nil {
+		_ = old.Close()
+	}
+	return nil
+}
+
+// takePreconnected hands the standing connection to sess, or to an API
+// request when sess is nil, if it dials the shared browser endpoint
+// offering no subprotocols and the connection is still current. It
+// returns nil when the session has to dial for itself.
+func (p *proxyServer) takePreconnected(sess *session, subprotocols []string) *websocket.Conn {
+	c := p.preconnect
+	if c == nil || p.fallback != nil || len(subprotocols) > 0 {
+		return nil
+	}
+	if sess != nil && (sess.browser != nil || sess.upstreamPath != "") {
+		return nil
+	}
+	p.mu.RLock()
+	target, generation := p.debuggerURL, p.generation
+	p.mu.RUnlock()
+
+	c.mu.Lock()
+	conn := c.conn
+	current := conn != nil && target != "" && c.generation == generation && time.Since(c.dialed) < preconnectMaxAge
+	c.conn = nil
+	c.mu.Unlock()
+	c.poke()
+
+	if !current {
+		if conn != nil {
+			_ = conn.Close()
+		}
+		p.metrics.add("browserd_preconnect_requests_total", map[string]string{"result": "miss"}, 1)
+		return nil
+	}
+	p.metrics.add("browserd_preconnect_requests_total", map[string]string{"result": "hit"}, 1)
+	return conn
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// probePolicy configures active health probing of the Chromium backend.
+type probePolicy struct {
+	interval       time.Duration
+	unhealthyAfter int
+	healthyAfter   int
+}
+
+func (p probePolicy) enabled() bool {
+	return p.interval > 0
+}
+
+// backendHealth is the prober's verdict on the backend. Consecutive
+// failures mark it down and consecutive successes bring it back, so a
+// single slow response doesn't flap it.
+type backendHealth struct {
+	policy probePolicy
+
+	mu        sync.Mutex
+	up        bool
+	failures  int
+	successes int
+}
+
+func newBackendHealth(policy probePolicy) *backendHealth {
+	return &backendHealth{policy: policy, up: true}
+}
+
+// record folds one probe result in and reports whether the state changed.
+func (h *backendHealth) record(err error) (changed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		h.successes = 0
+		h.failures++
+		if h.up && h.failures >= h.policy.unhealthyAfter {
+			h.up = false
+			return true
+		}
+		return false
+	}
+	h.failures = 0
+	h.successes++
+	if !h.up && h.successes >= h.policy.healthyAfter {
+		h.up = true
+		return true
+	}
+	return false
+}
+
+// healthy reports the current verdict; nil means probing is off and the
+// backend is assumed up.
+func (h *backendHealth) healthy() bool {
+	if h == nil {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.up
+}
+
+// monitorBackend probes the backend every interval until ctx is cancelled.
+func (p *proxyServer) monitorBackend(ctx context.Context) {
+	ticker := time.NewTicker(p.health.policy.interval)
+	defer ticker.Stop()
+	p.metrics.set("browserd_chromium_up", nil, 1)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		probeCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+		err := p.probeBackend(probeCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			p.metrics.add("browserd_chromium_probe_failures_total", nil, 1)
+		}
+		if !p.health.record(err) {
+			continue
+		}
+		p.preconnect.refresh()
+		if p.health.healthy() {
+			slog.Info("chromium backend is healthy again", "event", "backend_healthy", "backend", p.versionEndpoint())
+			p.metrics.set("browserd_chromium_up", nil, 1)
+			p.notify(webhookEvent{Event: eventBackendHealthy, Backend: p.versionEndpoint()})
+		} else {
+			slog.Error("chromium backend marked unhealthy", "event", "backend_unhealthy", "backend", p.versionEndpoint(), "failed_probes", p.health.policy.unhealthyAfter, "error", err)
+			p.metrics.set("browserd_chromium_up", nil, 0)
+			p.notify(webhookEvent{Event: eventBackendUnhealthy, Backend: p.versionEndpoint(), Error: err.Error()})
+		}
+	}
+}
+
+// probeBackend performs one health check: /json/version, or a WebSocket
+// handshake for a static debugger URL.
+func (p *proxyServer) probeBackend(ctx context.Context) error {
+	if p.staticDebugger {
+		conn, _, err := p.dialer.DialContext(ctx, p.getDebuggerURL(), p.upstreamHeader())
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	_, err := p.fetchVersionInfo(ctx)
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// terminate ends a child process. Without SIGTERM there is no asking, so
+// it is killed straight away.
+func terminate(p *os.Process) {
+	_ = p.Kill()
+}
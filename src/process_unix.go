@@ -0,0 +1,13 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// terminate asks a child process to exit.
+func terminate(p *os.Process) {
+	_ = p.Signal(syscall.SIGTERM)
+}
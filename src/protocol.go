@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+)
+
+const maxProtocolSize = 16 << 20
+
+// protocolCache holds Chromium's /json/protocol descriptor. It is fetched
+// on first use and kept until the browser restarts, which is the only time
+// it can change.
+type protocolCache struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+// get returns the cached descriptor, fetching it with fetch when there is
+// none. Concurrent callers wait for the one fetch in flight.
+func (c *protocolCache) get(fetch func() ([]byte, error)) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.data != nil {
+		return c.data, nil
+	}
+	data, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	c.data = data
+	return data, nil
+}
+
+func (c *protocolCache) reset() {
+	c.mu.Lock()
+	c.data = nil
+	c.mu.Unlock()
+}
+
+// protocolDescriptor returns Chromium's protocol descriptor from the cache.
+func (p *proxyServer) protocolDescriptor(ctx context.Context) ([]byte, error) {
+	return p.protocol.get(func() ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.jsonEndpoint("/json/protocol"), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := p.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New(resp.Status)
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxProtocolSize))
+		if err != nil {
+			return nil, err
+		}
+		if !json.Valid(data) {
+			return nil, errors.New("invalid protocol descriptor")
+		}
+		return data, nil
+	})
+}
+
+// handleJSONProtocol serves the cached /json/protocol descriptor.
+func (p *proxyServer) handleJSONProtocol(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !p.authorize(r) {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if p.staticDebugger {
+		writeError(w, http.StatusNotFound, "protocol descriptor unavailable with a ws:// chromium endpoint")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	data, err := p.protocolDescriptor(ctx)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Protocol buffer wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errMalformedProto = errors.New("malformed protobuf message")
+
+// The append helpers encode proto3 scalar fields, leaving out default
+// values as proto3 encoders do.
+
+func appendVarint(b []byte, v uint64) []byte {
+	return binary.AppendUvarint(b, v)
+}
+
+func appendTag(b []byte, field, wire int) []byte {
+	return appendVarint(b, uint64(field)<<3|uint64(wire))
+}
+
+func appendStringField(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendBoolField(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = appendTag(b, field, wireVarint)
+	return append(b, 1)
+}
+
+func appendIntField(b []byte, field int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendTag(b, field, wireVarint)
+	return appendVarint(b, uint64(v))
+}
+
+func appendMessageField(b []byte, field int, msg []byte) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(msg)))
+	return append(b, msg...)
+}
+
+// appendTimestampField encodes t as a google.protobuf.Timestamp.
+func appendTimestampField(b []byte, field int, t time.Time) []byte {
+	var ts []byte
+	ts = appendIntField(ts, 1, t.Unix())
+	ts = appendIntField(ts, 2, int64(t.Nanosecond()))
+	return appendMessageField(b, field, ts)
+}
+
+// protoField is one decoded field: value for varints, data for
+// length-delimited fields. Fixed-width fields are skipped.
+type protoField struct {
+	number int
+	wire   int
+	value  uint64
+	data   []byte
+}
+
+func parseProto(b []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errMalformedProto
+		}
+		b = b[n:]
+		f := protoField{number: int(tag >> 3), wire: int(tag & 7)}
+		switch f.wire {
+		case wireVarint:
+			if f.value, n = binary.Uvarint(b); n <= 0 {
+				return nil, errMalformedProto
+			}
+			b = b[n:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return nil, errMalformedProto
+			}
+			f.data = b[n : n+int(size)]
+			b = b[n+int(size):]
+		case wireFixed64, wireFixed32:
+			width := 8
+			if f.wire == wireFixed32 {
+				width = 4
+			}
+			if len(b) < width {
+				return nil, errMalformedProto
+			}
+			b = b[width:]
+			continue
+		default:
+			return nil, errMalformedProto
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import "time"
+
+// commandLimiter is the -max-command-rate token bucket of one session:
+// it refills at rate tokens a second up to burst, and each client frame
+// takes one. It is only used from the relay's client pump.
+type commandLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newCommandLimiter(rate float64, burst int) *commandLimiter {
+	if burst < 1 {
+		burst = max(1, int(rate))
+	}
+	return &commandLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// reserve takes a token and returns how long to wait before the frame
+// may be sent, which is zero while the bucket isn't empty.
+func (l *commandLimiter) reserve(now time.Time) time.Duration {
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// throttle holds the client pump back while the session is over its
+// command rate. Frames queue up in the client's connection meanwhile,
+// so a flooding client slows itself down rather than the browser.
+func (r *relay) throttle() {
+	if r.commandLimit == nil {
+		return
+	}
+	wait := r.commandLimit.reserve(time.Now())
+	if wait <= 0 {
+		return
+	}
+	if r.onThrottled != nil {
+		r.onThrottled()
+	}
+	time.Sleep(wait)
+}
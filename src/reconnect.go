@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// errReconnectOverflow ends a session whose client sent more frames than
+// -reconnect-buffer holds while its upstream was being reconnected.
+var errReconnectOverflow = errors.New("too many client frames while reconnecting upstream")
+
+// replayedMethods are the browser-level client commands that set a session
+// up rather than act in it. Those that succeed are sent again, in order,
+// on a reconnected upstream.
+var replayedMethods = map[string]bool{
+	"Target.createBrowserContext": true,
+	"Target.setDiscoverTargets":   true,
+	"Target.setAutoAttach":        true,
+	"Browser.setDownloadBehavior": true,
+	"Browser.grantPermissions":    true,
+	"Browser.setPermission":       true,
+}
+
+// reconnector carries a relay through losing its upstream connection, as
+// when the supervisor restarts Chromium. While the upstream is redialed,
+// client frames are buffered; once it is back, the session's own browser
+// context and the client's setup commands are replayed on it, and the
+// buffered frames follow. Targets don't survive a restart, so the client
+// is told they detached, and commands it had in flight get an error.
+type reconnector struct {
+	redial      func(ctx context.Context) (*websocket.Conn, error)
+	window      time.Duration
+	limit       int
+	onReconnect func(result string)
+
+	// swapMu serializes replacing the upstream connection, whether it was
+	// lost or the session is being migrated.
+	swapMu sync.Mutex
+
+	// mu guards the frames buffered while reconnecting and the client
+	// commands in flight on the current upstream.
+	mu           sync.Mutex
+	reconnecting bool
+	buffered     []bufferedFrame
+	inFlight     map[commandKey]bool
+	// closing is set once the client asks the browser to close, or
+	// restoring the session failed, so the loss isn't recovered from.
+	closing bool
+
+	// asked holds the client's setup commands awaiting their response by
+	// ID; setup, those that succeeded.
+	setupMu sync.Mutex
+	asked   map[int64]cdpCommand
+	setup   []setupCommand
+
+	// aliases map the browser context IDs the client knows to those
+	// recreated on the current upstream; reverse maps them back.
+	aliasMu sync.RWMutex
+	aliases map[string]string
+	reverse map[string]string
+}
+
+type bufferedFrame struct {
+	msgType int
+	data    []byte
+	key     *commandKey
+	queued  time.Time
+}
+
+type setupCommand struct {
+	cdpCommand
+	// contextID is the browser context a Target.createBrowserContext made.
+	contextID string
+}
+
+func newReconnector(opts relayOptions) *reconnector {
+	return &reconnector{
+		redial:      opts.redial,
+		window:      opts.reconnectWindow,
+		limit:       opts.reconnectBuffer,
+		onReconnect: opts.onReconnect,
+		inFlight:    make(map[commandKey]bool),
+		asked:       make(map[int64]cdpCommand),
+		aliases:     make(map[string]string),
+		reverse:     make(map[string]string),
+	}
+}
+
+// noteClient records a client command about to be forwarded: setup
+// commands to replay once answered, and a request to close the browser.
+// The command's key is returned so it is tracked while in flight.
+func (rc *reconnector) noteClient(msg *cdpMessage) *commandKey {
+	if msg.ID == nil || msg.Method == "" {
+		return nil
+	}
+	if msg.SessionID == "" {
+		switch {
+		case msg.Method == "Browser.close":
+			rc.mu.Lock()
+			rc.closing = true
+			rc.mu.Unlock()
+		case replayedMethods[msg.Method] || msg.Method == "Target.disposeBrowserContext":
+			rc.setupMu.Lock()
+			rc.asked[*msg.ID] = cdpCommand{Method: msg.Method, Params: msg.Params}
+			rc.setupMu.Unlock()
+		}
+	}
+	return &commandKey{sessionID: msg.SessionID, id: *msg.ID}
+}
+
+// noteResponse settles a client command with the upstream's response.
+func (rc *reconnector) noteResponse(msg *cdpMessage) {
+	if msg.ID == nil || msg.Method != "" {
+		return
+	}
+	rc.mu.Lock()
+	delete(rc.inFlight, commandKey{sessionID: msg.SessionID, id: *msg.ID})
+	rc.mu.Unlock()
+	if msg.SessionID != "" {
+		return
+	}
+
+	rc.setupMu.Lock()
+	defer rc.setupMu.Unlock()
+	cmd, ok := rc.asked[*msg.ID]
+	if !ok {
+		return
+	}
+	delete(rc.asked, *msg.ID)
+	if len(msg.Error) > 0 {
+		return
+	}
+	if cmd.Method != "Target.disposeBrowserContext" {
+		rc.setup = append(rc.setup, setupCommand{cdpCommand: cmd, contextID: createdContext(msg.Result)})
+		return
+	}
+	// Nothing set up in a disposed context is worth replaying.
+	var params struct {
+		BrowserContextID string `json:"browserContextId"`
+	}
+	if json.Unmarshal(cmd.Params, &params) != nil || params.BrowserContextID == "" {
+		return
+	}
+	kept := rc.setup[:0]
+	for _, s := range rc.setup {
+		if s.contextID != params.BrowserContextID && !bytes.Contains(s.Params, []byte(`"`+params.BrowserContextID+`"`)) {
+			kept = append(kept, s)
+		}
+	}
+	rc.setup = kept
+}
+
+func (rc *reconnector) setupCommands() []setupCommand {
+	rc.setupMu.Lock()
+	defer rc.setupMu.Unlock()
+	return append([]setupCommand(nil), rc.setup...)
+}
+
+// worthTrying reports whether an upstream read error is a lost browser
+// rather than the session ending.
+func (rc *reconnector) worthTrying(err error) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.worthTryingLocked(err)
+}
+
+func (rc *reconnector) worthTryingLocked(err error) bool {
+	return !rc.closing && !errors.Is(err, net.ErrClosed) && !errors.Is(err, websocket.ErrReadLimit)
+}
+
+// begin starts buffering client frames and returns the commands that were
+// in flight on the lost upstream.
+func (rc *reconnector) begin() []commandKey {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.reconnecting = true
+	keys := make([]commandKey, 0, len(rc.inFlight))
+	for key := range rc.inFlight {
+		keys = append(keys, key)
+	}
+	clear(rc.inFlight)
+	return keys
+}
+
+// alias points the client's browser context id at its recreation.
+func (rc *reconnector) alias(id, current string) {
+	rc.aliasMu.Lock()
+	defer rc.aliasMu.Unlock()
+	delete(rc.reverse, rc.aliases[id])
+	rc.aliases[id], rc.reverse[current] = current, id
+}
+
+// toUpstream and toClient swap browser context IDs between those the
+// client knows and those of the current upstream.
+func (rc *reconnector) toUpstream(data []byte) []byte {
+	return rc.translate(data, rc.aliases)
+}
+
+func (rc *reconnector) toClient(data []byte) []byte {
+	return rc.translate(data, rc.reverse)
+}
+
+func (rc *reconnector) translate(data []byte, ids map[string]string) []byte {
+	rc.aliasMu.RLock()
+	defer rc.aliasMu.RUnlock()
+	for from, to := range ids {
+		quoted := []byte(`"` + from + `"`)
+		if bytes.Contains(data, quoted) {
+			data = bytes.ReplaceAll(data, quoted, []byte(`"`+to+`"`))
+		}
+	}
+	return data
+}
+
+// forward sends a client frame upstream, or buffers it while the upstream
+// is being reconnected. key identifies the frame's command, if it is one.
+func (r *relay) forward(msgType int, data []byte, key *commandKey) error {
+	rc := r.reconnect
+	if rc == nil {
+		return r.writeUpstream(msgType, data)
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.reconnecting {
+		if len(rc.buffered) >= rc.limit {
+			_ = r.client.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeUpstreamUnavailable, "upstream reconnecting"), time.Now().Add(time.Second))
+			return errReconnectOverflow
+		}
+		rc.buffered = append(rc.buffered, bufferedFrame{msgType: msgType, data: data, key: key, queued: time.Now()})
+		r.queued(queueReconnect, len(rc.buffered))
+		return nil
+	}
+	if key != nil {
+		rc.inFlight[*key] = true
+	}
+	if err := r.writeUpstream(msgType, data); err != nil && !rc.worthTryingLocked(err) {
+		return err
+	}
+	// A write failing on a lost upstream is left to pumpUpstream, which
+	// answers the command once it notices.
+	return nil
+}
+
+// reconnectUpstream replaces a lost upstream connection within
+// -reconnect-window and restores the session on the new one in the
+// background, while pumpUpstream goes on reading it.
+func (r *relay) reconnectUpstream(conn *websocket.Conn, lost error) error {
+	rc := r.reconnect
+	rc.swapMu.Lock()
+	defer rc.swapMu.Unlock()
+	if conn != r.currentUpstream() {
+		// A migration replaced the connection meanwhile.
+		return nil
+	}
+	started := time.Now()
+	// Closing the connection first fails a write still blocked on it.
+	conn.Close()
+	inFlight := rc.begin()
+	r.sess.log.Warn("upstream connection lost, reconnecting", "event", "upstream_reconnecting", "error", lost, "window", rc.window.String())
+	r.sess.logf("upstream lost (%v), reconnecting", lost)
+
+	r.failPending()
+	for _, key := range inFlight {
+		r.abandonCommand(key)
+	}
+	r.detachTargets()
+
+	ctx, cancel := context.WithTimeout(context.Background(), rc.window)
+	defer cancel()
+	go func() {
+		select {
+		case <-r.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	redialed, err := rc.redial(ctx)
+	if err != nil {
+		rc.onReconnect("failed")
+		r.sess.log.Warn("upstream reconnect failed", "event", "upstream_reconnect_failed", "error", err)
+		r.sess.logf("upstream reconnect failed: %v", err)
+		return err
+	}
+
+	r.swapUpstream(redialed)
+	go r.restoreSession(started)
+	return nil
+}
+
+// swapUpstream makes conn the relay's upstream connection and closes the
+// one it replaces, which pumpUpstream then stops reading.
+func (r *relay) swapUpstream(conn *websocket.Conn) {
+	r.connMu.Lock()
+	r.upstreamMu.Lock()
+	old := r.upstream
+	r.upstream = conn
+	r.upstreamMu.Unlock()
+	r.connMu.Unlock()
+	old.Close()
+	select {
+	case <-r.done:
+		// stop may have closed the old connection before the swap.
+		conn.Close()
+	default:
+	}
+}
+
+// currentUpstream is the upstream connection pumpUpstream reads.
+func (r *relay) currentUpstream() *websocket.Conn {
+	r.connMu.Lock()
+	defer r.connMu.Unlock()
+	return r.upstream
+}
+
+// failPending answers the injected commands the lost upstream never will.
+func (r *relay) failPending() {
+	lost := cdpMessage{Error: json.RawMessage(`{"code":-32000,"message":"upstream connection lost"}`)}
+	r.pendingMu.Lock()
+	defer r.pendingMu.Unlock()
+	for _, ch := range r.pending {
+		select {
+		case ch <- lost:
+		default:
+		}
+	}
+}
+
+// abandonCommand answers a client command lost with the upstream with an
+// error, dropping its -command-timeout deadline.
+func (r *relay) abandonCommand(key commandKey) {
+	r.commandsMu.Lock()
+	if cmd, ok := r.outstanding[key]; ok {
+		cmd.timer.Stop()
+		delete(r.outstanding, key)
+	}
+	r.commandsMu.Unlock()
+	r.endTurnFor(key)
+
+	id := key.id
+	_ = r.replyError(&cdpMessage{ID: &id, SessionID: key.sessionID}, "upstream connection lost while the browser restarted")
+}
+
+// detachTargets tells the client the session's targets are gone with the
+// browser that had them.
+func (r *relay) detachTargets() {
+	for _, t := range r.sess.takeTargets() {
+		params, _ := json.Marshal(map[string]string{"sessionId": t.cdpSession, "targetId": t.targetID})
+		detached, _ := json.Marshal(cdpMessage{Method: "Target.detachedFromTarget", Params: params})
+		_ = r.writeClient(websocket.TextMessage, detached)
+		params, _ = json.Marshal(map[string]string{"targetId": t.targetID})
+		destroyed, _ := json.Marshal(cdpMessage{Method: "Target.targetDestroyed", Params: params})
+		_ = r.writeClient(websocket.TextMessage, destroyed)
+	}
+}
+
+// restoreSession recreates the session's browser context and permission
+// policy on a reconnected upstream, replays the client's setup commands
+// and then flushes the frames buffered meanwhile. A session whose own
+// context can't be recreated ends, rather than going on without its
+// isolation or egress proxy.
+func (r *relay) restoreSession(started time.Time) {
+	rc := r.reconnect
+	replayed, err := r.restoreSetup()
+	if err != nil {
+		rc.onReconnect("failed")
+		r.sess.log.Warn("failed to restore session after upstream reconnect", "event", "upstream_reconnect_failed", "error", err)
+		r.sess.logf("failed to restore session after reconnect: %v", err)
+		r.abandonUpstream()
+		return
+	}
+	buffered := r.flushBuffered()
+	rc.onReconnect("ok")
+	r.sess.log.Info("upstream reconnected", "event", "upstream_reconnected", "duration", time.Since(started).Round(time.Millisecond).String(), "replayed", replayed, "buffered", buffered)
+	r.sess.logf("upstream reconnected after %s, replayed %d setup commands and %d buffered frames", time.Since(started).Round(time.Millisecond), replayed, buffered)
+}
+
+// abandonUpstream ends a session that couldn't be restored on its new
+// upstream connection.
+func (r *relay) abandonUpstream() {
+	rc := r.reconnect
+	rc.mu.Lock()
+	rc.closing = true
+	rc.mu.Unlock()
+	r.currentUpstream().Close()
+}
+
+// restoreSetup recreates the session's own context on the current upstream
+// and replays the client's setup commands, returning how many it sent.
+func (r *relay) restoreSetup() (int, error) {
+	rc := r.reconnect
+	if err := r.restoreContext(); err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	setup := rc.setupCommands()
+	for _, cmd := range setup {
+		resp, err := r.call(ctx, "", cmd.Method, cmd.Params)
+		if err == nil && len(resp.Error) > 0 {
+			err = errors.New(string(resp.Error))
+		}
+		if err != nil {
+			r.sess.log.Warn("failed to replay setup command", "method", cmd.Method, "error", err)
+			r.sess.logf("replaying %s failed: %v", cmd.Method, err)
+			continue
+		}
+		if cmd.contextID != "" {
+			if id := createdContext(resp.Result); id != "" {
+				rc.alias(cmd.contextID, id)
+			}
+		}
+	}
+	return len(setup), nil
+}
+
+// flushBuffered sends the client frames buffered meanwhile upstream and
+// stops buffering, returning how many there were.
+func (r *relay) flushBuffered() int {
+	rc := r.reconnect
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	buffered := len(rc.buffered)
+	var err error
+	for _, frame := range rc.buffered {
+		r.dequeued(queueReconnect, frame.queued)
+		if err != nil {
+			continue
+		}
+		if frame.key != nil {
+			rc.inFlight[*frame.key] = true
+		}
+		err = r.writeUpstream(frame.msgType, frame.data)
+	}
+	rc.buffered, rc.reconnecting = nil, false
+	return buffered
+}
+
+// restoreContext recreates the session's own browser context under the ID
+// the client knows it by, and its permission policy.
+func (r *relay) restoreContext() error {
+	if r.contextID == "" {
+		return nil
+	}
+	id, err := r.openSessionContext()
+	if err != nil {
+		return err
+	}
+	r.reconnect.alias(r.contextID, id)
+	if r.permissions != nil {
+		return r.applyPermissions()
+	}
+	return nil
+}
+
+// redialShared dials the shared browser again for a session that lost it,
+// offering the subprotocol the first connection settled on, with the
+// backoff of dialWithRetry until ctx ends.
+func (p *proxyServer) redialShared(ctx context.Context, sess *session, subprotocol string) (*websocket.Conn, error) {
+	var subprotocols []string
+	if subprotocol != "" {
+		subprotocols = []string{subprotocol}
+	}
+	backoff := dialRetryMinBackoff
+	for {
+		migrated := sess.migrated.Load()
+		var err error
+		if migrated != nil {
+			err = migrated.resolve(ctx, p.client)
+		} else {
+			err = p.ensureDebuggerURL(ctx)
+		}
+		if err == nil {
+			var conn *websocket.Conn
+			if conn, _, err = p.dial(ctx, p.currentDebuggerURL(sess), subprotocols); err == nil {
+				if p.maxMessage > 0 {
+					conn.SetReadLimit(p.maxMessage)
+				}
+				return conn, nil
+			}
+		}
+		if migrated == nil && !p.staticDebugger {
+			_ = p.refreshDebuggerURL(ctx)
+		}
+
+		wait := backoff/2 + rand.N(backoff/2)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, dialRetryMaxBackoff)
+	}
+}
+
+// currentDebuggerURL is the browser endpoint of the backend sess is on now:
+// the shared browser, or the one it was migrated to. The browser id in the
+// session's path may have gone with an earlier browser, so it isn't used.
+func (p *proxyServer) currentDebuggerURL(sess *session) string {
+	if migrated := sess.migrated.Load(); migrated != nil {
+		return migrated.getDebuggerURL()
+	}
+	return p.getDebuggerURL()
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxIndexedURLs caps the distinct URLs indexed per recording, so a crawl
+// can't grow the index without bound.
+const maxIndexedURLs = 1000
+
+// recordingIndex summarizes every recording kept under -temp-dir: the
+// commands the client sent and the URLs the session touched, so
+// GET /admin/recordings can find sessions without reading each recording.
+// Entries whose recording has been swept are dropped as they are found.
+type recordingIndex struct {
+	mu      sync.Mutex
+	entries map[string]*recordingSummary
+}
+
+// recordingSummary is the index entry of one recording.
+type recordingSummary struct {
+	SessionID     string         `json:"sessionId"`
+	FirstFrame    time.Time      `json:"firstFrameAt"`
+	LastFrame     time.Time      `json:"lastFrameAt"`
+	Frames        int            `json:"frames"`
+	Methods       map[string]int `json:"methods"`
+	URLs          []string       `json:"urls"`
+	URLsTruncated bool           `json:"urlsTruncated,omitempty"`
+
+	urls map[string]bool
+}
+
+func newRecordingIndex() *recordingIndex {
+	return &recordingIndex{entries: make(map[string]*recordingSummary)}
+}
+
+// load indexes the recordings a previous run left within -temp-retention.
+func (x *recordingIndex) load(temp *tempStore) {
+	paths, _ := filepath.Glob(filepath.Join(temp.root, tempSessionsDir, "*", recordingFile))
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		id := filepath.Base(filepath.Dir(path))
+		dec := json.NewDecoder(f)
+		for {
+			var frame tapFrame
+			if dec.Decode(&frame) != nil {
+				break
+			}
+			x.add(id, frame)
+		}
+		_ = f.Close()
+	}
+	if len(paths) > 0 {
+		slog.Info("indexed recordings", "event", "recordings_indexed", "count", len(paths))
+	}
+}
+
+// urlEvents are the upstream events that name a URL the session touched;
+// other upstream frames aren't decoded.
+var urlEvents = [][]byte{
+	[]byte(`"Network.requestWillBeSent"`),
+	[]byte(`"Page.frameNavigated"`),
+	[]byte(`"Page.navigatedWithinDocument"`),
+	[]byte(`"Target.targetInfoChanged"`),
+}
+
+// add folds one recorded frame into the session's summary.
+func (x *recordingIndex) add(id string, frame tapFrame) {
+	var method, url string
+	if frame.Frame != nil {
+		switch frame.Direction {
+		case "client":
+			var msg struct {
+				Method string `json:"method"`
+				Params struct {
+					URL string `json:"url"`
+				} `json:"params"`
+			}
+			if json.Unmarshal(frame.Frame, &msg) == nil {
+				method, url = msg.Method, msg.Params.URL
+			}
+		case "upstream":
+			if eventNamesURL(frame.Frame) {
+				var msg struct {
+					Params struct {
+						URL     string `json:"url"`
+						Request struct {
+							URL string `json:"url"`
+						} `json:"request"`
+						Frame struct {
+							URL string `json:"url"`
+						} `json:"frame"`
+						TargetInfo struct {
+							URL string `json:"url"`
+						} `json:"targetInfo"`
+					} `json:"params"`
+				}
+				if json.Unmarshal(frame.Frame, &msg) == nil {
+					params := msg.Params
+					url = firstNonEmpty(params.Request.URL, params.Frame.URL, params.TargetInfo.URL, params.URL)
+				}
+			}
+		}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	entry := x.entries[id]
+	if entry == nil {
+		entry = &recordingSummary{SessionID: id, FirstFrame: frame.Time, Methods: make(map[string]int), urls: make(map[string]bool)}
+		x.entries[id] = entry
+	}
+	entry.Frames++
+	entry.LastFrame = frame.Time
+	if method != "" {
+		entry.Methods[method]++
+	}
+	if url != "" && url != "about:blank" && !entry.urls[url] {
+		if len(entry.URLs) >= maxIndexedURLs {
+			entry.URLsTruncated = true
+			return
+		}
+		entry.urls[url] = true
+		entry.URLs = append(entry.URLs, url)
+	}
+}
+
+func eventNamesURL(data []byte) bool {
+	for _, name := range urlEvents {
+		if bytes.Contains(data, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// recordingQuery is what GET /admin/recordings filters on.
+type recordingQuery struct {
+	method      string
+	url         string
+	urlContains string
+	since       time.Time
+	until       time.Time
+}
+
+// matches reports whether a summary passes q, returning the URLs that
+// matched a URL filter, or all of them without one.
+func (q recordingQuery) matches(entry *recordingSummary) ([]string, bool) {
+	if q.method != "" && entry.Methods[q.method] == 0 {
+		return nil, false
+	}
+	if !q.since.IsZero() && entry.LastFrame.Before(q.since) {
+		return nil, false
+	}
+	if !q.until.IsZero() && entry.FirstFrame.After(q.until) {
+		return nil, false
+	}
+	if q.url == "" && q.urlContains == "" {
+		return entry.URLs, true
+	}
+	var urls []string
+	for _, u := range entry.URLs {
+		if (q.url == "" || u == q.url) && (q.urlContains == "" || strings.Contains(u, q.urlContains)) {
+			urls = append(urls, u)
+		}
+	}
+	return urls, len(urls) > 0
+}
+
+// handleRecordings serves GET /admin/recordings: the recordings of
+// sessions that called ?method= or touched a URL equal to ?url= or
+// containing ?url~=, within ?since= and ?until= (RFC 3339), newest first.
+// ?limit= caps the results, 100 by default.
+func (p *proxyServer) handleRecordings(w http.ResponseWriter, r *http.Request) {
+	if p.recordings == nil {
+		writeError(w, http.StatusNotFound, "recording is off; start browserd with -record")
+		return
+	}
+	query := r.URL.Query()
+	q := recordingQuery{method: query.Get("method"), url: query.Get("url"), urlContains: query.Get("url~")}
+	for name, t := range map[string]*time.Time{"since": &q.since, "until": &q.until} {
+		if raw := query.Get(name); raw != "" {
+			parsed, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, name+" must be an RFC 3339 time")
+				return
+			}
+			*t = parsed
+		}
+	}
+	limit := 100
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+		limit = n
+	}
+
+	type result struct {
+		recordingSummary
+		Active bool `json:"active"`
+	}
+	x := p.recordings
+	x.mu.Lock()
+	results := []result{}
+	for id, entry := range x.entries {
+		if path, _ := p.recordingPath(id); path == "" || !fileExists(path) {
+			delete(x.entries, id)
+			continue
+		}
+		urls, ok := q.matches(entry)
+		if !ok {
+			continue
+		}
+		view := *entry
+		view.URLs = append([]string{}, urls...)
+		view.Methods = make(map[string]int, len(entry.Methods))
+		for method, n := range entry.Methods {
+			view.Methods[method] = n
+		}
+		results = append(results, result{recordingSummary: view})
+	}
+	x.mu.Unlock()
+
+	sort.Slice(results, func(i, j int) bool { return results[i].FirstFrame.After(results[j].FirstFrame) })
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	for i := range results {
+		results[i].Active = p.findSession(results[i].SessionID) != nil
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// recordingFile is the name of a session's recording in its temp
+// directory.
+const recordingFile = "recording.jsonl"
+
+// sessionRecording appends every frame a session relays to recordingFile,
+// one tapFrame per line, so the session can be replayed, inspected or
+// turned into a script after it ends.
+type sessionRecording struct {
+	index *recordingIndex
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// startRecording opens the session's recording in its temp directory,
+// adding what it records to index.
+func (s *session) startRecording(index *recordingIndex) error {
+	dir, err := s.temp.sessionDir(s.id)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, recordingFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.recording = &sessionRecording{index: index, file: f}
+	return nil
+}
+
+func (s *session) stopRecording() {
+	if s.recording == nil {
+		return
+	}
+	s.recording.mu.Lock()
+	defer s.recording.mu.Unlock()
+	_ = s.recording.file.Close()
+	s.recording.file = nil
+}
+
+// write appends one frame. A failed write ends the recording rather than
+// failing it on every frame that follows.
+func (r *sessionRecording) write(s *session, frame tapFrame) {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return
+	}
+	if _, err := r.file.Write(append(data, '\n')); err != nil {
+		s.log.Warn("failed to write session recording; recording stopped", "event", "recording_failed", "error", err)
+		_ = r.file.Close()
+		r.file = nil
+		return
+	}
+	r.index.add(s.id, frame)
+}
+
+// newTapFrame copies a relayed frame for taps and the recording.
+func newTapFrame(dir frameDirection, msgType int, data []byte) tapFrame {
+	frame := tapFrame{Direction: "client", Time: time.Now().UTC()}
+	if dir == toClient {
+		frame.Direction = "upstream"
+	}
+	if msgType == websocket.TextMessage && json.Valid(data) {
+		frame.Frame = append(json.RawMessage(nil), data...)
+	} else {
+		frame.Binary = append([]byte(nil), data...)
+	}
+	return frame
+}
+
+// readRecording loads the frames of a session's recording, which may still
+// be growing, or the copy -artifact-store kept once it is gone.
+func (p *proxyServer) readRecording(id string) ([]tapFrame, error) {
+	f, err := p.openRecording(id)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var frames []tapFrame
+	dec := json.NewDecoder(f)
+	for {
+		var frame tapFrame
+		if err := dec.Decode(&frame); err != nil {
+			// A line cut short by a write in progress ends the read.
+			return frames, nil
+		}
+		frames = append(frames, frame)
+	}
+}
+
+// recordingPath is where a session's recording is kept. Session IDs are
+// checked so a crafted one can't reach outside the temp directory.
+func (p *proxyServer) recordingPath(id string) (string, error) {
+	if id == "" || id != filepath.Base(id) || id == "." || id == ".." {
+		return "", os.ErrNotExist
+	}
+	return filepath.Join(p.temp.root, tempSessionsDir, id, recordingFile), nil
+}
+
+// openRecording opens a session's recording in its temp directory or, when
+// it isn't there, in -artifact-store.
+func (p *proxyServer) openRecording(id string) (io.ReadCloser, error) {
+	path, err := p.recordingPath(id)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) && p.artifacts != nil && p.artifacts.stores(artifactRecording) {
+		return p.artifacts.store.get(context.Background(), artifactPrefixes[artifactRecording]+id+".jsonl")
+	}
+	return f, err
+}
+
+// handleRecording serves a session's raw recording as JSON lines.
+func (p *proxyServer) handleRecording(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	path, err := p.recordingPath(id)
+	if err == nil {
+		_, err = os.Stat(path)
+	}
+	if errors.Is(err, os.ErrNotExist) && path != "" && p.artifacts != nil && p.artifacts.stores(artifactRecording) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		p.serveArtifact(w, r, artifactPrefixes[artifactRecording]+id+".jsonl", "recording not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusNotFound, "recording not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	http.ServeFile(w, r, path)
+}
+
+// handleRecordingScript converts a session's recording into a Puppeteer or
+// Playwright script, picked with ?format=.
+func (p *proxyServer) handleRecordingScript(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = scriptPuppeteer
+	}
+	if format != scriptPuppeteer && format != scriptPlaywright {
+		writeError(w, http.StatusBadRequest, "format must be puppeteer or playwright")
+		return
+	}
+	frames, err := p.readRecording(id)
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, http.StatusNotFound, "recording not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to read recording")
+		return
+	}
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+id+"."+format+`.js"`)
+	_, _ = w.Write(renderScript(format, id, scriptSteps(frames)))
+}
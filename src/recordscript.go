@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	scriptPuppeteer  = "puppeteer"
+	scriptPlaywright = "playwright"
+)
+
+// scriptStep is one user-level action recovered from a recording.
+type scriptStep struct {
+	kind string // viewport, goto, reload, click, wheel, type, press or navigated
+	url  string
+	text string
+	x, y float64
+	// button and clicks qualify a click; width and height a viewport.
+	button        string
+	clicks        int
+	width, height int
+}
+
+// scriptKeys are the keys a recording replays with keyboard.press rather
+// than as typed text. The names are CDP's, which both libraries share.
+var scriptKeys = map[string]bool{
+	"Enter": true, "Tab": true, "Escape": true, "Backspace": true, "Delete": true,
+	"ArrowUp": true, "ArrowDown": true, "ArrowLeft": true, "ArrowRight": true,
+	"Home": true, "End": true, "PageUp": true, "PageDown": true,
+}
+
+// scriptSteps derives navigations, clicks, scrolling and typing from the
+// Page and Input commands a client sent, and notes the navigations they
+// caused. Every page the client drove is folded onto one, so multi-page
+// sessions need the script adjusting by hand.
+func scriptSteps(frames []tapFrame) []scriptStep {
+	var steps []scriptStep
+	var typed strings.Builder
+	flush := func() {
+		if typed.Len() > 0 {
+			steps = append(steps, scriptStep{kind: "type", text: typed.String()})
+			typed.Reset()
+		}
+	}
+	add := func(step scriptStep) {
+		flush()
+		steps = append(steps, step)
+	}
+	lastURL := ""
+
+	for _, frame := range frames {
+		if len(frame.Frame) == 0 {
+			continue
+		}
+		var msg struct {
+			Method string `json:"method"`
+			Params struct {
+				URL        string  `json:"url"`
+				Type       string  `json:"type"`
+				X          float64 `json:"x"`
+				Y          float64 `json:"y"`
+				DeltaX     float64 `json:"deltaX"`
+				DeltaY     float64 `json:"deltaY"`
+				Button     string  `json:"button"`
+				ClickCount int     `json:"clickCount"`
+				Text       string  `json:"text"`
+				Key        string  `json:"key"`
+				Width      int     `json:"width"`
+				Height     int     `json:"height"`
+				Frame      struct {
+					ParentID string `json:"parentId"`
+					URL      string `json:"url"`
+				} `json:"frame"`
+			} `json:"params"`
+		}
+		if json.Unmarshal(frame.Frame, &msg) != nil || msg.Method == "" {
+			continue
+		}
+		params := msg.Params
+
+		if frame.Direction == "upstream" {
+			// A top-level navigation nobody asked for by URL came from
+			// something the page did, usually the click before it.
+			if msg.Method == "Page.frameNavigated" && params.Frame.ParentID == "" && params.Frame.URL != lastURL {
+				lastURL = params.Frame.URL
+				if lastURL != "about:blank" {
+					add(scriptStep{kind: "navigated", url: lastURL})
+				}
+			}
+			continue
+		}
+
+		switch msg.Method {
+		case "Page.navigate", "Target.createTarget":
+			if params.URL != "" && params.URL != "about:blank" {
+				lastURL = params.URL
+				add(scriptStep{kind: "goto", url: params.URL})
+			}
+		case "Page.reload":
+			add(scriptStep{kind: "reload"})
+		case "Emulation.setDeviceMetricsOverride":
+			if params.Width > 0 && params.Height > 0 {
+				add(scriptStep{kind: "viewport", width: params.Width, height: params.Height})
+			}
+		case "Input.dispatchMouseEvent":
+			switch params.Type {
+			case "mouseReleased":
+				add(scriptStep{kind: "click", x: params.X, y: params.Y, button: params.Button, clicks: params.ClickCount})
+			case "mouseWheel":
+				add(scriptStep{kind: "wheel", x: params.DeltaX, y: params.DeltaY})
+			}
+		case "Input.insertText":
+			typed.WriteString(params.Text)
+		case "Input.dispatchKeyEvent":
+			switch {
+			case params.Type == "keyUp":
+			case scriptKeys[params.Key] && params.Type != "char":
+				add(scriptStep{kind: "press", text: params.Key})
+			// Chromium's own pattern is rawKeyDown then char, Puppeteer's
+			// and Playwright's a keyDown carrying the text.
+			case params.Type == "keyDown" || params.Type == "char":
+				if params.Text != "" && params.Text[0] >= ' ' {
+					typed.WriteString(params.Text)
+				}
+			}
+		}
+	}
+	flush()
+	return steps
+}
+
+// renderScript writes steps as a runnable script for format. Puppeteer and
+// Playwright differ only in setup and a few method names.
+func renderScript(format, sessionID string, steps []scriptStep) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Recorded by browserd from session %s, exported %s.\n", sessionID, time.Now().UTC().Format(time.RFC3339))
+	if format == scriptPlaywright {
+		b.WriteString("const { chromium } = require('playwright');\n\n(async () => {\n  const browser = await chromium.launch();\n")
+	} else {
+		b.WriteString("const puppeteer = require('puppeteer');\n\n(async () => {\n  const browser = await puppeteer.launch();\n")
+	}
+	b.WriteString("  const page = await browser.newPage();\n")
+
+	for _, step := range steps {
+		b.WriteString("  ")
+		switch step.kind {
+		case "viewport":
+			if format == scriptPlaywright {
+				fmt.Fprintf(&b, "await page.setViewportSize({ width: %d, height: %d });\n", step.width, step.height)
+			} else {
+				fmt.Fprintf(&b, "await page.setViewport({ width: %d, height: %d });\n", step.width, step.height)
+			}
+		case "goto":
+			fmt.Fprintf(&b, "await page.goto(%s);\n", jsString(step.url))
+		case "reload":
+			b.WriteString("await page.reload();\n")
+		case "navigated":
+			fmt.Fprintf(&b, "// The page navigated to %s.\n", step.url)
+		case "click":
+			var options []string
+			if step.button != "" && step.button != "left" && step.button != "none" {
+				options = append(options, "button: "+jsString(step.button))
+			}
+			if step.clicks > 1 {
+				options = append(options, "clickCount: "+strconv.Itoa(step.clicks))
+			}
+			args := jsNumber(step.x) + ", " + jsNumber(step.y)
+			if len(options) > 0 {
+				args += ", { " + strings.Join(options, ", ") + " }"
+			}
+			fmt.Fprintf(&b, "await page.mouse.click(%s);\n", args)
+		case "wheel":
+			if format == scriptPlaywright {
+				fmt.Fprintf(&b, "await page.mouse.wheel(%s, %s);\n", jsNumber(step.x), jsNumber(step.y))
+			} else {
+				fmt.Fprintf(&b, "await page.mouse.wheel({ deltaX: %s, deltaY: %s });\n", jsNumber(step.x), jsNumber(step.y))
+			}
+		case "type":
+			fmt.Fprintf(&b, "await page.keyboard.type(%s);\n", jsString(step.text))
+		case "press":
+			fmt.Fprintf(&b, "await page.keyboard.press(%s);\n", jsString(step.text))
+		}
+	}
+	b.WriteString("  await browser.close();\n})();\n")
+	return b.Bytes()
+}
+
+// jsString quotes s as a JavaScript string literal; JSON's escaping is
+// valid JavaScript.
+func jsString(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+func jsNumber(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
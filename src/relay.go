@@ -0,0 +1,912 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// injectedIDBase starts the ID range used for commands browserd sends on a
+// client's behalf. Chromium treats IDs as 32-bit ints and clients count up
+// from 1, so the two ranges don't meet in practice.
+const injectedIDBase = 1 << 30
+
+// cdpCommand is a CDP method call configured by the operator.
+type cdpCommand struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// cdpMessage covers commands, responses and events in either direction.
+type cdpMessage struct {
+	ID        *int64          `json:"id,omitempty"`
+	Method    string          `json:"method,omitempty"`
+	SessionID string          `json:"sessionId,omitempty"`
+	Params    json.RawMessage `json:"params,omitempty"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     json.RawMessage `json:"error,omitempty"`
+}
+
+type attachedToTargetParams struct {
+	SessionID  string `json:"sessionId"`
+	TargetInfo struct {
+		TargetID string `json:"targetId"`
+		Type     string `json:"type"`
+	} `json:"targetInfo"`
+}
+
+// loadCDPCommands reads a JSON array of {"method", "params"} objects.
+func loadCDPCommands(path string) ([]cdpCommand, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var commands []cdpCommand
+	if err := unmarshalConfig(data, &commands); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i, cmd := range commands {
+		if cmd.Method == "" {
+			return nil, fmt.Errorf("parse %s: command %d has no method", path, i)
+		}
+	}
+	return commands, nil
+}
+
+// Frames over -max-message-size end the session. The connection that sent
+// one has already been closed with 1009 (message too big) by the time
+// these are returned.
+var (
+	errClientMessageTooBig   = errors.New("client sent a message over the maximum message size")
+	errUpstreamMessageTooBig = errors.New("upstream sent a message over the maximum message size")
+)
+
+// errRelayStopped answers commands browserd injected that were still
+// waiting for Chromium when the session ended.
+var errRelayStopped = errors.New("session ended")
+
+// relayOptions carries the per-session CDP behaviour of a relay.
+type relayOptions struct {
+	// init commands are sent to every page target before the client sees it.
+	init []cdpCommand
+	// policies decide paused requests on the session's page targets.
+	policies []requestPolicy
+	// guard, when set, is the -block-private-networks guard among the
+	// policies. Paused requests wait off the read loop for the names it
+	// resolves.
+	guard *networkGuard
+	// isolate confines the client to a browser context of its own.
+	isolate bool
+	// hidden keeps the -hide-targets from the client's Target.getTargets
+	// and Target.attachToTarget.
+	hidden targetFilter
+	// middleware sees every frame the relay forwards.
+	middleware middlewareChain
+	// navigationPolicy, when set, returns why a URL the client navigates
+	// to or opens a target on is refused, or "".
+	navigationPolicy func(url string) string
+	// onInvalidFrame, when set, turns on client frame validation and is
+	// told why each rejected frame was.
+	onInvalidFrame func(reason string)
+	// commandTimeout, when set, answers client commands the upstream hasn't
+	// within it with an error; killHung also closes the target the command
+	// hung in. onCommandTimeout is told of each, with the closed target.
+	commandTimeout   time.Duration
+	killHung         bool
+	onCommandTimeout func(method, targetID string)
+	// proxy routes the session's browsing traffic through an egress proxy.
+	proxy *url.URL
+	// stealth adds anti-automation-detection patches to the init commands.
+	stealth bool
+	// siteCredentials answer the auth challenges of the sites they match.
+	siteCredentials siteCredentials
+	// permissions are granted and denied in the session's browser context.
+	permissions *permissionPolicy
+	// commandRate, when set, caps the frames the client sends a second,
+	// allowing bursts of commandBurst; onThrottled is told each time a
+	// frame is held back.
+	commandRate  float64
+	commandBurst int
+	onThrottled  func()
+	// onPump is told of each pump goroutine starting (1) and ending (-1);
+	// onStuck, of a relay whose pumps outlived relayStopTimeout.
+	onPump  func(delta float64)
+	onStuck func()
+	// onTargetLost is told when a target's debugging session is taken
+	// away, by the kind of loss.
+	onTargetLost func(kind string)
+	// anomalies, when set, applies the anomaly rules to client commands.
+	anomalies *anomalyWatch
+	// screencast caps the screencasts the client starts; onScreencastCapped
+	// is told of each command rewritten ("command") or frame dropped
+	// ("frame").
+	screencast         screencastCap
+	onScreencastCapped func(kind string)
+	// redial, when set, replaces a lost upstream connection within
+	// reconnectWindow, buffering up to reconnectBuffer client frames
+	// meanwhile; onReconnect is told how each attempt went.
+	redial          func(ctx context.Context) (*websocket.Conn, error)
+	reconnectWindow time.Duration
+	reconnectBuffer int
+	onReconnect     func(result string)
+	// onFailure is called with the error ending the relay, unless the
+	// client closed normally, before either connection is closed.
+	onFailure func(err error)
+	// onQueue is told of each frame entering (1) and leaving (-1, with how
+	// long it waited) one of the relay's buffers, by queue.
+	onQueue func(queue string, delta int, wait time.Duration)
+	// fair, when set, takes turns with the heavy commands of the sessions
+	// sharing the browser; onFairWait is told of each, with how long it
+	// waited for its turn.
+	fair       *fairScheduler
+	onFairWait func(method string, waited time.Duration)
+}
+
+// relay shuttles frames between a client and its upstream connection. When
+// the session has init commands or request policies it also inspects frames
+// so it can configure page targets before the client learns about them.
+type relay struct {
+	sess     *session
+	client   *websocket.Conn
+	upstream *websocket.Conn
+	init     []cdpCommand
+	policies []requestPolicy
+	guard    *networkGuard
+
+	middleware middlewareChain
+
+	navigationPolicy func(url string) string
+	onInvalidFrame   func(reason string)
+	anomalies        *anomalyWatch
+
+	screencast         screencastCap
+	onScreencastCapped func(kind string)
+	// frameDue is when each CDP session's next screencast frame may be
+	// written to the client.
+	frameDue map[string]time.Time
+
+	commandTimeout   time.Duration
+	killHung         bool
+	onCommandTimeout func(method, targetID string)
+	commandsMu       sync.Mutex
+	outstanding      map[commandKey]*outstandingCommand
+	timedOut         map[commandKey]bool
+
+	// isolation is set under strict isolation mode.
+	isolation *isolation
+
+	// hidden are the -hide-targets; targetLists are the client's
+	// Target.getTargets awaiting their response, to drop them from.
+	hidden        targetFilter
+	targetListsMu sync.Mutex
+	targetLists   map[int64]bool
+
+	// decodeClient and decodeUpstream are set when the session's options
+	// act on every frame from that side, so each must be decoded.
+	decodeClient   bool
+	decodeUpstream bool
+
+	// proxy is the session's egress proxy, and contextID the browser
+	// context created for the session when it has one.
+	proxy     *url.URL
+	contextID string
+	stealth   bool
+
+	siteCredentials siteCredentials
+	permissions     *permissionPolicy
+
+	commandLimit *commandLimiter
+	onThrottled  func()
+
+	// pumps tracks the two pump goroutines, which report how they ended
+	// on errCh; done is closed once the relay stops.
+	pumps   sync.WaitGroup
+	errCh   chan error
+	done    chan struct{}
+	onPump  func(delta float64)
+	onStuck func()
+
+	onTargetLost func(kind string)
+	onFailure    func(err error)
+	onQueue      func(queue string, delta int, wait time.Duration)
+
+	// reconnect is set when a lost upstream is redialed.
+	reconnect *reconnector
+
+	// fair is the shared browser's scheduler; fairRunning are the client's
+	// heavy commands holding one of its slots until they are answered.
+	fair        *fairScheduler
+	onFairWait  func(method string, waited time.Duration)
+	fairMu      sync.Mutex
+	fairRunning map[commandKey]bool
+
+	// upstreamMu serializes writes to the upstream; connMu guards
+	// replacing the connection against stop closing it.
+	clientMu   sync.Mutex
+	upstreamMu sync.Mutex
+	connMu     sync.Mutex
+
+	nextID    atomic.Int64
+	pendingMu sync.Mutex
+	pending   map[int64]chan cdpMessage
+
+	// holds counts in-flight target initializations; while positive,
+	// client-bound frames are queued in order rather than written.
+	holdMu sync.Mutex
+	holds  int
+	held   []heldFrame
+
+	// clientFetch records the Fetch patterns the client enabled per CDP
+	// session, so paused requests it asked for are still forwarded;
+	// clientAuth likewise records whether it handles auth challenges.
+	fetchMu         sync.Mutex
+	clientFetch     map[string][]requestPattern
+	clientAuth      map[string]bool
+	proxyChallenged map[string]bool
+	siteChallenged  map[string]bool
+}
+
+type heldFrame struct {
+	msgType int
+	data    []byte
+	queued  time.Time
+}
+
+func newRelay(sess *session, client, upstream *websocket.Conn, opts relayOptions) *relay {
+	r := &relay{
+		sess:               sess,
+		client:             client,
+		upstream:           upstream,
+		init:               opts.init,
+		policies:           opts.policies,
+		guard:              opts.guard,
+		middleware:         opts.middleware,
+		navigationPolicy:   opts.navigationPolicy,
+		onInvalidFrame:     opts.onInvalidFrame,
+		anomalies:          opts.anomalies,
+		screencast:         opts.screencast,
+		onScreencastCapped: opts.onScreencastCapped,
+		frameDue:           make(map[string]time.Time),
+		commandTimeout:     opts.commandTimeout,
+		killHung:           opts.killHung,
+		onCommandTimeout:   opts.onCommandTimeout,
+		outstanding:        make(map[commandKey]*outstandingCommand),
+		timedOut:           make(map[commandKey]bool),
+		proxy:              opts.proxy,
+		stealth:            opts.stealth,
+		pending:            make(map[int64]chan cdpMessage),
+		clientFetch:        make(map[string][]requestPattern),
+		clientAuth:         make(map[string]bool),
+		proxyChallenged:    make(map[string]bool),
+		siteChallenged:     make(map[string]bool),
+		siteCredentials:    opts.siteCredentials,
+		permissions:        opts.permissions,
+		onThrottled:        opts.onThrottled,
+		errCh:              make(chan error, 2),
+		done:               make(chan struct{}),
+		onPump:             opts.onPump,
+		onStuck:            opts.onStuck,
+		onTargetLost:       opts.onTargetLost,
+		onFailure:          opts.onFailure,
+		onQueue:            opts.onQueue,
+		fair:               opts.fair,
+		onFairWait:         opts.onFairWait,
+		fairRunning:        make(map[commandKey]bool),
+		hidden:             opts.hidden,
+		targetLists:        make(map[int64]bool),
+	}
+	if opts.commandRate > 0 {
+		r.commandLimit = newCommandLimiter(opts.commandRate, opts.commandBurst)
+	}
+	if opts.isolate {
+		r.isolation = newIsolation()
+	}
+	if opts.redial != nil {
+		r.reconnect = newReconnector(opts)
+	}
+	if r.intercepting() {
+		r.init = append([]cdpCommand{r.fetchEnableCommand()}, r.init...)
+	}
+	r.decodeClient = r.intercepting() || r.needsContext() || r.commandTimeout > 0 || r.reconnect != nil || r.fair != nil
+	r.decodeUpstream = r.inspecting() || r.reconnect != nil
+	r.nextID.Store(injectedIDBase)
+	return r
+}
+
+// parsesClient reports whether a client frame must be decoded: any frame
+// when decodeClient is set, and otherwise those naming a command one of
+// the session's options rewrites or checks.
+func (r *relay) parsesClient(data []byte) bool {
+	return r.decodeClient || mentionsDownloads(data) ||
+		r.navigationPolicy != nil && mentionsNavigation(data) ||
+		r.screencast.enabled() && mentionsScreencast(data) ||
+		r.hidden.active() && mentionsTargetQuery(data)
+}
+
+// parsesUpstream is parsesClient's counterpart for upstream frames, which
+// must also be decoded while responses to browserd's own commands or the
+// client's heavy commands and target lists are awaited.
+func (r *relay) parsesUpstream(data []byte) bool {
+	return r.decodeUpstream || r.runningHeavy() || r.listingTargets() || r.calling() ||
+		mentionsAttachment(data) ||
+		r.screencast.MaxFPS > 0 && mentionsScreencastFrame(data)
+}
+
+// inspecting reports whether upstream frames need to be decoded at all.
+func (r *relay) inspecting() bool {
+	return len(r.init) > 0 || r.stealth || r.intercepting() || r.needsContext() || r.commandTimeout > 0
+}
+
+// intercepting reports whether browserd handles Fetch events itself.
+func (r *relay) intercepting() bool {
+	return len(r.policies) > 0 || r.handlesAuth()
+}
+
+// proxyAuth reports whether the egress proxy needs credentials.
+func (r *relay) proxyAuth() bool {
+	return r.proxy != nil && r.proxy.User != nil
+}
+
+// handlesAuth reports whether browserd answers auth challenges itself,
+// for the egress proxy or for -site-credentials.
+func (r *relay) handlesAuth() bool {
+	return r.proxyAuth() || r.siteCredentials.hasBasic()
+}
+
+// run relays until either side fails and returns the first error.
+// pageTarget marks connections made directly to a page target, which are
+// initialized before any client frame is forwarded. Both pumps have ended
+// by the time it returns, however the relay ends.
+func (r *relay) run(pageTarget bool) (err error) {
+	if r.needsContext() && pageTarget {
+		// A page connection is bound to one existing target; there is no
+		// browser context to confine or route it through.
+		return errors.New("strict isolation, session proxies and permission policies require a browser debugger URL")
+	}
+
+	if pageTarget {
+		// The page is gone with the browser; there is nothing to reconnect to.
+		r.reconnect = nil
+	}
+
+	defer r.stopCommandTimers()
+	defer func() { err = r.stop(err) }()
+
+	r.spawn(r.pumpUpstream)
+
+	if r.needsContext() {
+		if err := r.createSessionContext(); err != nil {
+			return fmt.Errorf("create session browser context: %w", err)
+		}
+	}
+
+	if r.permissions != nil {
+		if err := r.applyPermissions(); err != nil {
+			return fmt.Errorf("apply permission policy: %w", err)
+		}
+	}
+
+	if r.stealth {
+		// Stealth goes first so a device preset's user agent still wins.
+		if commands, err := r.stealthCommands(); err != nil {
+			r.sess.log.Warn("stealth mode unavailable", "error", err)
+			r.sess.logf("stealth mode unavailable: %v", err)
+		} else {
+			r.init = append(commands, r.init...)
+		}
+	}
+
+	if pageTarget && r.inspecting() {
+		r.hold()
+		r.initTarget("")
+	}
+
+	r.spawn(r.pumpClient)
+
+	return <-r.errCh
+}
+
+// relayStopTimeout bounds how long a stopping relay waits for its pumps
+// once both connections are closed.
+const relayStopTimeout = 5 * time.Second
+
+// spawn starts a pump goroutine.
+func (r *relay) spawn(pump func() error) {
+	r.pumps.Add(1)
+	if r.onPump != nil {
+		r.onPump(1)
+	}
+	go func() {
+		defer r.pumps.Done()
+		if r.onPump != nil {
+			defer r.onPump(-1)
+		}
+		r.errCh <- pump()
+	}()
+}
+
+// stop ends a relay whose first error, if any, is first. Closing both
+// connections unblocks whichever pump is still reading or writing, and
+// injected commands still waiting for an answer give up. The pumps are
+// waited for and their errors drained, so nothing outlives the session.
+func (r *relay) stop(first error) error {
+	if r.onFailure != nil && first != nil && !websocket.IsCloseError(first, websocket.CloseNormalClosure) {
+		r.onFailure(first)
+	}
+	close(r.done)
+	r.client.Close()
+	r.connMu.Lock()
+	r.upstream.Close()
+	r.connMu.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		r.pumps.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		r.dropQueued()
+	case <-time.After(relayStopTimeout):
+		r.sess.log.Warn("relay goroutines still running after both connections closed", "event", "relay_stuck", "timeout", relayStopTimeout.String())
+		if r.onStuck != nil {
+			r.onStuck()
+		}
+	}
+	r.endTurns()
+	for {
+		select {
+		case err := <-r.errCh:
+			if first == nil {
+				first = err
+			}
+		default:
+			return first
+		}
+	}
+}
+
+// pumpClient forwards client frames upstream, adjusting the client's own
+// Fetch commands when browserd intercepts requests too and defaulting
+// download directories.
+func (r *relay) pumpClient() error {
+	for {
+		msgType, data, err := r.client.ReadMessage()
+		if errors.Is(err, websocket.ErrReadLimit) {
+			return errClientMessageTooBig
+		}
+		if err != nil {
+			return err
+		}
+		r.sess.stats.clientMessages.Add(1)
+		r.sess.stats.clientBytes.Add(int64(len(data)))
+		r.sess.touch()
+		r.throttle()
+
+		if len(r.middleware) > 0 {
+			f := relayFrame{sess: r.sess, dir: toUpstream, msgType: msgType, data: data}
+			if !r.middleware.handle(&f) {
+				continue
+			}
+			data = f.data
+		}
+
+		if r.anomalies != nil && msgType == websocket.TextMessage {
+			if rule := r.anomalies.observe(data); rule != nil {
+				_ = r.client.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closePolicyViolation, "anomalous CDP usage: "+rule.Name), time.Now().Add(time.Second))
+				return errAnomalyTerminated
+			}
+		}
+
+		if r.onInvalidFrame != nil {
+			// Garbage is answered here rather than sent up the connection,
+			// which Chromium may close over it.
+			if fe := validateFrame(msgType, data); fe != nil {
+				r.onInvalidFrame(fe.reason)
+				if err := r.replyInvalid(fe); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		reapplyPermissions := false
+		var key *commandKey
+		if msgType == websocket.TextMessage && r.parsesClient(data) {
+			var msg cdpMessage
+			if err := json.Unmarshal(data, &msg); err == nil {
+				if r.navigationPolicy != nil {
+					if reason := r.checkNavigation(&msg); reason != "" {
+						if err := r.replyError(&msg, reason); err != nil {
+							return err
+						}
+						continue
+					}
+				}
+				changed := false
+				if r.isolation != nil {
+					reason, rewritten := r.checkClient(&msg)
+					if reason != "" {
+						r.sess.logf("rejected %s: %s", msg.Method, reason)
+						if err := r.replyError(&msg, reason); err != nil {
+							return err
+						}
+						continue
+					}
+					changed = rewritten
+				} else if r.contextID != "" && r.defaultTargetContext(&msg) {
+					changed = true
+				}
+				if r.hidden.active() {
+					if reason := r.checkHidden(&msg); reason != "" {
+						if err := r.replyError(&msg, reason); err != nil {
+							return err
+						}
+						continue
+					}
+				}
+				if r.permissions != nil {
+					reason, reapply := r.checkPermissions(&msg)
+					if reason != "" {
+						r.sess.logf("rejected %s: %s", msg.Method, reason)
+						if err := r.replyError(&msg, reason); err != nil {
+							return err
+						}
+						continue
+					}
+					reapplyPermissions = reapply
+				}
+				if r.intercepting() && r.rewriteClientFetch(&msg) {
+					changed = true
+				}
+				if r.sess.temp != nil && r.defaultDownloadPath(&msg) {
+					changed = true
+				}
+				if r.screencast.enabled() && r.capScreencast(&msg) {
+					changed = true
+				}
+				if changed {
+					if rewritten, err := json.Marshal(msg); err == nil {
+						data = rewritten
+					}
+				}
+				if !r.waitTurn(&msg) {
+					return errRelayStopped
+				}
+				r.trackCommand(&msg)
+				if r.reconnect != nil {
+					key = r.reconnect.noteClient(&msg)
+				}
+			}
+		}
+
+		if reapplyPermissions {
+			// Hold the client's answer back until the policy is in place
+			// again, so it never sees the permissions reset.
+			r.hold()
+		}
+		if err := r.forward(msgType, data, key); err != nil {
+			return err
+		}
+		if reapplyPermissions {
+			go func() {
+				defer r.release()
+				if err := r.applyPermissions(); err != nil {
+					r.sess.log.Warn("failed to reapply permission policy", "error", err)
+					r.sess.logf("failed to reapply permission policy: %v", err)
+				}
+			}()
+		}
+	}
+}
+
+// forwardClose passes the code and reason Chromium closed the upstream
+// connection with on to the client, so client libraries can tell a
+// DevTools takeover from a browser shutting down. A connection lost
+// without a close frame becomes 1011. Nothing is sent when browserd closed
+// the connection itself.
+func (r *relay) forwardClose(err error) {
+	if errors.Is(err, net.ErrClosed) {
+		return
+	}
+	code, reason := closeUpstreamLost, "upstream connection lost"
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) && closeErr.Code != websocket.CloseAbnormalClosure && closeErr.Code != websocket.CloseTLSHandshake {
+		code, reason = closeErr.Code, closeErr.Text
+	}
+	r.sess.logf("upstream closed: %d %s", code, reason)
+	_ = r.client.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+}
+
+// pumpUpstream forwards upstream frames to the client, consuming responses
+// to injected commands, tracking the session's page targets and starting
+// their initialization.
+func (r *relay) pumpUpstream() error {
+	for {
+		conn := r.currentUpstream()
+		msgType, data, err := conn.ReadMessage()
+		if errors.Is(err, websocket.ErrReadLimit) {
+			// Tell the client why its session ends rather than just dropping it.
+			_ = r.client.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeMessageTooBig, "upstream message too big"), time.Now().Add(time.Second))
+			return errUpstreamMessageTooBig
+		}
+		if err != nil {
+			if r.reconnect != nil && conn != r.currentUpstream() {
+				// Replaced by a migration, which closed this connection.
+				continue
+			}
+			if r.reconnect != nil && r.reconnect.worthTrying(err) && r.reconnectUpstream(conn, err) == nil {
+				continue
+			}
+			r.forwardClose(err)
+			return err
+		}
+		r.sess.stats.upstreamMessages.Add(1)
+		r.sess.stats.upstreamBytes.Add(int64(len(data)))
+		if r.reconnect != nil && msgType == websocket.TextMessage {
+			data = r.reconnect.toClient(data)
+		}
+
+		var (
+			lost        error
+			closeCode   int
+			closeReason string
+		)
+		if msgType == websocket.TextMessage && r.parsesUpstream(data) {
+			var msg cdpMessage
+			if err := json.Unmarshal(data, &msg); err == nil {
+				if msg.ID != nil && r.resolve(*msg.ID, msg) {
+					continue
+				}
+				if r.reconnect != nil {
+					r.reconnect.noteResponse(&msg)
+				}
+				if r.fair != nil {
+					r.endTurn(&msg)
+				}
+				if !r.answerCommand(&msg) {
+					continue
+				}
+				if r.isolation != nil && !r.filterUpstream(&msg, &data) {
+					continue
+				}
+				if msg.ID != nil && msg.SessionID == "" && r.listedTargets(*msg.ID) {
+					r.dropHidden(&msg, &data)
+				}
+				switch msg.Method {
+				case "Target.attachedToTarget":
+					r.onAttached(msg)
+				case "Target.detachedFromTarget":
+					r.onDetached(msg)
+				case "Fetch.requestPaused":
+					if r.intercepting() && !r.onRequestPaused(msg, data) {
+						continue
+					}
+				case "Fetch.authRequired":
+					if r.handlesAuth() && !r.onAuthRequired(msg) {
+						continue
+					}
+				case "Inspector.detached", "Inspector.targetCrashed":
+					lost, closeCode, closeReason = r.onInspectorEvent(msg)
+				case "Page.screencastFrame":
+					if r.screencast.MaxFPS > 0 && r.paceScreencast(&msg) {
+						continue
+					}
+				}
+			}
+		}
+
+		if len(r.middleware) > 0 {
+			f := relayFrame{sess: r.sess, dir: toClient, msgType: msgType, data: data}
+			if !r.middleware.handle(&f) {
+				continue
+			}
+			data = f.data
+		}
+
+		if err := r.writeClient(msgType, data); err != nil {
+			return err
+		}
+		if lost != nil {
+			_ = r.client.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, closeReason), time.Now().Add(time.Second))
+			return lost
+		}
+	}
+}
+
+func (r *relay) onAttached(msg cdpMessage) {
+	var params attachedToTargetParams
+	if err := json.Unmarshal(msg.Params, &params); err != nil || params.SessionID == "" {
+		return
+	}
+	if params.TargetInfo.Type != "page" {
+		return
+	}
+	r.sess.addTarget(params.SessionID, params.TargetInfo.TargetID)
+	if !r.inspecting() {
+		return
+	}
+
+	// Hold before this event is queued so the client only sees the target
+	// once it has been initialized.
+	r.hold()
+	go r.initTarget(params.SessionID)
+}
+
+func (r *relay) onDetached(msg cdpMessage) {
+	var params struct {
+		SessionID string `json:"sessionId"`
+	}
+	if err := json.Unmarshal(msg.Params, &params); err == nil {
+		r.sess.removeTarget(params.SessionID)
+		delete(r.frameDue, params.SessionID)
+	}
+}
+
+// mentionsAttachment cheaply spots the frames needed to track a session's
+// targets, and notice losing them, when nothing else requires decoding
+// upstream traffic.
+func mentionsAttachment(data []byte) bool {
+	return bytes.Contains(data, []byte(`"Target.attachedToTarget"`)) || bytes.Contains(data, []byte(`"Target.detachedFromTarget"`)) ||
+		bytes.Contains(data, []byte(`"Inspector.detached"`)) || bytes.Contains(data, []byte(`"Inspector.targetCrashed"`))
+}
+
+// initTarget sends the init commands to a target's flattened CDP session
+// (or the connection itself when sessionID is empty), then releases held
+// client frames.
+func (r *relay) initTarget(sessionID string) {
+	defer r.release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	for _, cmd := range r.init {
+		resp, err := r.call(ctx, sessionID, cmd.Method, cmd.Params)
+		if err != nil {
+			r.sess.log.Warn("init command failed", "method", cmd.Method, "error", err)
+			r.sess.logf("init command %s failed: %v", cmd.Method, err)
+			continue
+		}
+		if len(resp.Error) > 0 {
+			r.sess.log.Warn("init command returned error", "method", cmd.Method, "error", string(resp.Error))
+			r.sess.logf("init command %s returned error: %s", cmd.Method, resp.Error)
+		}
+	}
+}
+
+// call sends a browserd-originated command upstream and waits for its reply.
+func (r *relay) call(ctx context.Context, sessionID, method string, params json.RawMessage) (cdpMessage, error) {
+	id := r.nextID.Add(1)
+	ch := make(chan cdpMessage, 1)
+
+	r.pendingMu.Lock()
+	r.pending[id] = ch
+	r.pendingMu.Unlock()
+	defer func() {
+		r.pendingMu.Lock()
+		delete(r.pending, id)
+		r.pendingMu.Unlock()
+	}()
+
+	data, err := json.Marshal(cdpMessage{ID: &id, Method: method, SessionID: sessionID, Params: params})
+	if err != nil {
+		return cdpMessage{}, err
+	}
+	if err := r.writeUpstream(websocket.TextMessage, data); err != nil {
+		return cdpMessage{}, err
+	}
+
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-ctx.Done():
+		return cdpMessage{}, errors.New("timed out waiting for response")
+	case <-r.done:
+		return cdpMessage{}, errRelayStopped
+	}
+}
+
+// calling reports whether browserd awaits responses of its own.
+func (r *relay) calling() bool {
+	r.pendingMu.Lock()
+	defer r.pendingMu.Unlock()
+	return len(r.pending) > 0
+}
+
+func (r *relay) resolve(id int64, msg cdpMessage) bool {
+	r.pendingMu.Lock()
+	ch, ok := r.pending[id]
+	r.pendingMu.Unlock()
+	if ok {
+		ch <- msg
+	}
+	return ok
+}
+
+func (r *relay) hold() {
+	r.holdMu.Lock()
+	r.holds++
+	r.holdMu.Unlock()
+}
+
+// release ends one hold and flushes queued frames once none remain.
+func (r *relay) release() {
+	r.holdMu.Lock()
+	defer r.holdMu.Unlock()
+
+	r.holds--
+	if r.holds > 0 {
+		return
+	}
+	var err error
+	for _, frame := range r.held {
+		r.dequeued(queueHeld, frame.queued)
+		if err == nil && frame.data != nil {
+			err = r.writeClientLocked(frame.msgType, frame.data)
+		}
+	}
+	r.held = nil
+}
+
+// reserve holds client frames back behind a place in the queue for a text
+// frame decided later, which fill puts there.
+func (r *relay) reserve() int {
+	r.holdMu.Lock()
+	defer r.holdMu.Unlock()
+	r.holds++
+	r.held = append(r.held, heldFrame{msgType: websocket.TextMessage, queued: time.Now()})
+	r.queued(queueHeld, len(r.held))
+	return len(r.held) - 1
+}
+
+// fill puts data in the place reserve kept, or drops it when data is nil,
+// and ends the hold.
+func (r *relay) fill(slot int, data []byte) {
+	r.holdMu.Lock()
+	if slot < len(r.held) {
+		r.held[slot].data = data
+	}
+	r.holdMu.Unlock()
+	r.release()
+}
+
+func (r *relay) writeClient(msgType int, data []byte) error {
+	r.holdMu.Lock()
+	defer r.holdMu.Unlock()
+
+	if r.holds > 0 {
+		r.held = append(r.held, heldFrame{msgType: msgType, data: data, queued: time.Now()})
+		r.queued(queueHeld, len(r.held))
+		return nil
+	}
+	return r.writeClientLocked(msgType, data)
+}
+
+// writeClientLocked writes to the client; callers hold holdMu so queued
+// frames and new frames keep their order.
+func (r *relay) writeClientLocked(msgType int, data []byte) error {
+	r.clientMu.Lock()
+	defer r.clientMu.Unlock()
+	r.sess.tap(toClient, msgType, data)
+	return r.client.WriteMessage(msgType, data)
+}
+
+func (r *relay) writeUpstream(msgType int, data []byte) error {
+	r.upstreamMu.Lock()
+	defer r.upstreamMu.Unlock()
+	r.sess.tap(toUpstream, msgType, data)
+	if r.reconnect != nil && msgType == websocket.TextMessage {
+		data = r.reconnect.toUpstream(data)
+	}
+	return r.upstream.WriteMessage(msgType, data)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"chromiumproxy/cdptest"
+
+	"github.com/gorilla/websocket"
+)
+
+// relayTest is a client connected through a harness to a fake browser.
+type relayTest struct {
+	t        *testing.T
+	chromium *cdptest.Server
+	harness  *harness
+	client   *websocket.Conn
+	frames   chan cdpMessage
+	ctx      context.Context
+}
+
+func newRelayTest(t *testing.T, cfg proxyConfig, setup func(chromium *cdptest.Server)) *relayTest {
+	t.Helper()
+	chromium := cdptest.NewServer()
+	t.Cleanup(chromium.Close)
+	if setup != nil {
+		setup(chromium)
+	}
+	h, err := startHarness(cfg, chromium, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = h.close() })
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	client, _, err := h.connect(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	rt := &relayTest{t: t, chromium: chromium, harness: h, client: client, frames: make(chan cdpMessage, 100), ctx: ctx}
+	// A read deadline breaks the connection, so frames are read here and
+	// waited for with a timer instead.
+	go func() {
+		defer close(rt.frames)
+		for {
+			var msg cdpMessage
+			if err := client.ReadJSON(&msg); err != nil {
+				return
+			}
+			rt.frames <- msg
+		}
+	}()
+	return rt
+}
+
+func (rt *relayTest) send(id int64, method string, params any) {
+	rt.t.Helper()
+	msg := map[string]any{"id": id, "method": method}
+	if params != nil {
+		msg["params"] = params
+	}
+	if err := rt.client.WriteJSON(msg); err != nil {
+		rt.t.Fatal(err)
+	}
+}
+
+// read returns the next frame the client gets within wait, or false.
+func (rt *relayTest) read(wait time.Duration) (cdpMessage, bool) {
+	select {
+	case msg, ok := <-rt.frames:
+		return msg, ok
+	case <-time.After(wait):
+		return cdpMessage{}, false
+	}
+}
+
+// response reads frames until the response to id.
+func (rt *relayTest) response(id int64) cdpMessage {
+	rt.t.Helper()
+	for {
+		msg, ok := rt.read(5 * time.Second)
+		if !ok {
+			rt.t.Fatalf("no response to %d", id)
+		}
+		if msg.ID != nil && *msg.ID == id {
+			return msg
+		}
+	}
+}
+
+// upstream returns the fake browser's connection for the client.
+func (rt *relayTest) upstream() *cdptest.Conn {
+	rt.t.Helper()
+	if _, err := rt.chromium.WaitFor(rt.ctx, "Target.setAutoAttach"); err != nil {
+		rt.t.Fatal(err)
+	}
+	conns := rt.chromium.Conns()
+	if len(conns) == 0 {
+		rt.t.Fatal("no upstream connection")
+	}
+	return conns[len(conns)-1]
+}
+
+func TestRelayForwardsCommands(t *testing.T) {
+	rt := newRelayTest(t, proxyConfig{}, func(chromium *cdptest.Server) {
+		chromium.Handle("Runtime.evaluate", func(*cdptest.Conn, cdptest.Message) (any, error) {
+			return map[string]any{"result": map[string]any{"type": "number", "value": 2}}, nil
+		})
+	})
+	rt.send(7, "Runtime.evaluate", map[string]any{"expression": "1+1"})
+	resp := rt.response(7)
+	if string(resp.Result) != `{"result":{"type":"number","value":2}}` {
+		t.Fatalf("result = %s", resp.Result)
+	}
+}
+
+func TestRelayHoldsTargetUntilInitialized(t *testing.T) {
+	initialized := make(chan struct{})
+	cfg := proxyConfig{initCommands: []cdpCommand{{Method: "Page.addScriptToEvaluateOnNewDocument", Params: json.RawMessage(`{"source":"1"}`)}}}
+	rt := newRelayTest(t, cfg, func(chromium *cdptest.Server) {
+		chromium.Handle("Page.addScriptToEvaluateOnNewDocument", func(*cdptest.Conn, cdptest.Message) (any, error) {
+			<-initialized
+			return map[string]string{"identifier": "1"}, nil
+		})
+	})
+	rt.send(1, "Target.setAutoAttach", map[string]any{"autoAttach": true, "flatten": true, "waitForDebuggerOnStart": false})
+	rt.response(1)
+
+	upstream := rt.upstream()
+	target := rt.chromium.Targets()[0]
+	if err := upstream.Send("Target.attachedToTarget", map[string]any{
+		"sessionId":  "SESSION-1",
+		"targetInfo": map[string]any{"targetId": target.ID, "type": "page", "url": target.URL},
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+	_ = upstream.Send("Page.frameNavigated", map[string]any{}, "SESSION-1")
+	if msg, ok := rt.read(200 * time.Millisecond); ok {
+		t.Fatalf("client got %s before the target was initialized", msg.Method)
+	}
+
+	close(initialized)
+	// The target is announced first, and the init command's response,
+	// sent with an ID browserd injected, never reaches the client.
+	for _, want := range []string{"Target.attachedToTarget", "Page.frameNavigated"} {
+		msg, ok := rt.read(5 * time.Second)
+		if !ok || msg.Method != want {
+			t.Fatalf("client got %+v, want %s", msg, want)
+		}
+	}
+	if msg, ok := rt.read(200 * time.Millisecond); ok {
+		t.Fatalf("client got unexpected frame %+v", msg)
+	}
+}
+
+func TestRelayResolvesInjectedIDs(t *testing.T) {
+	cfg := proxyConfig{initCommands: []cdpCommand{{Method: "Emulation.setTimezoneOverride", Params: json.RawMessage(`{"timezoneId":"UTC"}`)}}}
+	rt := newRelayTest(t, cfg, nil)
+	rt.send(1, "Target.setAutoAttach", map[string]any{"autoAttach": true, "flatten": true, "waitForDebuggerOnStart": false})
+	rt.response(1)
+
+	upstream := rt.upstream()
+	target := rt.chromium.Targets()[0]
+	_ = upstream.Send("Target.attachedToTarget", map[string]any{
+		"sessionId":  "SESSION-1",
+		"targetInfo": map[string]any{"targetId": target.ID, "type": "page", "url": target.URL},
+	}, "")
+	if msg, ok := rt.read(5 * time.Second); !ok || msg.Method != "Target.attachedToTarget" {
+		t.Fatalf("client got %+v, want Target.attachedToTarget", msg)
+	}
+	injected, err := rt.chromium.WaitFor(rt.ctx, "Emulation.setTimezoneOverride")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if injected.SessionID != "SESSION-1" {
+		t.Fatalf("init command sent on session %q", injected.SessionID)
+	}
+
+	// A client command reusing the injected command's ID still gets its
+	// own response.
+	rt.send(*injected.ID, "Runtime.enable", nil)
+	if resp := rt.response(*injected.ID); len(resp.Error) > 0 {
+		t.Fatalf("error = %s", resp.Error)
+	}
+	if msg, ok := rt.read(200 * time.Millisecond); ok {
+		t.Fatalf("client got unexpected frame %+v", msg)
+	}
+}
+
+func TestRelayStrictIsolationDenies(t *testing.T) {
+	rt := newRelayTest(t, proxyConfig{strictIsolation: true}, nil)
+	if _, err := rt.chromium.WaitFor(rt.ctx, "Target.createBrowserContext"); err != nil {
+		t.Fatal(err)
+	}
+	foreign := rt.chromium.Targets()[0]
+
+	for i, tc := range []struct {
+		method string
+		params any
+	}{
+		{"Browser.close", nil},
+		{"Target.attachToBrowserTarget", nil},
+		{"Storage.clearDataForOrigin", map[string]string{"origin": "https://example.com", "storageTypes": "all"}},
+		{"Target.attachToTarget", map[string]any{"targetId": foreign.ID, "flatten": true}},
+		{"Target.createTarget", map[string]string{"url": "about:blank", "browserContextId": "CONTEXT-OTHER"}},
+	} {
+		id := int64(i + 1)
+		rt.send(id, tc.method, tc.params)
+		resp := rt.response(id)
+		var cerr cdpError
+		if err := json.Unmarshal(resp.Error, &cerr); err != nil || cerr.Code != cdpServerError {
+			t.Errorf("%s: response %s %s, want a %d error", tc.method, resp.Result, resp.Error, cdpServerError)
+		}
+	}
+	for _, msg := range rt.chromium.Received() {
+		switch msg.Method {
+		case "Browser.close", "Target.attachToBrowserTarget", "Storage.clearDataForOrigin", "Target.attachToTarget":
+			t.Errorf("%s reached the browser", msg.Method)
+		}
+	}
+}
+
+func TestRelayReconnectsUpstream(t *testing.T) {
+	rt := newRelayTest(t, proxyConfig{reconnectWindow: 5 * time.Second, reconnectBuffer: 10}, nil)
+	rt.send(1, "Target.setDiscoverTargets", map[string]bool{"discover": true})
+	rt.response(1)
+
+	conns := rt.chromium.Conns()
+	if len(conns) != 1 {
+		t.Fatalf("%d upstream connections, want 1", len(conns))
+	}
+	_ = conns[0].Close(websocket.CloseAbnormalClosure, "")
+
+	// The client stays connected; its setup is replayed on the new
+	// upstream, and commands go there.
+	rt.send(2, "Browser.getVersion", nil)
+	if resp := rt.response(2); len(resp.Error) > 0 {
+		t.Fatalf("error = %s", resp.Error)
+	}
+	conns = rt.chromium.Conns()
+	if len(conns) != 1 {
+		t.Fatalf("%d upstream connections after reconnecting, want 1", len(conns))
+	}
+	discovers := 0
+	for _, msg := range rt.chromium.Received() {
+		if msg.Method == "Target.setDiscoverTargets" {
+			discovers++
+		}
+	}
+	if discovers != 2 {
+		t.Fatalf("Target.setDiscoverTargets sent %d times, want 2", discovers)
+	}
+}
+
+func TestRelayHidesTargets(t *testing.T) {
+	var extension cdptest.Target
+	rt := newRelayTest(t, proxyConfig{hiddenTargets: []string{hiddenExtensionTargets}}, func(chromium *cdptest.Server) {
+		extension = chromium.AddTarget("chrome-extension://abc/background.html")
+	})
+
+	rt.send(1, "Target.getTargets", nil)
+	var result struct {
+		TargetInfos []targetInfoPayload `json:"targetInfos"`
+	}
+	if err := json.Unmarshal(rt.response(1).Result, &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.TargetInfos) != 1 || result.TargetInfos[0].TargetID == extension.ID {
+		t.Fatalf("Target.getTargets listed %+v", result.TargetInfos)
+	}
+
+	rt.send(2, "Target.attachToTarget", map[string]any{"targetId": extension.ID, "flatten": true})
+	if resp := rt.response(2); len(resp.Error) == 0 {
+		t.Fatal("attached to a hidden target")
+	}
+
+	if _, resp, err := rt.harness.connect(rt.ctx, "/devtools/page/"+extension.ID); err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("connecting to a hidden target: %v", err)
+	}
+
+	resp, err := rt.harness.client.Get(rt.harness.url("/json/list"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var list []map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("/json/list has %d targets, want 1", len(list))
+	}
+	if want := "ws://browserd/devtools/page/" + list[0]["id"].(string); list[0]["webSocketDebuggerUrl"] != want {
+		t.Fatalf("webSocketDebuggerUrl = %v, want %s", list[0]["webSocketDebuggerUrl"], want)
+	}
+}
+
+func TestRelayDropsOverRateScreencastFrames(t *testing.T) {
+	rt := newRelayTest(t, proxyConfig{screencast: screencastCap{MaxFPS: 1}}, nil)
+	rt.send(1, "Page.startScreencast", map[string]any{"format": "jpeg"})
+	rt.response(1)
+
+	upstream := rt.chromium.Conns()[0]
+	for n := 1; n <= 3; n++ {
+		if err := upstream.Send("Page.screencastFrame", map[string]any{"data": "", "metadata": map[string]any{}, "sessionId": n}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first frame goes through; the others come too soon and are
+	// acknowledged by browserd instead.
+	msg, ok := rt.read(5 * time.Second)
+	if !ok || msg.Method != "Page.screencastFrame" {
+		t.Fatalf("client got %+v, want a screencast frame", msg)
+	}
+	if msg, ok := rt.read(200 * time.Millisecond); ok {
+		t.Fatalf("client got over-rate frame %+v", msg)
+	}
+	acked := map[string]bool{}
+	for _, received := range rt.chromium.Received() {
+		if received.Method == "Page.screencastFrameAck" {
+			acked[string(received.Params)] = true
+		}
+	}
+	if len(acked) != 2 || !acked[`{"sessionId":2}`] || !acked[`{"sessionId":3}`] {
+		t.Fatalf("acknowledged %v, want frames 2 and 3", acked)
+	}
+}
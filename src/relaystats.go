@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Relay buffers, as the queue label of the relay metrics names them.
+const (
+	// queueHeld holds client-bound frames while a new target is set up.
+	queueHeld = "held"
+	// queueReconnect holds client frames while the upstream is redialed
+	// or the session migrated.
+	queueReconnect = "reconnect"
+)
+
+// relayHighWater is the most a session's relay has had to buffer, for
+// tuning -reconnect-buffer and spotting slow target setup.
+type relayHighWater struct {
+	HeldFrames      int64 `json:"heldFrames"`
+	ReconnectFrames int64 `json:"reconnectFrames"`
+	// QueueWaitMs is the longest a frame waited in either buffer.
+	QueueWaitMs int64 `json:"queueWaitMs"`
+}
+
+func (s *sessionStats) highWater() relayHighWater {
+	return relayHighWater{
+		HeldFrames:      s.maxHeld.Load(),
+		ReconnectFrames: s.maxBuffered.Load(),
+		QueueWaitMs:     time.Duration(s.maxWait.Load()).Milliseconds(),
+	}
+}
+
+// raiseTo sets mark to n if n is higher.
+func raiseTo(mark *atomic.Int64, n int64) {
+	for {
+		current := mark.Load()
+		if n <= current || mark.CompareAndSwap(current, n) {
+			return
+		}
+	}
+}
+
+// queued accounts for a frame entering one of the relay's buffers, which
+// now holds depth frames.
+func (r *relay) queued(queue string, depth int) {
+	if queue == queueHeld {
+		raiseTo(&r.sess.stats.maxHeld, int64(depth))
+	} else {
+		raiseTo(&r.sess.stats.maxBuffered, int64(depth))
+	}
+	if r.onQueue != nil {
+		r.onQueue(queue, 1, 0)
+	}
+}
+
+// dequeued accounts for a frame queued at since leaving its buffer, either
+// written or dropped.
+func (r *relay) dequeued(queue string, since time.Time) {
+	wait := time.Since(since)
+	raiseTo(&r.sess.stats.maxWait, int64(wait))
+	if r.onQueue != nil {
+		r.onQueue(queue, -1, wait)
+	}
+}
+
+// dropQueued forgets the frames still buffered once the relay's pumps
+// have stopped.
+func (r *relay) dropQueued() {
+	r.holdMu.Lock()
+	for _, frame := range r.held {
+		r.dequeued(queueHeld, frame.queued)
+	}
+	r.held = nil
+	r.holdMu.Unlock()
+	if rc := r.reconnect; rc != nil {
+		rc.mu.Lock()
+		for _, frame := range rc.buffered {
+			r.dequeued(queueReconnect, frame.queued)
+		}
+		rc.buffered = nil
+		rc.mu.Unlock()
+	}
+}
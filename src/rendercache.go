@@ -0,0 +1,184 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// renderCacheSuffix marks the files of a disk-backed render cache, so
+// clearing it at startup leaves anything else in the directory alone.
+const renderCacheSuffix = ".render"
+
+// renderCache keeps the responses of the rendering endpoints, such as
+// /api/content, for ttl, so the same page rendered the same way is served
+// without a browser. Entries are evicted least recently used first once
+// they add up to more than maxBytes. Bodies are held in memory, or in dir
+// when it is set.
+type renderCache struct {
+	ttl      time.Duration
+	maxBytes int64
+	dir      string
+	metrics  *metricsRegistry
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+}
+
+type renderCacheEntry struct {
+	key         string
+	contentType string
+	body        []byte
+	size        int64
+	expires     time.Time
+}
+
+// newRenderCache creates a cache, emptying dir of a previous run's entries
+// if it is set.
+func newRenderCache(ttl time.Duration, maxBytes int64, dir string, metrics *metricsRegistry) (*renderCache, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		stale, _ := filepath.Glob(filepath.Join(dir, "*"+renderCacheSuffix))
+		for _, path := range stale {
+			_ = os.Remove(path)
+		}
+	}
+	metrics.register("browserd_render_cache_requests_total", metricCounter, "Rendering API requests looked up in the render cache, by endpoint and result (hit or miss).")
+	metrics.register("browserd_render_cache_bytes", metricGauge, "Size of the responses held in the render cache.")
+	metrics.register("browserd_render_cache_evictions_total", metricCounter, "Render cache entries evicted to stay under -render-cache-size.")
+	return &renderCache{
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		dir:      dir,
+		metrics:  metrics,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}, nil
+}
+
+// renderCacheKey identifies a rendering by endpoint and request. The
+// request must already be normalized, with fields that don't change the
+// result, such as the timeout, cleared.
+func renderCacheKey(endpoint string, req any) string {
+	data, _ := json.Marshal(req)
+	sum := sha256.Sum256(append([]byte(endpoint+"\n"), data...))
+	return hex.EncodeToString(sum[:])
+}
+
+// lookup returns a cached response, counting the hit or miss. A client
+// sending Cache-Control: no-cache always misses, though what it renders is
+// still cached.
+func (c *renderCache) lookup(r *http.Request, endpoint, key string) (contentType string, body []byte, ok bool) {
+	result := "miss"
+	defer func() {
+		c.metrics.add("browserd_render_cache_requests_total", map[string]string{"endpoint": endpoint, "result": result}, 1)
+	}()
+	if strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+		return "", nil, false
+	}
+
+	c.mu.Lock()
+	el := c.entries[key]
+	if el == nil {
+		c.mu.Unlock()
+		return "", nil, false
+	}
+	entry := el.Value.(*renderCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.removeLocked(el)
+		c.mu.Unlock()
+		return "", nil, false
+	}
+	c.lru.MoveToFront(el)
+	contentType, body = entry.contentType, entry.body
+	c.mu.Unlock()
+
+	if c.dir != "" {
+		var err error
+		if body, err = os.ReadFile(c.path(key)); err != nil {
+			slog.Warn("failed to read render cache entry", "key", key, "error", err)
+			c.mu.Lock()
+			if el := c.entries[key]; el != nil {
+				c.removeLocked(el)
+			}
+			c.mu.Unlock()
+			return "", nil, false
+		}
+	}
+	result = "hit"
+	return contentType, body, true
+}
+
+// store caches a response, unless it alone is larger than the cache.
+func (c *renderCache) store(key, contentType string, body []byte) {
+	size := int64(len(body))
+	if size > c.maxBytes {
+		return
+	}
+	entry := &renderCacheEntry{key: key, contentType: contentType, size: size, expires: time.Now().Add(c.ttl)}
+	if c.dir != "" {
+		tmp, err := os.CreateTemp(c.dir, "tmp-")
+		if err == nil {
+			_, err = tmp.Write(body)
+			if closeErr := tmp.Close(); err == nil {
+				err = closeErr
+			}
+			if err == nil {
+				err = os.Rename(tmp.Name(), c.path(key))
+			}
+			if err != nil {
+				_ = os.Remove(tmp.Name())
+			}
+		}
+		if err != nil {
+			slog.Warn("failed to write render cache entry", "key", key, "error", err)
+			return
+		}
+	} else {
+		entry.body = body
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el := c.entries[key]; el != nil {
+		// Replaced on disk already; only the accounting goes.
+		old := el.Value.(*renderCacheEntry)
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		c.size -= old.size
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += size
+	for c.size > c.maxBytes {
+		c.removeLocked(c.lru.Back())
+		c.metrics.add("browserd_render_cache_evictions_total", nil, 1)
+	}
+	c.metrics.set("browserd_render_cache_bytes", nil, float64(c.size))
+}
+
+func (c *renderCache) removeLocked(el *list.Element) {
+	entry := el.Value.(*renderCacheEntry)
+	c.lru.Remove(el)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+	if c.dir != "" {
+		_ = os.Remove(c.path(entry.key))
+	}
+	c.metrics.set("browserd_render_cache_bytes", nil, float64(c.size))
+}
+
+func (c *renderCache) path(key string) string {
+	return filepath.Join(c.dir, key+renderCacheSuffix)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// limitRequest caps the body of requests to h at -max-request-size. One
+// declaring a larger Content-Length is refused before it is read; one that
+// turns out larger fails to read, which the handler answers with
+// writeBodyError.
+func (p *proxyServer) limitRequest(h http.HandlerFunc) http.HandlerFunc {
+	if p.maxRequest <= 0 {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > p.maxRequest {
+			p.refuseOversized(w, p.maxRequest)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, p.maxRequest)
+		h(w, r)
+	}
+}
+
+// writeBodyError answers a request whose body couldn't be decoded: 413 if
+// it was over its limit, 400 otherwise.
+func (p *proxyServer) writeBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		p.refuseOversized(w, tooLarge.Limit)
+		return
+	}
+	writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+}
+
+func (p *proxyServer) refuseOversized(w http.ResponseWriter, limit int64) {
+	p.metrics.add("browserd_oversized_requests_total", nil, 1)
+	writeErrorCode(w, http.StatusRequestEntityTooLarge, "", fmt.Sprintf("request body exceeds %d bytes", limit), map[string]any{"limitBytes": limit})
+}
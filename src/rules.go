@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Actions an interception rule can take.
+const (
+	ruleBlock    = "block"
+	ruleRedirect = "redirect"
+	ruleHeaders  = "headers"
+	ruleFulfill  = "fulfill"
+)
+
+// interceptRule is one entry of the -intercept-rules file. The first rule
+// whose match fields all apply decides the request.
+type interceptRule struct {
+	Match struct {
+		URL          string `json:"url"`
+		ResourceType string `json:"resourceType,omitempty"`
+		Method       string `json:"method,omitempty"`
+	} `json:"match"`
+	Action string `json:"action"`
+
+	// redirect
+	Location string `json:"location,omitempty"`
+
+	// headers
+	SetHeaders    map[string]string `json:"setHeaders,omitempty"`
+	RemoveHeaders []string          `json:"removeHeaders,omitempty"`
+
+	// fulfill
+	Status      int               `json:"status,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Body        string            `json:"body,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+type headerEntry struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func loadInterceptRules(path string) ([]interceptRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []interceptRule
+	if err := unmarshalConfig(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i, rule := range rules {
+		if rule.Match.URL == "" {
+			return nil, fmt.Errorf("parse %s: rule %d has no match.url", path, i)
+		}
+		switch rule.Action {
+		case ruleBlock, ruleHeaders, ruleFulfill:
+		case ruleRedirect:
+			if rule.Location == "" {
+				return nil, fmt.Errorf("parse %s: redirect rule %d has no location", path, i)
+			}
+		default:
+			return nil, fmt.Errorf("parse %s: rule %d has unknown action %q", path, i, rule.Action)
+		}
+	}
+	return rules, nil
+}
+
+func (rule *interceptRule) matches(req *pausedRequest) bool {
+	if rule.Match.ResourceType != "" && !strings.EqualFold(rule.Match.ResourceType, req.ResourceType) {
+		return false
+	}
+	if rule.Match.Method != "" && !strings.EqualFold(rule.Match.Method, req.Request.Method) {
+		return false
+	}
+	return wildcardMatch(rule.Match.URL, req.Request.URL)
+}
+
+func (rule *interceptRule) decide(req *pausedRequest) *fetchDecision {
+	switch rule.Action {
+	case ruleBlock:
+		return failRequest("BlockedByClient")
+
+	case ruleRedirect:
+		return &fetchDecision{method: "Fetch.fulfillRequest", params: map[string]any{
+			"responseCode":    http.StatusFound,
+			"responseHeaders": []headerEntry{{Name: "Location", Value: rule.Location}},
+		}}
+
+	case ruleHeaders:
+		headers := make(map[string]string, len(req.Request.Headers))
+		for name, value := range req.Request.Headers {
+			headers[http.CanonicalHeaderKey(name)] = value
+		}
+		for _, name := range rule.RemoveHeaders {
+			delete(headers, http.CanonicalHeaderKey(name))
+		}
+		for name, value := range rule.SetHeaders {
+			headers[http.CanonicalHeaderKey(name)] = value
+		}
+		entries := make([]headerEntry, 0, len(headers))
+		for name, value := range headers {
+			entries = append(entries, headerEntry{Name: name, Value: value})
+		}
+		return &fetchDecision{method: "Fetch.continueRequest", params: map[string]any{"headers": entries}}
+
+	default: // ruleFulfill
+		status := rule.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		entries := make([]headerEntry, 0, len(rule.Headers)+1)
+		if rule.ContentType != "" {
+			entries = append(entries, headerEntry{Name: "Content-Type", Value: rule.ContentType})
+		}
+		for name, value := range rule.Headers {
+			entries = append(entries, headerEntry{Name: name, Value: value})
+		}
+		return &fetchDecision{method: "Fetch.fulfillRequest", params: map[string]any{
+			"responseCode":    status,
+			"responseHeaders": entries,
+			"body":            base64.StdEncoding.EncodeToString([]byte(rule.Body)),
+		}}
+	}
+}
+
+// interceptPolicy applies the first matching rule.
+func interceptPolicy(rules []interceptRule) requestPolicy {
+	return func(req *pausedRequest) *fetchDecision {
+		for i := range rules {
+			if rules[i].matches(req) {
+				return rules[i].decide(req)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptySHA256 is the hex SHA-256 of an empty payload.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Store keeps artifacts in an S3-compatible bucket: AWS S3, MinIO and
+// the like, or Google Cloud Storage through its XML API with HMAC keys.
+// Requests are signed with AWS Signature Version 4.
+type s3Store struct {
+	client *http.Client
+	// endpoint is the scheme and host requests go to. With pathStyle the
+	// bucket is the first path segment, otherwise a subdomain.
+	endpoint  *url.URL
+	pathStyle bool
+	bucket    string
+	prefix    string
+	region    string
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// newS3Store configures a store from s3://bucket/prefix, with ?region=
+// and ?endpoint= for other S3-compatible services, or gs://bucket/prefix.
+// Credentials come from ARTIFACT_ACCESS_KEY_ID and
+// ARTIFACT_SECRET_ACCESS_KEY, or AWS's variables.
+func newS3Store(u *url.URL) (*s3Store, error) {
+	s := &s3Store{
+		client:       &http.Client{},
+		bucket:       u.Host,
+		prefix:       strings.Trim(u.Path, "/"),
+		region:       firstNonEmpty(u.Query().Get("region"), os.Getenv("AWS_REGION"), "us-east-1"),
+		accessKey:    firstNonEmpty(os.Getenv("ARTIFACT_ACCESS_KEY_ID"), os.Getenv("AWS_ACCESS_KEY_ID")),
+		secretKey:    firstNonEmpty(os.Getenv("ARTIFACT_SECRET_ACCESS_KEY"), os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.bucket == "" {
+		return nil, errors.New("missing bucket")
+	}
+	if s.prefix != "" {
+		s.prefix += "/"
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("ARTIFACT_ACCESS_KEY_ID and ARTIFACT_SECRET_ACCESS_KEY must be set")
+	}
+
+	endpoint := u.Query().Get("endpoint")
+	switch {
+	case u.Scheme == "gs":
+		endpoint, s.region, s.pathStyle = "https://storage.googleapis.com", "auto", true
+	case endpoint != "":
+		s.pathStyle = true
+	default:
+		endpoint = "https://s3." + s.region + ".amazonaws.com"
+		// Bucket names with dots don't match the wildcard certificate.
+		s.pathStyle = strings.Contains(s.bucket, ".")
+	}
+	var err error
+	if s.endpoint, err = url.Parse(endpoint); err != nil || s.endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+	return s, nil
+}
+
+func (s *s3Store) String() string {
+	if s.endpoint.Host == "storage.googleapis.com" {
+		return "gs://" + s.bucket + "/" + s.prefix
+	}
+	return "s3://" + s.bucket + "/" + s.prefix
+}
+
+func (s *s3Store) put(ctx context.Context, key string, body io.ReadSeeker, contentType string) error {
+	resp, err := s.do(ctx, http.MethodPut, s.prefix+key, nil, body, contentType)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Store) get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.prefix+key, nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Store) remove(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.prefix+key, nil, nil, "")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// list pages through ListObjectsV2.
+func (s *s3Store) list(ctx context.Context, prefix string) ([]artifactObject, error) {
+	var objects []artifactObject
+	query := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+	for {
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, "")
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %w", prefix, err)
+		}
+		for _, c := range result.Contents {
+			objects = append(objects, artifactObject{Key: strings.TrimPrefix(c.Key, s.prefix), Size: c.Size, Modified: c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// do sends a signed request for key, or for the bucket when key is empty.
+// A response other than 2xx is returned as an error, os.ErrNotExist for
+// 404.
+func (s *s3Store) do(ctx context.Context, method, key string, query url.Values, body io.ReadSeeker, contentType string) (*http.Response, error) {
+	payloadHash, size := emptySHA256, int64(0)
+	if body != nil {
+		h := sha256.New()
+		n, err := io.Copy(h, body)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		payloadHash, size = hex.EncodeToString(h.Sum(nil)), n
+	}
+
+	u := *s.endpoint
+	path := "/" + key
+	if s.pathStyle {
+		path = "/" + s.bucket + path
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	u.Path, u.RawPath = path, s3Escape(path, true)
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil && size > 0 {
+		req.Body, req.ContentLength = io.NopCloser(body), size
+	} else if method == http.MethodPut {
+		req.Body = http.NoBody
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && key != "" {
+		return nil, os.ErrNotExist
+	}
+	var s3err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	_ = xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&s3err)
+	return nil, fmt.Errorf("%s %s: %s %s %s", method, key, resp.Status, s3err.Code, s3err.Message)
+}
+
+// sign adds a Signature Version 4 Authorization header to req.
+func (s *s3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	digest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but unreserved characters, and
+// slashes too unless path is set, as Signature Version 4 requires.
+func s3Escape(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || (path && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query is the canonical query string of query, sorted by name.
+func s3Query(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			parts = append(parts, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
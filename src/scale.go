@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+)
+
+// pressureInterval is how often browserd_scale_pressure is recomputed and,
+// when there is a memory budget, the supervised browser's RSS sampled.
+const pressureInterval = 5 * time.Second
+
+// scaleReport is the /scale answer. Pressure is the highest of the
+// components: 1 means this replica is at its capacity, more than 1 that
+// it is turning clients away or about to.
+type scaleReport struct {
+	Pressure       float64            `json:"pressure"`
+	Components     map[string]float64 `json:"components"`
+	ActiveSessions int                `json:"activeSessions"`
+	QueuedSessions int64              `json:"queuedSessions"`
+	Draining       bool               `json:"draining,omitempty"`
+}
+
+// sessionCapacity is the session count at which this replica is full:
+// -max-sessions, or -scale-target-sessions without one.
+func (p *proxyServer) sessionCapacity() int {
+	if p.maxSessions > 0 {
+		return p.maxSessions
+	}
+	return p.scaleTarget
+}
+
+// memoryBudget is the supervised browser's RSS at which this replica is
+// full: its -chromium-memory-limit, or -recycle-max-rss without one.
+func (p *proxyServer) memoryBudget() int64 {
+	if p.supervisor == nil {
+		return 0
+	}
+	if p.supervisor.limits.memoryBytes > 0 {
+		return p.supervisor.limits.memoryBytes
+	}
+	return p.recycle.maxRSS
+}
+
+// scalePressure gathers the utilization of every limit this replica has.
+// Sessions waiting in the admission queue or on their upstream dial count
+// as queued and toward the session component. Each named pool with a
+// session capacity is a component of its own.
+func (p *proxyServer) scalePressure() scaleReport {
+	active := len(p.sessions.list())
+	queued := p.dialing.Load() + int64(p.admission.waiting())
+	report := scaleReport{
+		Components:     make(map[string]float64),
+		ActiveSessions: len(p.allSessions()),
+		QueuedSessions: queued,
+		Draining:       p.draining.Load(),
+	}
+	if capacity := p.sessionCapacity(); capacity > 0 {
+		report.Components["sessions"] = float64(int64(active)+queued) / float64(capacity)
+	}
+	if p.apiSlots != nil {
+		report.Components["apiRequests"] = float64(len(p.apiSlots)) / float64(cap(p.apiSlots))
+	}
+	if p.pool != nil && p.pool.size > 0 {
+		ready, _, _ := p.pool.counts()
+		report.Components["warmPool"] = 1 - float64(min(ready, p.pool.size))/float64(p.pool.size)
+	}
+	if budget := p.memoryBudget(); budget > 0 {
+		report.Components["memory"] = float64(p.browserRSS.Load()) / float64(budget)
+	}
+	for name, pool := range p.namedPools {
+		if capacity := pool.sessionCapacity(); capacity > 0 {
+			queued := pool.dialing.Load() + int64(pool.admission.waiting())
+			report.Components["pool:"+name] = float64(int64(len(pool.sessions.list()))+queued) / float64(capacity)
+		}
+	}
+	for _, value := range report.Components {
+		report.Pressure = max(report.Pressure, value)
+	}
+	report.Pressure = math.Round(report.Pressure*1000) / 1000
+	return report
+}
+
+// handleScale serves /scale for a Kubernetes HPA external metric or a
+// KEDA metrics-api scaler.
+func (p *proxyServer) handleScale(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, p.scalePressure())
+}
+
+// trackPressure keeps browserd_scale_pressure current until ctx ends.
+func (p *proxyServer) trackPressure(ctx context.Context) {
+	ticker := time.NewTicker(pressureInterval)
+	defer ticker.Stop()
+	for {
+		if p.memoryBudget() > 0 {
+			if pid, _, _ := p.supervisor.usage(); pid != 0 {
+				if rss, err := processTreeRSS(pid); err == nil {
+					p.browserRSS.Store(rss)
+				} else {
+					slog.Warn("failed to read chromium rss", "error", err)
+				}
+			}
+		}
+		p.metrics.set("browserd_scale_pressure", nil, p.scalePressure().Pressure)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
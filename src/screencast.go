@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// screencastFrame is the payload of Page.screencastFrame.
+type screencastFrame struct {
+	Data      string `json:"data"`
+	SessionID int    `json:"sessionId"`
+}
+
+// handleScreencast streams a session's page to an observer, as binary JPEG
+// WebSocket messages or, for plain HTTP requests, as an MJPEG stream. The
+// observer gets its own CDP connection and never sees the session's
+// traffic.
+func (p *proxyServer) handleScreencast(w http.ResponseWriter, r *http.Request) {
+	if !p.authorize(r) {
+		p.refuseUnauthorized(w, r)
+		return
+	}
+	sess := p.clientSession(w, r)
+	if sess == nil {
+		return
+	}
+
+	query := r.URL.Query()
+	targetID, err := sess.resolveTarget(query.Get("target"))
+	if err != nil {
+		writeError(w, targetErrorStatus(err), err.Error())
+		return
+	}
+
+	params := map[string]any{"format": "jpeg", "quality": 60}
+	for _, name := range []string{"quality", "maxWidth", "maxHeight", "everyNthFrame"} {
+		raw := query.Get(name)
+		if raw == "" {
+			continue
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || (name == "quality" && n > 100) {
+			writeError(w, http.StatusBadRequest, "invalid "+name)
+			return
+		}
+		params[name] = n
+	}
+	// Observers share the session's link budget.
+	sess.screencast.apply(params)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	dialCtx, dialCancel := context.WithTimeout(ctx, requestTimeout)
+	client, err := p.dialCDP(dialCtx, sess)
+	dialCancel()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "upstream unavailable")
+		return
+	}
+	defer client.close()
+
+	cdpSession, err := p.startScreencast(ctx, client, targetID, params)
+	if err != nil {
+		sess.log.Warn("screencast failed to start", "error", err)
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	defer func() {
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), time.Second)
+		defer stopCancel()
+		_, _ = client.call(stopCtx, cdpSession, "Page.stopScreencast", nil)
+	}()
+
+	var emit func([]byte) error
+	if websocket.IsWebSocketUpgrade(r) {
+		conn, err := p.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			sess.log.Warn("failed to upgrade screencast connection", "error", err)
+			return
+		}
+		defer conn.Close()
+		go func() {
+			// Observers only watch; reading just detects them leaving.
+			defer cancel()
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		emit = func(frame []byte) error {
+			return conn.WriteMessage(websocket.BinaryMessage, frame)
+		}
+	} else {
+		flusher, _ := w.(http.Flusher)
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=frame")
+		w.Header().Set("Cache-Control", "no-store")
+		emit = func(frame []byte) error {
+			if _, err := fmt.Fprintf(w, "--frame\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", len(frame)); err != nil {
+				return err
+			}
+			if _, err := w.Write(append(frame, '\r', '\n')); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		}
+	}
+
+	sess.log.Info("observer watching session", "event", "observer_started", "observer_ip", clientIP(r.RemoteAddr), "target", targetID)
+	sess.logf("observer %s watching target %s", r.RemoteAddr, targetID)
+	go func() {
+		select {
+		case <-sess.ended:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	streamScreencast(ctx, client, cdpSession, sess.screencast.interval(), emit)
+	sess.log.Info("observer stopped watching session", "event", "observer_stopped", "observer_ip", clientIP(r.RemoteAddr))
+}
+
+// startScreencast attaches to the target, unless the debugger URL already
+// is a page, and starts the screencast. It returns the CDP session to use.
+func (p *proxyServer) startScreencast(ctx context.Context, client *cdpClient, targetID string, params map[string]any) (string, error) {
+	callCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	cdpSession := ""
+	if !strings.Contains(p.getDebuggerURL(), "/devtools/page/") {
+		var err error
+		if cdpSession, err = client.attach(callCtx, targetID); err != nil {
+			return "", err
+		}
+	}
+	if _, err := client.call(callCtx, cdpSession, "Page.startScreencast", params); err != nil {
+		return "", err
+	}
+	return cdpSession, nil
+}
+
+// streamScreencast emits decoded frames until the observer leaves, the
+// target goes away or the session ends. Acks are spaced at least interval
+// apart, which paces Chromium's frames.
+func streamScreencast(ctx context.Context, client *cdpClient, cdpSession string, interval time.Duration, emit func([]byte) error) {
+	var due time.Time
+	for {
+		ev, err := client.next(ctx)
+		if err != nil {
+			return
+		}
+		if ev.Method == "Target.detachedFromTarget" && cdpSession != "" {
+			var params struct {
+				SessionID string `json:"sessionId"`
+			}
+			if json.Unmarshal(ev.Params, &params) == nil && params.SessionID == cdpSession {
+				return
+			}
+		}
+		if ev.SessionID != cdpSession {
+			continue
+		}
+
+		switch ev.Method {
+		case "Page.screencastFrame":
+			var frame screencastFrame
+			if err := json.Unmarshal(ev.Params, &frame); err != nil {
+				continue
+			}
+			// Ack right away, or once interval has passed, so Chromium
+			// keeps sending frames.
+			wait := time.Until(due)
+			due = time.Now().Add(max(wait, 0) + interval)
+			go func() {
+				if wait > 0 {
+					select {
+					case <-time.After(wait):
+					case <-ctx.Done():
+						return
+					}
+				}
+				ackCtx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+				defer cancel()
+				_, _ = client.call(ackCtx, cdpSession, "Page.screencastFrameAck", map[string]any{"sessionId": frame.SessionID})
+			}()
+			data, err := base64.StdEncoding.DecodeString(frame.Data)
+			if err != nil {
+				continue
+			}
+			if err := emit(data); err != nil {
+				return
+			}
+		case "Inspector.detached", "Inspector.targetCrashed":
+			return
+		}
+	}
+}
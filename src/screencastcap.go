@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// screencastCap bounds the screencasts a session starts, since uncapped
+// ones regularly saturate the links between browserd and its clients.
+// Zero fields are unbounded.
+type screencastCap struct {
+	// MaxFPS paces the Page.screencastFrame events written to the client.
+	MaxFPS int `json:"maxFps,omitempty"`
+	// MaxQuality caps the JPEG quality, and turns PNG screencasts into
+	// JPEG ones.
+	MaxQuality int `json:"maxQuality,omitempty"`
+	// MaxWidth and MaxHeight cap the frame size.
+	MaxWidth  int `json:"maxWidth,omitempty"`
+	MaxHeight int `json:"maxHeight,omitempty"`
+}
+
+func (c screencastCap) enabled() bool {
+	return c != screencastCap{}
+}
+
+// interval is the least time between two frames, or 0.
+func (c screencastCap) interval() time.Duration {
+	if c.MaxFPS <= 0 {
+		return 0
+	}
+	return time.Second / time.Duration(c.MaxFPS)
+}
+
+// parseScreencastSize parses a WIDTHxHEIGHT size such as 1280x720.
+func parseScreencastSize(raw string) (width, height int, err error) {
+	w, h, ok := strings.Cut(raw, "x")
+	if ok {
+		width, err = strconv.Atoi(w)
+		if err == nil {
+			height, err = strconv.Atoi(h)
+		}
+	}
+	if !ok || err != nil || width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("%q is not a WIDTHxHEIGHT size", raw)
+	}
+	return width, height, nil
+}
+
+// parseScreencastCap reads the session's own cap from ?screencast-fps=,
+// ?screencast-quality= and ?screencast-size=. A client may only tighten
+// the fallback, the -screencast-max-* flags; looser values are clamped.
+func parseScreencastCap(query url.Values, fallback screencastCap) (screencastCap, error) {
+	c := fallback
+	for _, name := range []string{"screencast-fps", "screencast-quality"} {
+		raw := query.Get(name)
+		if raw == "" {
+			continue
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || (name == "screencast-quality" && n > 100) {
+			return c, fmt.Errorf("invalid %s %q", name, raw)
+		}
+		if name == "screencast-fps" {
+			c.MaxFPS = tighter(c.MaxFPS, n)
+		} else {
+			c.MaxQuality = tighter(c.MaxQuality, n)
+		}
+	}
+	if raw := query.Get("screencast-size"); raw != "" {
+		width, height, err := parseScreencastSize(raw)
+		if err != nil {
+			return c, fmt.Errorf("invalid screencast-size: %w", err)
+		}
+		c.MaxWidth, c.MaxHeight = tighter(c.MaxWidth, width), tighter(c.MaxHeight, height)
+	}
+	return c, nil
+}
+
+// tighter is the smaller of two limits, where 0 is unbounded.
+func tighter(limit, n int) int {
+	if limit == 0 || n < limit {
+		return n
+	}
+	return limit
+}
+
+// apply clamps Page.startScreencast params to the cap, reporting whether
+// any changed. Bounds the client left out are filled in.
+func (c screencastCap) apply(params map[string]any) bool {
+	changed := false
+	clamp := func(name string, limit int) {
+		if limit <= 0 {
+			return
+		}
+		if n, ok := params[name].(float64); ok && n > 0 && n <= float64(limit) {
+			return
+		}
+		if n, ok := params[name].(int); ok && n > 0 && n <= limit {
+			return
+		}
+		params[name] = limit
+		changed = true
+	}
+	if c.MaxQuality > 0 {
+		if format, _ := params["format"].(string); format != "jpeg" {
+			// PNG ignores quality.
+			params["format"] = "jpeg"
+			changed = true
+		}
+	}
+	clamp("quality", c.MaxQuality)
+	clamp("maxWidth", c.MaxWidth)
+	clamp("maxHeight", c.MaxHeight)
+	return changed
+}
+
+// mentionsScreencast is a cheap pre-check for capScreencast.
+func mentionsScreencast(data []byte) bool {
+	return bytes.Contains(data, []byte(`"Page.startScreencast"`))
+}
+
+// mentionsScreencastFrame is a cheap pre-check for paceScreencast.
+func mentionsScreencastFrame(data []byte) bool {
+	return bytes.Contains(data, []byte(`"Page.screencastFrame"`))
+}
+
+// capScreencast rewrites a Page.startScreencast command to stay within the
+// session's cap.
+func (r *relay) capScreencast(msg *cdpMessage) bool {
+	if msg.Method != "Page.startScreencast" {
+		return false
+	}
+	params := make(map[string]any)
+	if len(msg.Params) > 0 {
+		if err := json.Unmarshal(msg.Params, &params); err != nil || params == nil {
+			return false
+		}
+	}
+	if !r.screencast.apply(params) {
+		return false
+	}
+	msg.Params, _ = json.Marshal(params)
+	if r.onScreencastCapped != nil {
+		r.onScreencastCapped("command")
+	}
+	return true
+}
+
+// paceScreencast reports whether a Page.screencastFrame comes before its
+// page's next frame is due, so the client gets at most MaxFPS frames a
+// second from each page. Such a frame is dropped and acknowledged on the
+// client's behalf, so Chromium goes on to send the next. Only pumpUpstream
+// calls it.
+func (r *relay) paceScreencast(msg *cdpMessage) bool {
+	now := time.Now()
+	if due := r.frameDue[msg.SessionID]; !due.After(now) {
+		r.frameDue[msg.SessionID] = now.Add(r.screencast.interval())
+		return false
+	}
+	var frame struct {
+		SessionID int `json:"sessionId"`
+	}
+	if err := json.Unmarshal(msg.Params, &frame); err != nil {
+		return false
+	}
+	go r.send(msg.SessionID, "Page.screencastFrameAck", map[string]any{"sessionId": frame.SessionID})
+	if r.onScreencastCapped != nil {
+		r.onScreencastCapped("frame")
+	}
+	return true
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// headerPolicy is the security headers browserd adds to its HTTP
+// responses, now that people reach the DevTools frontend and the admin
+// endpoints from a browser.
+type headerPolicy struct {
+	// enabled sets X-Content-Type-Options, Referrer-Policy and a
+	// Content-Security-Policy of frameAncestors on every response.
+	enabled        bool
+	frameAncestors string
+	// hstsMaxAge, when positive, sends Strict-Transport-Security on
+	// responses served over TLS.
+	hstsMaxAge time.Duration
+	// hideServer drops headers naming the software behind browserd from
+	// proxied responses, and browserd's name from the admin realm.
+	hideServer bool
+}
+
+// validate checks frameAncestors is a list of CSP sources that can't
+// smuggle in other directives.
+func (h headerPolicy) validate() error {
+	if !h.enabled {
+		return nil
+	}
+	if strings.TrimSpace(h.frameAncestors) == "" || strings.ContainsAny(h.frameAncestors, ";,\r\n") {
+		return errors.New("must be a space-separated list of CSP sources, such as 'self' or 'none'")
+	}
+	return nil
+}
+
+// identifyingHeaders name the server or framework that produced a
+// response.
+var identifyingHeaders = []string{"Server", "Via", "X-Powered-By"}
+
+// secure adds the policy's headers to every response of h. Handlers that
+// take over the connection for a WebSocket write their own handshake
+// response, so the headers only reach plain HTTP responses.
+func (h headerPolicy) secure(next http.Handler) http.Handler {
+	if !h.enabled && h.hstsMaxAge <= 0 {
+		return next
+	}
+	csp := "frame-ancestors " + h.frameAncestors
+	hsts := "max-age=" + strconv.FormatInt(int64(h.hstsMaxAge/time.Second), 10)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		if h.enabled {
+			header.Set("X-Content-Type-Options", "nosniff")
+			header.Set("Referrer-Policy", "no-referrer")
+			header.Set("Content-Security-Policy", csp)
+		}
+		if h.hstsMaxAge > 0 && r.TLS != nil {
+			header.Set("Strict-Transport-Security", hsts)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// stripIdentity removes identifyingHeaders from a proxied response when
+// the policy hides the server.
+func (h headerPolicy) stripIdentity(header http.Header) {
+	if !h.hideServer {
+		return
+	}
+	for _, name := range identifyingHeaders {
+		header.Del(name)
+	}
+}
+
+// adminRealm is the Basic authentication realm of the admin endpoints.
+func (h headerPolicy) adminRealm() string {
+	if h.hideServer {
+		return `Basic realm="admin"`
+	}
+	return `Basic realm="browserd admin"`
+}
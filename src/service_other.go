@@ -0,0 +1,22 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+var errNotWindows = errors.New("Windows services are only available on Windows")
+
+func runWindowsService(context.Context, func(context.Context) error) error {
+	return errNotWindows
+}
+
+func installService([]string) error {
+	return errNotWindows
+}
+
+func uninstallService() error {
+	return errNotWindows
+}
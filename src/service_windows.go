@@ -0,0 +1,250 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// The service control manager API, called through advapi32 directly.
+var (
+	advapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procStartServiceCtrlDispatcher = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandler = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus           = advapi32.NewProc("SetServiceStatus")
+	procOpenSCManager              = advapi32.NewProc("OpenSCManagerW")
+	procCreateService              = advapi32.NewProc("CreateServiceW")
+	procOpenService                = advapi32.NewProc("OpenServiceW")
+	procControlService             = advapi32.NewProc("ControlService")
+	procDeleteService              = advapi32.NewProc("DeleteService")
+	procCloseServiceHandle         = advapi32.NewProc("CloseServiceHandle")
+)
+
+// The name browserd is installed as.
+const (
+	serviceName        = "browserd"
+	serviceDisplayName = "browserd Chromium proxy"
+)
+
+const (
+	serviceWin32OwnProcess = 0x10
+	serviceAutoStart       = 2
+	serviceErrorNormal     = 1
+
+	serviceStopped      = 1
+	serviceStartPending = 2
+	serviceStopPending  = 3
+	serviceRunning      = 4
+
+	serviceAcceptStop     = 0x1
+	serviceAcceptShutdown = 0x4
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+
+	scManagerAllAccess = 0xF003F
+	serviceAllAccess   = 0xF01FF
+	serviceStop        = 0x20
+	serviceDelete      = 0x10000
+
+	errorCallNotImplemented   = 120
+	errorServiceSpecificError = 1066
+	errorServiceNotActive     = syscall.Errno(1062)
+
+	// serviceStopWait is the stop time reported to the service control
+	// manager, covering the HTTP server's shutdown.
+	serviceStopWait = 10000
+)
+
+// serviceStatus is SERVICE_STATUS.
+type serviceStatus struct {
+	serviceType             uint32
+	currentState            uint32
+	controlsAccepted        uint32
+	win32ExitCode           uint32
+	serviceSpecificExitCode uint32
+	checkPoint              uint32
+	waitHint                uint32
+}
+
+// serviceTableEntry is SERVICE_TABLE_ENTRYW.
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// winService is the service runWindowsService runs.
+type winService struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	start  func(context.Context) error
+	err    error
+
+	mu     sync.Mutex
+	handle uintptr
+	status serviceStatus
+}
+
+// currentService is found by serviceMain and serviceHandler, which the
+// service control manager calls on threads of its own.
+var currentService = &winService{}
+
+// runWindowsService serves as a service started by the service control
+// manager, which stops it with SERVICE_CONTROL_STOP or, at system
+// shutdown, SERVICE_CONTROL_SHUTDOWN. Either ends ctx.
+func runWindowsService(ctx context.Context, start func(context.Context) error) error {
+	svc := currentService
+	svc.ctx, svc.cancel = context.WithCancel(ctx)
+	defer svc.cancel()
+	svc.start = start
+
+	name, err := syscall.UTF16PtrFromString(serviceName)
+	if err != nil {
+		return err
+	}
+	table := []serviceTableEntry{{name: name, proc: syscall.NewCallback(serviceMain)}, {}}
+	if r, _, err := procStartServiceCtrlDispatcher.Call(uintptr(unsafe.Pointer(&table[0]))); r == 0 {
+		return fmt.Errorf("connect to the service control manager: %w", err)
+	}
+	return svc.err
+}
+
+func serviceMain(_, _ uintptr) uintptr {
+	svc := currentService
+	name, _ := syscall.UTF16PtrFromString(serviceName)
+	handle, _, err := procRegisterServiceCtrlHandler.Call(uintptr(unsafe.Pointer(name)), syscall.NewCallback(serviceHandler), 0)
+	if handle == 0 {
+		svc.err = fmt.Errorf("register service control handler: %w", err)
+		return 0
+	}
+	svc.mu.Lock()
+	svc.handle = handle
+	svc.status.serviceType = serviceWin32OwnProcess
+	svc.mu.Unlock()
+
+	svc.setState(serviceStartPending, 0, 0)
+	svc.setState(serviceRunning, serviceAcceptStop|serviceAcceptShutdown, 0)
+	err = svc.start(svc.ctx)
+	svc.mu.Lock()
+	svc.err = err
+	if err != nil {
+		svc.status.win32ExitCode, svc.status.serviceSpecificExitCode = errorServiceSpecificError, 1
+	}
+	svc.mu.Unlock()
+	svc.setState(serviceStopped, 0, 0)
+	return 0
+}
+
+func serviceHandler(control, _, _, _ uintptr) uintptr {
+	svc := currentService
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		svc.setState(serviceStopPending, 0, serviceStopWait)
+		svc.cancel()
+	case serviceControlInterrogate:
+		svc.mu.Lock()
+		svc.reportLocked()
+		svc.mu.Unlock()
+	default:
+		return errorCallNotImplemented
+	}
+	return 0
+}
+
+func (s *winService) setState(state, accepts, waitHint uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.currentState, s.status.controlsAccepted, s.status.waitHint = state, accepts, waitHint
+	if state == serviceStartPending || state == serviceStopPending {
+		s.status.checkPoint++
+	} else {
+		s.status.checkPoint = 0
+	}
+	s.reportLocked()
+}
+
+func (s *winService) reportLocked() {
+	_, _, _ = procSetServiceStatus.Call(s.handle, uintptr(unsafe.Pointer(&s.status)))
+}
+
+// installService registers browserd as an automatically started service
+// running as LocalSystem, with args as its flags.
+func installService(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.Abs(exe); err != nil {
+		return err
+	}
+	command := []string{syscall.EscapeArg(exe), "-windows-service"}
+	for _, arg := range args {
+		command = append(command, syscall.EscapeArg(arg))
+	}
+
+	manager, err := openServiceManager()
+	if err != nil {
+		return err
+	}
+	defer closeServiceHandle(manager)
+	name, _ := syscall.UTF16PtrFromString(serviceName)
+	display, _ := syscall.UTF16PtrFromString(serviceDisplayName)
+	binary, err := syscall.UTF16PtrFromString(strings.Join(command, " "))
+	if err != nil {
+		return err
+	}
+	service, _, err := procCreateService.Call(manager, uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(display)),
+		serviceAllAccess, serviceWin32OwnProcess, serviceAutoStart, serviceErrorNormal,
+		uintptr(unsafe.Pointer(binary)), 0, 0, 0, 0, 0)
+	if service == 0 {
+		return fmt.Errorf("create service %s: %w", serviceName, err)
+	}
+	closeServiceHandle(service)
+	return nil
+}
+
+// uninstallService stops the service if it is running and removes it.
+func uninstallService() error {
+	manager, err := openServiceManager()
+	if err != nil {
+		return err
+	}
+	defer closeServiceHandle(manager)
+	name, _ := syscall.UTF16PtrFromString(serviceName)
+	service, _, err := procOpenService.Call(manager, uintptr(unsafe.Pointer(name)), serviceStop|serviceDelete)
+	if service == 0 {
+		return fmt.Errorf("open service %s: %w", serviceName, err)
+	}
+	defer closeServiceHandle(service)
+
+	var status serviceStatus
+	if r, _, err := procControlService.Call(service, serviceControlStop, uintptr(unsafe.Pointer(&status))); r == 0 && !errors.Is(err, errorServiceNotActive) {
+		return fmt.Errorf("stop service %s: %w", serviceName, err)
+	}
+	if r, _, err := procDeleteService.Call(service); r == 0 {
+		return fmt.Errorf("delete service %s: %w", serviceName, err)
+	}
+	return nil
+}
+
+func openServiceManager() (uintptr, error) {
+	manager, _, err := procOpenSCManager.Call(0, 0, scManagerAllAccess)
+	if manager == 0 {
+		return 0, fmt.Errorf("open the service control manager: %w", err)
+	}
+	return manager, nil
+}
+
+func closeServiceHandle(h uintptr) {
+	_, _, _ = procCloseServiceHandle.Call(h)
+}
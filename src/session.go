@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxSessionLabels     = 8
+	maxSessionLabelValue = 64
+)
+
+var labelKeyPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]{0,31}$`)
+
+// reservedQueryParams are connect-time query parameters with their own
+// meaning; every other parameter is treated as a session label.
+var reservedQueryParams = map[string]bool{
+	"token":              true,
+	"launch":             true,
+	"proxy":              true,
+	"device":             true,
+	"stealth":            true,
+	"exclusive":          true,
+	"profile":            true,
+	"flags":              true,
+	"tz":                 true,
+	"locale":             true,
+	"geo":                true,
+	"network":            true,
+	"grant-permissions":  true,
+	"deny-permissions":   true,
+	"expires":            true,
+	"signature":          true,
+	"screencast-fps":     true,
+	"screencast-quality": true,
+	"screencast-size":    true,
+	"env":                true,
+	"arg":                true,
+}
+
+// session is a single proxied client connection.
+type session struct {
+	id         string
+	remoteAddr string
+	startedAt  time.Time
+	labels     map[string]string
+
+	// proxy is the egress proxy requested with ?proxy=, if any.
+	proxy *url.URL
+	// device names the emulated device preset, if any.
+	device string
+	// network names the emulated network profile, if any.
+	network string
+	// screencast caps the screencasts the session starts, if set.
+	screencast screencastCap
+	// emulation is the ?tz=, ?locale= and ?geo= override, if any.
+	emulation *sessionEmulation
+	// permissions is the permission policy of the session's browser
+	// context, if any.
+	permissions *permissionPolicy
+	// stealth enables the anti-automation-detection patches.
+	stealth bool
+	// apiKey names the -api-keys key the client connected with, if any.
+	apiKey string
+	// pool names the -pools named pool the session runs in, if any.
+	pool string
+	// temp holds the session's artifacts, such as downloads.
+	temp *tempStore
+	// browser is the warm pool or profile browser the session has to
+	// itself, if any.
+	browser *pooledBrowser
+	// compat holds the -protocol-shims applied to the session, if any.
+	compat *sessionCompat
+	// upstreamPath and upstreamQuery replace those of the debugger URL
+	// when the client connected to a /devtools/ path itself.
+	upstreamPath  string
+	upstreamQuery string
+	// onFallback is set when the session was sent to -chromium-fallback,
+	// and onPrimary when it asked for a primary target by its qualified
+	// ID, which the fallback can't serve.
+	onFallback bool
+	onPrimary  bool
+	// migrated is the backend POST /admin/migrate moved the session to.
+	migrated atomic.Pointer[fallbackBackend]
+
+	// targets are the page targets the client is attached to, keyed by
+	// its flattened CDP session ("" for a direct page connection).
+	targetsMu sync.Mutex
+	targets   []sessionTarget
+
+	// ended is closed when the client disconnects.
+	ended chan struct{}
+
+	stats sessionStats
+
+	// taps are the observers of GET /admin/sessions/{id}/tap, and
+	// tapCount how many there are.
+	tapsMu   sync.Mutex
+	taps     map[*sessionTap]struct{}
+	tapCount atomic.Int32
+	// recording is set when -record is on.
+	recording *sessionRecording
+	// screenshots are the file names -error-screenshots saved when the
+	// session failed.
+	screenshotOnce sync.Once
+	screenshots    []string
+	// annotations are the notes added through the annotations API.
+	annotationsMu sync.Mutex
+	annotations   []sessionAnnotation
+
+	// disconnectFunc closes both hops, telling the client code and reason;
+	// it is set once the session is connected, and called through
+	// disconnect. killed records that an operator ended the session,
+	// idled that -idle-timeout did.
+	disconnectFunc atomic.Pointer[func(code int, reason string)]
+	killed         atomic.Bool
+	idled          atomic.Bool
+	// maxDuration is the session's API key's duration limit, if any.
+	maxDuration time.Duration
+	// migrate moves the session to another backend; it is set when a lost
+	// upstream would be reconnected, whose machinery it shares.
+	migrate func(ctx context.Context, to *fallbackBackend) error
+
+	// lastActivity is when the client last sent a CDP command, in Unix
+	// nanoseconds.
+	lastActivity atomic.Int64
+
+	// log carries the session's id and client address on every record.
+	log *slog.Logger
+
+	// logFile and logger are set when per-session log files are enabled.
+	logFile *os.File
+	logger  *log.Logger
+}
+
+func newSession(remoteAddr string, labels map[string]string) *session {
+	id := newSessionID()
+	s := &session{
+		id:         id,
+		remoteAddr: remoteAddr,
+		startedAt:  time.Now(),
+		labels:     labels,
+		ended:      make(chan struct{}),
+		log:        slog.With("session_id", id, "client_ip", clientIP(remoteAddr)),
+	}
+	s.touch()
+	return s
+}
+
+// kill disconnects the session on an operator's request.
+func (s *session) kill() {
+	s.killed.Store(true)
+	s.disconnect(closeTerminated, "session terminated")
+}
+
+// disconnect closes the session with code and reason, reporting false if
+// it isn't connected yet.
+func (s *session) disconnect(code int, reason string) bool {
+	fn := s.disconnectFunc.Load()
+	if fn == nil {
+		return false
+	}
+	(*fn)(code, reason)
+	return true
+}
+
+// touch records client activity.
+func (s *session) touch() {
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (s *session) lastActive() time.Time {
+	return time.Unix(0, s.lastActivity.Load())
+}
+
+type sessionTarget struct {
+	cdpSession string
+	targetID   string
+}
+
+func (s *session) addTarget(cdpSession, targetID string) {
+	s.targetsMu.Lock()
+	defer s.targetsMu.Unlock()
+	s.targets = append(s.targets, sessionTarget{cdpSession: cdpSession, targetID: targetID})
+	s.stats.pages.Add(1)
+}
+
+func (s *session) removeTarget(cdpSession string) {
+	s.targetsMu.Lock()
+	defer s.targetsMu.Unlock()
+	for i, t := range s.targets {
+		if t.cdpSession == cdpSession {
+			s.targets = append(s.targets[:i], s.targets[i+1:]...)
+			return
+		}
+	}
+}
+
+// targetFor returns the target attached as cdpSession, or "".
+func (s *session) targetFor(cdpSession string) string {
+	s.targetsMu.Lock()
+	defer s.targetsMu.Unlock()
+	for _, t := range s.targets {
+		if t.cdpSession == cdpSession {
+			return t.targetID
+		}
+	}
+	return ""
+}
+
+// pageTargets returns the IDs of the session's page targets, oldest first.
+func (s *session) pageTargets() []string {
+	s.targetsMu.Lock()
+	defer s.targetsMu.Unlock()
+	ids := make([]string, 0, len(s.targets))
+	for _, t := range s.targets {
+		ids = append(ids, t.targetID)
+	}
+	return ids
+}
+
+// takeTargets forgets the session's targets, returning them.
+func (s *session) takeTargets() []sessionTarget {
+	s.targetsMu.Lock()
+	defer s.targetsMu.Unlock()
+	targets := s.targets
+	s.targets = nil
+	return targets
+}
+
+var (
+	errNoPageTarget       = errors.New("session has no page target")
+	errTargetNotInSession = errors.New("target not found in session")
+)
+
+// resolveTarget checks that targetID is one of the session's pages, or
+// picks the most recently attached one when it is empty.
+func (s *session) resolveTarget(targetID string) (string, error) {
+	s.targetsMu.Lock()
+	defer s.targetsMu.Unlock()
+	if targetID == "" {
+		if len(s.targets) == 0 {
+			return "", errNoPageTarget
+		}
+		return s.targets[len(s.targets)-1].targetID, nil
+	}
+	for _, t := range s.targets {
+		if t.targetID == targetID {
+			return targetID, nil
+		}
+	}
+	return "", errTargetNotInSession
+}
+
+// targetErrorStatus maps resolveTarget errors to HTTP statuses.
+func targetErrorStatus(err error) int {
+	if errors.Is(err, errNoPageTarget) {
+		return http.StatusConflict
+	}
+	return http.StatusNotFound
+}
+
+// downloadDir returns the session's downloads directory, creating it.
+func (s *session) downloadDir() (string, error) {
+	if s.temp == nil {
+		return "", errors.New("no temp directory")
+	}
+	dir, err := s.temp.sessionDir(s.id)
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, tempDownloads)
+	return dir, os.MkdirAll(dir, 0o755)
+}
+
+// uploadDir is the session's directory for files staged through
+// POST /api/sessions/{id}/files, creating it.
+func (s *session) uploadDir() (string, error) {
+	if s.temp == nil {
+		return "", errors.New("no temp directory")
+	}
+	dir, err := s.temp.sessionDir(s.id)
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, tempUploads)
+	return dir, os.MkdirAll(dir, 0o755)
+}
+
+// openLog creates the session's log file, named by session ID, under dir.
+func (s *session) openLog(dir string) error {
+	f, err := os.OpenFile(filepath.Join(dir, s.id+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.logFile = f
+	s.logger = log.New(f, "", log.LstdFlags|log.Lmicroseconds)
+	return nil
+}
+
+// logf records a lifecycle event in the session's own log file, if any.
+func (s *session) logf(format string, args ...any) {
+	if s.logger != nil {
+		s.logger.Printf(format, args...)
+	}
+}
+
+func (s *session) closeLog() {
+	if s.logFile != nil {
+		_ = s.logFile.Close()
+	}
+}
+
+func newSessionID() string {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// queryFlag reads a boolean connect-time parameter; a bare ?name counts as
+// true.
+func queryFlag(query url.Values, name string) bool {
+	values, ok := query[name]
+	if !ok || len(values) == 0 {
+		return false
+	}
+	if values[0] == "" {
+		return true
+	}
+	enabled, _ := strconv.ParseBool(values[0])
+	return enabled
+}
+
+// forwardedQuery is the connect query minus browserd's own parameters,
+// which the upstream has no use for and, like ?token=, may be secret.
+func forwardedQuery(query url.Values) string {
+	forwarded := url.Values{}
+	for key, values := range query {
+		if !reservedQueryParams[key] {
+			forwarded[key] = values
+		}
+	}
+	return forwarded.Encode()
+}
+
+// parseSessionLabels extracts client-supplied labels such as
+// ?label=ci-job-1234&team=payments from the connect URL.
+func parseSessionLabels(query url.Values) (map[string]string, error) {
+	labels := make(map[string]string)
+	for key, values := range query {
+		if reservedQueryParams[key] || len(values) == 0 {
+			continue
+		}
+		if !labelKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("invalid label name %q", key)
+		}
+		value := values[0]
+		if len(value) > maxSessionLabelValue {
+			return nil, fmt.Errorf("label %q exceeds %d characters", key, maxSessionLabelValue)
+		}
+		labels[key] = value
+	}
+	if len(labels) > maxSessionLabels {
+		return nil, errors.New("too many session labels")
+	}
+	return labels, nil
+}
+
+type sessionRegistry struct {
+	mu       sync.RWMutex
+	sessions map[string]*session
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[string]*session)}
+}
+
+func (r *sessionRegistry) add(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[s.id] = s
+}
+
+func (r *sessionRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, id)
+}
+
+func (r *sessionRegistry) get(id string) *session {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.sessions[id]
+}
+
+// list returns the active sessions ordered by start time.
+func (r *sessionRegistry) list() []*session {
+	r.mu.RLock()
+	out := make([]*session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		out = append(out, s)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].startedAt.Before(out[j].startedAt) })
+	return out
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ssrfLookupTimeout = 2 * time.Second
+	ssrfCacheTTL      = 30 * time.Second
+	ssrfCacheSize     = 4096
+)
+
+// privateNetworks are the ranges -block-private-networks keeps pages away
+// from: loopback, RFC 1918, carrier-grade NAT, link-local (which holds the
+// cloud metadata endpoints), unique local and other special-purpose ranges.
+var privateNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+}
+
+// networkGuard refuses requests whose host is, or resolves to, a private
+// address. Chromium resolves names again on its own, so the check narrows
+// rather than closes the window for DNS rebinding.
+type networkGuard struct {
+	allow    []netip.Prefix
+	resolver *net.Resolver
+
+	// cache holds the verdicts on names, the most recently used first in
+	// lru, which drops the least recently used past ssrfCacheSize.
+	mu    sync.Mutex
+	cache map[string]*list.Element
+	lru   *list.List
+}
+
+type guardVerdict struct {
+	host    string
+	reason  string
+	expires time.Time
+}
+
+func newNetworkGuard(allow []string) (*networkGuard, error) {
+	g := &networkGuard{resolver: net.DefaultResolver, cache: make(map[string]*list.Element), lru: list.New()}
+	for _, entry := range allow {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid address or CIDR %q", entry)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		g.allow = append(g.allow, prefix.Masked())
+	}
+	return g, nil
+}
+
+// check returns why rawURL may not be fetched, or "" when it may. Only
+// network schemes are checked; data:, blob: and the like never leave the
+// browser.
+func (g *networkGuard) check(rawURL string) string {
+	host, reason, decided := g.decide(rawURL)
+	if decided {
+		return reason
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ssrfLookupTimeout)
+	defer cancel()
+	addrs, err := g.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		// Not knowing where a name points is treated as private.
+		reason = "name did not resolve"
+	}
+	for _, addr := range addrs {
+		if reason = g.checkAddr(addr); reason != "" {
+			break
+		}
+	}
+	g.remember(host, reason)
+	return reason
+}
+
+// decided reports whether check can answer for rawURL without a lookup.
+func (g *networkGuard) decided(rawURL string) bool {
+	_, _, decided := g.decide(rawURL)
+	return decided
+}
+
+// decide answers for rawURL from its scheme, an address host or the cache,
+// or returns the host to resolve.
+func (g *networkGuard) decide(rawURL string) (host, reason string, decided bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", true
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "ws", "wss", "ftp":
+	default:
+		return "", "", true
+	}
+	host = strings.ToLower(u.Hostname())
+	if host == "" {
+		return "", "", true
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return host, g.checkAddr(addr), true
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	el, ok := g.cache[host]
+	if !ok {
+		return host, "", false
+	}
+	verdict := el.Value.(*guardVerdict)
+	if time.Now().After(verdict.expires) {
+		g.lru.Remove(el)
+		delete(g.cache, host)
+		return host, "", false
+	}
+	g.lru.MoveToFront(el)
+	return host, verdict.reason, true
+}
+
+// remember caches the verdict on host.
+func (g *networkGuard) remember(host, reason string) {
+	expires := time.Now().Add(ssrfCacheTTL)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if el, ok := g.cache[host]; ok {
+		verdict := el.Value.(*guardVerdict)
+		verdict.reason, verdict.expires = reason, expires
+		g.lru.MoveToFront(el)
+		return
+	}
+	g.cache[host] = g.lru.PushFront(&guardVerdict{host: host, reason: reason, expires: expires})
+	if g.lru.Len() > ssrfCacheSize {
+		oldest := g.lru.Back()
+		g.lru.Remove(oldest)
+		delete(g.cache, oldest.Value.(*guardVerdict).host)
+	}
+}
+
+func (g *networkGuard) checkAddr(addr netip.Addr) string {
+	addr = addr.Unmap()
+	for _, prefix := range g.allow {
+		if prefix.Contains(addr) {
+			return ""
+		}
+	}
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsUnspecified() {
+		return fmt.Sprintf("%s is a private address", addr)
+	}
+	for _, prefix := range privateNetworks {
+		if prefix.Contains(addr) {
+			return fmt.Sprintf("%s is a private address", addr)
+		}
+	}
+	return ""
+}
+
+// policy fails requests the guard refuses, reporting each to blocked.
+func (g *networkGuard) policy(blocked func(req *pausedRequest, reason string)) requestPolicy {
+	return func(req *pausedRequest) *fetchDecision {
+		reason := g.check(req.Request.URL)
+		if reason == "" {
+			return nil
+		}
+		blocked(req, reason)
+		return failRequest("BlockedByClient")
+	}
+}
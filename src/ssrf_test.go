@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestNetworkGuardRefusesPrivateTargets(t *testing.T) {
+	guard, err := newNetworkGuard([]string{"10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHarness(t, proxyConfig{networkGuard: guard})
+	for _, tc := range []struct {
+		url     string
+		blocked bool
+	}{
+		{"http://127.0.0.1:9222/json", true},
+		{"http://localhost/", true},
+		{"http://10.0.0.5/", true},
+		{"http://[::1]/", true},
+		{"http://169.254.169.254/latest/meta-data/", true},
+		{"http://[::ffff:127.0.0.1]/", true},
+		{"http://10.1.2.3/", false},
+		{"https://93.184.216.34/", false},
+	} {
+		t.Run(tc.url, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPut, h.url("/json/new?"+url.QueryEscape(tc.url)), nil)
+			resp, err := h.client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if !tc.blocked {
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("status %d, want 200", resp.StatusCode)
+				}
+				return
+			}
+			var body struct {
+				Code string `json:"code"`
+			}
+			_ = json.NewDecoder(resp.Body).Decode(&body)
+			if resp.StatusCode != http.StatusForbidden || body.Code != errorCodeNavigationBlocked {
+				t.Fatalf("status %d code %q, want 403 %s", resp.StatusCode, body.Code, errorCodeNavigationBlocked)
+			}
+		})
+	}
+}
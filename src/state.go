@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// maxStateSize bounds the bundle POST /api/sessions/{id}/state accepts.
+const maxStateSize = 10 << 20
+
+// stateBundle is a session's login state: the cookies of its browser
+// context and the localStorage of the origins its pages had open.
+type stateBundle struct {
+	Cookies []stateCookie  `json:"cookies"`
+	Origins []stateStorage `json:"origins"`
+}
+
+// stateCookie holds the fields of a Network.Cookie that Network.setCookies
+// takes back. Expires is omitted for session cookies.
+type stateCookie struct {
+	Name         string          `json:"name"`
+	Value        string          `json:"value"`
+	Domain       string          `json:"domain"`
+	Path         string          `json:"path"`
+	Expires      float64         `json:"expires,omitempty"`
+	HTTPOnly     bool            `json:"httpOnly"`
+	Secure       bool            `json:"secure"`
+	SameSite     string          `json:"sameSite,omitempty"`
+	Priority     string          `json:"priority,omitempty"`
+	SourceScheme string          `json:"sourceScheme,omitempty"`
+	SourcePort   int             `json:"sourcePort,omitempty"`
+	PartitionKey json.RawMessage `json:"partitionKey,omitempty"`
+}
+
+type stateStorage struct {
+	Origin       string            `json:"origin"`
+	LocalStorage map[string]string `json:"localStorage"`
+}
+
+// localStorageExpression reads a page's origin and localStorage; opaque
+// origins, where localStorage throws, yield null.
+const localStorageExpression = `(() => { try { return {origin: location.origin, localStorage: {...localStorage}} } catch (e) { return null } })()`
+
+// handleExportState answers GET /api/sessions/{id}/state with the
+// session's cookies and the localStorage of its pages, for seeding a later
+// session through handleImportState.
+func (p *proxyServer) handleExportState(w http.ResponseWriter, r *http.Request) {
+	if !p.authorize(r) {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	sess := p.clientSession(w, r)
+	if sess == nil {
+		return
+	}
+	if !p.acquireAPI() {
+		p.rejectOverloaded(w, r, reasonMaxAPIRequests)
+		return
+	}
+	defer p.releaseAPI()
+
+	targetID, err := sess.resolveTarget(r.URL.Query().Get("target"))
+	if err != nil {
+		writeError(w, targetErrorStatus(err), err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), defaultAPITimeout)
+	defer cancel()
+	page, err := p.attachPage(ctx, sess, targetID)
+	if err != nil {
+		p.apiError(w, "state", err)
+		return
+	}
+	defer page.close()
+
+	bundle, err := page.exportState(ctx, sess)
+	if err != nil {
+		p.apiError(w, "state", err)
+		return
+	}
+	sess.log.Info("session state exported", "event", "state_exported", "cookies", len(bundle.Cookies), "origins", len(bundle.Origins))
+	p.metrics.add("browserd_api_requests_total", map[string]string{"endpoint": "state", "status": "ok"}, 1)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "state-"+sess.id+".json"))
+	writeJSON(w, http.StatusOK, bundle)
+}
+
+// exportState reads the cookies of the page's browser context and the
+// localStorage of every page of sess. A session connected to a single page
+// target only has that page's.
+func (pg *apiPage) exportState(ctx context.Context, sess *session) (*stateBundle, error) {
+	cookies, err := pg.cookies(ctx)
+	if err != nil {
+		return nil, err
+	}
+	bundle := &stateBundle{Cookies: cookies, Origins: []stateStorage{}}
+
+	sessionIDs := []string{pg.sessionID}
+	if pg.sessionID != "" {
+		sessionIDs = sessionIDs[:0]
+		for _, targetID := range sess.pageTargets() {
+			sessionID, err := pg.client.attach(ctx, targetID)
+			if err != nil {
+				// The page may have closed since; skip it.
+				continue
+			}
+			sessionIDs = append(sessionIDs, sessionID)
+		}
+	}
+	seen := make(map[string]int)
+	for _, sessionID := range sessionIDs {
+		page := &apiPage{client: pg.client, sessionID: sessionID}
+		storage, err := page.localStorage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if storage == nil {
+			continue
+		}
+		if i, ok := seen[storage.Origin]; ok {
+			// Pages of one origin share their localStorage.
+			bundle.Origins[i] = *storage
+			continue
+		}
+		seen[storage.Origin] = len(bundle.Origins)
+		bundle.Origins = append(bundle.Origins, *storage)
+	}
+	return bundle, nil
+}
+
+// cookies reads the cookies of the page's browser context.
+func (pg *apiPage) cookies(ctx context.Context) ([]stateCookie, error) {
+	result, err := pg.client.call(ctx, pg.sessionID, "Network.getAllCookies", nil)
+	if err != nil {
+		return nil, err
+	}
+	var all struct {
+		Cookies []struct {
+			stateCookie
+			Session bool `json:"session"`
+		} `json:"cookies"`
+	}
+	if err := json.Unmarshal(result, &all); err != nil {
+		return nil, err
+	}
+	cookies := make([]stateCookie, 0, len(all.Cookies))
+	for _, c := range all.Cookies {
+		if c.Session || c.Expires < 0 {
+			c.Expires = 0
+		}
+		cookies = append(cookies, c.stateCookie)
+	}
+	return cookies, nil
+}
+
+// localStorage reads the page's origin and its localStorage, or nil for
+// an opaque origin.
+func (pg *apiPage) localStorage(ctx context.Context) (*stateStorage, error) {
+	value, err := pg.evaluate(ctx, localStorageExpression, false)
+	if err != nil {
+		return nil, err
+	}
+	var storage *stateStorage
+	if err := json.Unmarshal(value.Value, &storage); err != nil || storage == nil || storage.Origin == "null" {
+		return nil, nil
+	}
+	return storage, nil
+}
+
+// handleImportState loads a bundle from handleExportState into a session's
+// browser context: its cookies are set and each origin's localStorage is
+// written from a background page whose requests never reach the network.
+// Seeding a new session before it navigates restores a login.
+func (p *proxyServer) handleImportState(w http.ResponseWriter, r *http.Request) {
+	if !p.authorize(r) {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	sess := p.clientSession(w, r)
+	if sess == nil {
+		return
+	}
+	if !p.acquireAPI() {
+		p.rejectOverloaded(w, r, reasonMaxAPIRequests)
+		return
+	}
+	defer p.releaseAPI()
+
+	var bundle stateBundle
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxStateSize)).Decode(&bundle); err != nil {
+		p.writeBodyError(w, err)
+		return
+	}
+	for i, storage := range bundle.Origins {
+		u, err := url.Parse(storage.Origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid origin %q", storage.Origin))
+			return
+		}
+		bundle.Origins[i].Origin = u.Scheme + "://" + u.Host
+	}
+	targetID, err := sess.resolveTarget(r.URL.Query().Get("target"))
+	if err != nil {
+		writeError(w, targetErrorStatus(err), err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), defaultAPITimeout)
+	defer cancel()
+	page, err := p.attachPage(ctx, sess, targetID)
+	if err != nil {
+		p.apiError(w, "state", err)
+		return
+	}
+	defer page.close()
+
+	if err := page.importState(ctx, targetID, &bundle); err != nil {
+		p.apiError(w, "state", err)
+		return
+	}
+	sess.log.Info("session state imported", "event", "state_imported", "cookies", len(bundle.Cookies), "origins", len(bundle.Origins))
+	sess.logf("imported %d cookies and localStorage of %d origins", len(bundle.Cookies), len(bundle.Origins))
+	p.metrics.add("browserd_api_requests_total", map[string]string{"endpoint": "state", "status": "ok"}, 1)
+	writeJSON(w, http.StatusOK, map[string]int{"cookies": len(bundle.Cookies), "origins": len(bundle.Origins)})
+}
+
+// importState sets the bundle's cookies through the page and writes its
+// localStorage from a page opened beside it, in the same browser context.
+func (pg *apiPage) importState(ctx context.Context, targetID string, bundle *stateBundle) error {
+	if len(bundle.Cookies) > 0 {
+		if _, err := pg.client.call(ctx, pg.sessionID, "Network.setCookies", map[string]any{"cookies": bundle.Cookies}); err != nil {
+			return err
+		}
+	}
+	if len(bundle.Origins) == 0 {
+		return nil
+	}
+	if pg.sessionID == "" {
+		return errPageDebugger
+	}
+
+	result, err := pg.client.call(ctx, "", "Target.getTargetInfo", map[string]any{"targetId": targetID})
+	if err != nil {
+		return err
+	}
+	var info struct {
+		TargetInfo targetInfoPayload `json:"targetInfo"`
+	}
+	if err := json.Unmarshal(result, &info); err != nil {
+		return err
+	}
+	params := map[string]any{"url": "about:blank", "background": true}
+	if info.TargetInfo.BrowserContextID != "" {
+		params["browserContextId"] = info.TargetInfo.BrowserContextID
+	}
+	if result, err = pg.client.call(ctx, "", "Target.createTarget", params); err != nil {
+		return err
+	}
+	var target struct {
+		TargetID string `json:"targetId"`
+	}
+	_ = json.Unmarshal(result, &target)
+	// Closed with the page when the request is done.
+	pg.targetID = target.TargetID
+
+	seeder := &apiPage{client: pg.client}
+	if seeder.sessionID, err = pg.client.attach(ctx, target.TargetID); err != nil {
+		return err
+	}
+	if _, err := pg.client.call(ctx, seeder.sessionID, "Page.enable", nil); err != nil {
+		return err
+	}
+	if _, err := pg.client.call(ctx, seeder.sessionID, "Fetch.enable", map[string]any{"patterns": []map[string]string{{"urlPattern": "*"}}}); err != nil {
+		return err
+	}
+	for _, storage := range bundle.Origins {
+		if err := seeder.seedOrigin(ctx, storage); err != nil {
+			return fmt.Errorf("seed %s: %w", storage.Origin, err)
+		}
+	}
+	return nil
+}
+
+// seedOrigin loads an empty document for storage.Origin, answering its
+// request itself, and writes the origin's localStorage from it.
+func (pg *apiPage) seedOrigin(ctx context.Context, storage stateStorage) error {
+	navigated := make(chan error, 1)
+	go func() {
+		_, err := pg.client.call(ctx, pg.sessionID, "Page.navigate", map[string]any{"url": storage.Origin + "/"})
+		navigated <- err
+	}()
+
+	var request struct {
+		RequestID    string `json:"requestId"`
+		ResourceType string `json:"resourceType"`
+	}
+	for request.ResourceType != "Document" {
+		paused, err := pg.client.waitEvent(ctx, pg.sessionID, "Fetch.requestPaused")
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(paused.Params, &request); err != nil {
+			return err
+		}
+		if request.ResourceType != "Document" {
+			// Such as the favicon of the previous origin.
+			_, _ = pg.client.call(ctx, pg.sessionID, "Fetch.failRequest", map[string]any{"requestId": request.RequestID, "errorReason": "Aborted"})
+		}
+	}
+	if _, err := pg.client.call(ctx, pg.sessionID, "Fetch.fulfillRequest", map[string]any{
+		"requestId":       request.RequestID,
+		"responseCode":    http.StatusOK,
+		"responseHeaders": []headerEntry{{Name: "Content-Type", Value: "text/html"}},
+		"body":            "",
+	}); err != nil {
+		return err
+	}
+	if err := <-navigated; err != nil {
+		return err
+	}
+	if _, err := pg.client.waitEvent(ctx, pg.sessionID, "Page.loadEventFired"); err != nil {
+		return err
+	}
+
+	items, err := json.Marshal(storage.LocalStorage)
+	if err != nil {
+		return err
+	}
+	value, err := pg.evaluate(ctx, "(items => { for (const [k, v] of Object.entries(items)) localStorage.setItem(k, v); return location.origin })("+string(items)+")", false)
+	if err != nil {
+		return err
+	}
+	var origin string
+	if err := json.Unmarshal(value.Value, &origin); err != nil || origin != storage.Origin {
+		return errors.New("page did not load at the origin")
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statsdMaxPacket keeps datagrams under the common 1500-byte MTU.
+const statsdMaxPacket = 1432
+
+// statsdSink periodically pushes the metrics registry to a StatsD or
+// DogStatsD agent over UDP. Counters are sent as the increase since the
+// previous flush and gauges as their current value; metric labels and the
+// configured tags become DogStatsD tags.
+type statsdSink struct {
+	addr     string
+	prefix   string
+	tags     []string
+	interval time.Duration
+	metrics  *metricsRegistry
+	// sample, when set, refreshes sampled metrics before each flush.
+	sample func()
+
+	// sent holds each counter's value at the previous flush.
+	sent map[string]float64
+}
+
+func newStatsdSink(addr, prefix string, tags []string, interval time.Duration, metrics *metricsRegistry) (*statsdSink, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, err
+	}
+	for _, tag := range tags {
+		if strings.ContainsAny(tag, "|,#\n") {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("flush interval must be positive")
+	}
+	return &statsdSink{
+		addr:     addr,
+		prefix:   prefix,
+		tags:     tags,
+		interval: interval,
+		metrics:  metrics,
+		sent:     make(map[string]float64),
+	}, nil
+}
+
+// run flushes every interval until ctx is cancelled. UDP is fire and
+// forget, so a missing agent only shows up as write errors being logged.
+func (s *statsdSink) run(ctx context.Context) {
+	conn, err := net.Dial("udp", s.addr)
+	if err != nil {
+		slog.Error("statsd sink disabled", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	failing := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if s.sample != nil {
+			s.sample()
+		}
+		var writeErr error
+		for _, packet := range s.packets(s.collect()) {
+			if _, writeErr = conn.Write(packet); writeErr != nil {
+				break
+			}
+		}
+		if writeErr != nil && !failing {
+			slog.Warn("statsd write failed", "addr", s.addr, "error", writeErr)
+		}
+		failing = writeErr != nil
+	}
+}
+
+// collect renders one line per series that has something to report.
+func (s *statsdSink) collect() []string {
+	var lines []string
+	s.metrics.each(func(sample metricSample) {
+		name := s.prefix + sample.name
+		tags := s.formatTags(sample.labels)
+		switch sample.kind {
+		case metricCounter:
+			id := sample.name + sample.key
+			delta := sample.value - s.sent[id]
+			s.sent[id] = sample.value
+			if delta > 0 {
+				lines = append(lines, name+":"+formatStatsdValue(delta)+"|c"+tags)
+			}
+		default:
+			if sample.value < 0 {
+				// A leading sign means "adjust by" in StatsD, so reset to
+				// zero before sending a negative gauge.
+				lines = append(lines, name+":0|g"+tags)
+			}
+			lines = append(lines, name+":"+formatStatsdValue(sample.value)+"|g"+tags)
+		}
+	})
+	return lines
+}
+
+func (s *statsdSink) formatTags(labels map[string]string) string {
+	if len(labels) == 0 && len(s.tags) == 0 {
+		return ""
+	}
+	tags := append([]string(nil), s.tags...)
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", "_").Replace(labels[key])
+		tags = append(tags, key+":"+value)
+	}
+	return "|#" + strings.Join(tags, ",")
+}
+
+// packets joins lines into newline-separated datagrams.
+func (s *statsdSink) packets(lines []string) [][]byte {
+	var out [][]byte
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(line) > statsdMaxPacket {
+			out = append(out, bytes.Clone(buf.Bytes()))
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		out = append(out, buf.Bytes())
+	}
+	return out
+}
+
+func formatStatsdValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
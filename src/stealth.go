@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// stealthScript hides the most common signs of an automated browser from
+// page scripts. It runs before any page script in every document.
+const stealthScript = `(() => {
+  const define = (target, prop, get) => {
+    try { Object.defineProperty(target, prop, { get, configurable: true }); } catch (e) {}
+  };
+
+  define(Navigator.prototype, 'webdriver', () => undefined);
+  define(Navigator.prototype, 'languages', () => Object.freeze(['en-US', 'en']));
+
+  if (navigator.plugins.length === 0) {
+    const names = ['PDF Viewer', 'Chrome PDF Viewer', 'Chromium PDF Viewer', 'Microsoft Edge PDF Viewer', 'WebKit built-in PDF'];
+    const mime = { type: 'application/pdf', suffixes: 'pdf', description: 'Portable Document Format' };
+    const plugins = names.map((name) => ({ name, filename: 'internal-pdf-viewer', description: mime.description, length: 1, 0: mime }));
+    const list = (items) => Object.assign(Object.create(null), items, {
+      length: items.length,
+      item: (i) => items[i] || null,
+      namedItem: (name) => items.find((p) => p.name === name || p.type === name) || null,
+      [Symbol.iterator]: function* () { yield* items; },
+    });
+    define(Navigator.prototype, 'plugins', () => list(plugins));
+    define(Navigator.prototype, 'mimeTypes', () => list([mime]));
+  }
+
+  if (!window.chrome) {
+    window.chrome = { app: { isInstalled: false }, runtime: {}, csi: () => ({}), loadTimes: () => ({}) };
+  }
+
+  if (typeof Permissions !== 'undefined' && typeof Notification !== 'undefined') {
+    const query = Permissions.prototype.query;
+    Permissions.prototype.query = function (desc) {
+      if (desc && desc.name === 'notifications') {
+        return Promise.resolve({ state: Notification.permission === 'default' ? 'prompt' : Notification.permission, onchange: null });
+      }
+      return query.call(this, desc);
+    };
+  }
+})();`
+
+// stealthCommands builds the init commands for stealth mode from the
+// browser's own user agent, so the override stays consistent with the real
+// Chromium version and only drops the "Headless" marker.
+func (r *relay) stealthCommands() ([]cdpCommand, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	resp, err := r.call(ctx, "", "Browser.getVersion", nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Error) > 0 {
+		return nil, errors.New(string(resp.Error))
+	}
+	var version struct {
+		Product   string `json:"product"`
+		UserAgent string `json:"userAgent"`
+	}
+	if err := json.Unmarshal(resp.Result, &version); err != nil || version.UserAgent == "" {
+		return nil, errors.New("Browser.getVersion returned no userAgent")
+	}
+
+	ua, _ := json.Marshal(stealthUserAgent(version.Product, version.UserAgent))
+	return []cdpCommand{
+		newDocumentScript(stealthScript),
+		{Method: "Emulation.setUserAgentOverride", Params: ua},
+	}, nil
+}
+
+// stealthUserAgent returns Emulation.setUserAgentOverride params whose
+// user agent string and client hints agree with each other.
+func stealthUserAgent(product, userAgent string) map[string]any {
+	userAgent = strings.ReplaceAll(userAgent, "HeadlessChrome", "Chrome")
+
+	fullVersion := product
+	if _, v, ok := strings.Cut(product, "/"); ok {
+		fullVersion = v
+	}
+	major, _, _ := strings.Cut(fullVersion, ".")
+
+	platform, navigatorPlatform := "Linux", "Linux x86_64"
+	switch {
+	case strings.Contains(userAgent, "Windows"):
+		platform, navigatorPlatform = "Windows", "Win32"
+	case strings.Contains(userAgent, "Macintosh"):
+		platform, navigatorPlatform = "macOS", "MacIntel"
+	}
+
+	brands := []map[string]string{
+		{"brand": "Not_A Brand", "version": "8"},
+		{"brand": "Chromium", "version": major},
+		{"brand": "Google Chrome", "version": major},
+	}
+	fullBrands := []map[string]string{
+		{"brand": "Not_A Brand", "version": "8.0.0.0"},
+		{"brand": "Chromium", "version": fullVersion},
+		{"brand": "Google Chrome", "version": fullVersion},
+	}
+	return map[string]any{
+		"userAgent":      userAgent,
+		"acceptLanguage": "en-US,en;q=0.9",
+		"platform":       navigatorPlatform,
+		"userAgentMetadata": map[string]any{
+			"brands":          brands,
+			"fullVersionList": fullBrands,
+			"fullVersion":     fullVersion,
+			"platform":        platform,
+			"platformVersion": "",
+			"architecture":    "x86",
+			"model":           "",
+			"mobile":          false,
+		},
+	}
+}
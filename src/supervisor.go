@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	supervisorMinBackoff  = time.Second
+	supervisorMaxBackoff  = 30 * time.Second
+	supervisorStopTimeout = 5 * time.Second
+	cgroupPollInterval    = 5 * time.Second
+)
+
+// resourceLimits bounds the supervised Chromium process tree.
+type resourceLimits struct {
+	memoryBytes int64
+	cpuCores    float64
+}
+
+func (l resourceLimits) enabled() bool {
+	return l.memoryBytes > 0 || l.cpuCores > 0
+}
+
+// supervisor launches Chromium itself (supervised mode) instead of relying
+// on an externally started browser, and restarts it when it exits.
+type supervisor struct {
+	bin     string
+	args    []string
+	limits  resourceLimits
+	metrics *metricsRegistry
+	// logs captures the browser's output, when enabled.
+	logs *chromiumLogs
+	// onRestart is called each time the browser has stopped and is about
+	// to be relaunched, with the exit error unless it was recycled.
+	onRestart   func(recycled bool, err error)
+	userDataDir string
+	// display is the managed X server in headful mode, and vnc the
+	// optional VNC server attached to it.
+	display *virtualDisplay
+	vnc     *vncServer
+	// pipe, for -chromium-pipe, carries CDP over fds 3 and 4 instead of a
+	// debugging port.
+	pipe *cdpPipe
+
+	mu        sync.Mutex
+	cmd       *exec.Cmd
+	exited    chan struct{}
+	recycling bool
+	// startedAt and sessions describe the running browser, for the
+	// recycling policy.
+	startedAt time.Time
+	sessions  int
+}
+
+func newSupervisor(cfg proxyConfig, chromiumURL *url.URL, metrics *metricsRegistry, logs *chromiumLogs) (*supervisor, error) {
+	port := chromiumURL.Port()
+	if port == "" {
+		return nil, errors.New("supervised mode requires -chromium to include the remote debugging port")
+	}
+
+	userDataDir := cfg.userDataDir
+	if userDataDir == "" {
+		userDataDir = defaultUserDataDir
+	}
+
+	var display *virtualDisplay
+	var vnc *vncServer
+	if cfg.headful {
+		display = newVirtualDisplay(cfg.xvfbBin, cfg.displayNumber, cfg.displaySize)
+		if cfg.vncAddr != "" {
+			vnc = newVNCServer(cfg.x11vncBin, display, cfg.vncAddr, cfg.vncPassword)
+		}
+	}
+
+	metrics.register("browserd_chromium_restarts_total", metricCounter, "Times the supervised Chromium process was restarted.")
+	metrics.register("browserd_chromium_oom_kills_total", metricCounter, "OOM kills inside the supervised Chromium cgroup.")
+	metrics.register("browserd_chromium_memory_limit_hits_total", metricCounter, "Times the supervised Chromium cgroup reached its memory limit.")
+	metrics.register("browserd_chromium_cpu_throttled_total", metricCounter, "CPU throttling periods for the supervised Chromium cgroup.")
+
+	return &supervisor{
+		bin:         cfg.chromiumBin,
+		args:        chromiumArgs(cfg, port, userDataDir),
+		limits:      cfg.limits,
+		metrics:     metrics,
+		logs:        logs,
+		userDataDir: userDataDir,
+		display:     display,
+		vnc:         vnc,
+	}, nil
+}
+
+// chromiumArgs builds the command line of a supervised Chromium debugging
+// on port with its profile in userDataDir.
+func chromiumArgs(cfg proxyConfig, port, userDataDir string) []string {
+	var args []string
+	switch {
+	case cfg.headful:
+		args = append(args,
+			fmt.Sprintf("--window-size=%d,%d", cfg.displaySize.width, cfg.displaySize.height),
+			"--window-position=0,0",
+		)
+	case len(cfg.extensions) > 0:
+		// Old headless mode can't run extensions.
+		args = append(args, "--headless=new")
+	default:
+		args = append(args, "--headless")
+	}
+
+	if cfg.chromiumPipe {
+		args = append(args, "--remote-debugging-pipe")
+	} else {
+		args = append(args, "--remote-debugging-address=127.0.0.1", "--remote-debugging-port="+port)
+	}
+	args = append(args,
+		"--disable-gpu",
+		"--disable-dev-shm-usage",
+		"--disable-background-networking",
+		"--user-data-dir="+userDataDir,
+		"--disable-features=VizDisplayCompositor",
+	)
+	if cfg.crashDir != "" {
+		args = append(args, "--enable-crash-reporter", "--crash-dumps-dir="+crashpadDir(cfg.crashDir))
+	}
+	if len(cfg.extensions) > 0 {
+		list := strings.Join(cfg.extensions, ",")
+		args = append(args, "--load-extension="+list, "--disable-extensions-except="+list)
+	}
+	args = append(args, cfg.dns.args()...)
+	return mergeFeatureFlags(append(args, cfg.chromiumArgs...))
+}
+
+// run keeps Chromium running until ctx is cancelled, then stops it.
+func (s *supervisor) run(ctx context.Context) {
+	if err := os.MkdirAll(s.userDataDir, 0o755); err != nil {
+		slog.Error("failed to create chromium user data dir", "error", err)
+	}
+
+	if s.display != nil {
+		defer s.display.stop()
+	}
+	if s.vnc != nil {
+		defer s.vnc.stop()
+	}
+
+	var cgroup *chromiumCgroup
+	if s.limits.enabled() {
+		var err error
+		cgroup, err = setupChromiumCgroup(s.limits)
+		if err != nil {
+			slog.Warn("resource limits disabled", "error", err)
+		} else {
+			defer cgroup.close()
+			go s.watchCgroup(ctx, cgroup)
+			slog.Info("chromium resource limits applied", "cgroup", cgroup.path)
+		}
+	}
+
+	backoff := supervisorMinBackoff
+	for {
+		started := time.Now()
+		err := s.launch(ctx, cgroup)
+		if ctx.Err() != nil {
+			return
+		}
+
+		s.mu.Lock()
+		recycled := s.recycling
+		s.recycling = false
+		s.mu.Unlock()
+
+		if s.onRestart != nil {
+			s.onRestart(recycled, err)
+		}
+		if recycled {
+			slog.Info("chromium stopped for recycling, relaunching", "event", "browser_recycled")
+			backoff = supervisorMinBackoff
+			continue
+		}
+
+		slog.Error("chromium exited", "event", "browser_exited", "error", err)
+		s.metrics.add("browserd_chromium_restarts_total", nil, 1)
+
+		if time.Since(started) > supervisorMaxBackoff {
+			backoff = supervisorMinBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, supervisorMaxBackoff)
+	}
+}
+
+// launch starts one Chromium process and waits for it to exit. When ctx is
+// cancelled the browser is terminated, and killed after a grace period.
+func (s *supervisor) launch(ctx context.Context, cgroup *chromiumCgroup) error {
+	if s.display != nil {
+		if err := s.display.ensure(); err != nil {
+			return fmt.Errorf("start virtual display: %w", err)
+		}
+	}
+	if s.vnc != nil {
+		if err := s.vnc.ensure(); err != nil {
+			// The browser is still useful without a live view.
+			slog.Warn("failed to start x11vnc", "error", err)
+		}
+	}
+
+	cmd, started, err := s.command()
+	if err != nil {
+		return err
+	}
+	if cgroup != nil {
+		cgroup.apply(cmd.SysProcAttr)
+	}
+
+	if err := cmd.Start(); err != nil {
+		if cgroup == nil {
+			return err
+		}
+		// Older kernels reject CLONE_INTO_CGROUP; start normally and move
+		// the process into the cgroup right after, on pipes of its own.
+		if s.pipe != nil {
+			s.pipe.discard()
+		}
+		if cmd, started, err = s.command(); err != nil {
+			return err
+		}
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		if err := cgroup.add(cmd.Process.Pid); err != nil {
+			slog.Warn("failed to move chromium into its cgroup", "error", err)
+		}
+	}
+	started(cmd.Process.Pid)
+	slog.Info("started chromium", "event", "browser_started", "pid", cmd.Process.Pid)
+
+	exited := make(chan struct{})
+	s.mu.Lock()
+	s.cmd = cmd
+	s.exited = exited
+	s.startedAt = time.Now()
+	s.sessions = 0
+	s.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		s.mu.Lock()
+		s.cmd = nil
+		s.mu.Unlock()
+		close(exited)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		terminate(cmd.Process)
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(supervisorStopTimeout):
+			_ = cmd.Process.Kill()
+			return <-done
+		}
+	}
+}
+
+// usage returns the running Chromium's process ID, or 0 when it is down,
+// along with when it started and how many sessions it has served.
+func (s *supervisor) usage() (pid int, startedAt time.Time, sessions int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cmd == nil || s.cmd.Process == nil {
+		return 0, time.Time{}, 0
+	}
+	return s.cmd.Process.Pid, s.startedAt, s.sessions
+}
+
+// countSession records a session connecting to the running browser.
+func (s *supervisor) countSession() {
+	s.mu.Lock()
+	s.sessions++
+	s.mu.Unlock()
+}
+
+// restart stops the running browser and returns once it has exited; the
+// run loop then relaunches it immediately.
+func (s *supervisor) restart() {
+	s.mu.Lock()
+	cmd, exited := s.cmd, s.exited
+	if cmd != nil {
+		s.recycling = true
+	}
+	s.mu.Unlock()
+	if cmd == nil {
+		return
+	}
+
+	terminate(cmd.Process)
+	select {
+	case <-exited:
+	case <-time.After(supervisorStopTimeout):
+		_ = cmd.Process.Kill()
+		<-exited
+	}
+}
+
+// command builds the browser's command, and the function to call with its
+// pid once it has started.
+func (s *supervisor) command() (*exec.Cmd, func(pid int), error) {
+	cmd := exec.Command(s.bin, s.args...)
+	started := s.logs.attach(cmd, "main")
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	if s.display != nil {
+		cmd.Env = append(os.Environ(), "DISPLAY="+s.display.name())
+	}
+	if s.pipe != nil {
+		connect, err := s.pipe.attach(cmd)
+		if err != nil {
+			return nil, nil, fmt.Errorf("create debugging pipe: %w", err)
+		}
+		logStarted := started
+		started = func(pid int) {
+			logStarted(pid)
+			connect()
+		}
+	}
+	return cmd, started, nil
+}
+
+// watchCgroup turns cgroup limit events into log lines and metrics.
+func (s *supervisor) watchCgroup(ctx context.Context, cgroup *chromiumCgroup) {
+	ticker := time.NewTicker(cgroupPollInterval)
+	defer ticker.Stop()
+
+	var last cgroupEvents
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current, err := cgroup.events()
+		if err != nil {
+			slog.Warn("failed to read cgroup events", "error", err)
+			continue
+		}
+
+		if delta := current.oomKills - last.oomKills; delta > 0 {
+			slog.Error("chromium cgroup hit oom kills", "event", "oom_kill", "count", delta, "memory_limit_bytes", s.limits.memoryBytes)
+			s.metrics.add("browserd_chromium_oom_kills_total", nil, float64(delta))
+		}
+		if delta := current.memoryMax - last.memoryMax; delta > 0 {
+			slog.Warn("chromium cgroup reached its memory limit", "event", "memory_limit", "count", delta)
+			s.metrics.add("browserd_chromium_memory_limit_hits_total", nil, float64(delta))
+		}
+		if delta := current.cpuThrottled - last.cpuThrottled; delta > 0 {
+			s.metrics.add("browserd_chromium_cpu_throttled_total", nil, float64(delta))
+		}
+		last = current
+	}
+}
+
+// resolveExtensions checks that each path is an unpacked extension and
+// makes it absolute, since Chromium resolves relative paths against its own
+// working directory.
+func resolveExtensions(paths []string) ([]string, error) {
+	resolved := make([]string, 0, len(paths))
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		if strings.Contains(abs, ",") {
+			return nil, fmt.Errorf("extension path %s contains a comma", abs)
+		}
+		if _, err := os.Stat(filepath.Join(abs, "manifest.json")); err != nil {
+			return nil, fmt.Errorf("%s is not an unpacked extension: %w", path, err)
+		}
+		resolved = append(resolved, abs)
+	}
+	return resolved, nil
+}
+
+// parseByteSize accepts plain byte counts or values with a K/M/G suffix.
+func parseByteSize(value string) (int64, error) {
+	value = strings.TrimSpace(strings.ToUpper(value))
+	if value == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n * multiplier, nil
+}
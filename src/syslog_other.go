@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func openSyslog(string) (io.Writer, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
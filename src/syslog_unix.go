@@ -0,0 +1,51 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"net/url"
+)
+
+// syslogSink sends log records to syslog under the daemon facility.
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+// openSyslog connects to the local syslog daemon, or to addr given as
+// udp://host:port or tcp://host:port.
+func openSyslog(addr string) (*syslogSink, error) {
+	var network, raddr string
+	if addr != "" {
+		u, err := url.Parse(addr)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+			return nil, fmt.Errorf("invalid syslog address %q (want udp://host:port or tcp://host:port)", addr)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+	w, err := syslog.Dial(network, raddr, syslog.LOG_DAEMON|syslog.LOG_INFO, "browserd")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
+
+func (s *syslogSink) writeRecord(level slog.Level, line []byte) error {
+	msg := string(line)
+	switch {
+	case level >= slog.LevelError:
+		return s.w.Err(msg)
+	case level >= slog.LevelWarn:
+		return s.w.Warning(msg)
+	case level >= slog.LevelInfo:
+		return s.w.Info(msg)
+	default:
+		return s.w.Debug(msg)
+	}
+}
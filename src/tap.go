@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// tapQueueSize bounds the frames queued for one tap; an observer that
+// falls further behind misses frames rather than slowing the session.
+const tapQueueSize = 256
+
+// tapFrame is one relayed frame as an observer receives it.
+type tapFrame struct {
+	Direction string          `json:"direction"`
+	Time      time.Time       `json:"time"`
+	Frame     json.RawMessage `json:"frame,omitempty"`
+	// Binary holds frames that aren't JSON.
+	Binary []byte `json:"binary,omitempty"`
+}
+
+// sessionTap is one observer of GET /admin/sessions/{id}/tap. With method
+// patterns it only gets matching commands and events, and the responses to
+// those commands.
+type sessionTap struct {
+	methods []string
+	frames  chan tapFrame
+	dropped atomic.Int64
+
+	mu      sync.Mutex
+	pending map[tapCommand]struct{}
+}
+
+// tapCommand identifies a command whose response a tap is waiting for.
+type tapCommand struct {
+	id        int64
+	sessionID string
+}
+
+func (t *sessionTap) matches(dir frameDirection, data []byte) bool {
+	if len(t.methods) == 0 {
+		return true
+	}
+	var msg cdpMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return false
+	}
+	if msg.Method == "" {
+		if msg.ID == nil || dir != toClient {
+			return false
+		}
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		key := tapCommand{*msg.ID, msg.SessionID}
+		_, ok := t.pending[key]
+		delete(t.pending, key)
+		return ok
+	}
+	if !eventMatches(t.methods, msg.Method) {
+		return false
+	}
+	if msg.ID != nil && dir == toUpstream {
+		t.mu.Lock()
+		t.pending[tapCommand{*msg.ID, msg.SessionID}] = struct{}{}
+		t.mu.Unlock()
+	}
+	return true
+}
+
+// tap copies a relayed frame to the session's recording and observers.
+func (s *session) tap(dir frameDirection, msgType int, data []byte) {
+	if s.recording == nil && s.tapCount.Load() == 0 {
+		return
+	}
+	frame := newTapFrame(dir, msgType, data)
+	if s.recording != nil {
+		s.recording.write(s, frame)
+	}
+	if s.tapCount.Load() == 0 {
+		return
+	}
+
+	s.tapsMu.Lock()
+	defer s.tapsMu.Unlock()
+	for t := range s.taps {
+		if !t.matches(dir, data) {
+			continue
+		}
+		select {
+		case t.frames <- frame:
+		default:
+			t.dropped.Add(1)
+		}
+	}
+}
+
+func (s *session) addTap(t *sessionTap) {
+	s.tapsMu.Lock()
+	defer s.tapsMu.Unlock()
+	if s.taps == nil {
+		s.taps = make(map[*sessionTap]struct{})
+	}
+	s.taps[t] = struct{}{}
+	s.tapCount.Add(1)
+}
+
+func (s *session) removeTap(t *sessionTap) {
+	s.tapsMu.Lock()
+	defer s.tapsMu.Unlock()
+	delete(s.taps, t)
+	s.tapCount.Add(-1)
+}
+
+// handleTap streams a live, read-only copy of a session's CDP traffic to a
+// WebSocket until the session or the observer goes away. ?method= limits
+// it to a comma-separated list of methods, where "Network.*" stands for a
+// whole domain.
+func (p *proxyServer) handleTap(w http.ResponseWriter, r *http.Request) {
+	sess := p.findSession(r.PathValue("id"))
+	if sess == nil {
+		if p.redirectToOwner(w, r, r.PathValue("id")) {
+			return
+		}
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	if !websocket.IsWebSocketUpgrade(r) {
+		writeError(w, http.StatusBadRequest, "tap requires a WebSocket upgrade")
+		return
+	}
+	conn, err := p.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var methods []string
+	for _, method := range splitList(r.URL.Query().Get("method")) {
+		methods = append(methods, strings.TrimSpace(method))
+	}
+	t := &sessionTap{methods: methods, frames: make(chan tapFrame, tapQueueSize), pending: make(map[tapCommand]struct{})}
+	sess.addTap(t)
+	p.metrics.add("browserd_session_taps", nil, 1)
+	sess.log.Info("session tap attached", "event", "tap_attached", "observer_ip", clientIP(r.RemoteAddr), "methods", methods)
+	defer func() {
+		sess.removeTap(t)
+		p.metrics.add("browserd_session_taps", nil, -1)
+		p.metrics.add("browserd_tap_dropped_frames_total", nil, float64(t.dropped.Load()))
+		sess.log.Info("session tap detached", "event", "tap_detached", "observer_ip", clientIP(r.RemoteAddr), "dropped_frames", t.dropped.Load())
+	}()
+
+	// The observer only reads; its reads are drained to notice it leave.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-gone:
+			return
+		case <-sess.ended:
+			_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeTerminated, "session ended"), time.Now().Add(time.Second))
+			return
+		case frame := <-t.frames:
+			data, err := json.Marshal(frame)
+			if err != nil {
+				continue
+			}
+			_ = conn.SetWriteDeadline(time.Now().Add(requestTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Pseudo target types accepted by -hide-targets in addition to Chromium's
+// own target types (service_worker, shared_worker, background_page, ...).
+const (
+	hiddenExtensionTargets = "extension"
+	hiddenDevtoolsTargets  = "devtools"
+)
+
+// targetFilter decides which targets are hidden from proxied target lists.
+type targetFilter struct {
+	types map[string]bool
+}
+
+func newTargetFilter(hidden []string) targetFilter {
+	filter := targetFilter{types: make(map[string]bool, len(hidden))}
+	for _, kind := range hidden {
+		filter.types[kind] = true
+	}
+	return filter
+}
+
+// active reports whether any targets are hidden.
+func (f targetFilter) active() bool {
+	return len(f.types) > 0
+}
+
+func (f targetFilter) hides(target map[string]any) bool {
+	kind, _ := target["type"].(string)
+	targetURL, _ := target["url"].(string)
+
+	switch {
+	case f.types[kind]:
+		return true
+	case f.types[hiddenExtensionTargets] && strings.HasPrefix(targetURL, "chrome-extension://"):
+		return true
+	case f.types[hiddenDevtoolsTargets] && strings.HasPrefix(targetURL, "devtools://"):
+		return true
+	}
+	return false
+}
+
+// Backends named in qualified target IDs, <backend>.<targetId>, which the
+// merged /json/list of -chromium-fallback uses.
+const (
+	primaryTargets  = "primary"
+	fallbackTargets = "fallback"
+)
+
+// fetchRawTargets returns /json/list entries with all upstream fields intact.
+func (p *proxyServer) fetchRawTargets(ctx context.Context) ([]map[string]any, error) {
+	return fetchTargetList(ctx, p.client, p.jsonEndpoint("/json/list"))
+}
+
+func fetchTargetList(ctx context.Context, client *http.Client, endpoint string) ([]map[string]any, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+
+	var targets []map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&targets); err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+// listTargets returns the primary's targets or, with a -chromium-fallback
+// that has a target list, those of both backends that answer, with IDs
+// qualified by backend so routeTarget can send connections to the right
+// one.
+func (p *proxyServer) listTargets(ctx context.Context) ([]map[string]any, error) {
+	if p.fallback == nil || p.fallback.static {
+		return p.fetchRawTargets(ctx)
+	}
+
+	type backendTargets struct {
+		name     string
+		endpoint string
+		targets  []map[string]any
+		err      error
+	}
+	backends := []*backendTargets{
+		{name: primaryTargets, endpoint: p.jsonEndpoint("/json/list")},
+		{name: fallbackTargets, endpoint: p.fallback.jsonEndpoint("/json/list")},
+	}
+	// The prober knows when the primary is down; don't wait on it.
+	if !p.health.healthy() {
+		backends = backends[1:]
+	}
+	var wg sync.WaitGroup
+	for _, b := range backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.targets, b.err = fetchTargetList(ctx, p.client, b.endpoint)
+		}()
+	}
+	wg.Wait()
+
+	var merged []map[string]any
+	var err error
+	answered := false
+	for _, b := range backends {
+		if b.err != nil {
+			err = errors.Join(err, fmt.Errorf("%s: %w", b.name, b.err))
+			continue
+		}
+		answered = true
+		for _, target := range b.targets {
+			qualifyTarget(target, b.name)
+			merged = append(merged, target)
+		}
+	}
+	if !answered {
+		return nil, err
+	}
+	return merged, nil
+}
+
+// qualifyTarget prefixes a target's ID, and the page URLs built on it, with
+// the backend it runs on.
+func qualifyTarget(target map[string]any, backend string) {
+	id, _ := target["id"].(string)
+	if id == "" {
+		return
+	}
+	qualified := backend + "." + id
+	target["id"] = qualified
+	for _, key := range []string{"webSocketDebuggerUrl", "devtoolsFrontendUrl"} {
+		if value, ok := target[key].(string); ok {
+			target[key] = strings.Replace(value, "/devtools/page/"+id, "/devtools/page/"+qualified, 1)
+		}
+	}
+}
+
+// routeTarget pins sess to the backend a qualified /devtools/page/ path
+// names, returning the path with Chromium's own target ID. Other paths are
+// returned as they are.
+func routeTarget(sess *session, path string) string {
+	rest, ok := strings.CutPrefix(path, "/devtools/page/")
+	if !ok {
+		return path
+	}
+	backend, id, ok := strings.Cut(rest, ".")
+	if !ok {
+		return path
+	}
+	switch backend {
+	case primaryTargets:
+		sess.onPrimary = true
+	case fallbackTargets:
+		sess.onFallback = true
+	default:
+		return path
+	}
+	return "/devtools/page/" + id
+}
+
+// handleJSONList proxies Chromium's /json/list (and its /json alias),
+// merged across backends by listTargets, dropping targets hidden by
+// -hide-targets, pointing the rest at browserd and, with
+// -devtools-frontend, linking each to browserd's DevTools UI.
+func (p *proxyServer) handleJSONList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !p.authorize(r) {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if p.staticDebugger {
+		writeError(w, http.StatusNotFound, "target list unavailable with a ws:// chromium endpoint")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	targets, err := p.listTargets(ctx)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	visible := make([]map[string]any, 0, len(targets))
+	for _, target := range targets {
+		if p.targetFilter.hides(target) {
+			continue
+		}
+		rewriteDebuggerURL(target, r)
+		if p.frontend != nil {
+			rewriteFrontendURL(target, r)
+		}
+		visible = append(visible, target)
+	}
+
+	writeJSON(w, http.StatusOK, visible)
+}
+
+// rewriteDebuggerURL points a target's webSocketDebuggerUrl at browserd,
+// as the pipe backend's lists do, so clients connect through the proxy
+// rather than to Chromium's own address.
+func rewriteDebuggerURL(target map[string]any, r *http.Request) {
+	wsURL, _ := target["webSocketDebuggerUrl"].(string)
+	parsed, err := url.Parse(wsURL)
+	if err != nil || !strings.HasPrefix(parsed.Path, "/devtools/") {
+		return
+	}
+	target["webSocketDebuggerUrl"] = "ws://" + r.Host + parsed.Path
+}
+
+// hiddenTarget reports whether path is the /devtools/page/ path of a
+// target -hide-targets hides, which clients mustn't connect to any more
+// than they see it listed. A list that can't be fetched hides nothing;
+// the dial to the same backend would fail too.
+func (p *proxyServer) hiddenTarget(ctx context.Context, path string) bool {
+	id, ok := strings.CutPrefix(path, "/devtools/page/")
+	if !ok || !p.targetFilter.active() || p.staticDebugger {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	targets, err := p.listTargets(ctx)
+	if err != nil {
+		return false
+	}
+	for _, target := range targets {
+		if target["id"] == id {
+			return p.targetFilter.hides(target)
+		}
+	}
+	return false
+}
+
+// mentionsTargetQuery cheaply spots the client commands -hide-targets
+// applies to.
+func mentionsTargetQuery(data []byte) bool {
+	return bytes.Contains(data, []byte(`"Target.attachToTarget"`)) || bytes.Contains(data, []byte(`"Target.getTargets"`))
+}
+
+// checkHidden returns why a client command reaches a hidden target, or "".
+// Target.getTargets is let through, to have its response filtered.
+func (r *relay) checkHidden(msg *cdpMessage) string {
+	switch msg.Method {
+	case "Target.getTargets":
+		if msg.ID != nil && msg.SessionID == "" {
+			r.targetListsMu.Lock()
+			r.targetLists[*msg.ID] = true
+			r.targetListsMu.Unlock()
+		}
+	case "Target.attachToTarget":
+		var params struct {
+			TargetID string `json:"targetId"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil || params.TargetID == "" {
+			return ""
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		defer cancel()
+		raw, _ := json.Marshal(map[string]string{"targetId": params.TargetID})
+		resp, err := r.call(ctx, "", "Target.getTargetInfo", raw)
+		if err != nil || len(resp.Error) > 0 {
+			return ""
+		}
+		var result struct {
+			TargetInfo map[string]any `json:"targetInfo"`
+		}
+		if json.Unmarshal(resp.Result, &result) == nil && r.hidden.hides(result.TargetInfo) {
+			// As Chromium answers for a target that doesn't exist.
+			return "No target with given id found"
+		}
+	}
+	return ""
+}
+
+// listingTargets reports whether Target.getTargets responses are awaited.
+func (r *relay) listingTargets() bool {
+	if !r.hidden.active() {
+		return false
+	}
+	r.targetListsMu.Lock()
+	defer r.targetListsMu.Unlock()
+	return len(r.targetLists) > 0
+}
+
+// listedTargets reports whether id is a client's Target.getTargets, and
+// forgets it.
+func (r *relay) listedTargets(id int64) bool {
+	r.targetListsMu.Lock()
+	defer r.targetListsMu.Unlock()
+	listed := r.targetLists[id]
+	delete(r.targetLists, id)
+	return listed
+}
+
+// dropHidden removes the hidden targets from a Target.getTargets response.
+func (r *relay) dropHidden(msg *cdpMessage, data *[]byte) {
+	var result struct {
+		TargetInfos []json.RawMessage `json:"targetInfos"`
+	}
+	if len(msg.Result) == 0 || json.Unmarshal(msg.Result, &result) != nil {
+		return
+	}
+	visible := make([]json.RawMessage, 0, len(result.TargetInfos))
+	for _, raw := range result.TargetInfos {
+		var info map[string]any
+		if json.Unmarshal(raw, &info) == nil && r.hidden.hides(info) {
+			continue
+		}
+		visible = append(visible, raw)
+	}
+	if len(visible) < len(result.TargetInfos) {
+		r.replaceResult(msg, data, map[string]any{"targetInfos": visible})
+	}
+}
+
+// targetBackend resolves a proxy-visible target ID to the /json endpoint
+// base of the backend it runs on and Chromium's own ID. Only IDs
+// qualified with a backend listTargets uses are routed to the fallback.
+func (p *proxyServer) targetBackend(id string) (jsonEndpoint func(string) string, upstreamID string) {
+	if p.fallback != nil && !p.fallback.static {
+		if backend, rest, ok := strings.Cut(id, "."); ok {
+			switch backend {
+			case primaryTargets:
+				return p.jsonEndpoint, rest
+			case fallbackTargets:
+				return p.fallback.jsonEndpoint, rest
+			}
+		}
+	}
+	return p.jsonEndpoint, id
+}
+
+// newTargetURL is the URL a /json/new request asks to open: its raw query,
+// as Chromium reads it, less the browserd ?token= it may carry.
+func newTargetURL(r *http.Request) (string, error) {
+	var parts []string
+	for _, part := range strings.Split(r.URL.RawQuery, "&") {
+		if part != "" && !strings.HasPrefix(part, "token=") {
+			parts = append(parts, part)
+		}
+	}
+	return url.QueryUnescape(strings.Join(parts, "&"))
+}
+
+// handleJSONNew proxies Chromium's /json/new. The target is opened on the
+// backend new sessions would use, and its ID and page URLs are qualified
+// like those of /json/list so /json/close and /devtools/page/ find it
+// again.
+func (p *proxyServer) handleJSONNew(w http.ResponseWriter, r *http.Request) {
+	// Chromium only takes PUT since 111; older clients still send GET.
+	if r.Method != http.MethodPut && r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !p.authorize(r) {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if p.staticDebugger {
+		writeError(w, http.StatusNotFound, "target creation unavailable with a ws:// chromium endpoint")
+		return
+	}
+	targetURL, err := newTargetURL(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid target URL")
+		return
+	}
+	if reason := p.refuseNavigation(r, targetURL); reason != "" {
+		writeErrorCode(w, http.StatusForbidden, errorCodeNavigationBlocked, reason, nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	jsonEndpoint, backend := p.jsonEndpoint, primaryTargets
+	if p.fallback != nil && !p.fallback.static && (!p.health.healthy() || !p.fallback.primaryDue()) {
+		jsonEndpoint, backend = p.fallback.jsonEndpoint, fallbackTargets
+	}
+	endpoint := jsonEndpoint("/json/new")
+	if targetURL != "" {
+		endpoint += "?" + targetURL
+	}
+	var target map[string]any
+	status, body, err := p.callJSONEndpoint(ctx, http.MethodPut, endpoint)
+	if err == nil && status == http.StatusOK {
+		err = json.Unmarshal(body, &target)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	if status != http.StatusOK {
+		writeError(w, status, strings.TrimSpace(string(body)))
+		return
+	}
+
+	if p.fallback != nil && !p.fallback.static {
+		qualifyTarget(target, backend)
+	}
+	rewriteDebuggerURL(target, r)
+	if p.frontend != nil {
+		rewriteFrontendURL(target, r)
+	}
+	writeJSON(w, http.StatusOK, target)
+}
+
+// handleJSONClose proxies Chromium's /json/close/{id}, sending a qualified
+// ID to the backend it names.
+func (p *proxyServer) handleJSONClose(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !p.authorize(r) {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if p.staticDebugger {
+		writeError(w, http.StatusNotFound, "target close unavailable with a ws:// chromium endpoint")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	jsonEndpoint, id := p.targetBackend(r.PathValue("id"))
+	status, body, err := p.callJSONEndpoint(ctx, http.MethodGet, jsonEndpoint("/json/close/"+url.PathEscape(id)))
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// callJSONEndpoint sends a request to one of Chromium's /json endpoints,
+// returning its status and body whatever the status.
+func (p *proxyServer) callJSONEndpoint(ctx context.Context, method, endpoint string) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, body, nil
+}
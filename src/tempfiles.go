@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	tempSessionsDir = "sessions"
+	tempPoolDir     = "pool"
+	tempJobsDir     = "jobs"
+	tempDownloads   = "downloads"
+	tempUploads     = "uploads"
+	tempScreenshots = "screenshots"
+
+	maxTempSweepInterval = time.Minute
+)
+
+// tempStore owns browserd's scratch files under one root: warm pool
+// profiles in pool/, per-session artifacts such as downloads and uploads
+// in sessions/<id>/ and job results in jobs/<id>/. Session directories are
+// kept for the retention period after their session ends so artifacts can
+// still be collected, then removed; everything left behind by a crashed
+// run is swept at startup.
+type tempStore struct {
+	root      string
+	retention time.Duration
+}
+
+func newTempStore(root string, retention time.Duration) (*tempStore, error) {
+	for _, dir := range []string{tempSessionsDir, tempPoolDir, tempJobsDir} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &tempStore{root: root, retention: retention}, nil
+}
+
+// poolDir is where warm pool browsers get their throwaway profiles.
+func (t *tempStore) poolDir() string {
+	return filepath.Join(t.root, tempPoolDir)
+}
+
+// sessionDir returns the artifact directory of a session, creating it.
+func (t *tempStore) sessionDir(id string) (string, error) {
+	dir := filepath.Join(t.root, tempSessionsDir, id)
+	return dir, os.MkdirAll(dir, 0o755)
+}
+
+// jobDir returns the result directory of a job, creating it.
+func (t *tempStore) jobDir(id string) (string, error) {
+	dir := filepath.Join(t.root, tempJobsDir, id)
+	return dir, os.MkdirAll(dir, 0o755)
+}
+
+// sessionEnded starts the retention period of a session's artifacts.
+func (t *tempStore) sessionEnded(id string) {
+	dir := filepath.Join(t.root, tempSessionsDir, id)
+	now := time.Now()
+	if err := os.Chtimes(dir, now, now); err != nil && !os.IsNotExist(err) {
+		slog.Warn("failed to mark directory for cleanup", "dir", dir, "error", err)
+	}
+}
+
+// sweepStartup removes pool profiles, none of which can be in use before
+// the pool starts, job results, which are only reachable from the run
+// that made them, and expired session directories.
+func (t *tempStore) sweepStartup() {
+	entries, _ := os.ReadDir(t.poolDir())
+	for _, entry := range entries {
+		t.remove(filepath.Join(t.poolDir(), entry.Name()))
+	}
+	if n := len(entries); n > 0 {
+		slog.Info("removed leftover warm pool profiles", "count", n)
+	}
+	jobs := filepath.Join(t.root, tempJobsDir)
+	entries, _ = os.ReadDir(jobs)
+	for _, entry := range entries {
+		t.remove(filepath.Join(jobs, entry.Name()))
+	}
+	t.sweep(func(string) bool { return false })
+}
+
+// sweep removes session directories whose retention has expired, skipping
+// those of sessions that are still active.
+func (t *tempStore) sweep(active func(id string) bool) {
+	dir := filepath.Join(t.root, tempSessionsDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Warn("failed to read temp directory", "dir", dir, "error", err)
+		return
+	}
+	for _, entry := range entries {
+		if active(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < t.retention {
+			continue
+		}
+		t.remove(filepath.Join(dir, entry.Name()))
+	}
+}
+
+func (t *tempStore) remove(path string) {
+	if err := os.RemoveAll(path); err != nil {
+		slog.Warn("failed to remove temp files", "path", path, "error", err)
+	}
+}
+
+// collectTemp sweeps expired session directories until ctx is cancelled.
+func (p *proxyServer) collectTemp(ctx context.Context) {
+	interval := min(p.temp.retention/4, maxTempSweepInterval)
+	if interval <= 0 {
+		interval = maxTempSweepInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.temp.sweep(func(id string) bool { return p.findSession(id) != nil })
+		}
+	}
+}
+
+// mentionsDownloads is a cheap pre-check for defaultDownloadPath.
+func mentionsDownloads(data []byte) bool {
+	return bytes.Contains(data, []byte(`setDownloadBehavior"`))
+}
+
+// defaultDownloadPath points downloads the client allows without choosing
+// a directory at the session's own downloads directory, so they are
+// cleaned up with it.
+func (r *relay) defaultDownloadPath(msg *cdpMessage) bool {
+	if msg.Method != "Browser.setDownloadBehavior" && msg.Method != "Page.setDownloadBehavior" {
+		return false
+	}
+	var params map[string]any
+	if err := json.Unmarshal(msg.Params, &params); err != nil || params == nil {
+		return false
+	}
+	if behavior, _ := params["behavior"].(string); behavior != "allow" && behavior != "allowAndName" {
+		return false
+	}
+	if path, _ := params["downloadPath"].(string); path != "" {
+		return false
+	}
+	dir, err := r.sess.downloadDir()
+	if err != nil {
+		r.sess.logf("downloads directory unavailable: %v", err)
+		return false
+	}
+	params["downloadPath"] = dir
+	msg.Params, _ = json.Marshal(params)
+	return true
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTraceDuration = 5 * time.Second
+	maxTraceDuration     = time.Minute
+	traceReadSize        = 1 << 20
+)
+
+// timelineCategories are what the DevTools performance panel records.
+var timelineCategories = []string{
+	"devtools.timeline",
+	"disabled-by-default-devtools.timeline",
+	"disabled-by-default-devtools.timeline.frame",
+	"disabled-by-default-devtools.timeline.stack",
+	"toplevel",
+	"v8.execute",
+	"disabled-by-default-v8.cpu_profiler",
+	"blink.console",
+	"blink.user_timing",
+	"latencyInfo",
+	"loading",
+}
+
+// tracePresets are the category sets ?preset= can pick.
+var tracePresets = map[string][]string{
+	"default":     timelineCategories,
+	"screenshots": append(append([]string(nil), timelineCategories...), "disabled-by-default-devtools.screenshot"),
+	"rendering": append(append([]string(nil), timelineCategories...),
+		"disabled-by-default-devtools.timeline.paint",
+		"disabled-by-default-devtools.timeline.layers",
+		"cc",
+		"gpu",
+	),
+}
+
+// traceRequest is the body of POST /api/sessions/{id}/trace; every field is
+// optional.
+type traceRequest struct {
+	Target string `json:"target"`
+	Preset string `json:"preset"`
+	// Duration is how long to record, in milliseconds.
+	Duration int `json:"duration"`
+}
+
+// handleTrace records a Chromium trace of a session's page for a while and
+// returns it in the trace event format that chrome://tracing, Perfetto and
+// the DevTools performance panel load.
+func (p *proxyServer) handleTrace(w http.ResponseWriter, r *http.Request) {
+	if !p.authorize(r) {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	sess := p.clientSession(w, r)
+	if sess == nil {
+		return
+	}
+	if !p.acquireAPI() {
+		p.rejectOverloaded(w, r, reasonMaxAPIRequests)
+		return
+	}
+	defer p.releaseAPI()
+
+	var req traceRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			p.writeBodyError(w, err)
+			return
+		}
+	}
+	if req.Preset == "" {
+		req.Preset = "default"
+	}
+	categories, ok := tracePresets[req.Preset]
+	if !ok {
+		known := make([]string, 0, len(tracePresets))
+		for name := range tracePresets {
+			known = append(known, name)
+		}
+		sort.Strings(known)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown preset %q (known: %s)", req.Preset, strings.Join(known, ", ")))
+		return
+	}
+	duration := defaultTraceDuration
+	if req.Duration > 0 {
+		duration = min(time.Duration(req.Duration)*time.Millisecond, maxTraceDuration)
+	}
+	targetID, err := sess.resolveTarget(req.Target)
+	if err != nil {
+		writeError(w, targetErrorStatus(err), err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), duration+defaultAPITimeout)
+	defer cancel()
+	page, err := p.attachPage(ctx, sess, targetID)
+	if err != nil {
+		p.apiError(w, "trace", err)
+		return
+	}
+	defer page.close()
+
+	sess.log.Info("recording trace", "event", "trace_started", "target", targetID, "preset", req.Preset, "duration", duration.String())
+	stream, err := page.trace(ctx, categories, duration)
+	if err != nil {
+		p.apiError(w, "trace", err)
+		return
+	}
+
+	// The first chunk is read before answering so a failure still gets an
+	// error status; later ones are streamed as they are read.
+	chunk, eof, err := page.readStream(ctx, stream)
+	if err != nil {
+		p.apiError(w, "trace", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "trace-"+sess.id+".json"))
+	w.WriteHeader(http.StatusOK)
+	for {
+		if _, err := w.Write(chunk); err != nil {
+			return
+		}
+		if eof {
+			break
+		}
+		if chunk, eof, err = page.readStream(ctx, stream); err != nil {
+			sess.log.Warn("trace stream failed", "error", err)
+			return
+		}
+	}
+	closeCtx, closeCancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer closeCancel()
+	_, _ = page.client.call(closeCtx, "", "IO.close", map[string]any{"handle": stream})
+	p.metrics.add("browserd_api_requests_total", map[string]string{"endpoint": "trace", "status": "ok"}, 1)
+}
+
+// trace records categories for duration and returns the IO stream handle
+// the trace can be read from.
+func (pg *apiPage) trace(ctx context.Context, categories []string, duration time.Duration) (string, error) {
+	_, err := pg.client.call(ctx, pg.sessionID, "Tracing.start", map[string]any{
+		"transferMode": "ReturnAsStream",
+		"streamFormat": "json",
+		"traceConfig": map[string]any{
+			"recordMode":         "recordAsMuchAsPossible",
+			"includedCategories": categories,
+			"excludedCategories": []string{"*"},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	select {
+	case <-time.After(duration):
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	if _, err := pg.client.call(ctx, pg.sessionID, "Tracing.end", nil); err != nil {
+		return "", err
+	}
+	ev, err := pg.client.waitEvent(ctx, pg.sessionID, "Tracing.tracingComplete")
+	if err != nil {
+		return "", err
+	}
+	var complete struct {
+		Stream string `json:"stream"`
+	}
+	if err := json.Unmarshal(ev.Params, &complete); err != nil || complete.Stream == "" {
+		return "", errors.New("Tracing.tracingComplete returned no stream")
+	}
+	return complete.Stream, nil
+}
+
+// readStream reads the next chunk of an IO stream.
+func (pg *apiPage) readStream(ctx context.Context, handle string) (data []byte, eof bool, err error) {
+	result, err := pg.client.call(ctx, "", "IO.read", map[string]any{"handle": handle, "size": traceReadSize})
+	if err != nil {
+		return nil, false, err
+	}
+	var chunk struct {
+		Data          string `json:"data"`
+		Base64Encoded bool   `json:"base64Encoded"`
+		EOF           bool   `json:"eof"`
+	}
+	if err := json.Unmarshal(result, &chunk); err != nil {
+		return nil, false, err
+	}
+	if !chunk.Base64Encoded {
+		return []byte(chunk.Data), chunk.EOF, nil
+	}
+	data, err = base64.StdEncoding.DecodeString(chunk.Data)
+	return data, chunk.EOF, err
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	tunnelMinBackoff   = time.Second
+	tunnelMaxBackoff   = 30 * time.Second
+	tunnelPingInterval = 30 * time.Second
+	tunnelWriteTimeout = 10 * time.Second
+	// tunnelStreamQueue bounds the hub frames buffered for one stream; a
+	// stream that falls that far behind is reset rather than stall the
+	// others sharing the tunnel.
+	tunnelStreamQueue = 256
+	tunnelChunkSize   = 32 << 10
+)
+
+// Tunnel frame types. Every frame is a binary WebSocket message holding
+// the type, a big-endian uint32 stream ID and the payload.
+const (
+	// tunnelOpen, from the hub, starts a stream; its payload is the
+	// client's address.
+	tunnelOpen byte = 1
+	// tunnelData carries stream bytes either way.
+	tunnelData byte = 2
+	// tunnelClose ends a stream either way.
+	tunnelClose byte = 3
+)
+
+// tunnelAgent implements -tunnel-hub: it keeps a WebSocket open to a hub
+// and accepts the client connections the hub multiplexes over it. It is a
+// net.Listener, so those connections are served like any other.
+type tunnelAgent struct {
+	hubURL  string
+	token   string
+	name    string
+	metrics *metricsRegistry
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// tunnelAddr is a tunnelled client's address as the hub reported it.
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "tunnel" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// tunnelConn is the server's end of a stream.
+type tunnelConn struct {
+	net.Conn
+	remote tunnelAddr
+}
+
+func (c *tunnelConn) RemoteAddr() net.Addr { return c.remote }
+
+func newTunnelAgent(hubURL, token, name string, metrics *metricsRegistry) *tunnelAgent {
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	metrics.register("browserd_tunnel_connected", metricGauge, "Whether the -tunnel-hub connection is up.")
+	metrics.register("browserd_tunnel_streams_total", metricCounter, "Client connections received through -tunnel-hub.")
+	return &tunnelAgent{hubURL: hubURL, token: token, name: name, metrics: metrics, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (a *tunnelAgent) Accept() (net.Conn, error) {
+	select {
+	case conn := <-a.conns:
+		return conn, nil
+	case <-a.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (a *tunnelAgent) Close() error {
+	a.closeOnce.Do(func() { close(a.done) })
+	return nil
+}
+
+func (a *tunnelAgent) Addr() net.Addr { return tunnelAddr(a.hubURL) }
+
+// run keeps the tunnel connected, redialing with backoff, until ctx ends.
+func (a *tunnelAgent) run(ctx context.Context) {
+	header := http.Header{"X-Browserd-Agent": {a.name}}
+	if a.token != "" {
+		header.Set("Authorization", "Bearer "+a.token)
+	}
+	backoff := tunnelMinBackoff
+	for {
+		conn, _, err := websocket.DefaultDialer.DialContext(ctx, a.hubURL, header)
+		if err == nil {
+			slog.Info("tunnel connected", "event", "tunnel_connected", "hub", a.hubURL)
+			a.metrics.set("browserd_tunnel_connected", nil, 1)
+			started := time.Now()
+			err = a.serve(ctx, conn)
+			a.metrics.set("browserd_tunnel_connected", nil, 0)
+			if time.Since(started) > tunnelMaxBackoff {
+				backoff = tunnelMinBackoff
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("tunnel down, reconnecting", "event", "tunnel_down", "hub", a.hubURL, "error", err, "backoff", backoff.String())
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.done:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, tunnelMaxBackoff)
+	}
+}
+
+// tunnelSession is one connection to the hub and the streams on it.
+type tunnelSession struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]chan []byte
+}
+
+func (a *tunnelAgent) serve(ctx context.Context, conn *websocket.Conn) error {
+	t := &tunnelSession{conn: conn, streams: make(map[uint32]chan []byte)}
+	defer func() {
+		_ = conn.Close()
+		t.mu.Lock()
+		for id, queue := range t.streams {
+			close(queue)
+			delete(t.streams, id)
+		}
+		t.mu.Unlock()
+	}()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(tunnelPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				_ = conn.Close()
+				return
+			case <-stop:
+				return
+			case <-ticker.C:
+				t.writeMu.Lock()
+				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(tunnelWriteTimeout))
+				t.writeMu.Unlock()
+				if err != nil {
+					_ = conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if msgType != websocket.BinaryMessage || len(data) < 5 {
+			return errors.New("malformed tunnel frame")
+		}
+		kind, id, payload := data[0], binary.BigEndian.Uint32(data[1:5]), data[5:]
+		switch kind {
+		case tunnelOpen:
+			if err := a.open(t, id, string(payload)); err != nil {
+				return err
+			}
+		case tunnelData:
+			t.mu.Lock()
+			queue, ok := t.streams[id]
+			if ok {
+				select {
+				case queue <- payload:
+				default:
+					slog.Warn("tunnel stream fell behind, resetting", "event", "tunnel_stream_reset", "stream", id)
+					close(queue)
+					delete(t.streams, id)
+					go t.write(tunnelClose, id, nil)
+				}
+			}
+			t.mu.Unlock()
+		case tunnelClose:
+			t.mu.Lock()
+			if queue, ok := t.streams[id]; ok {
+				close(queue)
+				delete(t.streams, id)
+			}
+			t.mu.Unlock()
+		default:
+			return fmt.Errorf("unknown tunnel frame type %d", kind)
+		}
+	}
+}
+
+// open starts a stream and hands its server end to Accept.
+func (a *tunnelAgent) open(t *tunnelSession, id uint32, remote string) error {
+	server, agent := net.Pipe()
+	queue := make(chan []byte, tunnelStreamQueue)
+	t.mu.Lock()
+	if _, ok := t.streams[id]; ok {
+		t.mu.Unlock()
+		return fmt.Errorf("tunnel stream %d opened twice", id)
+	}
+	t.streams[id] = queue
+	t.mu.Unlock()
+	a.metrics.add("browserd_tunnel_streams_total", nil, 1)
+
+	// Hub to server.
+	go func() {
+		for payload := range queue {
+			if _, err := agent.Write(payload); err != nil {
+				break
+			}
+		}
+		_ = agent.Close()
+	}()
+	// Server to hub.
+	go func() {
+		buf := make([]byte, tunnelChunkSize)
+		for {
+			n, err := agent.Read(buf)
+			if n > 0 {
+				if t.write(tunnelData, id, buf[:n]) != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		t.mu.Lock()
+		if queue, ok := t.streams[id]; ok {
+			close(queue)
+			delete(t.streams, id)
+			t.mu.Unlock()
+			_ = t.write(tunnelClose, id, nil)
+			return
+		}
+		t.mu.Unlock()
+	}()
+
+	select {
+	case a.conns <- &tunnelConn{Conn: server, remote: tunnelAddr(remote)}:
+		return nil
+	case <-a.done:
+		return net.ErrClosed
+	}
+}
+
+func (t *tunnelSession) write(kind byte, id uint32, payload []byte) error {
+	frame := make([]byte, 5+len(payload))
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	copy(frame[5:], payload)
+
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	_ = t.conn.SetWriteDeadline(time.Now().Add(tunnelWriteTimeout))
+	return t.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// uploadedFile describes one file staged by POST /api/sessions/{id}/files.
+type uploadedFile struct {
+	Name string `json:"name"`
+	// Path is where the browser finds the file, for
+	// DOM.setFileInputFiles.
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// handleUpload stages files in a session's uploads directory so a remote
+// client can hand them to DOM.setFileInputFiles. The body is either
+// multipart/form-data, every file part being kept, or the raw file named
+// by ?name=. Uploads are removed with the session's other artifacts.
+func (p *proxyServer) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if !p.authorize(r) {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	sess := p.clientSession(w, r)
+	if sess == nil {
+		return
+	}
+	if !p.acquireAPI() {
+		p.rejectOverloaded(w, r, reasonMaxAPIRequests)
+		return
+	}
+	defer p.releaseAPI()
+
+	dir, err := sess.uploadDir()
+	if err != nil {
+		p.apiError(w, "files", err)
+		return
+	}
+	body := r.Body
+	if p.maxUpload > 0 {
+		body = http.MaxBytesReader(w, r.Body, p.maxUpload)
+	}
+
+	var files []uploadedFile
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		r.Body = body
+		reader, err := r.MultipartReader()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		for {
+			part, err := reader.NextPart()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				uploadError(w, err)
+				return
+			}
+			if part.FileName() == "" {
+				continue
+			}
+			file, err := saveUpload(dir, part.FileName(), part)
+			if err != nil {
+				uploadError(w, err)
+				return
+			}
+			files = append(files, file)
+		}
+	} else {
+		file, err := saveUpload(dir, r.URL.Query().Get("name"), body)
+		if err != nil {
+			uploadError(w, err)
+			return
+		}
+		files = append(files, file)
+	}
+	if len(files) == 0 {
+		writeError(w, http.StatusBadRequest, "no files in request")
+		return
+	}
+
+	for _, file := range files {
+		sess.log.Info("file uploaded", "event", "file_uploaded", "name", file.Name, "size", file.Size)
+		sess.logf("uploaded %s (%d bytes)", file.Name, file.Size)
+	}
+	p.metrics.add("browserd_api_requests_total", map[string]string{"endpoint": "files", "status": "ok"}, 1)
+	writeJSON(w, http.StatusOK, map[string]any{"files": files})
+}
+
+// errInvalidUploadName is returned for names that aren't a plain file name.
+var errInvalidUploadName = errors.New("file name must be a plain file name")
+
+// saveUpload writes src to name in dir, replacing a file of that name.
+func saveUpload(dir, name string, src io.Reader) (uploadedFile, error) {
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return uploadedFile{}, errInvalidUploadName
+	}
+	path := filepath.Join(dir, name)
+	out, err := os.Create(path)
+	if err != nil {
+		return uploadedFile{}, err
+	}
+	size, err := io.Copy(out, src)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return uploadedFile{}, err
+	}
+	return uploadedFile{Name: name, Path: path, Size: size}, nil
+}
+
+func uploadError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("upload exceeds %d bytes", tooLarge.Limit))
+	case errors.Is(err, errInvalidUploadName):
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadNames(t *testing.T) {
+	h := newHarness(t, proxyConfig{
+		tempDir:     t.TempDir(),
+		apiKeysFile: writeAPIKeys(t, `{"alpha": {"key": "k-alpha"}, "beta": {"key": "k-beta"}}`),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, _, err := h.connect(ctx, "/?token=k-alpha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var sess *session
+	for sess == nil {
+		if sessions := h.proxy.sessions.list(); len(sessions) > 0 {
+			sess = sessions[0]
+		} else if ctx.Err() != nil {
+			t.Fatal("session never started")
+		} else {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	dir, err := sess.uploadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"report.pdf", "k-alpha", http.StatusOK},
+		{"..", "k-alpha", http.StatusBadRequest},
+		{".", "k-alpha", http.StatusBadRequest},
+		{"../escape.txt", "k-alpha", http.StatusBadRequest},
+		{"nested/file.txt", "k-alpha", http.StatusBadRequest},
+		{`..\escape.txt`, "k-alpha", http.StatusBadRequest},
+		{"/etc/passwd", "k-alpha", http.StatusBadRequest},
+		{"", "k-alpha", http.StatusBadRequest},
+		{"other.pdf", "k-beta", http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := "/api/sessions/" + sess.id + "/files?name=" + url.QueryEscape(tc.name)
+			req, _ := http.NewRequest(http.MethodPost, h.url(path), strings.NewReader("contents"))
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+			resp, err := h.client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.want {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tc.want)
+			}
+		})
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "report.pdf" {
+		t.Fatalf("upload directory holds %v, want only report.pdf", entries)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "escape.txt")); err == nil {
+		t.Fatal("an upload escaped its directory")
+	}
+}
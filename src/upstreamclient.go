@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// upstreamRetryMaxBackoff caps the wait between retries of a /json
+// request.
+const upstreamRetryMaxBackoff = 2 * time.Second
+
+// upstreamClientConfig tunes the HTTP client for Chromium's /json
+// endpoints.
+type upstreamClientConfig struct {
+	// timeout bounds a whole request, retries included.
+	timeout time.Duration
+	// attempt, when set, bounds each try, so a hung one leaves time for
+	// the next.
+	attempt time.Duration
+	// retries is how often a GET that failed without an answer, or with
+	// 502, 503 or 504, is tried again, after backoff doubling up to
+	// upstreamRetryMaxBackoff.
+	retries int
+	backoff time.Duration
+	// maxIdleConns is how many idle connections are kept to each upstream
+	// for reuse, for at most idleTimeout; 0 opens one per request.
+	maxIdleConns int
+	idleTimeout  time.Duration
+}
+
+// newTransport returns the base transport, dialing with dial when set.
+func (c upstreamClientConfig) newTransport(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http.Transport {
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: c.timeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+	return &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dial,
+		MaxIdleConnsPerHost: c.maxIdleConns,
+		MaxIdleConns:        c.maxIdleConns,
+		IdleConnTimeout:     c.idleTimeout,
+		DisableKeepAlives:   c.maxIdleConns == 0,
+	}
+}
+
+// retryTransport retries /json requests that failed in a way a restarting
+// sidecar or a load balancer in front of Chromium fails transiently, so
+// clients don't see its 502s. Only GETs and HEADs without a body are
+// retried: PUT /json/new would open a second tab. No retry starts that
+// the request's deadline wouldn't leave time for.
+type retryTransport struct {
+	cfg     upstreamClientConfig
+	metrics *metricsRegistry
+	next    http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retryable := (req.Method == http.MethodGet || req.Method == http.MethodHead) && req.Body == nil
+	backoff := t.cfg.backoff
+	for try := 0; ; try++ {
+		resp, err := t.try(req)
+		if !retryable || try >= t.cfg.retries || !transientFailure(resp, err) || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		// Equal jitter keeps requests that failed together from retrying
+		// in lockstep.
+		wait := backoff/2 + rand.N(backoff/2+1)
+		if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) < wait {
+			return resp, err
+		}
+		reason := "error"
+		if resp != nil {
+			reason = strconv.Itoa(resp.StatusCode)
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+		slog.Debug("retrying upstream request", "event", "upstream_request_retry", "url", req.URL.Redacted(), "reason", reason, "error", err, "backoff", wait.String())
+		t.metrics.add("browserd_upstream_request_retries_total", map[string]string{"reason": reason}, 1)
+		backoff = min(backoff*2, upstreamRetryMaxBackoff)
+	}
+}
+
+// try sends one attempt, bounded by the attempt timeout. The attempt's
+// context lives as long as its response body.
+func (t *retryTransport) try(req *http.Request) (*http.Response, error) {
+	if t.cfg.attempt <= 0 {
+		return t.next.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.cfg.attempt)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// transientFailure reports whether an attempt failed without Chromium
+// answering, or with a status a proxy or sidecar in front of it sends
+// while it restarts.
+func transientFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
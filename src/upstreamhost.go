@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// upstreamTransport adds -chromium-headers to every upstream request and
+// sends a fixed Host header for -chromium-host-header. Chromium refuses
+// /json requests, and WebSocket handshakes, whose Host isn't an IP address
+// or localhost, which rules out reaching it by a DNS name such as a
+// Kubernetes service.
+type upstreamTransport struct {
+	host   string
+	header http.Header
+	next   http.RoundTripper
+}
+
+func (t upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	req = req.Clone(req.Context())
+	for name, values := range t.header {
+		req.Header[name] = values
+	}
+	if t.host != "" {
+		req.Host = t.host
+	}
+	return next.RoundTrip(req)
+}
+
+// upstreamHeader is the header for WebSocket handshakes with Chromium.
+func (p *proxyServer) upstreamHeader() http.Header {
+	if p.upstreamHost == "" && len(p.upstreamHeaders) == 0 {
+		return nil
+	}
+	header := p.upstreamHeaders.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if p.upstreamHost != "" {
+		header.Set("Host", p.upstreamHost)
+	}
+	return header
+}
+
+// parseUpstreamHeaders reads -chromium-headers entries, "Name: value".
+// Host has a flag of its own, and the WebSocket handshake headers are the
+// dialer's to set.
+func parseUpstreamHeaders(entries []string) (http.Header, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	header := http.Header{}
+	for _, entry := range entries {
+		name, value, ok := strings.Cut(entry, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("%q is not Name: value", entry)
+		}
+		name = http.CanonicalHeaderKey(name)
+		switch {
+		case name == "Host":
+			return nil, errors.New("set Host with -chromium-host-header")
+		case name == "Connection", name == "Upgrade", strings.HasPrefix(name, "Sec-Websocket-"):
+			return nil, fmt.Errorf("header %s is set by the WebSocket handshake", name)
+		}
+		header.Add(name, value)
+	}
+	return header, nil
+}
+
+// restoreDebuggerHost undoes a Host override in a debugger URL: Chromium
+// builds webSocketDebuggerUrl from the Host it was sent, so the URL names
+// sent rather than the address it was actually reached at.
+func restoreDebuggerHost(raw string, req *http.Request) string {
+	if req == nil || req.Host == "" || req.Host == req.URL.Host {
+		return raw
+	}
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Host != req.Host {
+		return raw
+	}
+	parsed.Host = req.URL.Host
+	return parsed.String()
+}
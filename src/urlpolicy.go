@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// urlPolicy restricts the URLs clients can open with Page.navigate and
+// Target.createTarget. A URL matching a deny pattern is refused; when
+// there are allow patterns, so is one matching none of them. about:blank,
+// which clients open new targets on, is always allowed.
+type urlPolicy struct {
+	allow []urlPattern
+	deny  []urlPattern
+}
+
+// urlPattern is one -url-allow or -url-deny entry: a scheme such as
+// "file:", a URL wildcard such as "https://*.example.com/*", a CIDR range
+// such as "10.0.0.0/8" for IP address hosts, or otherwise a host wildcard
+// such as "*.internal".
+type urlPattern struct {
+	raw    string
+	scheme string
+	url    string
+	prefix netip.Prefix
+	host   string
+}
+
+func parseURLPolicy(allow, deny []string) (*urlPolicy, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	policy := &urlPolicy{}
+	var err error
+	if policy.allow, err = parseURLPatterns(allow); err != nil {
+		return nil, err
+	}
+	if policy.deny, err = parseURLPatterns(deny); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func parseURLPatterns(raw []string) ([]urlPattern, error) {
+	patterns := make([]urlPattern, 0, len(raw))
+	for _, entry := range raw {
+		p := urlPattern{raw: entry}
+		switch {
+		case strings.HasSuffix(entry, ":") && !strings.ContainsAny(entry, "/*?"):
+			p.scheme = strings.ToLower(strings.TrimSuffix(entry, ":"))
+		case strings.Contains(entry, "://"):
+			p.url = entry
+		case strings.Contains(entry, "/"):
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid URL pattern %q: %v", entry, err)
+			}
+			p.prefix = prefix.Masked()
+		default:
+			p.host = strings.ToLower(entry)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+func (p urlPattern) matches(u *url.URL, raw string) bool {
+	switch {
+	case p.scheme != "":
+		return u.Scheme == p.scheme
+	case p.url != "":
+		return wildcardMatch(p.url, raw)
+	case p.prefix.IsValid():
+		addr, err := netip.ParseAddr(u.Hostname())
+		return err == nil && p.prefix.Contains(addr.Unmap())
+	default:
+		return u.Host != "" && wildcardMatch(p.host, strings.ToLower(u.Hostname()))
+	}
+}
+
+// check returns why raw may not be opened, or "" when it may.
+func (policy *urlPolicy) check(raw string) string {
+	if raw == "" || raw == "about:blank" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" {
+		return "invalid URL"
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	for _, p := range policy.deny {
+		if p.matches(u, raw) {
+			return fmt.Sprintf("URL denied by policy (%s)", p.raw)
+		}
+	}
+	if len(policy.allow) == 0 {
+		return ""
+	}
+	for _, p := range policy.allow {
+		if p.matches(u, raw) {
+			return ""
+		}
+	}
+	return "URL not allowed by policy"
+}
+
+// mentionsNavigation is a cheap check for frames that may carry a URL the
+// policy applies to, so others aren't decoded.
+func mentionsNavigation(data []byte) bool {
+	return bytes.Contains(data, []byte(`Page.navigate"`)) || bytes.Contains(data, []byte(`Target.createTarget"`))
+}
+
+// checkNavigation applies the session's URL policy to a client command,
+// returning why it is refused or "".
+func (r *relay) checkNavigation(msg *cdpMessage) string {
+	if msg.ID == nil || (msg.Method != "Page.navigate" && msg.Method != "Target.createTarget") {
+		return ""
+	}
+	var params struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		return "invalid params"
+	}
+	return r.navigationPolicy(params.URL)
+}
+
+// refuseNavigation returns why -url-allow, -url-deny or
+// -block-private-networks refuse rawURL to a request that would open it
+// outside a client's relay, such as /json/new or the render APIs, counting
+// and logging the refusal, or "".
+func (p *proxyServer) refuseNavigation(r *http.Request, rawURL string) string {
+	if rawURL == "" {
+		return ""
+	}
+	if p.urlPolicy != nil {
+		if reason := p.urlPolicy.check(rawURL); reason != "" {
+			p.metrics.add("browserd_blocked_navigations_total", nil, 1)
+			slog.Warn("navigation refused", "event", "navigation_blocked", "url", rawURL, "reason", reason, "client_ip", clientIP(r.RemoteAddr))
+			return reason
+		}
+	}
+	if p.networkGuard != nil {
+		if reason := p.networkGuard.check(rawURL); reason != "" {
+			p.metrics.add("browserd_private_network_blocked_total", nil, 1)
+			slog.Warn("request to private network blocked", "event", "private_network_blocked", "url", rawURL, "reason", reason, "client_ip", clientIP(r.RemoteAddr))
+			return reason
+		}
+	}
+	return ""
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// vncServer runs x11vnc against the managed display so humans can watch
+// and drive a headful browser, e.g. to solve a captcha.
+type vncServer struct {
+	bin      string
+	display  *virtualDisplay
+	addr     string
+	password string
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	exited chan struct{}
+}
+
+func newVNCServer(bin string, display *virtualDisplay, addr, password string) *vncServer {
+	return &vncServer{bin: bin, display: display, addr: addr, password: password}
+}
+
+// ensure starts x11vnc unless it is already running. It must be called
+// after the display is up, since x11vnc exits when its X server goes away.
+func (v *vncServer) ensure() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.cmd != nil {
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(v.addr)
+	if err != nil {
+		return err
+	}
+	args := []string{"-display", v.display.name(), "-rfbport", port, "-forever", "-shared", "-quiet"}
+	if host != "" {
+		args = append(args, "-listen", host)
+	}
+	if v.password == "" {
+		args = append(args, "-nopw")
+	} else {
+		// rm: makes x11vnc delete the file once read, keeping the password
+		// off the command line.
+		f, err := os.CreateTemp("", "browserd-vnc-*")
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteString(v.password + "\n")
+		f.Close()
+		if err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+		args = append(args, "-passwdfile", "rm:"+f.Name())
+	}
+
+	cmd := exec.Command(v.bin, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan struct{})
+	go func() {
+		err := cmd.Wait()
+		slog.Warn("x11vnc exited", "event", "vnc_exited", "error", err)
+		v.mu.Lock()
+		if v.cmd == cmd {
+			v.cmd = nil
+		}
+		v.mu.Unlock()
+		close(exited)
+	}()
+
+	v.cmd, v.exited = cmd, exited
+	slog.Info("started x11vnc", "event", "vnc_started", "addr", v.addr, "display", v.display.name(), "pid", cmd.Process.Pid)
+	return nil
+}
+
+// stop terminates x11vnc and waits for it to exit.
+func (v *vncServer) stop() {
+	v.mu.Lock()
+	cmd, exited := v.cmd, v.exited
+	v.cmd = nil
+	v.mu.Unlock()
+	if cmd == nil {
+		return
+	}
+
+	terminate(cmd.Process)
+	select {
+	case <-exited:
+	case <-time.After(supervisorStopTimeout):
+		_ = cmd.Process.Kill()
+		<-exited
+	}
+}
+
+// dialAddr is where browserd itself reaches the VNC port.
+func (v *vncServer) dialAddr() string {
+	host, port, err := net.SplitHostPort(v.addr)
+	if err != nil {
+		return v.addr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// handleVNC bridges a noVNC client's WebSocket to the VNC port, the way
+// websockify does: RFB bytes travel in binary frames.
+func (p *proxyServer) handleVNC(w http.ResponseWriter, r *http.Request) {
+	if !p.authorize(r) {
+		p.refuseUnauthorized(w, r)
+		return
+	}
+	vnc := p.supervisor.vnc
+
+	upgrader := p.upgrader
+	upgrader.Subprotocols = []string{"binary"}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Warn("failed to upgrade vnc connection", "client_ip", clientIP(r.RemoteAddr), "error", err)
+		return
+	}
+	defer conn.Close()
+
+	backend, err := net.DialTimeout("tcp", vnc.dialAddr(), requestTimeout)
+	if err != nil {
+		slog.Error("failed to connect to vnc server", "error", err)
+		_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeUpstreamUnavailable, "vnc unavailable"), time.Now().Add(time.Second))
+		return
+	}
+	defer backend.Close()
+	slog.Info("vnc viewer connected", "event", "vnc_viewer_connected", "client_ip", clientIP(r.RemoteAddr))
+
+	errCh := make(chan error, 2)
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := backend.Read(buf)
+			if n > 0 {
+				if werr := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); werr != nil {
+					errCh <- werr
+					return
+				}
+			}
+			if err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if _, err := backend.Write(data); err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}()
+	<-errCh
+	slog.Info("vnc viewer disconnected", "event", "vnc_viewer_disconnected", "client_ip", clientIP(r.RemoteAddr))
+}
+
+// validateVNCAddr checks a -vnc-listen value.
+func validateVNCAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
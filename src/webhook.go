@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Webhook event types.
+const (
+	eventSessionStarted   = "session.started"
+	eventSessionEnded     = "session.ended"
+	eventSessionError     = "session.error"
+	eventSessionAnomaly   = "session.anomaly"
+	eventSessionAnnotated = "session.annotated"
+	eventBrowserRestarted = "browser.restarted"
+	eventBrowserCrashed   = "browser.crashed"
+	eventBackendHealthy   = "backend.healthy"
+	eventBackendUnhealthy = "backend.unhealthy"
+	eventBackendFailover  = "backend.failover"
+	eventBackendFailback  = "backend.failback"
+)
+
+const (
+	// webhookQueueSize bounds the events waiting for delivery; when the
+	// receivers fall behind further events are dropped rather than
+	// slowing down sessions.
+	webhookQueueSize = 256
+	webhookAttempts  = 3
+	webhookBackoff   = time.Second
+
+	webhookSignatureHeader = "X-Browserd-Signature"
+)
+
+// webhookEvent is the JSON body POSTed to every webhook URL.
+type webhookEvent struct {
+	Event   string        `json:"event"`
+	Time    time.Time     `json:"time"`
+	Session *sessionView  `json:"session,omitempty"`
+	Stats   *sessionTally `json:"stats,omitempty"`
+	Error   string        `json:"error,omitempty"`
+	// Reason explains a browser restart: "exited" or "recycled", what a
+	// crash incident was collected for, names the anomaly rule that
+	// fired, or is the text of a session annotation.
+	Reason string `json:"reason,omitempty"`
+	// Incident is the directory a crash was collected into.
+	Incident string `json:"incident,omitempty"`
+	// Backend is the Chromium endpoint a backend event is about.
+	Backend string `json:"backend,omitempty"`
+	// Screenshots names the files -error-screenshots captured of a failed
+	// session's pages, as <target id>.png.
+	Screenshots []string `json:"screenshots,omitempty"`
+}
+
+// sessionTally is a snapshot of a session's sessionStats.
+type sessionTally struct {
+	DurationMs       int64 `json:"durationMs"`
+	ClientMessages   int64 `json:"clientMessages"`
+	ClientBytes      int64 `json:"clientBytes"`
+	UpstreamMessages int64 `json:"upstreamMessages"`
+	UpstreamBytes    int64 `json:"upstreamBytes"`
+	Pages            int64 `json:"pages"`
+}
+
+// sessionStats counts a session's traffic as the relay forwards it.
+type sessionStats struct {
+	clientMessages   atomic.Int64
+	clientBytes      atomic.Int64
+	upstreamMessages atomic.Int64
+	upstreamBytes    atomic.Int64
+	pages            atomic.Int64
+	// maxHeld, maxBuffered and maxWait, in nanoseconds, are the relay's
+	// high-water marks.
+	maxHeld     atomic.Int64
+	maxBuffered atomic.Int64
+	maxWait     atomic.Int64
+}
+
+// countTraffic adds an ended session's traffic to the relayed totals, by
+// the side that sent it and the session's metric labels.
+func (p *proxyServer) countTraffic(sess *session, labels map[string]string) {
+	for _, side := range []struct {
+		direction       string
+		messages, bytes int64
+	}{
+		{"client", sess.stats.clientMessages.Load(), sess.stats.clientBytes.Load()},
+		{"upstream", sess.stats.upstreamMessages.Load(), sess.stats.upstreamBytes.Load()},
+	} {
+		sideLabels := map[string]string{"direction": side.direction}
+		for key, value := range labels {
+			sideLabels[key] = value
+		}
+		p.metrics.add("browserd_relayed_messages_total", sideLabels, float64(side.messages))
+		p.metrics.add("browserd_relayed_bytes_total", sideLabels, float64(side.bytes))
+	}
+}
+
+func (s *session) tally() *sessionTally {
+	return &sessionTally{
+		DurationMs:       time.Since(s.startedAt).Milliseconds(),
+		ClientMessages:   s.stats.clientMessages.Load(),
+		ClientBytes:      s.stats.clientBytes.Load(),
+		UpstreamMessages: s.stats.upstreamMessages.Load(),
+		UpstreamBytes:    s.stats.upstreamBytes.Load(),
+		Pages:            s.stats.pages.Load(),
+	}
+}
+
+// webhookNotifier delivers lifecycle events to the -webhook-urls in the
+// background, retrying failed deliveries a few times.
+type webhookNotifier struct {
+	urls    []string
+	secret  string
+	client  *http.Client
+	metrics *metricsRegistry
+	queue   chan webhookEvent
+}
+
+func newWebhookNotifier(urls []string, secret string, metrics *metricsRegistry) *webhookNotifier {
+	metrics.register("browserd_webhook_deliveries_total", metricCounter, "Webhook deliveries by event and outcome.")
+	return &webhookNotifier{
+		urls:    urls,
+		secret:  secret,
+		client:  &http.Client{Timeout: requestTimeout},
+		metrics: metrics,
+		queue:   make(chan webhookEvent, webhookQueueSize),
+	}
+}
+
+// notify queues an event without blocking. A nil notifier ignores it.
+func (n *webhookNotifier) notify(event webhookEvent) {
+	if n == nil {
+		return
+	}
+	event.Time = time.Now().UTC()
+	select {
+	case n.queue <- event:
+	default:
+		n.metrics.add("browserd_webhook_deliveries_total", map[string]string{"event": event.Event, "outcome": "dropped"}, 1)
+		slog.Warn("webhook queue full, dropping event", "webhook_event", event.Event)
+	}
+}
+
+// run delivers queued events until ctx is cancelled.
+func (n *webhookNotifier) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-n.queue:
+			body, err := json.Marshal(event)
+			if err != nil {
+				slog.Error("failed to encode webhook", "webhook_event", event.Event, "error", err)
+				continue
+			}
+			for _, target := range n.urls {
+				outcome := "delivered"
+				if err := n.deliver(ctx, target, body); err != nil {
+					outcome = "failed"
+					slog.Warn("webhook delivery failed", "webhook_event", event.Event, "url", target, "error", err)
+				}
+				n.metrics.add("browserd_webhook_deliveries_total", map[string]string{"event": event.Event, "outcome": outcome}, 1)
+			}
+		}
+	}
+}
+
+func (n *webhookNotifier) deliver(ctx context.Context, target string, body []byte) error {
+	var err error
+	for attempt := 0; attempt < webhookAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(webhookBackoff << (attempt - 1)):
+			}
+		}
+		if err = n.post(ctx, target, body); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (n *webhookNotifier) post(ctx context.Context, target string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.secret))
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}